@@ -11,12 +11,14 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cea-hpc/sshproxy/pkg/record"
@@ -26,11 +28,39 @@ var (
 	// SshproxyVersion is set in the Makefile.
 	SshproxyVersion = "0.0.0+notproperlybuilt"
 	replayFlag      = flag.Bool("replay", false, "live replay a session (as the user did it)")
+	speedFlag       = flag.Float64("speed", 1, "speed `multiplier` of the live replay")
+	maxDelayFlag    = flag.Duration("max-delay", 0, "maximum `delay` between two records of the live replay (0 for no limit)")
+	rawFlag         = flag.Bool("raw", false, "write the raw output of the session without timing nor header")
 	versionFlag     = flag.Bool("version", false, "show version number and exit")
 )
 
+// replayDelay returns the time to wait before replaying a record received
+// delay after the previous one, according to the -speed and -max-delay
+// options.
+func replayDelay(delay time.Duration) time.Duration {
+	delay = time.Duration(float64(delay) / *speedFlag)
+	if *maxDelayFlag > 0 && delay > *maxDelayFlag {
+		delay = *maxDelayFlag
+	}
+	return delay
+}
+
+// outputStream returns the stream where the data of a record read from or
+// written to fd is replayed, or nil for the standard input.
+func outputStream(fd int) *os.File {
+	switch fd {
+	case 1:
+		return os.Stdout
+	case 2:
+		return os.Stderr
+	}
+	return nil
+}
+
 func replay(filename string) {
-	fmt.Printf("===> opening %s\n", filename)
+	if !*rawFlag {
+		fmt.Printf("===> opening %s\n", filename)
+	}
 
 	f, err := os.Open(filename)
 	if err != nil {
@@ -39,12 +69,38 @@ func replay(filename string) {
 	}
 	defer f.Close()
 
-	reader, err := record.NewReader(f)
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	reader, err := record.NewReader(r)
 	if err != nil {
 		log.Printf("error: %s\n", err)
 		return
 	}
 
+	if *rawFlag {
+		var rec record.Record
+		for {
+			if err := reader.Next(&rec); err != nil {
+				if err != io.EOF {
+					log.Printf("error reading: %s\n", err)
+				}
+				return
+			}
+			if stream := outputStream(rec.Fd); stream != nil {
+				stream.Write(rec.Data)
+			}
+		}
+	}
+
 	fmt.Printf("--> Version: %d\n", reader.Info.Version)
 	fmt.Printf("--> Start:   %s\n", reader.Info.Time)
 	fmt.Printf("--> User:    %s\n", reader.Info.User)
@@ -55,7 +111,6 @@ func replay(filename string) {
 	var rec record.Record
 	var start, previous time.Time
 	var elapsed, direction string
-	var stream *os.File
 	dayFormat := "Jan 02 15:04:05"
 	for {
 		err := reader.Next(&rec)
@@ -68,18 +123,12 @@ func replay(filename string) {
 		}
 		if *replayFlag {
 			if !previous.IsZero() {
-				time.Sleep(rec.Time.Sub(previous))
+				time.Sleep(replayDelay(rec.Time.Sub(previous)))
 			}
 			previous = rec.Time
-			switch rec.Fd {
-			case 0:
-				continue
-			case 1:
-				stream = os.Stdout
-			case 2:
-				stream = os.Stderr
+			if stream := outputStream(rec.Fd); stream != nil {
+				stream.Write(rec.Data)
 			}
-			stream.Write(rec.Data)
 		} else {
 			if start.IsZero() {
 				start = rec.Time
@@ -120,6 +169,16 @@ func main() {
 		usage()
 	}
 
+	if *speedFlag <= 0 {
+		log.Fatalf("invalid value for -speed: %g (must be positive)", *speedFlag)
+	}
+	if *maxDelayFlag < 0 {
+		log.Fatalf("invalid value for -max-delay: %s (must be positive)", *maxDelayFlag)
+	}
+	if *rawFlag && *replayFlag {
+		log.Fatal("-raw and -replay cannot be used together")
+	}
+
 	for _, fn := range flag.Args() {
 		replay(fn)
 	}
@@ -0,0 +1,77 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// cgroupRoot is the mount point of the cgroup filesystems.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupDirs returns the existing directories of the cgroup path. An absolute
+// path is used as is. A relative path is relative to cgroupRoot with cgroup
+// v2 (a single unified hierarchy) and to each hierarchy mounted in cgroupRoot
+// with cgroup v1 (one hierarchy per controller), except the systemd ones.
+func cgroupDirs(path string) ([]string, error) {
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+			candidates = []string{filepath.Join(cgroupRoot, path)}
+		} else {
+			entries, err := os.ReadDir(cgroupRoot)
+			if err != nil {
+				return nil, err
+			}
+			candidates = []string{}
+			for _, e := range entries {
+				// co-mounted controllers are symlinks (e.g. cpu ->
+				// cpu,cpuacct), which are not directories here.
+				if !e.IsDir() || e.Name() == "systemd" || e.Name() == "unified" {
+					continue
+				}
+				candidates = append(candidates, filepath.Join(cgroupRoot, e.Name(), path))
+			}
+		}
+	}
+
+	dirs := []string{}
+	for _, dir := range candidates {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("cgroup %s not found", path)
+	}
+	return dirs, nil
+}
+
+// joinCgroup moves the process pid in the cgroup path (see cgroupDirs). The
+// cgroup must already exist and the current user must be allowed to move
+// processes in it.
+func joinCgroup(path string, pid int) error {
+	dirs, err := cgroupDirs(path)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, dir := range dirs {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
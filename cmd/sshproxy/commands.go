@@ -13,12 +13,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
 
 	"github.com/creack/pty"
 	"github.com/moby/term"
@@ -26,25 +33,30 @@ import (
 
 // runCommand executes the *exec.Cmd command and waits for its completion.
 //
-// The command can already be started if the started boolean is true.
+// The command can already be started if the started boolean is true. If
+// onStart is not nil, it is called with the PID of the started command.
 //
 // Returns the exit code of the command or an error.
-func runCommand(cmd *exec.Cmd, started bool) (int, error) {
+func runCommand(cmd *exec.Cmd, started bool, onStart func(int)) (int, error) {
 	if !started {
 		if err := cmd.Start(); err != nil {
 			return -1, err
 		}
 	}
+	if onStart != nil {
+		onStart(cmd.Process.Pid)
+	}
 
 	err := cmd.Wait()
 	rc := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
 	return rc, err
 }
 
-// runStdCommand launches a command without the need for a PTY.
+// runStdCommand launches a command without the need for a PTY. onStart is
+// passed to runCommand.
 //
 // Returns the exit code of the command or an error.
-func runStdCommand(cmd *exec.Cmd, rec *Recorder) (int, error) {
+func runStdCommand(cmd *exec.Cmd, rec *Recorder, onStart func(int)) (int, error) {
 	if rec != nil {
 		stdin, err := cmd.StdinPipe()
 		if err != nil {
@@ -69,15 +81,15 @@ func runStdCommand(cmd *exec.Cmd, rec *Recorder) (int, error) {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 	}
-	return runCommand(cmd, false)
+	return runCommand(cmd, false, onStart)
 }
 
-// runTtyCommand launches a command in a PTY.
+// runTtyCommand launches a command in a PTY. onStart is passed to runCommand.
 //
 // From: https://github.com/9seconds/ah/blob/master/app/utils/exec.go
 //
 // Returns the exit code of the command or an error.
-func runTtyCommand(cmd *exec.Cmd, rec *Recorder) (int, error) {
+func runTtyCommand(cmd *exec.Cmd, rec *Recorder, onStart func(int)) (int, error) {
 	commandStarted := false
 	if rec != nil {
 		p, err := pty.Start(cmd)
@@ -104,7 +116,7 @@ func runTtyCommand(cmd *exec.Cmd, rec *Recorder) (int, error) {
 		cmd.Stderr = os.Stderr
 	}
 
-	return runCommand(cmd, commandStarted)
+	return runCommand(cmd, commandStarted, onStart)
 }
 
 // monitorTtyResize resizes the guestFd TTY to the hostFd TTY size and checks
@@ -170,3 +182,94 @@ func prepareBackgroundCommand(ctx context.Context, command string, debug bool) *
 
 	return cmd
 }
+
+// runBlockingCommand runs one of the blocking commands of the configuration
+// with the env environment variables added to the environment of sshproxy.
+// Its standard and error outputs are only logged in debug mode. Its standard
+// output is returned if config.BlockingCommandDestOverride is set.
+//
+// A transient failure (any non-zero exit code, or only the exit codes listed
+// in config.BlockingCommandRetryCodes if not empty) is retried up to
+// config.BlockingCommandRetries times, the wait between two attempts being
+// doubled each time. Other failures, including an attempt killed after
+// config.BlockingCommandTimeout, are never retried. The command, or the wait
+// before its next attempt, is interrupted when ctx is canceled (e.g. when the
+// client disconnects).
+//
+// Returns the standard output and nil if the command succeeded or the reason
+// of its failure.
+func runBlockingCommand(ctx context.Context, config *utils.Config, command string, env []string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty blocking command")
+	}
+	timeout := config.BlockingCommandTimeout.Duration()
+	interval := config.BlockingCommandRetryInterval.Duration()
+	attempts := config.BlockingCommandRetries + 1
+	for attempt := 1; ; attempt++ {
+		var stdout bytes.Buffer
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		cmd := exec.CommandContext(attemptCtx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		if config.Debug {
+			cmd.Stdout = &BackgroundCommandLogger{"blocking_command.stdout"}
+			cmd.Stderr = &BackgroundCommandLogger{"blocking_command.stderr"}
+		}
+		if config.BlockingCommandDestOverride {
+			if cmd.Stdout != nil {
+				cmd.Stdout = io.MultiWriter(cmd.Stdout, &stdout)
+			} else {
+				cmd.Stdout = &stdout
+			}
+		}
+
+		rc, err := runCommand(cmd, false, nil)
+		timedOut := err != nil && attemptCtx.Err() != nil
+		cancel()
+		if timedOut && ctx.Err() != nil {
+			return "", fmt.Errorf("blocking command interrupted: %v", ctx.Err())
+		} else if timedOut {
+			return "", fmt.Errorf("blocking command timed out after %s", timeout)
+		}
+		if err == nil {
+			log.Debugf("blocking command succeeded (attempt %d/%d)", attempt, attempts)
+			return stdout.String(), nil
+		}
+		if _, ok := err.(*exec.ExitError); !ok || rc < 0 {
+			return "", fmt.Errorf("running blocking command: %v", err)
+		}
+		log.Warningf("blocking command exited with code %d (attempt %d/%d)", rc, attempt, attempts)
+		if len(config.BlockingCommandRetryCodes) > 0 && !slices.Contains(config.BlockingCommandRetryCodes, rc) {
+			return "", fmt.Errorf("blocking command exited with code %d", rc)
+		}
+		if attempt >= attempts {
+			return "", fmt.Errorf("blocking command exited with code %d after %d attempts", rc, attempts)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return "", fmt.Errorf("blocking command interrupted: %v", ctx.Err())
+		}
+		interval *= 2
+	}
+}
+
+// blockingCommandDest returns the destination ("host:port") printed by a
+// blocking command on its standard output, which must be one of the
+// destinations of the service. An empty string is returned if nothing was
+// printed.
+func blockingCommandDest(output string, config *utils.Config) (string, error) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return "", nil
+	}
+	host, port, err := utils.SplitHostPortWithDefault(output, strconv.Itoa(config.DefaultDestPort))
+	if err != nil {
+		return "", fmt.Errorf("invalid destination '%s': %v", output, err)
+	}
+	dest := net.JoinHostPort(host, port)
+	if !utils.IsDestinationInRoutes(dest, config.Dest) {
+		return "", fmt.Errorf("destination '%s' is not a destination of service '%s'", dest, config.Service)
+	}
+	return dest, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+var blockingCommandDestTests = []struct {
+	output string
+	want   string
+	err    bool
+}{
+	{"", "", false},
+	{"  \n", "", false},
+	{"server2\n", "server2:22", false},
+	{"server2:2222\n", "server2:2222", false},
+	{"server3", "", true},
+	{"server2:22:22", "", true},
+}
+
+func TestBlockingCommandDest(t *testing.T) {
+	config := &utils.Config{Service: "default", Dest: []string{"server1:22", "server2:22", "server2:2222"}, DefaultDestPort: 22}
+	for _, tt := range blockingCommandDestTests {
+		got, err := blockingCommandDest(tt.output, config)
+		if (err != nil) != tt.err {
+			t.Errorf("blockingCommandDest(%q) error = %v, want error %v", tt.output, err, tt.err)
+		} else if got != tt.want {
+			t.Errorf("blockingCommandDest(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+var runBlockingCommandTests = []struct {
+	command string
+	output  string
+	err     string
+}{
+	{"echo server2", "server2\n", ""},
+	{"  ", "", "empty blocking command"},
+	{"false", "", "blocking command exited with code 1 after 2 attempts"},
+	{"sleep 5", "", "blocking command timed out after 100ms"},
+	{"/nonexistent/command", "", "running blocking command"},
+}
+
+func TestRunBlockingCommand(t *testing.T) {
+	config := &utils.Config{
+		BlockingCommandRetries:       1,
+		BlockingCommandRetryInterval: utils.Duration(time.Millisecond),
+		BlockingCommandTimeout:       utils.Duration(100 * time.Millisecond),
+		BlockingCommandDestOverride:  true,
+	}
+	for _, tt := range runBlockingCommandTests {
+		start := time.Now()
+		got, err := runBlockingCommand(context.Background(), config, tt.command, nil)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("runBlockingCommand(%q) took %s", tt.command, elapsed)
+		}
+		if tt.err == "" && err != nil {
+			t.Errorf("runBlockingCommand(%q) error = %v, want nil", tt.command, err)
+		} else if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("runBlockingCommand(%q) error = %v, want %q", tt.command, err, tt.err)
+		} else if got != tt.output {
+			t.Errorf("runBlockingCommand(%q) = %q, want %q", tt.command, got, tt.output)
+		}
+	}
+}
+
+func TestRunBlockingCommandCanceled(t *testing.T) {
+	config := &utils.Config{
+		BlockingCommandRetries:       3,
+		BlockingCommandRetryInterval: utils.Duration(time.Hour),
+		BlockingCommandTimeout:       utils.Duration(time.Hour),
+	}
+	// the command itself, then the wait before its next attempt
+	for _, command := range []string{"sleep 5", "false"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := runBlockingCommand(ctx, config, command, nil)
+		cancel()
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("runBlockingCommand(%q) took %s after the cancellation", command, elapsed)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "blocking command interrupted") {
+			t.Errorf("runBlockingCommand(%q) error = %v, want \"blocking command interrupted\"", command, err)
+		}
+	}
+}
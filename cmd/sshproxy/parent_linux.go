@@ -0,0 +1,24 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"syscall"
+)
+
+// setParentDeathSignal asks the kernel to send SIGHUP to sshproxy as soon as
+// its SSH parent connection dies.
+func setParentDeathSignal() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(syscall.SIGHUP), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// setParentDeathSignal is only supported on Linux.
+func setParentDeathSignal() error {
+	return errors.New("parent death signal is only supported on Linux")
+}
@@ -0,0 +1,62 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+// startProfile starts writing a CPU profile in the file filename and an
+// execution trace in the file filename.trace, to diagnose slow logins (e.g.
+// slow etcd interactions). It returns the function stopping the profiling,
+// which can be called several times (the files are left empty if sshproxy
+// exits on a fatal error before). Nothing is done if filename is empty, and
+// the profiling is only disabled if the files cannot be written.
+func startProfile(filename string) func() {
+	if filename == "" {
+		return func() {}
+	}
+
+	var files []*os.File
+	cpuFile, err := os.Create(filename)
+	if err != nil {
+		log.Warningf("profiling disabled: %s", err)
+		return func() {}
+	}
+	files = append(files, cpuFile)
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		log.Warningf("CPU profiling disabled: %s", err)
+	}
+
+	traceFile, err := os.Create(filename + ".trace")
+	if err != nil {
+		log.Warningf("execution tracing disabled: %s", err)
+	} else {
+		files = append(files, traceFile)
+		if err := trace.Start(traceFile); err != nil {
+			log.Warningf("execution tracing disabled: %s", err)
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pprof.StopCPUProfile()
+			trace.Stop()
+			for _, f := range files {
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushTimeout is the timeout of a push to the Prometheus pushgateway.
+const pushTimeout = 2 * time.Second
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sessionMetrics are the metrics of a connection pushed to the Prometheus
+// pushgateway.
+type sessionMetrics struct {
+	User    string
+	Service string
+	Dest    string
+	Bytes   map[int]uint64 // total of bytes for each file descriptor, nil if unknown
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *sessionMetrics) write(w io.Writer) {
+	labels := fmt.Sprintf("user=\"%s\",service=\"%s\",dest=\"%s\"",
+		metricLabelEscaper.Replace(m.User),
+		metricLabelEscaper.Replace(m.Service),
+		metricLabelEscaper.Replace(m.Dest))
+	fmt.Fprintln(w, "# HELP sshproxy_connections_total Number of connections made through sshproxy.")
+	fmt.Fprintln(w, "# TYPE sshproxy_connections_total counter")
+	fmt.Fprintf(w, "sshproxy_connections_total{%s} 1\n", labels)
+	if m.Bytes == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP sshproxy_transferred_bytes Number of bytes transferred by the connection.")
+	fmt.Fprintln(w, "# TYPE sshproxy_transferred_bytes gauge")
+	for fd, name := range []string{"stdin", "stdout", "stderr"} {
+		fmt.Fprintf(w, "sshproxy_transferred_bytes{%s,fd=\"%s\"} %d\n", labels, name, m.Bytes[fd])
+	}
+}
+
+// groupURL returns the URL of the group of the session sid in the Prometheus
+// pushgateway at gatewayURL. Each session has its own group (job "sshproxy"
+// and label "sid"), so the concurrent sshproxy processes do not overwrite the
+// metrics of each other.
+func groupURL(gatewayURL, sid string) string {
+	return fmt.Sprintf("%s/metrics/job/sshproxy/sid/%s", strings.TrimSuffix(gatewayURL, "/"), url.PathEscape(sid))
+}
+
+// pushMetrics replaces the metrics of the session sid in the Prometheus
+// pushgateway at gatewayURL.
+func pushMetrics(gatewayURL, sid string, metrics *sessionMetrics) error {
+	var body bytes.Buffer
+	metrics.write(&body)
+	return doPushRequest(http.MethodPut, groupURL(gatewayURL, sid), &body)
+}
+
+// deleteMetrics deletes the group of the session sid from the Prometheus
+// pushgateway at gatewayURL.
+func deleteMetrics(gatewayURL, sid string) error {
+	return doPushRequest(http.MethodDelete, groupURL(gatewayURL, sid), nil)
+}
+
+// doPushRequest sends a request with the given method to the pushgateway.
+func doPushRequest(method, pushURL string, body io.Reader) error {
+	req, err := http.NewRequest(method, pushURL, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	client := &http.Client{Timeout: pushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", pushURL, resp.Status)
+	}
+	return nil
+}
+
+// runMetricsPusher pushes the metrics of the session sid to the Prometheus
+// pushgateway at gatewayURL until ctx is done, without delaying the
+// connection. The bytes transferred, given by totals (nil if unknown), are
+// pushed again every interval (if not 0). The group of the session is deleted
+// at the end, so the pushgateway only keeps the metrics of the running
+// sessions. Any error is logged.
+func runMetricsPusher(ctx context.Context, gatewayURL, sid string, metrics sessionMetrics, totals func() map[int]uint64, interval time.Duration) {
+	push := func() {
+		if totals != nil {
+			metrics.Bytes = totals()
+		}
+		if err := pushMetrics(gatewayURL, sid, &metrics); err != nil {
+			log.Errorf("pushing metrics to the Prometheus pushgateway: %v", err)
+		}
+	}
+	push()
+	var tick <-chan time.Time
+	if totals != nil && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			push()
+		case <-ctx.Done():
+			if err := deleteMetrics(gatewayURL, sid); err != nil {
+				log.Errorf("deleting metrics from the Prometheus pushgateway: %v", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushRequest is a request received by the test pushgateway.
+type pushRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func TestRunMetricsPusher(t *testing.T) {
+	var lock sync.Mutex
+	var requests []pushRequest
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, pushRequest{r.Method, r.URL.EscapedPath(), string(body)})
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	totals := func() map[int]uint64 { return map[int]uint64{0: 10, 1: 20} }
+	metrics := sessionMetrics{User: "alice", Service: "default", Dest: "server1:22"}
+	done := make(chan struct{})
+	go func() {
+		runMetricsPusher(ctx, gateway.URL+"/", "a/b", metrics, totals, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(35 * time.Millisecond)
+	cancel()
+	<-done
+
+	if len(requests) < 3 {
+		t.Fatalf("got %d requests, want the initial push, at least one update and the deletion", len(requests))
+	}
+	for i, req := range requests {
+		if req.path != "/metrics/job/sshproxy/sid/a%2Fb" {
+			t.Errorf("request %d path = %s, want /metrics/job/sshproxy/sid/a%%2Fb", i, req.path)
+		}
+		want := http.MethodPut
+		if i == len(requests)-1 {
+			want = http.MethodDelete
+		}
+		if req.method != want {
+			t.Errorf("request %d method = %s, want %s", i, req.method, want)
+		}
+	}
+	for _, line := range []string{
+		`sshproxy_connections_total{user="alice",service="default",dest="server1:22"} 1`,
+		`sshproxy_transferred_bytes{user="alice",service="default",dest="server1:22",fd="stdout"} 20`,
+	} {
+		if !strings.Contains(requests[1].body, line) {
+			t.Errorf("pushed metrics = %q, want a line %q", requests[1].body, line)
+		}
+	}
+}
+
+func TestRunMetricsPusherNoTotals(t *testing.T) {
+	var methods []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runMetricsPusher(ctx, gateway.URL, "sid", sessionMetrics{User: "alice"}, nil, time.Millisecond)
+	if want := []string{http.MethodPut, http.MethodDelete}; strings.Join(methods, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %v, want %v", methods, want)
+	}
+}
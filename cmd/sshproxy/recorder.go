@@ -11,6 +11,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -32,20 +33,66 @@ func Dup(a []byte, n int) []byte {
 	return b
 }
 
+// A throttle limits a throughput with a token bucket, whose tokens are bytes.
+// The bucket is refilled at rate bytes per second and holds at most one
+// second of data, so short bursts are not slowed down.
+//
+// A nil *throttle does not limit anything.
+type throttle struct {
+	rate   float64   // bytes per second
+	tokens float64   // available bytes, negative when in debt
+	last   time.Time // last refill of the bucket
+	lock   sync.Mutex
+}
+
+// newThrottle returns a throttle limiting the throughput to rate kB/s, or nil
+// if rate is 0.
+func newThrottle(rate int) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	bytes := float64(rate) * 1024
+	return &throttle{rate: bytes, tokens: bytes, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, waiting until they are available.
+func (t *throttle) wait(n int) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	// the bytes are taken even if they are not available yet, so the
+	// concurrent writers wait for their turn
+	t.tokens -= float64(n)
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
 // A Splitter reads from and/or writes to a file descriptor and sends a
 // record.Record struct to a channel for each read/write operation.
 type Splitter struct {
-	f  *os.File             // opened file
-	fd int                  // integer file descriptor
-	ch chan<- record.Record // channel to send record.Record structs
+	f        *os.File             // opened file
+	fd       int                  // integer file descriptor
+	ch       chan<- record.Record // channel to send record.Record structs
+	throttle *throttle            // limit of the throughput of the writes (nil if none)
 }
 
 // NewSplitter returns a new Splitter struct from an already opened *os.File
-// and a channel where record.Record structs will be sent.
+// and a channel where record.Record structs will be sent. The writes are
+// limited by t if it is not nil.
 //
 // It implements the ReadWriteCloser interface.
-func NewSplitter(f *os.File, ch chan record.Record) *Splitter {
-	return &Splitter{f, int(f.Fd()), ch}
+func NewSplitter(f *os.File, ch chan record.Record, t *throttle) *Splitter {
+	return &Splitter{f, int(f.Fd()), ch, t}
 }
 
 // Close implements the Closer Close method.
@@ -70,6 +117,7 @@ func (s *Splitter) Read(p []byte) (int, error) {
 // Write implements the Writer Write method. It sends a copy of the written
 // slice to its internal channel.
 func (s *Splitter) Write(p []byte) (int, error) {
+	s.throttle.wait(len(p))
 	pp := Dup(p, len(p))
 	s.ch <- record.Record{
 		Time: time.Now(),
@@ -101,6 +149,9 @@ type Recorder struct {
 	dumpfile              string             // path to filename where the raw records are dumped
 	dumpLimitSize         uint64             // number of bytes beyond which records are no longer dumped
 	dumpLimitWindow       time.Duration      // time window in which dump size is accounted
+	dumpUserQuota         uint64             // number of bytes of the existing dumps beyond which a new dump is not started
+	dumpMode              string             // mode of opening of the dump file (see utils.FileOpenFlags)
+	dumpCompress          string             // compression of the dump file ("none" or "gzip")
 	lock                  sync.RWMutex       // mutex to avoid concurrent reads and writes in bandwidth and totals maps
 	writer                *record.Writer     // *record.Writer where the raw records are dumped
 }
@@ -108,15 +159,21 @@ type Recorder struct {
 // NewRecorder returns a new Recorder struct.
 //
 // If dumpfile is not empty, the intercepted raw data will be written in this
-// file. Logging of basic statistics will be done every logStatsInterval seconds. Bandwidth will be updated in etcd every etcdStatsInterval seconds.
+// file, where the pattern {kind} is replaced by the kind of the session (see
+// utils.SessionKind), unless the existing dumps of the user already use dumpUserQuota bytes
+// (if not 0). The dump file is compressed with gzip if dumpCompress is "gzip"
+// (a ".gz" suffix is then added to its name if missing). Logging of basic statistics will be done every logStatsInterval seconds. Bandwidth will be updated in etcd every etcdStatsInterval seconds.
+// If bandwidthLimit is not 0, the data written to standard output and
+// standard error are limited to bandwidthLimit kB/s (in total).
 // It will stop recording when the context is cancelled.
-func NewRecorder(conninfo *ConnInfo, dumpfile, command string, etcdStatsInterval time.Duration, logStatsInterval time.Duration, dumpLimitSize uint64, dumpLimitWindow time.Duration) *Recorder {
+func NewRecorder(conninfo *ConnInfo, dumpfile, command, kind string, etcdStatsInterval time.Duration, logStatsInterval time.Duration, dumpLimitSize uint64, dumpLimitWindow time.Duration, dumpUserQuota uint64, dumpMode, dumpCompress string, bandwidthLimit int) *Recorder {
 	ch := make(chan record.Record)
+	t := newThrottle(bandwidthLimit)
 
 	return &Recorder{
-		Stdin:             NewSplitter(os.Stdin, ch),
-		Stdout:            NewSplitter(os.Stdout, ch),
-		Stderr:            NewSplitter(os.Stderr, ch),
+		Stdin:             NewSplitter(os.Stdin, ch, nil),
+		Stdout:            NewSplitter(os.Stdout, ch, t),
+		Stderr:            NewSplitter(os.Stderr, ch, t),
 		etcdStatsInterval: etcdStatsInterval,
 		logStatsInterval:  logStatsInterval,
 		bandwidth:         map[int]uint64{0: 0, 1: 0, 2: 0},
@@ -124,9 +181,12 @@ func NewRecorder(conninfo *ConnInfo, dumpfile, command string, etcdStatsInterval
 		ch:                ch,
 		conninfo:          conninfo,
 		command:           command,
-		dumpfile:          dumpfile,
+		dumpfile:          strings.ReplaceAll(dumpfile, "{kind}", kind),
 		dumpLimitSize:     dumpLimitSize,
 		dumpLimitWindow:   dumpLimitWindow,
+		dumpUserQuota:     dumpUserQuota,
+		dumpMode:          dumpMode,
+		dumpCompress:      dumpCompress,
 		lock:              sync.RWMutex{},
 		writer:            nil,
 	}
@@ -146,6 +206,18 @@ func (r *Recorder) updateStats(cli *utils.Client, etcdPath string) {
 	}
 }
 
+// Totals returns a copy of the total of bytes for each recorded file
+// descriptor.
+func (r *Recorder) Totals() map[int]uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	totals := make(map[int]uint64, len(r.totals))
+	for fd, total := range r.totals {
+		totals[fd] = total
+	}
+	return totals
+}
+
 // log formats the internal statistics and logs them.
 func (r *Recorder) log(ctx context.Context, step string) {
 	fds := []string{"stdin", "stdout", "stderr"}
@@ -174,6 +246,7 @@ func (r *Recorder) dump(rec record.Record) {
 // Run starts the recorder.
 func (r *Recorder) Run(ctx context.Context, cli *utils.Client, etcdPath string) {
 	var fd io.WriteCloser
+	appending := false
 	if r.dumpfile != "" {
 		var err error
 		if strings.HasPrefix(r.dumpfile, "TCP:") {
@@ -186,13 +259,29 @@ func (r *Recorder) Run(ctx context.Context, cli *utils.Client, etcdPath string)
 		} else if r.dumpfile == "etcd" {
 			fd = nil
 		} else {
-			fd, err = openRecordFile(r.dumpfile)
+			filename := r.dumpfile
+			if r.dumpCompress == "gzip" && !strings.HasSuffix(filename, ".gz") {
+				filename += ".gz"
+			}
+			f, err := openRecordFile(filename, r.dumpUserQuota, r.dumpMode)
 			if err != nil {
 				log.Errorf("session recording disabled due to error: %s", err)
 				fd = nil
+			} else {
+				// a file appended to already starts with a header
+				if info, err := f.Stat(); err == nil && info.Size() > 0 {
+					appending = true
+				}
+				if r.dumpCompress == "gzip" {
+					fd = newGzipFile(f)
+				} else {
+					fd = f
+				}
 			}
 		}
-		if fd != nil {
+		if fd != nil && appending {
+			r.writer = record.NewAppendWriter(fd)
+		} else if fd != nil {
 			infos := &record.FileInfo{
 				Version: 1,
 				Time:    r.conninfo.Start,
@@ -313,15 +402,69 @@ func (r *Recorder) Run(ctx context.Context, cli *utils.Client, etcdPath string)
 	}
 }
 
+// gzipFile is a file whose content is compressed with gzip.
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+// newGzipFile returns a gzipFile writing in the already opened file f.
+func newGzipFile(f *os.File) *gzipFile {
+	return &gzipFile{gzip.NewWriter(f), f}
+}
+
+// Close flushes and closes the gzip layer, then closes the underlying file.
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dirSize returns the total size of the regular files of a directory.
+func dirSize(dir string) (uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// the file may have been removed in the meantime
+			continue
+		}
+		size += uint64(info.Size())
+	}
+	return size, nil
+}
+
 // openRecordFile opens a record file, creating missing subdirectories if
-// missing.
-func openRecordFile(filename string) (*os.File, error) {
+// missing. If quota is not 0, the record file is not opened when the files
+// already present in its directory (which should be specific to the user) use
+// quota bytes or more. The file is opened according to mode (see
+// utils.FileOpenFlags).
+func openRecordFile(filename string, quota uint64, mode string) (*os.File, error) {
 	err := os.MkdirAll(path.Dir(filename), 0700)
 	if err != nil {
 		return nil, fmt.Errorf("creating directory %s: %s", path.Dir(filename), err)
 	}
 
-	f, err := os.Create(filename)
+	if quota != 0 {
+		size, err := dirSize(path.Dir(filename))
+		if err != nil {
+			return nil, fmt.Errorf("computing the size of the dumps in %s: %s", path.Dir(filename), err)
+		}
+		if size >= quota {
+			return nil, fmt.Errorf("dump quota exceeded in %s: %d bytes used, quota is %d bytes", path.Dir(filename), size, quota)
+		}
+	}
+
+	f, err := os.OpenFile(filename, utils.FileOpenFlags(mode), 0666)
 	if err != nil {
 		return nil, fmt.Errorf("creating %s: %s", filename, err)
 	}
@@ -0,0 +1,228 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/record"
+)
+
+func TestSplitterThrottle(t *testing.T) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("opening %s: %v", os.DevNull, err)
+	}
+	defer f.Close()
+	ch := make(chan record.Record)
+	go func() {
+		for range ch {
+		}
+	}()
+	defer close(ch)
+
+	// 1024 kB/s, i.e. a burst of 1 MiB then 1 MiB/s
+	const limit = 1024
+	splitter := NewSplitter(f, ch, newThrottle(limit))
+	buf := make([]byte, 32*1024)
+	written := 0
+	start := time.Now()
+	for written < 3*1024*1024/2 {
+		n, err := splitter.Write(buf)
+		if err != nil {
+			t.Fatalf("Write error = %v, want nil", err)
+		}
+		written += n
+	}
+	elapsed := time.Since(start)
+	ceiling := float64(limit*1024) * (1 + elapsed.Seconds())
+	if float64(written) > ceiling {
+		t.Errorf("%d bytes written in %s, want at most %.0f", written, elapsed, ceiling)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("%d bytes written in %s, want at least 400ms", written, elapsed)
+	}
+}
+
+func TestRecorderDumpAppend(t *testing.T) {
+	for _, compress := range []string{"none", "gzip"} {
+		dir := t.TempDir()
+		var want []record.Record
+		for i, user := range []string{"alice", "bob"} {
+			conninfo := &ConnInfo{
+				Start: time.Unix(1700000000, 0),
+				User:  user,
+				SSH:   &SSHInfo{SrcIP: net.ParseIP("192.168.0.1"), SrcPort: 12345, DstIP: net.ParseIP("192.168.0.2"), DstPort: 22},
+			}
+			recorder := NewRecorder(conninfo, filepath.Join(dir, "session.dump"), "hostname", "exec", 0, 0, 0, 0, 0, "append", compress, 0)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				recorder.Run(ctx, nil, "")
+				close(done)
+			}()
+			rec := record.Record{Time: time.Unix(int64(1700000001+i), 0), Fd: 1, Size: 8, Data: []byte("server1\n")}
+			recorder.ch <- rec
+			want = append(want, rec)
+			cancel()
+			<-done
+		}
+
+		filename := filepath.Join(dir, "session.dump")
+		if compress == "gzip" {
+			filename += ".gz"
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("%s: opening the dump file: %v", compress, err)
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if compress == "gzip" {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatalf("%s: gzip.NewReader error = %v, want nil", compress, err)
+			}
+		}
+		// the header of the first session is kept
+		reader, err := record.NewReader(r)
+		if err != nil {
+			t.Fatalf("%s: record.NewReader error = %v, want nil", compress, err)
+		}
+		if reader.Info.User != "alice" {
+			t.Errorf("%s: dump header user = %s, want alice", compress, reader.Info.User)
+		}
+		for i, w := range want {
+			var got record.Record
+			if err := reader.Next(&got); err != nil {
+				t.Fatalf("%s: reading record %d: %v", compress, i, err)
+			}
+			if !got.Time.Equal(w.Time) || !reflect.DeepEqual(got.Data, w.Data) {
+				t.Errorf("%s: record %d = %+v, want %+v", compress, i, got, w)
+			}
+		}
+		var rec record.Record
+		if err := reader.Next(&rec); err != io.EOF {
+			t.Errorf("%s: reading after the last record error = %v, want EOF", compress, err)
+		}
+	}
+}
+
+func TestRecorderDumpGzip(t *testing.T) {
+	dir := t.TempDir()
+	conninfo := &ConnInfo{
+		Start: time.Unix(1700000000, 0),
+		User:  "alice",
+		SSH: &SSHInfo{
+			SrcIP:   net.ParseIP("192.168.0.1"),
+			SrcPort: 12345,
+			DstIP:   net.ParseIP("192.168.0.2"),
+			DstPort: 22,
+		},
+	}
+	recorder := NewRecorder(conninfo, filepath.Join(dir, "alice", "{kind}.dump"), "hostname", "exec", 0, 0, 0, 0, 0, "truncate", "gzip", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		recorder.Run(ctx, nil, "")
+		close(done)
+	}()
+	want := []record.Record{
+		{Time: time.Unix(1700000001, 0), Fd: 0, Size: 9, Data: []byte("hostname\n")},
+		{Time: time.Unix(1700000002, 0), Fd: 1, Size: 8, Data: []byte("server1\n")},
+	}
+	for _, rec := range want {
+		recorder.ch <- rec
+	}
+	cancel()
+	<-done
+
+	// the pattern {kind} is replaced by the kind of the session
+	f, err := os.Open(filepath.Join(dir, "alice", "exec.dump.gz"))
+	if err != nil {
+		t.Fatalf("opening the dump file: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader error = %v, want nil", err)
+	}
+	reader, err := record.NewReader(gz)
+	if err != nil {
+		t.Fatalf("record.NewReader error = %v, want nil", err)
+	}
+	if reader.Info.User != "alice" || reader.Info.Command != "hostname" {
+		t.Errorf("dump header = %+v, want user alice and command hostname", reader.Info)
+	}
+	for i, w := range want {
+		var got record.Record
+		if err := reader.Next(&got); err != nil {
+			t.Fatalf("reading record %d: %v", i, err)
+		}
+		if !got.Time.Equal(w.Time) || got.Fd != w.Fd || got.Size != w.Size || !reflect.DeepEqual(got.Data, w.Data) {
+			t.Errorf("record %d = %+v, want %+v", i, got, w)
+		}
+	}
+	var rec record.Record
+	if err := reader.Next(&rec); err != io.EOF {
+		t.Errorf("reading after the last record error = %v, want EOF", err)
+	}
+}
+
+func TestOpenRecordFileQuota(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		sizes   []int
+		quota   uint64
+		wantErr bool
+	}{
+		{"no quota", []int{100, 100}, 0, false},
+		{"empty directory", nil, 10, false},
+		{"under quota", []int{40, 50}, 100, false},
+		{"quota reached", []int{50, 50}, 100, true},
+		{"over quota", []int{150}, 100, true},
+	} {
+		dir := filepath.Join(t.TempDir(), "alice")
+		if err := os.MkdirAll(filepath.Join(dir, "subdir"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		// the files of the subdirectories are not accounted
+		if err := os.WriteFile(filepath.Join(dir, "subdir", "old.dump"), make([]byte, 1000), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for i, size := range tt.sizes {
+			filename := filepath.Join(dir, string(rune('a'+i))+".dump")
+			if err := os.WriteFile(filename, make([]byte, size), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		filename := filepath.Join(dir, "new.dump")
+		f, err := openRecordFile(filename, tt.quota, "truncate")
+		if f != nil {
+			f.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: openRecordFile error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if _, err := os.Stat(filename); os.IsNotExist(err) != tt.wantErr {
+			t.Errorf("%s: %s exists = %v, want %v", tt.name, filename, err == nil, !tt.wantErr)
+		}
+	}
+}
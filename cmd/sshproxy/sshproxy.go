@@ -22,6 +22,7 @@ import (
 	"os/user"
 	"regexp"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,89 +45,18 @@ var (
 // main logger for sshproxy
 var log = logging.MustGetLogger("sshproxy")
 
-type etcdChecker struct {
-	LastState     utils.State
-	checkInterval utils.Duration
-	cli           *utils.Client
-}
-
-func (c *etcdChecker) Check(hostport string) bool {
-	ts := time.Now()
-	var host *utils.Host
-	var err error
-	if c.cli != nil && c.cli.IsAlive() {
-		host, err = c.cli.GetHost(hostport)
-	} else {
-		host = &utils.Host{}
-	}
-
-	switch {
-	case err != nil:
-		if err != utils.ErrKeyNotFound {
-			log.Errorf("problem with etcd: %v", err)
-		}
-		c.LastState = c.doCheck(hostport)
-	case host.State == utils.Disabled:
-		c.LastState = host.State
-	case ts.Sub(host.Ts) > c.checkInterval.Duration():
-		c.LastState = c.doCheck(hostport)
-	default:
-		c.LastState = host.State
-	}
-	return c.LastState == utils.Up
-}
-
-func (c *etcdChecker) doCheck(hostport string) utils.State {
-	ts := time.Now()
-	state := utils.Down
-	if utils.CanConnect(hostport) {
-		state = utils.Up
+// isConnectionLimitExempt returns true if the user, or one of its groups, is
+// exempt from the connection limits.
+func isConnectionLimitExempt(config *utils.Config, username string, groups map[string]bool) bool {
+	if slices.Contains(config.ConnectionLimitExemptUsers, username) {
+		return true
 	}
-	if c.cli != nil && c.cli.IsAlive() {
-		if err := c.cli.SetHost(hostport, state, ts); err != nil {
-			log.Errorf("setting host state in etcd: %v", err)
+	for _, group := range config.ConnectionLimitExemptGroups {
+		if groups[group] {
+			return true
 		}
 	}
-	return state
-}
-
-// findDestination finds a reachable destination for the sshd server according
-// to the etcd database if available or the config.Dest and config.RouteSelect
-// algorithm.  It returns a string with host:port; an empty string if no
-// destination is found or an error if any.
-func findDestination(cli *utils.Client, username string, config *utils.Config, sshdHostport string) (string, error) {
-	checker := &etcdChecker{
-		checkInterval: config.CheckInterval,
-		cli:           cli,
-	}
-
-	key := fmt.Sprintf("%s@%s", username, config.Service)
-
-	if config.Mode == "sticky" && cli != nil && cli.IsAlive() {
-		dest, err := cli.GetDestination(key, config.EtcdKeyTTL)
-		if err != nil {
-			if err != utils.ErrKeyNotFound {
-				log.Errorf("problem with etcd: %v", err)
-			}
-		} else {
-			if utils.IsDestinationInRoutes(dest, config.Dest) {
-				if checker.Check(dest) {
-					log.Debugf("found destination in etcd: %s", dest)
-					return dest, nil
-				}
-				log.Infof("cannot connect %s to already existing connection(s) to %s: host %s", key, dest, checker.LastState)
-			} else {
-				log.Infof("cannot connect %s to already existing connection(s) to %s: not in routes", key, dest)
-			}
-		}
-	}
-
-	if len(config.Dest) > 0 {
-		selected, err := utils.SelectRoute(config.RouteSelect, config.Dest, checker, cli, key)
-		return selected, err
-	}
-
-	return "", fmt.Errorf("no destination set for service %s", config.Service)
+	return false
 }
 
 // setEnvironment sets environment variables from a map whose keys are the
@@ -140,12 +70,67 @@ func setEnvironment(environment map[string]string) {
 	}
 }
 
+// hiddenFlags are the flags for developers, which are not shown in the usage.
+var hiddenFlags = map[string]bool{"profile": true}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: sshproxy [config]\n")
-	flag.PrintDefaults()
+	visible := flag.NewFlagSet("sshproxy", flag.ContinueOnError)
+	visible.SetOutput(os.Stderr)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
 	os.Exit(2)
 }
 
+// connectionRateWindow is the window in which the connections of a user are
+// counted for the max_connections_per_minute option.
+const connectionRateWindow = time.Minute
+
+// checkConnectionRate exits if the user already made maxPerMinute connections
+// during the last minute, otherwise it records the connection being made. The
+// limit is not enforced if etcd cannot be read or written.
+func checkConnectionRate(cli *utils.Client, tracer *tracer, maxPerMinute int, username, sid string, start time.Time) {
+	count, err := cli.CountRecentConnects(username, connectionRateWindow)
+	if err != nil {
+		log.Errorf("Getting recent connections count: %s", err)
+		return
+	}
+	log.Debugf("Number of connections of %s during the last minute: %d", username, count)
+	if count >= maxPerMinute {
+		fmt.Fprintln(os.Stderr, "Too many connections in the last minute, please retry later")
+		tracer.fatalf("Max connections per minute reached for %s", username)
+	}
+	if err := cli.RecordConnectAttempt(username, sid, start, connectionRateWindow); err != nil {
+		log.Errorf("Recording connection attempt: %s", err)
+	}
+}
+
+// checkConnectionShare exits if the user already has pct percent of all the
+// active connections (see utils.ConnectionShareLimit). The limit is not
+// enforced if etcd cannot be read.
+func checkConnectionShare(cli *utils.Client, tracer *tracer, pct int, username string) {
+	total, err := cli.GetTotalConnectionsCount()
+	if err != nil {
+		log.Errorf("Getting total connections count: %s", err)
+		return
+	}
+	userCount, err := cli.GetUserConnectionsCount(username)
+	if err != nil {
+		log.Errorf("Getting user connections count: %s", err)
+		return
+	}
+	limit := utils.ConnectionShareLimit(pct, total)
+	log.Debugf("Number of connections of %s: %d/%d (%d%% of %d connections)", username, userCount, limit, pct, total)
+	if userCount >= limit {
+		fmt.Fprintf(os.Stderr, "Too many connections: you are using %d of the %d active connections (%d%% allowed)\n", userCount, total, pct)
+		tracer.fatalf("Max connections per user pct reached for %s (%d/%d)", username, userCount, limit)
+	}
+}
+
 // SSHInfo represents the SSH connection information provided by the
 // environment variable SSH_CONNECTION.
 type SSHInfo struct {
@@ -186,6 +171,24 @@ func NewSSHInfo(s string) (*SSHInfo, error) {
 	}, nil
 }
 
+// newSSHInfoFromFlags returns the SSH connection information given by the -src
+// and -dst command line options (host:port each) instead of the environment
+// variable SSH_CONNECTION.
+func newSSHInfoFromFlags(src, dst string) (*SSHInfo, error) {
+	if src == "" || dst == "" {
+		return nil, errors.New("both -src and -dst are needed")
+	}
+	srcHost, srcPort, err := net.SplitHostPort(src)
+	if err != nil {
+		return nil, fmt.Errorf("bad value for -src: %s", err)
+	}
+	dstHost, dstPort, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, fmt.Errorf("bad value for -dst: %s", err)
+	}
+	return NewSSHInfo(fmt.Sprintf("%s %s %s %s", srcHost, srcPort, dstHost, dstPort))
+}
+
 // Src returns the source address with the format host:port.
 func (s *SSHInfo) Src() string {
 	return net.JoinHostPort(s.SrcIP.String(), strconv.Itoa(s.SrcPort))
@@ -220,9 +223,15 @@ func mainExitCode() int {
 	start := time.Now()
 
 	versionFlag := flag.Bool("version", false, "show version number and exit")
+	srcFlag := flag.String("src", "", "source of the connection (IP:port) when not run by sshd, for testing")
+	dstFlag := flag.String("dst", "", "address of sshd (IP:port) when not run by sshd, for testing")
+	profileFlag := flag.String("profile", "", "write a CPU profile in `PATH` and an execution trace in PATH.trace until ssh is started")
 	flag.Usage = usage
 	flag.Parse()
 
+	stopProfile := startProfile(*profileFlag)
+	defer stopProfile()
+
 	if *versionFlag {
 		fmt.Fprintf(os.Stderr, "sshproxy version %s\n", SshproxyVersion)
 		return 0
@@ -239,14 +248,21 @@ func mainExitCode() int {
 	}
 	username := currentUser.Username
 
-	sshConnection := os.Getenv("SSH_CONNECTION")
-	if sshConnection == "" {
-		log.Fatal("No SSH_CONNECTION environment variable")
-	}
-
-	sshInfos, err := NewSSHInfo(sshConnection)
-	if err != nil {
-		log.Fatalf("parsing SSH_CONNECTION '%s': %s", sshConnection, err)
+	var sshInfos *SSHInfo
+	if *srcFlag != "" || *dstFlag != "" {
+		sshInfos, err = newSSHInfoFromFlags(*srcFlag, *dstFlag)
+		if err != nil {
+			log.Fatalf("parsing the connection information: %s", err)
+		}
+	} else {
+		sshConnection := os.Getenv("SSH_CONNECTION")
+		if sshConnection == "" {
+			log.Fatal("No SSH_CONNECTION environment variable: sshproxy must be run by sshd (ForceCommand), or with -src and -dst for testing")
+		}
+		sshInfos, err = NewSSHInfo(sshConnection)
+		if err != nil {
+			log.Fatalf("parsing SSH_CONNECTION '%s': %s", sshConnection, err)
+		}
 	}
 
 	conninfo := &ConnInfo{
@@ -262,49 +278,185 @@ func mainExitCode() int {
 		log.Fatalf("Cannot find current user groups: %s", err)
 	}
 
-	config, err := utils.LoadConfig(configFile, username, sid, start, groups, sshInfos.Dst())
+	configStart := time.Now()
+	config, err := utils.LoadConfig(configFile, username, sid, start, groups, sshInfos.Dst(), utils.EnvironMap(os.Environ()))
 	if err != nil {
 		log.Fatalf("Reading configuration '%s': %s", configFile, err)
 	}
 
 	logformat := fmt.Sprintf("%%{time:2006-01-02 15:04:05} %%{level} %s: %%{message}", sid)
 	syslogformat := fmt.Sprintf("%%{level} %s: %%{message}", sid)
-	utils.MustSetupLogging("sshproxy", config.Log, logformat, syslogformat, config.Debug)
+	var jsonFields map[string]string
+	if config.LogFormat == "json" {
+		jsonFields = map[string]string{
+			"sid":     sid,
+			"user":    username,
+			"src":     sshInfos.Src(),
+			"dst":     sshInfos.Dst(),
+			"service": config.Service,
+		}
+	}
+	utils.MustSetupLogging("sshproxy", config.Log, config.LogMode, logformat, syslogformat, jsonFields, config.Debug)
+	if err := config.EtcdConfigError(); err != nil {
+		log.Errorf("%v, using the local configuration file", err)
+	}
 
 	for _, configLine := range utils.PrintConfig(config, groups) {
 		log.Debug(configLine)
 	}
 
+	// registered first, so the traces are exported once the connection
+	// is over (or by tracer.fatalf if sshproxy exits before)
+	tracer := newTracer(config.OtelEndpoint, start)
+	tracer.setAttribute("sshproxy.user", username)
+	tracer.setAttribute("sshproxy.service", config.Service)
+	tracer.setAttribute("sshproxy.sid", sid)
+	tracer.addSpan("load config", configStart).End()
+	defer tracer.exportAll()
+
 	log.Infof("%s connected from %s to sshd listening on %s", username, sshInfos.Src(), sshInfos.Dst())
 	defer log.Info("disconnected")
 
+	if utils.MatchCIDRs(sshInfos.SrcIP, config.SourceDeny) {
+		fmt.Fprintf(os.Stderr, "Connections from %s are not allowed\n", sshInfos.SrcIP)
+		tracer.fatalf("Source %s is denied by source_deny", sshInfos.SrcIP)
+	}
+	if len(config.SourceAllow) > 0 && !utils.MatchCIDRs(sshInfos.SrcIP, config.SourceAllow) {
+		fmt.Fprintf(os.Stderr, "Connections from %s are not allowed\n", sshInfos.SrcIP)
+		tracer.fatalf("Source %s is not allowed by source_allow", sshInfos.SrcIP)
+	}
+
+	originalCmd := os.Getenv("SSH_ORIGINAL_COMMAND")
+	log.Debugf("original command = %s", originalCmd)
+
+	interactiveCommand := term.IsTerminal(os.Stdout.Fd())
+	log.Debugf("interactiveCommand = %v", interactiveCommand)
+
+	doCmd := ""
+	if config.ForceCommand != "" {
+		doCmd = config.ForceCommand
+	} else if originalCmd != "" {
+		doCmd = originalCmd
+	}
+
+	if utils.MatchRegexps(doCmd, config.CommandDenyRegexps) {
+		fmt.Fprintln(os.Stderr, "This command is not allowed")
+		tracer.fatalf("Command \"%s\" is denied by command_deny", doCmd)
+	}
+	if len(config.CommandAllowRegexps) > 0 && !utils.MatchRegexps(doCmd, config.CommandAllowRegexps) {
+		fmt.Fprintln(os.Stderr, "This command is not allowed")
+		tracer.fatalf("Command \"%s\" is not allowed by command_allow", doCmd)
+	}
+
+	kind := utils.SessionKind(doCmd, interactiveCommand)
+	log.Debugf("session kind = %s", kind)
+
+	limitSpan := tracer.startSpan("check limits")
 	cli, err := utils.NewEtcdClient(config, log)
 	if err != nil {
 		log.Errorf("Cannot contact etcd cluster to update state: %v", err)
 	}
 
+	exempt := isConnectionLimitExempt(config, username, groups)
+	if exempt {
+		log.Debugf("%s is exempt from the connection limits", username)
+	}
+
 	if cli != nil && cli.IsAlive() {
-		if config.MaxConnectionsPerUser > 0 {
+		if !exempt {
+			// a temporary limit set with sshproxyctl set-limit replaces
+			// max_connections_per_user
+			limit, err := cli.GetUserLimit(username)
+			if err == nil {
+				log.Infof("Using the max connections of %s set in etcd: %d (until %s)", username, limit.Max, limit.Expire.Format("2006-01-02 15:04:05"))
+				config.MaxConnectionsPerUser = limit.Max
+			} else if err != utils.ErrKeyNotFound {
+				log.Errorf("Getting user limit: %s", err)
+			}
+		}
+		if config.MaxConnectionsPerUser > 0 && !exempt {
 			userConnectionsCount, err := cli.GetUserConnectionsCount(username)
 			if err != nil {
-				log.Fatalf("Getting user connections count: %s", err)
+				tracer.fatalf("Getting user connections count: %s", err)
 			}
 			log.Debugf("Number of connections of %s: %d", username, userConnectionsCount)
+			if userConnectionsCount >= config.MaxConnectionsPerUser && config.DedupWindow > 0 {
+				// a rapid reconnect from the same source is probably a
+				// replacement of a dropped connection: at most one is
+				// forgiven, so concurrent sessions are still limited
+				recent, err := cli.GetRecentConnectionsCount(username, config.Service, sshInfos.SrcIP.String(), start.Add(-config.DedupWindow.Duration()))
+				if err != nil {
+					log.Errorf("Getting recent connections count: %s", err)
+				} else if recent > 0 {
+					log.Infof("%s reconnected from %s within dedup_window, one of its recent connections is not counted", username, sshInfos.SrcIP)
+					userConnectionsCount--
+				}
+			}
 			if userConnectionsCount >= config.MaxConnectionsPerUser {
 				fmt.Fprintln(os.Stderr, "Too many simultaneous connections")
-				log.Fatalf("Max connections per user reached for %s", username)
+				tracer.fatalf("Max connections per user reached for %s", username)
+			}
+			// count the connection being made
+			current := userConnectionsCount + 1
+			if kind == utils.InteractiveSession && config.ConnectionLimitWarnRatio > 0 && float64(current) >= config.ConnectionLimitWarnRatio*float64(config.MaxConnectionsPerUser) {
+				fmt.Fprintf(os.Stderr, "Warning: you are using %d of your %d allowed simultaneous connections, please close the unused ones\n", current, config.MaxConnectionsPerUser)
+				log.Infof("%s is approaching the max connections per user (%d/%d)", username, current, config.MaxConnectionsPerUser)
+			}
+		}
+		if limitedGroups := utils.LimitedGroups(config.MaxConnectionsPerGroup, groups); len(limitedGroups) > 0 && !exempt {
+			groupConnectionsCount, err := cli.GetGroupConnectionsCount(limitedGroups)
+			if err != nil {
+				tracer.fatalf("Getting group connections count: %s", err)
+			}
+			for _, group := range utils.SortedGroups(limitedGroups) {
+				log.Debugf("Number of connections of group %s: %d", group, groupConnectionsCount[group])
+				if groupConnectionsCount[group] >= config.MaxConnectionsPerGroup[group] {
+					fmt.Fprintf(os.Stderr, "Too many simultaneous connections for group %s\n", group)
+					tracer.fatalf("Max connections per group reached for %s (group %s)", username, group)
+				}
+			}
+		}
+		if config.MaxConnectionsPerSource > 0 && !utils.MatchCIDRs(sshInfos.SrcIP, config.ConnectionLimitExemptSources) {
+			sourceConnectionsCount, err := cli.GetSourceConnectionsCount(sshInfos.SrcIP.String())
+			if err != nil {
+				tracer.fatalf("Getting source connections count: %s", err)
+			}
+			log.Debugf("Number of connections from %s: %d", sshInfos.SrcIP, sourceConnectionsCount)
+			if sourceConnectionsCount >= config.MaxConnectionsPerSource {
+				fmt.Fprintln(os.Stderr, "Too many simultaneous connections from your host")
+				tracer.fatalf("Max connections per source reached for %s (source %s)", username, sshInfos.SrcIP)
+			}
+		}
+		if config.MaxConnectionsPerMinute > 0 && !exempt {
+			checkConnectionRate(cli, tracer, config.MaxConnectionsPerMinute, username, sid, start)
+		}
+		if config.MaxConnectionsPerUserPct > 0 && !exempt {
+			checkConnectionShare(cli, tracer, config.MaxConnectionsPerUserPct, username)
+		}
+		if config.MaxTransfersPerUser > 0 && !exempt && utils.IsTransferSession(kind) {
+			userTransfersCount, err := cli.GetUserTransfersCount(username)
+			if err != nil {
+				tracer.fatalf("Getting user transfers count: %s", err)
+			}
+			log.Debugf("Number of transfers of %s: %d", username, userTransfersCount)
+			if userTransfersCount >= config.MaxTransfersPerUser {
+				fmt.Fprintln(os.Stderr, "Too many simultaneous file transfers, please retry later")
+				tracer.fatalf("Max transfers per user reached for %s", username)
 			}
 		}
 	} else {
 		if config.Etcd.Mandatory {
-			log.Fatal("Etcd is mandatory but unavailable")
+			tracer.fatalf("Etcd is mandatory but unavailable")
 		}
 	}
+	limitSpan.End()
 
-	hostport, err := findDestination(cli, username, config, sshInfos.Dst())
+	routeSpan := tracer.startSpan("select route")
+	hostport, err := utils.FindDestination(cli, username, config, sshInfos.Dst(), sshInfos.SrcIP, nil)
+	routeSpan.End()
 	switch {
 	case err != nil:
-		log.Fatalf("Finding destination: %s", err)
+		tracer.fatalf("Finding destination: %s", err)
 	case hostport == "":
 		errorBanner := ""
 		if cli != nil && cli.IsAlive() {
@@ -316,16 +468,13 @@ func mainExitCode() int {
 		if errorBanner != "" {
 			fmt.Println(errorBanner)
 		}
-		log.Fatal("Cannot find a valid destination")
-	}
-	host, port, err := utils.SplitHostPort(hostport)
-	if err != nil {
-		log.Fatalf("Invalid destination '%s': %s", hostport, err)
+		tracer.fatalf("Cannot find a valid destination")
 	}
 
 	setEnvironment(config.Environment)
 
-	// waitgroup and channel to stop our background command when exiting.
+	// waitgroup and channel to stop our background command when exiting,
+	// the blocking commands being interrupted too.
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
@@ -341,16 +490,89 @@ func mainExitCode() int {
 		cancel()
 	}()
 
+	for _, command := range config.BlockingCommand {
+		env := []string{
+			fmt.Sprintf("SSHPROXY_USER=%s", username),
+			fmt.Sprintf("SSHPROXY_SERVICE=%s", config.Service),
+			fmt.Sprintf("SSHPROXY_DEST=%s", hostport),
+			fmt.Sprintf("SSHPROXY_SOURCE=%s", sshInfos.Src()),
+		}
+		output, err := runBlockingCommand(ctx, config, command, env)
+		if err != nil {
+			tracer.fatalf("Connection denied by blocking command '%s': %s", command, err)
+		}
+		if config.BlockingCommandDestOverride {
+			dest, err := blockingCommandDest(output, config)
+			if err != nil {
+				tracer.fatalf("Connection denied by blocking command '%s': %s", command, err)
+			}
+			if dest != "" && dest != hostport {
+				// the destination chosen by the command is checked as
+				// the ones chosen by sshproxy, and ignored if rejected
+				trace := &utils.RouteTrace{}
+				if utils.CheckDestination(cli, config, dest, trace) {
+					log.Infof("destination %s overridden by blocking command '%s': %s", hostport, command, dest)
+					hostport = dest
+				} else {
+					log.Warningf("destination %s of blocking command '%s' rejected (%s), keeping %s", dest, command, strings.Join(trace.Steps, ", "), hostport)
+				}
+			}
+		}
+	}
+
+	tracer.setAttribute("sshproxy.dest", hostport)
+
+	var recorder *Recorder
+
+	// the logical destination is kept in etcd, only the connection uses the
+	// rewritten address
+	connectHostport := utils.RewriteDest(config.DestRewrite, hostport)
+	if connectHostport != hostport {
+		log.Debugf("destination %s rewritten to %s", hostport, connectHostport)
+	}
+	host, port, err := utils.SplitHostPort(connectHostport)
+	if err != nil {
+		tracer.fatalf("Invalid destination '%s': %s", connectHostport, err)
+	}
+
 	var etcdPath string
 	var tmpKeepAliveChan <-chan *clientv3.LeaseKeepAliveResponse
 	// Register destination in etcd and keep it alive while running.
 	if cli != nil && cli.IsAlive() {
 		key := fmt.Sprintf("%s@%s", username, config.Service)
-		keepAliveChan, eP, err := cli.SetDestination(ctx, key, sshInfos.Dst(), hostport, config.EtcdKeyTTL)
+		etcdSpan := tracer.startSpan("register connection in etcd")
+		keepAliveChan, eP, err := cli.SetDestination(ctx, key, sshInfos.Dst(), hostport, config.EtcdKeyTTL, &utils.Connection{Kind: kind, Groups: utils.SortedGroups(groups), Source: sshInfos.SrcIP.String(), Mode: config.Mode, RouteSelect: config.RouteSelect})
 		etcdPath = eP
+		etcdSpan.End()
 		if err != nil {
 			log.Warningf("setting destination in etcd: %v", err)
 		}
+		// exit when the connection is deleted by "sshproxyctl disconnect"
+		if etcdPath != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := cli.WaitConnectionDeleted(ctx, etcdPath)
+					switch {
+					case err == nil:
+						log.Warning("connection deleted in etcd, disconnecting")
+						cancel()
+						return
+					case ctx.Err() != nil:
+						return
+					}
+					// the watch was closed (e.g. the connection to etcd
+					// was replaced after a re-authentication): watch again
+					log.Debugf("watching the connection in etcd again: %v", err)
+					select {
+					case <-time.After(time.Second):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -360,6 +582,15 @@ func mainExitCode() int {
 					if isChanAlive == nil {
 						cli.Disable()
 						tmpKeepAliveChan, err = cli.NewLease(ctx)
+						if err != nil && utils.IsAuthError(err) {
+							log.Warningf("etcd authentication failed (%v), re-authenticating", err)
+							if err = cli.Reauthenticate(); err != nil {
+								log.Errorf("re-authenticating to etcd: %v", err)
+							} else {
+								log.Info("re-authenticated to etcd")
+								tmpKeepAliveChan, err = cli.NewLease(ctx)
+							}
+						}
 						if err != nil {
 							log.Warningf("getting a new lease in etcd: %v", err)
 						} else {
@@ -380,7 +611,7 @@ func mainExitCode() int {
 		go func() {
 			defer wg.Done()
 			cmd := prepareBackgroundCommand(ctx, config.BgCommand, config.Debug)
-			if _, err := runCommand(cmd, false); err != nil {
+			if _, err := runCommand(cmd, false, nil); err != nil {
 				select {
 				case <-ctx.Done():
 					// stay silent as the session is now finished
@@ -391,65 +622,75 @@ func mainExitCode() int {
 		}()
 	}
 
-	// Launch goroutine which exits sshproxy if it's attached to PID 1
-	// (which means its ssh parent connection is dead).
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-time.After(1 * time.Second):
-				if os.Getppid() == 1 {
-					log.Warning("SSH parent connection is dead")
-					cancel()
+	// Exit sshproxy when its ssh parent connection is dead: SIGHUP is
+	// received (see the signal handler above) where it is supported,
+	// otherwise a goroutine checks if sshproxy is attached to PID 1.
+	if err := setParentDeathSignal(); err == nil {
+		// the parent may have died before the signal was set up
+		if os.Getppid() == 1 {
+			log.Warning("SSH parent connection is dead")
+			cancel()
+		}
+	} else {
+		log.Debugf("checking the SSH parent connection every %s: %v", config.ParentCheckInterval.Duration(), err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-time.After(config.ParentCheckInterval.Duration()):
+					if os.Getppid() == 1 {
+						log.Warning("SSH parent connection is dead")
+						cancel()
+						return
+					}
+				case <-ctx.Done():
 					return
 				}
-			case <-ctx.Done():
-				return
 			}
-		}
-	}()
-
-	originalCmd := os.Getenv("SSH_ORIGINAL_COMMAND")
-	log.Debugf("original command = %s", originalCmd)
-
-	interactiveCommand := term.IsTerminal(os.Stdout.Fd())
-	log.Debugf("interactiveCommand = %v", interactiveCommand)
+		}()
+	}
 
-	sshArgs := config.SSH.Args
+	sshArgs := append([]string{}, config.SSH.Args...)
+	switch kind {
+	case utils.InteractiveSession:
+		sshArgs = append(sshArgs, config.SSH.InteractiveArgs...)
+	case utils.SFTPSession:
+		sshArgs = append(sshArgs, config.SSH.SFTPArgs...)
+	case utils.SCPSession, utils.ExecSession:
+		sshArgs = append(sshArgs, config.SSH.ExecArgs...)
+	}
 	envSshproxyArgs := strings.Fields(os.Getenv("SSHPROXY_ARGS"))
 	if len(envSshproxyArgs) != 0 {
 		sshArgs = append(sshArgs, envSshproxyArgs...)
 	}
+	if config.SSH.BindAddress != "" {
+		sshArgs = append(sshArgs, "-b", config.SSH.BindAddress)
+	}
 	if port != utils.DefaultSSHPort {
 		sshArgs = append(sshArgs, "-p", port)
 	}
-	doCmd := ""
-	if config.ForceCommand != "" {
-		doCmd = config.ForceCommand
-	} else if originalCmd != "" {
-		doCmd = originalCmd
-	}
 	commandTranslated := false
 	if doCmd != "" {
 		if config.CommandMustMatch && originalCmd != doCmd {
 			log.Errorf("error executing proxied ssh command: originalCmd \"%s\" does not match forceCommand \"%s\"", originalCmd, config.ForceCommand)
 			return 1
 		}
-		for fromCmd, translateCmdConf := range config.TranslateCommands {
-			if doCmd == fromCmd {
-				log.Debugf("translateCmdConf = %+v", translateCmdConf)
-				sshArgs = append(sshArgs, translateCmdConf.SSHArgs...)
-				sshArgs = append(sshArgs, host, "--", translateCmdConf.Command)
-				if config.Dump != "" && translateCmdConf.DisableDump {
-					config.Dump = "etcd"
-				}
-				commandTranslated = true
-				break
+		if translateCmdConf, translatedCmd := utils.TranslateCommand(config.TranslateCommands, doCmd); translateCmdConf != nil {
+			log.Debugf("translateCmdConf = %+v", translateCmdConf)
+			sshArgs = append(sshArgs, translateCmdConf.SSHArgs...)
+			sshArgs = append(sshArgs, host, "--", translatedCmd)
+			if config.Dump != "" && translateCmdConf.DisableDump {
+				config.Dump = "etcd"
 			}
+			commandTranslated = true
 		}
 		if !commandTranslated {
-			if interactiveCommand {
+			switch {
+			case config.ForceTTY == "always":
+				// Force TTY allocation even if stdin is not a terminal.
+				sshArgs = append(sshArgs, "-tt")
+			case config.ForceTTY == "auto" && interactiveCommand:
 				// Force TTY allocation because the user probably asked for it.
 				sshArgs = append(sshArgs, "-t")
 			}
@@ -461,9 +702,9 @@ func mainExitCode() int {
 	cmd := exec.CommandContext(ctx, config.SSH.Exe, sshArgs...)
 	log.Debugf("command = %s %q", cmd.Path, cmd.Args)
 
-	var recorder *Recorder
-	if config.Dump != "" {
-		recorder = NewRecorder(conninfo, config.Dump, doCmd, config.EtcdStatsInterval.Duration(), config.LogStatsInterval.Duration(), config.DumpLimitSize, config.DumpLimitWindow.Duration())
+	// the data go through sshproxy to be recorded or throttled
+	if config.Dump != "" || config.BandwidthLimit > 0 {
+		recorder = NewRecorder(conninfo, config.Dump, doCmd, kind, config.EtcdStatsInterval.Duration(), config.LogStatsInterval.Duration(), config.DumpLimitSize, config.DumpLimitWindow.Duration(), config.DumpUserQuota, config.DumpMode, config.DumpCompress, config.BandwidthLimit)
 
 		wg.Add(1)
 		go func() {
@@ -472,14 +713,65 @@ func mainExitCode() int {
 		}()
 	}
 
+	if config.PrometheusPushgateway != "" {
+		var totals func() map[int]uint64
+		if recorder != nil {
+			totals = recorder.Totals
+		}
+		metrics := sessionMetrics{User: username, Service: config.Service, Dest: hostport}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMetricsPusher(ctx, config.PrometheusPushgateway, sid, metrics, totals, config.LogStatsInterval.Duration())
+		}()
+	}
+
 	log.Infof("proxied to %s (service: %s)", hostport, config.Service)
 
+	// set the priorities and the cgroup of the ssh process once started
+	var onStart func(int)
+	nice, hasNice := config.Nice[kind]
+	ioprio, hasIOPrio := config.IONice[kind]
+	if hasNice || hasIOPrio || config.Cgroup != "" {
+		onStart = func(pid int) {
+			if hasNice {
+				if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+					log.Warningf("setting nice value %d: %s", nice, err)
+				}
+			}
+			if hasIOPrio {
+				if err := setIOPriority(pid, ioprio); err != nil {
+					log.Warningf("setting I/O priority %s: %s", ioprio, err)
+				}
+			}
+			if config.Cgroup != "" {
+				if err := joinCgroup(config.Cgroup, pid); err != nil {
+					log.Warningf("placing ssh in cgroup %s: %s", config.Cgroup, err)
+				}
+			}
+		}
+	}
+
+	// the profiling only covers the choice of the destination and the
+	// setup of the connection, not the whole session
+	stopProfile()
+
 	var rc int
+	execSpan := tracer.startSpan("ssh exec")
+	// the setup of the connection is exported without waiting for its end
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := tracer.export(false); err != nil {
+			log.Errorf("exporting traces to the OTLP endpoint: %v", err)
+		}
+	}()
 	if interactiveCommand {
-		rc, err = runTtyCommand(cmd, recorder)
+		rc, err = runTtyCommand(cmd, recorder, onStart)
 	} else {
-		rc, err = runStdCommand(cmd, recorder)
+		rc, err = runStdCommand(cmd, recorder, onStart)
 	}
+	execSpan.End()
 	if err != nil {
 		log.Errorf("error executing proxied ssh command: %s", err)
 	}
@@ -0,0 +1,44 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"testing"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+func TestIsConnectionLimitExempt(t *testing.T) {
+	config := &utils.Config{
+		ConnectionLimitExemptUsers:  []string{"root", "backup"},
+		ConnectionLimitExemptGroups: []string{"admin"},
+	}
+	for _, tt := range []struct {
+		username string
+		groups   map[string]bool
+		want     bool
+	}{
+		{"alice", nil, false},
+		{"alice", map[string]bool{"users": true}, false},
+		{"root", nil, true},
+		{"backup", map[string]bool{"users": true}, true},
+		{"alice", map[string]bool{"users": true, "admin": true}, true},
+		{"alice", map[string]bool{"admin": false}, false},
+	} {
+		if got := isConnectionLimitExempt(config, tt.username, tt.groups); got != tt.want {
+			t.Errorf("isConnectionLimitExempt(%q, %v) = %v, want %v", tt.username, tt.groups, got, tt.want)
+		}
+	}
+
+	if isConnectionLimitExempt(&utils.Config{}, "root", map[string]bool{"admin": true}) {
+		t.Errorf("isConnectionLimitExempt without exemptions = true, want false")
+	}
+}
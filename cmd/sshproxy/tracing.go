@@ -0,0 +1,256 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportTimeout is the timeout of the export of the traces to the OTLP
+// endpoint.
+const exportTimeout = 2 * time.Second
+
+// A tracer records the spans of the lifecycle of a connection and exports
+// them to an OpenTelemetry collector with OTLP/HTTP (JSON encoding). All the
+// spans are children of a root span covering the whole connection, and carry
+// the attributes of the tracer (user, service, destination).
+//
+// A nil *tracer records nothing, so tracing costs nothing when it is not
+// configured.
+type tracer struct {
+	endpoint   string
+	traceID    string
+	root       *span
+	attributes map[string]string
+	spans      []*span
+	lock       sync.Mutex
+	exportLock sync.Mutex // serializes the exports, so a span is sent once
+}
+
+// A span is a timed operation of a trace.
+type span struct {
+	tracer *tracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	sent   bool
+}
+
+// randomID returns a random identifier of n bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTracer returns a tracer exporting its spans to the OTLP endpoint (e.g.
+// "http://collector:4318"), whose root span starts at start. It returns nil if
+// endpoint is empty.
+func newTracer(endpoint string, start time.Time) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint:   endpoint,
+		traceID:    randomID(16),
+		attributes: map[string]string{},
+	}
+	t.root = &span{tracer: t, id: randomID(8), name: "sshproxy connection", start: start}
+	return t
+}
+
+// setAttribute sets an attribute of all the spans of the tracer.
+func (t *tracer) setAttribute(key, value string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.attributes[key] = value
+	t.lock.Unlock()
+}
+
+// startSpan starts a span named name, child of the root span.
+func (t *tracer) startSpan(name string) *span {
+	return t.addSpan(name, time.Now())
+}
+
+// addSpan starts a span named name at start, child of the root span. It is
+// used for the operations which happened before the tracer was created.
+func (t *tracer) addSpan(name string, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, id: randomID(8), parent: t.root.id, name: name, start: start}
+	t.lock.Lock()
+	t.spans = append(t.spans, s)
+	t.lock.Unlock()
+	return s
+}
+
+// End ends the span. It can be called several times, only the first call is
+// taken into account.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.tracer.lock.Lock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	s.tracer.lock.Unlock()
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+}
+
+// otlpAttributes returns the attributes in the OTLP format, sorted by key.
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	otlp := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		otlp = append(otlp, otlpAttribute{key, otlpValue{value}})
+	}
+	sort.Slice(otlp, func(i, j int) bool { return otlp[i].Key < otlp[j].Key })
+	return otlp
+}
+
+// write writes the ended spans which were not sent yet in the OTLP/HTTP JSON
+// format, and returns them. If final is true, the spans which were not ended,
+// including the root span, end now.
+func (t *tracer) write(w *bytes.Buffer, final bool) ([]*span, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	attributes := otlpAttributes(t.attributes)
+	var written []*span
+	var spans []otlpSpan
+	for _, s := range append([]*span{t.root}, t.spans...) {
+		if final && s.end.IsZero() {
+			s.end = now
+		}
+		if s.sent || s.end.IsZero() {
+			continue
+		}
+		written = append(written, s)
+		spans = append(spans, otlpSpan{
+			TraceID:      t.traceID,
+			SpanID:       s.id,
+			ParentSpanID: s.parent,
+			Name:         s.name,
+			// SPAN_KIND_INTERNAL
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes,
+		})
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	return written, json.NewEncoder(w).Encode(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": "sshproxy"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "sshproxy", "version": SshproxyVersion},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+}
+
+// export sends the ended spans which were not sent yet to the OTLP endpoint,
+// so the spans of the setup of the connection are not lost if sshproxy is
+// killed during the session. If final is true, all the spans end now and are
+// sent.
+func (t *tracer) export(final bool) error {
+	if t == nil {
+		return nil
+	}
+	t.exportLock.Lock()
+	defer t.exportLock.Unlock()
+	var body bytes.Buffer
+	written, err := t.write(&body, final)
+	if err != nil || len(written) == 0 {
+		return err
+	}
+
+	exportURL := strings.TrimSuffix(t.endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequest(http.MethodPost, exportURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: exportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", exportURL, resp.Status)
+	}
+	t.lock.Lock()
+	for _, s := range written {
+		s.sent = true
+	}
+	t.lock.Unlock()
+	return nil
+}
+
+// exportAll sends all the spans to the OTLP endpoint (see export) and logs
+// any error.
+func (t *tracer) exportAll() {
+	if err := t.export(true); err != nil {
+		log.Errorf("exporting traces to the OTLP endpoint: %v", err)
+	}
+}
+
+// fatalf is like log.Fatalf, but it first exports the traces with the error
+// message, as the deferred functions are not run.
+func (t *tracer) fatalf(format string, args ...interface{}) {
+	t.setAttribute("sshproxy.error", fmt.Sprintf(format, args...))
+	t.exportAll()
+	log.Fatalf(format, args...)
+}
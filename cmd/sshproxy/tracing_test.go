@@ -0,0 +1,83 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// otlpPayload is the part of an OTLP/HTTP JSON payload checked by the tests.
+type otlpPayload struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTracerExport(t *testing.T) {
+	var payloads []otlpPayload
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with content type %q, want /v1/traces with JSON", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var payload otlpPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding the OTLP payload: %v", err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer collector.Close()
+
+	tracer := newTracer(collector.URL+"/", time.Now())
+	tracer.setAttribute("sshproxy.user", "alice")
+	tracer.startSpan("select route").End()
+	tracer.startSpan("ssh exec")
+	// only the ended spans are exported during the session
+	if err := tracer.export(false); err != nil {
+		t.Fatalf("export(false) error = %v, want nil", err)
+	}
+	// nothing new to export
+	if err := tracer.export(false); err != nil {
+		t.Fatalf("export(false) error = %v, want nil", err)
+	}
+	if err := tracer.export(true); err != nil {
+		t.Fatalf("export(true) error = %v, want nil", err)
+	}
+
+	want := [][]string{{"select route"}, {"sshproxy connection", "ssh exec"}}
+	if len(payloads) != len(want) {
+		t.Fatalf("got %d exports, want %d", len(payloads), len(want))
+	}
+	for i, payload := range payloads {
+		var names []string
+		for _, s := range payload.ResourceSpans[0].ScopeSpans[0].Spans {
+			names = append(names, s.Name)
+			if s.TraceID != tracer.traceID {
+				t.Errorf("span %s trace ID = %s, want %s", s.Name, s.TraceID, tracer.traceID)
+			}
+			if s.Name != "sshproxy connection" && s.ParentSpanID != tracer.root.id {
+				t.Errorf("span %s parent = %s, want the root span %s", s.Name, s.ParentSpanID, tracer.root.id)
+			}
+			if len(s.Attributes) != 1 || s.Attributes[0].Key != "sshproxy.user" || s.Attributes[0].Value.StringValue != "alice" {
+				t.Errorf("span %s attributes = %v, want sshproxy.user=alice", s.Name, s.Attributes)
+			}
+		}
+		if !reflect.DeepEqual(names, want[i]) {
+			t.Errorf("export %d spans = %v, want %v", i, names, want[i])
+		}
+	}
+}
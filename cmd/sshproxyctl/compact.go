@@ -0,0 +1,74 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// defaultCompactKeep is the default number of revisions kept by compact, so
+// that the watches in progress (e.g. of the connections) are not broken.
+const defaultCompactKeep = 1000
+
+// confirm asks a yes/no question on the terminal and returns true if the
+// answer is yes.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// compact discards the revision history of the etcd store, except the keep
+// last revisions. The compaction is only shown if dryRun is true, and it is
+// confirmed interactively unless yes is true.
+func compact(configFile string, keep int64, dryRun, yes bool) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	revision, count, err := cli.Revision()
+	if err != nil {
+		log.Fatalf("ERROR: getting the revision of etcd: %v", err)
+	}
+	target := revision - keep
+	fmt.Printf("current revision: %d (%d sshproxy keys)\n", revision, count)
+	if target <= 0 {
+		fmt.Printf("nothing to compact: less than %d revisions\n", keep)
+		return
+	}
+	if dryRun {
+		fmt.Printf("would compact the revisions older than %d\n", target)
+		return
+	}
+	if !yes && !confirm(fmt.Sprintf("Compact the revisions older than %d of the whole etcd store (not only sshproxy keys)?", target)) {
+		fmt.Println("aborted")
+		os.Exit(1)
+	}
+
+	switch err := cli.Compact(target); err {
+	case nil:
+		fmt.Printf("compacted the revisions older than %d\n", target)
+	case utils.ErrCompacted:
+		fmt.Printf("already compacted beyond revision %d\n", target)
+	default:
+		log.Fatalf("ERROR: compacting etcd: %v", etcdError(err))
+	}
+}
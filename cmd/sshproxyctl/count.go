@@ -0,0 +1,85 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// A count is a named number displayed by the -count option of show.
+type count struct {
+	Name string
+	N    int
+}
+
+// displayCounts displays the counts, one "name: n" per line, in CSV format if
+// csvFlag is true or as a JSON object if jsonFlag is true.
+func displayCounts(counts []count, csvFlag bool, jsonFlag bool) {
+	switch {
+	case jsonFlag:
+		obj := make(map[string]int, len(counts))
+		for _, c := range counts {
+			obj[c.Name] = c.N
+		}
+		displayJSON(obj)
+	case csvFlag:
+		rows := make([][]string, len(counts))
+		for i, c := range counts {
+			rows[i] = []string{c.Name, strconv.Itoa(c.N)}
+		}
+		displayCSV(rows)
+	default:
+		for _, c := range counts {
+			fmt.Printf("%s: %d\n", c.Name, c.N)
+		}
+	}
+}
+
+// connectionsCounts returns the total number of connections and the number
+// of aggregated connections (by user, service and destination, as shown
+// without -all).
+func connectionsCounts(fc flatConnections) []count {
+	return []count{
+		{"total", len(fc)},
+		{"aggregated", len(fc.getAggregatedConnections())},
+	}
+}
+
+// hostsCounts returns the total number of hosts, the number of hosts in each
+// state, the number of cordoned hosts and, if stale is not 0, the number of
+// stale hosts at now (see isStale).
+func hostsCounts(hosts []*utils.FlatHost, stale time.Duration, now time.Time) []count {
+	byState := map[string]int{}
+	cordoned := 0
+	staleCount := 0
+	for _, h := range hosts {
+		byState[h.State.String()]++
+		if h.Cordoned {
+			cordoned++
+		}
+		if isStale(h, stale, now) {
+			staleCount++
+		}
+	}
+	counts := []count{{"total", len(hosts)}}
+	for _, state := range utils.States() {
+		counts = append(counts, count{state, byState[state]})
+	}
+	counts = append(counts, count{"cordoned", cordoned})
+	if stale > 0 {
+		counts = append(counts, count{"stale", staleCount})
+	}
+	return counts
+}
@@ -0,0 +1,349 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// certExpirationWarning is the delay before the expiration of a certificate
+// from which a warning is issued.
+const certExpirationWarning = 30 * 24 * time.Hour
+
+// Status of a check of the doctor.
+type checkStatus int
+
+const (
+	checkPassed checkStatus = iota
+	checkWarning
+	checkFailed
+	checkSkipped
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkPassed:
+		return " OK "
+	case checkWarning:
+		return "WARN"
+	case checkFailed:
+		return "FAIL"
+	default:
+		return "SKIP"
+	}
+}
+
+// doctorCheck is the result of a check of the doctor. A failed check is
+// critical, a warning is not.
+type doctorCheck struct {
+	Name    string
+	Status  checkStatus
+	Details []string
+	Hint    string
+}
+
+// doctor runs the checks of the configuration file and of etcd, prints them
+// as a checklist and returns false if a critical check failed.
+func doctor(configFile string) bool {
+	var checks []*doctorCheck
+
+	configs, err := utils.LoadServicesConfigs(configFile)
+	if err != nil {
+		checks = append(checks, &doctorCheck{
+			Name:    "configuration file parses",
+			Status:  checkFailed,
+			Details: []string{err.Error()},
+			Hint:    fmt.Sprintf("fix %s (see sshproxy.yaml(5))", configFile),
+		})
+		printDoctorChecks(checks)
+		return false
+	}
+	checks = append(checks, &doctorCheck{Name: "configuration file parses", Status: checkPassed})
+	checks = append(checks, checkUnknownKeys(configFile))
+	checks = append(checks, checkDuplicateServices(configs))
+	checks = append(checks, checkSourcesConflicts(configFile))
+	checks = append(checks, checkDestinationsResolve(configs))
+	checks = append(checks, checkTLSCertificates(configs[0]))
+	checks = append(checks, checkEtcd(configs)...)
+
+	printDoctorChecks(checks)
+	for _, check := range checks {
+		if check.Status == checkFailed {
+			return false
+		}
+	}
+	return true
+}
+
+func printDoctorChecks(checks []*doctorCheck) {
+	for _, check := range checks {
+		fmt.Printf("[%s] %s\n", check.Status, check.Name)
+		for _, detail := range check.Details {
+			fmt.Printf("       %s\n", detail)
+		}
+		if (check.Status == checkWarning || check.Status == checkFailed) && check.Hint != "" {
+			fmt.Printf("       hint: %s\n", check.Hint)
+		}
+	}
+}
+
+// checkDuplicateServices warns about the services defined by several
+// overrides, which is legitimate (e.g. to route distinct users or groups
+// differently) but often a copy/paste mistake.
+func checkDuplicateServices(configs []*utils.Config) *doctorCheck {
+	check := &doctorCheck{
+		Name: "no duplicate service definitions",
+		Hint: "make sure the overrides defining the same service are not a copy/paste mistake",
+	}
+	if conflicts := utils.ServicesConflicts(configs); len(conflicts) > 0 {
+		check.Status = checkWarning
+		check.Details = conflicts
+		check.Hint = "make sure the overrides with a different routing match distinct users or groups, or give them a distinct service name"
+		return check
+	}
+	count := map[string]int{}
+	for _, config := range configs {
+		count[config.Service]++
+		if count[config.Service] == 2 {
+			check.Details = append(check.Details, fmt.Sprintf("service '%s' is defined several times", config.Service))
+		}
+	}
+	if len(check.Details) > 0 {
+		check.Status = checkWarning
+	}
+	return check
+}
+
+// checkUnknownKeys warns about the keys of the configuration file which are
+// not sshproxy options, as they are silently ignored.
+func checkUnknownKeys(configFile string) *doctorCheck {
+	check := &doctorCheck{
+		Name: "no unknown keys in the configuration file",
+		Hint: "fix or remove the unknown keys (see sshproxy.yaml(5))",
+	}
+	unknown, err := utils.UnknownConfigKeys(configFile)
+	if err != nil {
+		check.Status = checkFailed
+		check.Details = []string{err.Error()}
+	} else if len(unknown) > 0 {
+		check.Status = checkWarning
+		check.Details = unknown
+	}
+	return check
+}
+
+// checkSourcesConflicts warns about the services whose overrides match the
+// same sources, as the service used for a connection then depends on the
+// order of the overrides.
+func checkSourcesConflicts(configFile string) *doctorCheck {
+	check := &doctorCheck{
+		Name: "no overlapping sources between services",
+		Hint: "make the sources of the services distinct or merge the overrides",
+	}
+	conflicts, err := utils.SourcesConflicts(configFile)
+	if err != nil {
+		check.Status = checkFailed
+		check.Details = []string{err.Error()}
+		check.Hint = "fix the sources of the overrides or the name resolution of the hosts"
+	} else if len(conflicts) > 0 {
+		check.Status = checkWarning
+		check.Details = conflicts
+	}
+	return check
+}
+
+// checkDestinationsResolve checks that the destinations of all the services
+// can be resolved.
+func checkDestinationsResolve(configs []*utils.Config) *doctorCheck {
+	check := &doctorCheck{
+		Name: "all destinations resolve",
+		Hint: "fix the dest option of the service or the name resolution of the host",
+	}
+	resolved := map[string]bool{}
+	for _, config := range configs {
+		for _, dest := range config.Dest {
+			if resolved[dest] {
+				continue
+			}
+			resolved[dest] = true
+			host, _, err := net.SplitHostPort(dest)
+			if err == nil {
+				_, err = net.LookupHost(host)
+			}
+			if err != nil {
+				check.Status = checkFailed
+				check.Details = append(check.Details, fmt.Sprintf("service '%s': %v", config.Service, err))
+			}
+		}
+	}
+	return check
+}
+
+// checkTLSCertificates checks that the TLS certificates used to connect to
+// etcd can be read and are valid now and in the next days.
+func checkTLSCertificates(config *utils.Config) *doctorCheck {
+	check := &doctorCheck{
+		Name: "TLS certificates valid",
+		Hint: "renew the certificates or fix the etcd.tls options",
+	}
+	tlsConfig := config.Etcd.TLS
+	if tlsConfig.CertFile == "" && tlsConfig.CAFile == "" {
+		check.Status = checkSkipped
+		check.Details = []string{"no TLS certificate configured"}
+		return check
+	}
+
+	var certs []*x509.Certificate
+	addCert := func(filename string, der []byte) {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			check.Status = checkFailed
+			check.Details = append(check.Details, fmt.Sprintf("%s: %v", filename, err))
+			return
+		}
+		certs = append(certs, cert)
+	}
+	if tlsConfig.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			check.Status = checkFailed
+			check.Details = append(check.Details, fmt.Sprintf("%s: %v", tlsConfig.CertFile, err))
+		} else {
+			addCert(tlsConfig.CertFile, pair.Certificate[0])
+		}
+	}
+	if tlsConfig.CAFile != "" {
+		pemBytes, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			check.Status = checkFailed
+			check.Details = append(check.Details, err.Error())
+		}
+		for {
+			var block *pem.Block
+			block, pemBytes = pem.Decode(pemBytes)
+			if block == nil {
+				break
+			}
+			addCert(tlsConfig.CAFile, block.Bytes)
+		}
+	}
+
+	now := time.Now()
+	for _, cert := range certs {
+		subject := cert.Subject.String()
+		switch {
+		case now.Before(cert.NotBefore):
+			check.Status = checkFailed
+			check.Details = append(check.Details, fmt.Sprintf("%s: not valid before %s", subject, cert.NotBefore.Format("2006-01-02 15:04:05")))
+		case now.After(cert.NotAfter):
+			check.Status = checkFailed
+			check.Details = append(check.Details, fmt.Sprintf("%s: expired since %s", subject, cert.NotAfter.Format("2006-01-02 15:04:05")))
+		case now.Add(certExpirationWarning).After(cert.NotAfter):
+			if check.Status == checkPassed {
+				check.Status = checkWarning
+			}
+			check.Details = append(check.Details, fmt.Sprintf("%s: expires on %s", subject, cert.NotAfter.Format("2006-01-02 15:04:05")))
+		}
+	}
+	return check
+}
+
+// checkEtcd checks that etcd is reachable with the configuration of each
+// service, that sshproxy can read and write its keys and that the
+// destinations of the services have their state stored in etcd.
+func checkEtcd(configs []*utils.Config) []*doctorCheck {
+	reachable := &doctorCheck{
+		Name: "etcd reachable",
+		Hint: "check the etcd.endpoints option, the network and the etcd cluster",
+	}
+	access := &doctorCheck{
+		Name: "etcd permissions",
+		Hint: "grant read/write access on the sshproxy keys to the etcd user",
+	}
+	hosts := &doctorCheck{
+		Name: "host entries exist in etcd",
+		Hint: "the hosts are added by sshproxy on the first connection or by 'sshproxyctl show -probe -update hosts'",
+	}
+	checks := []*doctorCheck{reachable, access, hosts}
+	if len(configs[0].Etcd.Endpoints) == 0 {
+		for _, check := range checks {
+			check.Status = checkSkipped
+			check.Details = []string{"etcd is not configured"}
+		}
+		return checks
+	}
+
+	// the connections to etcd are shared by the services using the same
+	// etcd configuration
+	clients := map[string]*utils.Client{}
+	defer func() {
+		for _, cli := range clients {
+			if cli != nil {
+				cli.Close()
+			}
+		}
+	}()
+	checked := map[string]bool{}
+	for _, config := range configs {
+		etcdKey := fmt.Sprintf("%+v", config.Etcd)
+		cli, present := clients[etcdKey]
+		if !present {
+			var err error
+			cli, err = utils.NewEtcdClient(config, nil)
+			if err != nil {
+				reachable.Status = checkFailed
+				reachable.Details = append(reachable.Details, fmt.Sprintf("%s: %v", strings.Join(config.Etcd.Endpoints, ","), err))
+			}
+			clients[etcdKey] = cli
+		}
+		if cli == nil {
+			access.Status = checkSkipped
+			hosts.Status = checkSkipped
+			continue
+		}
+		cli = cli.WithNamespace(config.EtcdNamespace)
+
+		nsKey := etcdKey + "/" + config.EtcdNamespace
+		if !checked[nsKey] {
+			checked[nsKey] = true
+			if err := cli.CheckAccess(); err != nil {
+				access.Status = checkFailed
+				access.Details = append(access.Details, fmt.Sprintf("service '%s': %v", config.Service, err))
+			}
+		}
+
+		for _, dest := range config.Dest {
+			if checked[nsKey+"/"+dest] {
+				continue
+			}
+			checked[nsKey+"/"+dest] = true
+			if _, err := cli.GetHost(dest); err == utils.ErrKeyNotFound {
+				if hosts.Status == checkPassed {
+					hosts.Status = checkWarning
+				}
+				hosts.Details = append(hosts.Details, fmt.Sprintf("service '%s': no entry for %s", config.Service, dest))
+			} else if err != nil {
+				hosts.Status = checkFailed
+				hosts.Details = append(hosts.Details, fmt.Sprintf("service '%s': %s: %v", config.Service, dest, err))
+			}
+		}
+	}
+	return checks
+}
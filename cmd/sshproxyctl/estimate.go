@@ -0,0 +1,105 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// defaultKeyTTL is the TTL (in seconds) of the connection keys when the
+// keyttl option of etcd is not set (see utils.NewEtcdClient).
+const defaultKeyTTL = 5
+
+// loadEstimate is the expected write rate (in writes per second) to etcd of
+// a service.
+type loadEstimate struct {
+	Service    string
+	KeepAlives float64
+	Stats      float64
+	// HostChecks is an upper bound, reached when new connections keep
+	// coming. It is negative when the hosts are checked at each connection.
+	HostChecks float64
+}
+
+// Total returns the total write rate, without the host checks when they
+// cannot be estimated.
+func (e *loadEstimate) Total() float64 {
+	total := e.KeepAlives + e.Stats
+	if e.HostChecks > 0 {
+		total += e.HostChecks
+	}
+	return total
+}
+
+// estimateLoad computes the expected write rate to etcd of a service for the
+// given number of concurrent connections:
+//   - the lease of each connection key (and of its history key if etcd_keyttl
+//     is set) is kept alive every third of its TTL,
+//   - the bandwidth of each connection is updated every etcd_stats_interval,
+//   - the state of each destination is updated at most every check_interval.
+func estimateLoad(config *utils.Config, connections int) *loadEstimate {
+	estimate := &loadEstimate{Service: config.Service}
+	keyTTL := config.Etcd.KeyTTL
+	if keyTTL == 0 {
+		keyTTL = defaultKeyTTL
+	}
+	estimate.KeepAlives = float64(connections) * 3 / float64(keyTTL)
+	if config.EtcdKeyTTL > 0 {
+		estimate.KeepAlives += float64(connections) * 3 / float64(config.EtcdKeyTTL)
+	}
+	if interval := config.EtcdStatsInterval.Duration().Seconds(); interval > 0 {
+		estimate.Stats = float64(connections) / interval
+	}
+	if interval := config.CheckInterval.Duration().Seconds(); interval > 0 {
+		estimate.HostChecks = float64(len(config.Dest)) / interval
+	} else {
+		estimate.HostChecks = -1
+	}
+	return estimate
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', 2, 64)
+}
+
+// showLoadEstimate shows the expected write rate to etcd of each service
+// defined in the configuration file for the given number of concurrent
+// connections.
+func showLoadEstimate(configFile string, connections int) {
+	configs, err := utils.LoadServicesConfigs(configFile)
+	if err != nil {
+		log.Fatalf("ERROR: reading configuration file %s: %v", configFile, err)
+	}
+	if len(configs[0].Etcd.Endpoints) == 0 {
+		fmt.Println("WARNING: etcd is not configured, sshproxy does not write to it")
+	}
+
+	rows := make([][]string, len(configs))
+	for i, config := range configs {
+		estimate := estimateLoad(config, connections)
+		hostChecks := "per connection"
+		if estimate.HostChecks >= 0 {
+			hostChecks = formatRate(estimate.HostChecks)
+		}
+		rows[i] = []string{
+			estimate.Service,
+			formatRate(estimate.KeepAlives),
+			formatRate(estimate.Stats),
+			hostChecks,
+			formatRate(estimate.Total()),
+		}
+	}
+	displayTable([]string{"Service", "Keepalives/s", "Stats/s", "Host checks/s", "Total writes/s"}, rows)
+}
@@ -0,0 +1,132 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// parseAge parses a duration as time.ParseDuration, or a number of days
+// followed by "d" (e.g. "30d").
+func parseAge(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// showHistory shows the history entries (the destinations remembered with
+// etcd_keyttl) of each etcd namespace, only the ones of userString if it is
+// not empty, with their remaining TTL.
+func showHistory(configFile string, csvFlag bool, jsonFlag bool, userString string, anon *anonymizer) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	// a single timeout for all the namespaces
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	history := []*utils.FlatHistory{}
+	namespaces := etcdNamespaces(configFile)
+	for _, ns := range namespaces {
+		nsHistory, err := cli.WithNamespace(ns).GetAllHistory(ctx)
+		if err != nil {
+			log.Fatalf("ERROR: getting history from etcd: %v", err)
+		}
+		for _, h := range nsHistory {
+			user, service, _ := strings.Cut(h.User, "@")
+			if userString != "" && user != userString {
+				continue
+			}
+			h.User = fmt.Sprintf("%s@%s", anon.user(user), service)
+			history = append(history, h)
+		}
+	}
+	// the namespaces are only displayed if they are used
+	showNamespaces := len(namespaces) > 1 || namespaces[0] != ""
+
+	if jsonFlag {
+		displayJSON(history)
+		return
+	}
+
+	rows := make([][]string, len(history))
+	for i, h := range history {
+		ttl := strconv.FormatInt(h.TTL, 10)
+		if !csvFlag {
+			ttl = (time.Duration(h.TTL) * time.Second).String()
+		}
+		rows[i] = []string{h.User, h.Dest, ttl}
+		if showNamespaces {
+			rows[i] = append([]string{h.Namespace}, rows[i]...)
+		}
+	}
+
+	if csvFlag {
+		displayCSV(rows)
+		return
+	}
+	headers := []string{"User@service", "Destination", "TTL"}
+	if showNamespaces {
+		headers = append([]string{"Namespace"}, headers...)
+	}
+	displayTable(headers, rows)
+}
+
+// forgetHistory deletes the history entries (the destinations remembered
+// with etcd_keyttl) which were not used for more than olderThan, in each etcd
+// namespace. The entries are only printed if dryRun is true.
+func forgetHistory(configFile string, olderThan time.Duration, dryRun bool) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	action := "forgetting"
+	if dryRun {
+		action = "would forget"
+	}
+	n := 0
+	for _, ns := range etcdNamespaces(configFile) {
+		nsCli := cli.WithNamespace(ns)
+		ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+		history, err := nsCli.GetAllHistory(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("ERROR: getting history from etcd: %v", err)
+		}
+		for _, h := range history {
+			if h.Age < olderThan {
+				continue
+			}
+			fmt.Printf("%s %s -> %s (unused for %s)\n", action, h.User, h.Dest, h.Age)
+			if !dryRun {
+				if err := nsCli.DelHistory(h.User, h.Lease); err != nil {
+					log.Fatalf("ERROR: deleting history of %s from etcd: %v", h.User, etcdError(err))
+				}
+			}
+			n++
+		}
+	}
+	if dryRun {
+		fmt.Printf("%d history entries would be forgotten\n", n)
+	} else {
+		fmt.Printf("%d history entries forgotten\n", n)
+	}
+}
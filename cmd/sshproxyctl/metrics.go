@@ -0,0 +1,172 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// metric is a gauge in the Prometheus text format.
+type metric struct {
+	name    string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels [][2]string // name and value of the labels, the empty ones are omitted
+	value  float64
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// write writes the metric in the Prometheus text format.
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+	for _, s := range m.samples {
+		var labels []string
+		for _, label := range s.labels {
+			if label[1] != "" {
+				labels = append(labels, fmt.Sprintf("%s=\"%s\"", label[0], metricLabelEscaper.Replace(label[1])))
+			}
+		}
+		if len(labels) > 0 {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, strings.Join(labels, ","), s.value)
+		} else {
+			fmt.Fprintf(w, "%s %g\n", m.name, s.value)
+		}
+	}
+}
+
+// getMetrics returns the gauges describing the connections, users and hosts
+// stored in etcd.
+func getMetrics(configFile string) []*metric {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	namespaces := etcdNamespaces(configFile)
+	connections, err := cli.GetAllConnectionsInNamespaces(ctx, namespaces)
+	if err != nil {
+		log.Fatalf("ERROR: getting connections from etcd: %v", err)
+	}
+	var hosts []*utils.FlatHost
+	for _, ns := range namespaces {
+		nsHosts, err := cli.WithNamespace(ns).GetAllHosts(ctx)
+		if err != nil {
+			log.Fatalf("ERROR: getting hosts from etcd: %v", err)
+		}
+		hosts = append(hosts, nsHosts...)
+	}
+
+	type serviceDest struct {
+		service, dest string
+	}
+	perServiceDest := map[serviceDest]int{}
+	users := map[string]bool{}
+	for _, c := range connections {
+		perServiceDest[serviceDest{c.Service, c.Dest}]++
+		users[c.User] = true
+	}
+	keys := make([]serviceDest, 0, len(perServiceDest))
+	for k := range perServiceDest {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].dest < keys[j].dest
+	})
+
+	connectionsMetric := &metric{name: "sshproxy_connections", help: "Number of connections by service and destination."}
+	for _, k := range keys {
+		connectionsMetric.samples = append(connectionsMetric.samples, metricSample{
+			labels: [][2]string{{"service", k.service}, {"dest", k.dest}},
+			value:  float64(perServiceDest[k]),
+		})
+	}
+	usersMetric := &metric{
+		name:    "sshproxy_users",
+		help:    "Number of connected users.",
+		samples: []metricSample{{value: float64(len(users))}},
+	}
+
+	hostConnections := &metric{name: "sshproxy_host_connections", help: "Number of connections to the host."}
+	hostBwIn := &metric{name: "sshproxy_host_bandwidth_in_kilobytes_per_second", help: "Bandwidth from the clients to the host in kB/s."}
+	hostBwOut := &metric{name: "sshproxy_host_bandwidth_out_kilobytes_per_second", help: "Bandwidth from the host to the clients in kB/s."}
+	hostState := &metric{name: "sshproxy_host_state", help: "State of the host (1 for the current state)."}
+	for _, h := range hosts {
+		labels := [][2]string{{"host", h.Hostname}, {"namespace", h.Namespace}}
+		hostConnections.samples = append(hostConnections.samples, metricSample{labels, float64(h.N)})
+		hostBwIn.samples = append(hostBwIn.samples, metricSample{labels, float64(h.BwIn)})
+		hostBwOut.samples = append(hostBwOut.samples, metricSample{labels, float64(h.BwOut)})
+		for _, state := range utils.States() {
+			value := 0.0
+			if h.State.String() == state {
+				value = 1
+			}
+			hostState.samples = append(hostState.samples, metricSample{append(labels, [2]string{"state", state}), value})
+		}
+	}
+
+	return []*metric{connectionsMetric, usersMetric, hostConnections, hostBwIn, hostBwOut, hostState}
+}
+
+// writeTextfile atomically replaces filename with content, so that the
+// node_exporter textfile collector never reads a partial file.
+func writeTextfile(filename string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// showMetrics writes the metrics in the Prometheus text format in textfile,
+// or on the standard output if textfile is empty.
+func showMetrics(configFile, textfile string) {
+	var buf bytes.Buffer
+	for _, m := range getMetrics(configFile) {
+		m.write(&buf)
+	}
+	if textfile == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := writeTextfile(textfile, buf.Bytes()); err != nil {
+		log.Fatalf("ERROR: writing %s: %v", textfile, err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// writeCommands are the commands modifying etcd, refused in read-only mode.
+var writeCommands = []string{
+	"enable",
+	"forget",
+	"disable",
+	"maintenance",
+	"cordon",
+	"uncordon",
+	"disconnect",
+	"error_banner",
+	"set-limit",
+	"compact",
+}
+
+// isWriteCommand returns true if the command cmd modifies etcd.
+func isWriteCommand(cmd string) bool {
+	return slices.Contains(writeCommands, cmd)
+}
+
+// errPermission replaces the raw gRPC error returned by etcd when the user is
+// not allowed to modify it.
+var errPermission = errors.New("insufficient permissions (the etcd user may be read-only)")
+
+// etcdError returns a friendly error instead of err if etcd refused a
+// request for lack of permissions, otherwise err itself.
+func etcdError(err error) error {
+	if utils.IsPermissionError(err) {
+		return errPermission
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/record"
+)
+
+// recordingEntry is an entry of the manifest of the recordings.
+type recordingEntry struct {
+	File    string
+	User    string
+	Src     string
+	Dst     string
+	Command string
+	Start   time.Time
+	Size    int64
+}
+
+// readRecordingEntry only reads the header of the recording filename, which
+// is decompressed if its name ends with ".gz".
+func readRecordingEntry(filename string, size int64) (*recordingEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	info, err := record.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return &recordingEntry{
+		File:    filename,
+		User:    info.User,
+		Src:     info.Src(),
+		Dst:     info.Dst(),
+		Command: info.Command,
+		Start:   info.Time,
+		Size:    size,
+	}, nil
+}
+
+// indexRecordings walks the directories and returns the manifest of the
+// recordings found. The files which are not recordings (or are corrupted) are
+// skipped with a warning.
+func indexRecordings(dirs []string) []*recordingEntry {
+	entries := []*recordingEntry{}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("WARNING: skipping %s: %v", path, err)
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				log.Printf("WARNING: skipping %s: %v", path, err)
+				return nil
+			}
+			entry, err := readRecordingEntry(path, fi.Size())
+			if err != nil {
+				log.Printf("WARNING: skipping %s: %v", path, err)
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			log.Printf("WARNING: walking %s: %v", dir, err)
+		}
+	}
+	return entries
+}
+
+// replayIndex prints the manifest of the recordings found in the directories,
+// as CSV or JSON.
+func replayIndex(dirs []string, jsonFlag bool) {
+	entries := indexRecordings(dirs)
+	if jsonFlag {
+		displayJSON(entries)
+		return
+	}
+
+	rows := [][]string{{"File", "User", "Src", "Dst", "Command", "Start", "Size"}}
+	for _, entry := range entries {
+		rows = append(rows, []string{
+			entry.File,
+			entry.User,
+			entry.Src,
+			entry.Dst,
+			entry.Command,
+			entry.Start.Format("2006-01-02 15:04:05"),
+			strconv.FormatInt(entry.Size, 10),
+		})
+	}
+	displayCSV(rows)
+}
@@ -11,18 +11,25 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
 	"os"
 	"os/user"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cea-hpc/sshproxy/pkg/nodesets"
@@ -36,14 +43,25 @@ var (
 	SshproxyVersion = "0.0.0+noproperlybuilt"
 	defaultConfig   = "/etc/sshproxy/sshproxy.yaml"
 	defaultHostPort = "22"
+	// showTimeout bounds all the requests made to etcd by a show command.
+	showTimeout = 10 * time.Second
+	// scopedService is the service whose etcd namespace is used (the
+	// namespace of the top-level configuration if empty).
+	scopedService string
+	// readOnly is true if the commands modifying etcd are refused.
+	readOnly bool
 )
 
 func mustInitEtcdClient(configFile string) *utils.Client {
-	config, err := utils.LoadConfig(configFile, "", "", time.Now(), nil, "")
+	config, err := utils.LoadConfig(configFile, "", "", time.Now(), nil, "", nil)
 	if err != nil {
 		log.Fatalf("reading configuration file %s: %v", configFile, err)
 	}
 
+	if scopedService != "" {
+		config = mustGetServiceConfig(configFile, scopedService)
+	}
+
 	cli, err := utils.NewEtcdClient(config, nil)
 	if err != nil {
 		log.Fatalf("configuring etcd client: %v", err)
@@ -52,8 +70,43 @@ func mustInitEtcdClient(configFile string) *utils.Client {
 	return cli
 }
 
+// mustGetServiceConfig returns the configuration of the service named
+// service.
+func mustGetServiceConfig(configFile, service string) *utils.Config {
+	configs, err := utils.LoadServicesConfigs(configFile)
+	if err != nil {
+		log.Fatalf("reading configuration file %s: %v", configFile, err)
+	}
+	for _, config := range configs {
+		if config.Service == service {
+			return config
+		}
+	}
+	log.Fatalf("ERROR: unknown service: %s", service)
+	return nil
+}
+
+// etcdNamespaces returns the etcd namespaces to read: the one of the scoped
+// service if any, or all the namespaces used by the services.
+func etcdNamespaces(configFile string) []string {
+	if scopedService != "" {
+		return []string{mustGetServiceConfig(configFile, scopedService).EtcdNamespace}
+	}
+	configs, err := utils.LoadServicesConfigs(configFile)
+	if err != nil {
+		log.Fatalf("reading configuration file %s: %v", configFile, err)
+	}
+	var namespaces []string
+	for _, config := range configs {
+		if !slices.Contains(namespaces, config.EtcdNamespace) {
+			namespaces = append(namespaces, config.EtcdNamespace)
+		}
+	}
+	return namespaces
+}
+
 func getErrorBanner(configFile string) string {
-	config, err := utils.LoadConfig(configFile, "", "", time.Now(), nil, "")
+	config, err := utils.LoadConfig(configFile, "", "", time.Now(), nil, "", nil)
 	if err != nil {
 		log.Fatalf("reading configuration file %s: %v", configFile, err)
 	}
@@ -106,7 +159,49 @@ type aggConnection struct {
 
 type aggregatedConnections []*aggConnection
 
-func (ac aggregatedConnections) toRows(passthrough bool) [][]string {
+// aggConnectionsLess are the functions comparing two aggregated connections
+// for each key of the -sort option of "show connections".
+var aggConnectionsLess = map[string]func(a, b *aggConnection) bool{
+	"user":    func(a, b *aggConnection) bool { return a.User < b.User },
+	"service": func(a, b *aggConnection) bool { return a.Service < b.Service },
+	"dest":    func(a, b *aggConnection) bool { return a.Dest < b.Dest },
+	"n":       func(a, b *aggConnection) bool { return a.N < b.N },
+	"last":    func(a, b *aggConnection) bool { return a.Last.Before(b.Last) },
+	"bwin":    func(a, b *aggConnection) bool { return a.BwIn < b.BwIn },
+	"bwout":   func(a, b *aggConnection) bool { return a.BwOut < b.BwOut },
+}
+
+// sortBy sorts the aggregated connections by key (see aggConnectionsLess), in
+// reverse order if reverse is true. The order is unchanged if key is empty.
+func (ac aggregatedConnections) sortBy(key string, reverse bool) {
+	less, ok := aggConnectionsLess[key]
+	if !ok {
+		return
+	}
+	sort.SliceStable(ac, func(i, j int) bool {
+		if reverse {
+			return less(ac[j], ac[i])
+		}
+		return less(ac[i], ac[j])
+	})
+}
+
+// formatTime formats the time t of a connection, or its age at now if now is
+// not zero.
+func formatTime(t, now time.Time) string {
+	if now.IsZero() {
+		return t.Format("2006-01-02 15:04:05")
+	}
+	age := secondsToHuman(int64(now.Sub(t).Seconds()), false)
+	if age == "" {
+		age = "0s"
+	}
+	return age + " ago"
+}
+
+// toRows returns the rows of the aggregated connections, with the age of
+// their last connection at now if now is not zero.
+func (ac aggregatedConnections) toRows(passthrough bool, now time.Time) [][]string {
 	rows := make([][]string, len(ac))
 
 	for i, c := range ac {
@@ -115,7 +210,7 @@ func (ac aggregatedConnections) toRows(passthrough bool) [][]string {
 			c.Service,
 			c.Dest,
 			strconv.Itoa(c.N),
-			c.Last.Format("2006-01-02 15:04:05"),
+			formatTime(c.Last, now),
 			byteToHuman(c.BwIn, passthrough),
 			byteToHuman(c.BwOut, passthrough),
 		}
@@ -124,9 +219,146 @@ func (ac aggregatedConnections) toRows(passthrough bool) [][]string {
 	return rows
 }
 
+// anonymizer replaces user names by pseudonyms. The same user name always
+// gets the same pseudonym with the same salt.
+type anonymizer struct {
+	salt string
+}
+
+// newAnonymizer returns an anonymizer using salt, or a random salt (i.e.
+// pseudonyms only stable during this run) if salt is empty.
+func newAnonymizer(salt string) *anonymizer {
+	if salt == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("ERROR: generating a salt: %v", err)
+		}
+		salt = hex.EncodeToString(b)
+	}
+	return &anonymizer{salt}
+}
+
+// user returns the pseudonym of a user name. A nil anonymizer returns the
+// user name unchanged.
+func (a *anonymizer) user(name string) string {
+	if a == nil {
+		return name
+	}
+	sum := sha256.Sum256([]byte(a.salt + "\x00" + name))
+	return fmt.Sprintf("user-%x", sum[:5])
+}
+
+// users returns the pseudonyms of space separated user names.
+func (a *anonymizer) users(names string) string {
+	if a == nil || names == "" {
+		return names
+	}
+	fields := strings.Split(names, " ")
+	for i, name := range fields {
+		fields[i] = a.user(name)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
+
+// stateSeverity orders the states of the hosts by problem severity, the most
+// severe first.
+var stateSeverity = map[utils.State]int{
+	utils.Down:        0,
+	utils.Disabled:    1,
+	utils.Maintenance: 2,
+	utils.Unknown:     3,
+	utils.Up:          4,
+}
+
+// flatHostsLess are the functions comparing two hosts for each key of the
+// -sort option of "show hosts".
+var flatHostsLess = map[string]func(a, b *utils.FlatHost) bool{
+	"state":     func(a, b *utils.FlatHost) bool { return stateSeverity[a.State] < stateSeverity[b.State] },
+	"host":      func(a, b *utils.FlatHost) bool { return a.Hostname < b.Hostname },
+	"conns":     func(a, b *utils.FlatHost) bool { return a.N < b.N },
+	"bw":        func(a, b *utils.FlatHost) bool { return a.BwIn+a.BwOut < b.BwIn+b.BwOut },
+	"lastcheck": func(a, b *utils.FlatHost) bool { return a.Ts.Before(b.Ts) },
+}
+
+// hostsSortKeys returns the sorted list of the valid keys of the -sort option
+// of "show hosts".
+func hostsSortKeys() []string {
+	var keys []string
+	for key := range flatHostsLess {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortHosts sorts the hosts by key (see flatHostsLess), in reverse order if
+// reverse is true. The order is unchanged if key is empty.
+func sortHosts(hosts []*utils.FlatHost, key string, reverse bool) {
+	less, ok := flatHostsLess[key]
+	if !ok {
+		return
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		if reverse {
+			return less(hosts[j], hosts[i])
+		}
+		return less(hosts[i], hosts[j])
+	})
+}
+
 type flatConnections []*utils.FlatConnection
 
-func (fc flatConnections) getAllConnections(passthrough bool) [][]string {
+// flatConnectionsLess are the functions comparing two connections for each
+// key of the -sort option of "show connections -all".
+var flatConnectionsLess = map[string]func(a, b *utils.FlatConnection) bool{
+	"user":    func(a, b *utils.FlatConnection) bool { return a.User < b.User },
+	"service": func(a, b *utils.FlatConnection) bool { return a.Service < b.Service },
+	"from":    func(a, b *utils.FlatConnection) bool { return a.From < b.From },
+	"dest":    func(a, b *utils.FlatConnection) bool { return a.Dest < b.Dest },
+	"start":   func(a, b *utils.FlatConnection) bool { return a.Ts.Before(b.Ts) },
+	"bwin":    func(a, b *utils.FlatConnection) bool { return a.BwIn < b.BwIn },
+	"bwout":   func(a, b *utils.FlatConnection) bool { return a.BwOut < b.BwOut },
+	"kind":    func(a, b *utils.FlatConnection) bool { return a.Kind < b.Kind },
+	"mode":    func(a, b *utils.FlatConnection) bool { return a.Mode < b.Mode },
+	"route":   func(a, b *utils.FlatConnection) bool { return a.RouteSelect < b.RouteSelect },
+}
+
+// connectionsSortKeys returns the sorted list of the valid keys of the -sort
+// option of "show connections", with or without -all.
+func connectionsSortKeys(allFlag bool) []string {
+	var keys []string
+	if allFlag {
+		for key := range flatConnectionsLess {
+			keys = append(keys, key)
+		}
+	} else {
+		for key := range aggConnectionsLess {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortBy sorts the connections by key (see flatConnectionsLess), in reverse
+// order if reverse is true. The order is unchanged if key is empty.
+func (fc flatConnections) sortBy(key string, reverse bool) {
+	less, ok := flatConnectionsLess[key]
+	if !ok {
+		return
+	}
+	sort.SliceStable(fc, func(i, j int) bool {
+		if reverse {
+			return less(fc[j], fc[i])
+		}
+		return less(fc[i], fc[j])
+	})
+}
+
+// getAllConnections returns the rows of the connections, with their age at
+// now if now is not zero.
+func (fc flatConnections) getAllConnections(passthrough bool, now time.Time) [][]string {
 	rows := make([][]string, len(fc))
 
 	for i, c := range fc {
@@ -135,9 +367,12 @@ func (fc flatConnections) getAllConnections(passthrough bool) [][]string {
 			c.Service,
 			c.From,
 			c.Dest,
-			c.Ts.Format("2006-01-02 15:04:05"),
+			formatTime(c.Ts, now),
 			byteToHuman(c.BwIn, passthrough),
 			byteToHuman(c.BwOut, passthrough),
+			c.Kind,
+			c.Mode,
+			c.RouteSelect,
 		}
 	}
 
@@ -207,65 +442,272 @@ func (fc flatConnections) getAggregatedConnections() aggregatedConnections {
 	return connections
 }
 
-func (fc flatConnections) displayCSV(allFlag bool) {
+// sortedAggregatedConnections returns the aggregated connections sorted by
+// key (see aggregatedConnections.sortBy).
+func (fc flatConnections) sortedAggregatedConnections(sortKey string, reverseFlag bool) aggregatedConnections {
+	connections := fc.getAggregatedConnections()
+	connections.sortBy(sortKey, reverseFlag)
+	return connections
+}
+
+func (fc flatConnections) displayCSV(allFlag bool, sortKey string, reverseFlag bool) {
 	var rows [][]string
 
 	if allFlag {
-		rows = fc.getAllConnections(true)
+		fc.sortBy(sortKey, reverseFlag)
+		rows = fc.getAllConnections(true, time.Time{})
 	} else {
-		rows = fc.getAggregatedConnections().toRows(true)
+		rows = fc.sortedAggregatedConnections(sortKey, reverseFlag).toRows(true, time.Time{})
 	}
 
 	displayCSV(rows)
 }
 
-func (fc flatConnections) displayJSON(allFlag bool) {
+func (fc flatConnections) displayJSON(allFlag bool, sortKey string, reverseFlag bool) {
 	var objs interface{}
 
 	if allFlag {
+		fc.sortBy(sortKey, reverseFlag)
 		objs = fc
 	} else {
-		objs = fc.getAggregatedConnections()
+		objs = fc.sortedAggregatedConnections(sortKey, reverseFlag)
 	}
 
 	displayJSON(objs)
 }
 
-func (fc flatConnections) displayTable(allFlag bool) {
+// displayTable displays the connections as a table. The times are replaced by
+// the ages of the connections if ageFlag is true.
+func (fc flatConnections) displayTable(allFlag bool, sortKey string, reverseFlag bool, ageFlag bool) {
 	var rows [][]string
 
+	var now time.Time
+	if ageFlag {
+		now = time.Now()
+	}
 	if allFlag {
-		rows = fc.getAllConnections(false)
+		fc.sortBy(sortKey, reverseFlag)
+		rows = fc.getAllConnections(false, now)
 	} else {
-		rows = fc.getAggregatedConnections().toRows(false)
+		rows = fc.sortedAggregatedConnections(sortKey, reverseFlag).toRows(false, now)
 	}
 
 	var headers []string
 	if allFlag {
-		headers = []string{"User", "Service", "From", "Destination", "Start time", "Bw in", "Bw out"}
+		headers = []string{"User", "Service", "From", "Destination", "Start time", "Bw in", "Bw out", "Kind", "Mode", "Route select"}
 	} else {
 		headers = []string{"User", "Service", "Destination", "# of conns", "Last connection", "Bw in", "Bw out"}
 	}
+	if ageFlag {
+		// the time column is the same for both tables
+		headers[4] = "Age"
+	}
 
 	displayTable(headers, rows)
 }
 
-func showConnections(configFile string, csvFlag bool, jsonFlag bool, allFlag bool) {
-	cli := mustInitEtcdClient(configFile)
-	defer cli.Close()
+// groupMembers checks if users belong to one of some groups. The groups of
+// each user are only looked up once.
+type groupMembers struct {
+	wanted []string
+	groups map[string]map[string]bool
+}
+
+// newGroupMembers returns a groupMembers for the groups of groupsString
+// (comma separated).
+func newGroupMembers(groupsString string) *groupMembers {
+	gm := &groupMembers{groups: map[string]map[string]bool{}}
+	for _, group := range strings.Split(groupsString, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			gm.wanted = append(gm.wanted, group)
+		}
+	}
+	return gm
+}
+
+// isMember checks if the user of the connection c belongs to one of the
+// groups. If the user is unknown on this host, the groups stored with the
+// connection are used.
+func (gm *groupMembers) isMember(c *utils.FlatConnection) bool {
+	groups, present := gm.groups[c.User]
+	if !present {
+		var err error
+		groups, err = utils.GetGroupList(c.User)
+		if err != nil {
+			groups = map[string]bool{}
+		}
+		gm.groups[c.User] = groups
+	}
+	for _, group := range gm.wanted {
+		if groups[group] || slices.Contains(c.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionFilter selects the connections of a user, of the members of some
+// groups, to a service, to a destination and placed by a route_select
+// algorithm. The empty criteria are ignored.
+type connectionFilter struct {
+	user        string
+	members     *groupMembers
+	service     string
+	dest        string // host or host:port
+	routeSelect string
+}
+
+func newConnectionFilter(user, groups, service, dest, routeSelect string) *connectionFilter {
+	return &connectionFilter{
+		user:        user,
+		members:     newGroupMembers(groups),
+		service:     service,
+		dest:        dest,
+		routeSelect: routeSelect,
+	}
+}
+
+// matchDest checks if the destination of a connection (host:port) is the
+// destination of the filter, with or without the port.
+func (f *connectionFilter) matchDest(dest string) bool {
+	if dest == f.dest {
+		return true
+	}
+	if _, _, err := net.SplitHostPort(f.dest); err == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(dest)
+	return err == nil && host == f.dest
+}
+
+// match checks if the connection c matches all the criteria of the filter.
+func (f *connectionFilter) match(c *utils.FlatConnection) bool {
+	switch {
+	case f.user != "" && c.User != f.user:
+		return false
+	case f.service != "" && c.Service != f.service:
+		return false
+	case f.dest != "" && !f.matchDest(c.Dest):
+		return false
+	case f.routeSelect != "" && c.RouteSelect != f.routeSelect:
+		return false
+	case len(f.members.wanted) > 0 && !f.members.isMember(c):
+		return false
+	}
+	return true
+}
 
-	var connections flatConnections
-	connections, err := cli.GetAllConnections()
+// getConnections returns the connections stored in etcd, in the namespaces,
+// which match the filter.
+func getConnections(cli *utils.Client, namespaces []string, filter *connectionFilter, anon *anonymizer) flatConnections {
+	// a single timeout for all the namespaces
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	allConnections, err := cli.GetAllConnectionsInNamespaces(ctx, namespaces)
 	if err != nil {
 		log.Fatalf("ERROR: getting connections from etcd: %v", err)
 	}
 
+	connections := flatConnections{}
+	for _, c := range allConnections {
+		if !filter.match(c) {
+			continue
+		}
+		c.User = anon.user(c.User)
+		connections = append(connections, c)
+	}
+	return connections
+}
+
+func showConnections(configFile string, csvFlag bool, jsonFlag bool, allFlag bool, filter *connectionFilter, sortKey string, reverseFlag bool, anon *anonymizer, ageFlag bool, countFlag bool) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	connections := getConnections(cli, etcdNamespaces(configFile), filter, anon)
+	if countFlag {
+		displayCounts(connectionsCounts(connections), csvFlag, jsonFlag)
+		return
+	}
 	if csvFlag {
-		connections.displayCSV(allFlag)
+		connections.displayCSV(allFlag, sortKey, reverseFlag)
 	} else if jsonFlag {
-		connections.displayJSON(allFlag)
+		connections.displayJSON(allFlag, sortKey, reverseFlag)
 	} else {
-		connections.displayTable(allFlag)
+		connections.displayTable(allFlag, sortKey, reverseFlag, ageFlag)
+	}
+}
+
+// watchConnections clears the screen and shows the connections as a table
+// every interval, until interrupted. The etcd client is reused between the
+// refreshes.
+func watchConnections(configFile string, allFlag bool, filter *connectionFilter, sortKey string, reverseFlag bool, anon *anonymizer, interval time.Duration, ageFlag bool) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	namespaces := etcdNamespaces(configFile)
+	for {
+		connections := getConnections(cli, namespaces, filter, anon)
+		// move the cursor to the top left corner and clear the screen
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Every %s: %d connection(s)    %s\n\n", interval, len(connections), time.Now().Format("2006-01-02 15:04:05"))
+		connections.displayTable(allFlag, sortKey, reverseFlag, ageFlag)
+		time.Sleep(interval)
+	}
+}
+
+// followConnections prints the connections and disconnections of the user
+// userString as they happen, in all the etcd namespaces, until interrupted.
+func followConnections(configFile string, csvFlag bool, jsonFlag bool, userString string, anon *anonymizer) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	var w *csv.Writer
+	if csvFlag {
+		w = csv.NewWriter(os.Stdout)
+	}
+	// the events of the namespaces are printed one at a time
+	var lock sync.Mutex
+	printEvent := func(event *utils.ConnectionEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		event.User = anon.user(event.User)
+		action := "disconnect"
+		if event.Connected {
+			action = "connect"
+		}
+		row := []string{
+			event.Time.Format("2006-01-02 15:04:05"),
+			action,
+			event.User,
+			event.Service,
+			event.From,
+			event.Dest,
+			event.Kind,
+		}
+		switch {
+		case csvFlag:
+			w.Write(row)
+			w.Flush()
+			if err := w.Error(); err != nil {
+				log.Fatalln("error writing csv:", err)
+			}
+		case jsonFlag:
+			displayJSON(event)
+		default:
+			fmt.Println(strings.Join(row, "  "))
+		}
+	}
+
+	namespaces := etcdNamespaces(configFile)
+	errs := make(chan error, len(namespaces))
+	for _, ns := range namespaces {
+		go func(nsCli *utils.Client) {
+			errs <- nsCli.WatchUserConnections(context.Background(), userString, printEvent)
+		}(cli.WithNamespace(ns))
+	}
+	// the watches only end on error
+	if err := <-errs; err != nil {
+		log.Fatalf("ERROR: watching connections of %s in etcd: %v", userString, err)
 	}
 }
 
@@ -352,15 +794,25 @@ func (fu flatUsers) displayTable(allFlag bool) {
 	displayTable(headers, rows)
 }
 
-func showUsers(configFile string, csvFlag bool, jsonFlag bool, allFlag bool) {
+func showUsers(configFile string, csvFlag bool, jsonFlag bool, allFlag bool, anon *anonymizer, countFlag bool) {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
 
 	var users flatUsers
-	users, err := cli.GetAllUsers(allFlag)
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	users, err := cli.GetAllUsersInNamespaces(ctx, etcdNamespaces(configFile), allFlag)
 	if err != nil {
 		log.Fatalf("ERROR: getting users from etcd: %v", err)
 	}
+	if countFlag {
+		displayCounts([]count{{"total", len(users)}}, csvFlag, jsonFlag)
+		return
+	}
+
+	for _, u := range users {
+		u.User = anon.user(u.User)
+	}
 
 	if jsonFlag {
 		users.displayJSON(allFlag)
@@ -448,15 +900,25 @@ func (fg flatGroups) displayTable(allFlag bool) {
 	displayTable(headers, rows)
 }
 
-func showGroups(configFile string, csvFlag bool, jsonFlag bool, allFlag bool) {
+func showGroups(configFile string, csvFlag bool, jsonFlag bool, allFlag bool, anon *anonymizer, countFlag bool) {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
 
 	var groups flatGroups
-	groups, err := cli.GetAllGroups(allFlag)
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	groups, err := cli.GetAllGroupsInNamespaces(ctx, etcdNamespaces(configFile), allFlag)
 	if err != nil {
 		log.Fatalf("ERROR: getting groups from etcd: %v", err)
 	}
+	if countFlag {
+		displayCounts([]count{{"total", len(groups)}}, csvFlag, jsonFlag)
+		return
+	}
+
+	for _, g := range groups {
+		g.Users = anon.users(g.Users)
+	}
 
 	if jsonFlag {
 		groups.displayJSON(allFlag)
@@ -467,18 +929,135 @@ func showGroups(configFile string, csvFlag bool, jsonFlag bool, allFlag bool) {
 	}
 }
 
-func showHosts(configFile string, csvFlag bool, jsonFlag bool) {
+type probedHost struct {
+	*utils.FlatHost
+	Probe utils.State
+}
+
+// probeConfig returns the configuration used to probe the host h: the one of
+// the first service of its namespace routing to it, or the top level one (the
+// first of configs, as returned by utils.LoadServicesConfigs) if none.
+func probeConfig(configs []*utils.Config, h *utils.FlatHost) *utils.Config {
+	for _, config := range configs {
+		if config.EtcdNamespace == h.Namespace && utils.IsDestinationInRoutes(h.Hostname, config.Dest) {
+			return config
+		}
+	}
+	return configs[0]
+}
+
+// probeHosts checks concurrently if each host is alive, as sshproxy does with
+// the configuration of its service (see probeConfig). If update is true, the
+// result of the probe is saved in etcd (in the namespace of the host), except
+// for disabled hosts.
+func probeHosts(cli *utils.Client, configs []*utils.Config, hosts []*utils.FlatHost, update bool) []*probedHost {
+	probed := make([]*probedHost, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		probed[i] = &probedHost{h, utils.Down}
+		wg.Add(1)
+		go func(p *probedHost) {
+			defer wg.Done()
+			p.Probe = utils.ProbeDestination(probeConfig(configs, p.FlatHost), p.Hostname)
+		}(probed[i])
+	}
+	wg.Wait()
+
+	if update {
+		for _, p := range probed {
+			if p.State == utils.Disabled || p.State == utils.Maintenance {
+				continue
+			}
+			if err := cli.WithNamespace(p.Namespace).SetHost(p.Hostname, p.Probe, time.Now()); err != nil {
+				log.Fatalf("ERROR: setting host state in etcd: %v", etcdError(err))
+			}
+		}
+	}
+
+	return probed
+}
+
+// parseStates parses a comma separated list of host states. An empty string
+// gives no state.
+func parseStates(s string) ([]utils.State, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var states []utils.State
+	for _, name := range strings.Split(s, ",") {
+		state, err := utils.ParseState(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// isStale returns true if the host h was not checked by any gateway during
+// the stale duration before now (0 meaning never stale). The disabled hosts
+// and the hosts in maintenance are never stale, as they are not checked.
+func isStale(h *utils.FlatHost, stale time.Duration, now time.Time) bool {
+	if stale <= 0 || h.State == utils.Disabled || h.State == utils.Maintenance {
+		return false
+	}
+	return now.Sub(h.Ts) > stale
+}
+
+// showHosts shows the hosts stored in etcd and returns the number of stale
+// hosts (see isStale).
+func showHosts(configFile string, csvFlag bool, jsonFlag bool, probeFlag bool, updateFlag bool, states []utils.State, sortString string, reverseFlag bool, stale time.Duration, countFlag bool) int {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
 
-	hosts, err := cli.GetAllHosts()
-	if err != nil {
-		log.Fatalf("ERROR: getting hosts from etcd: %v", err)
+	// a single timeout for all the namespaces
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	var hosts []*utils.FlatHost
+	namespaces := etcdNamespaces(configFile)
+	for _, ns := range namespaces {
+		nsHosts, err := cli.WithNamespace(ns).GetAllHosts(ctx)
+		if err != nil {
+			log.Fatalf("ERROR: getting hosts from etcd: %v", err)
+		}
+		for _, h := range nsHosts {
+			if len(states) == 0 || slices.Contains(states, h.State) {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	// the namespaces are only displayed if they are used
+	showNamespaces := len(namespaces) > 1 || namespaces[0] != ""
+	sortHosts(hosts, sortString, reverseFlag)
+
+	now := time.Now()
+	staleCount := 0
+	for _, h := range hosts {
+		if isStale(h, stale, now) {
+			staleCount++
+		}
+	}
+	if countFlag {
+		displayCounts(hostsCounts(hosts, stale, now), csvFlag, jsonFlag)
+		return staleCount
+	}
+
+	var probed []*probedHost
+	if probeFlag {
+		configs, err := utils.LoadServicesConfigs(configFile)
+		if err != nil {
+			log.Fatalf("reading configuration file %s: %v", configFile, err)
+		}
+		probed = probeHosts(cli, configs, hosts, updateFlag)
 	}
 
 	if jsonFlag {
-		displayJSON(hosts)
-		return
+		if probeFlag {
+			displayJSON(probed)
+		} else {
+			displayJSON(hosts)
+		}
+		return staleCount
 	}
 
 	rows := make([][]string, len(hosts))
@@ -492,14 +1071,41 @@ func showHosts(configFile string, csvFlag bool, jsonFlag bool) {
 			byteToHuman(h.BwIn, csvFlag),
 			byteToHuman(h.BwOut, csvFlag),
 			fmt.Sprintf("%d", h.HistoryN),
+			fmt.Sprintf("%v", h.Cordoned),
+		}
+		if showNamespaces {
+			rows[i] = append([]string{h.Namespace}, rows[i]...)
+		}
+	}
+
+	headers := []string{"Host", "State", "Last check", "# of conns", "Bw in", "Bw out", "# persist", "Cordoned"}
+	if showNamespaces {
+		headers = append([]string{"Namespace"}, headers...)
+	}
+	if stale > 0 {
+		headers = append(headers, "Stale")
+		for i, h := range hosts {
+			rows[i] = append(rows[i], fmt.Sprintf("%v", isStale(h, stale, now)))
+		}
+	}
+	if probeFlag {
+		headers = append(headers, "Probe")
+		for i, p := range probed {
+			probe := p.Probe.String()
+			if !csvFlag && p.State != utils.Disabled && p.State != utils.Maintenance && p.State != p.Probe {
+				// highlight the discrepancies with etcd
+				probe += " (!)"
+			}
+			rows[i] = append(rows[i], probe)
 		}
 	}
 
 	if csvFlag {
 		displayCSV(rows)
 	} else {
-		displayTable([]string{"Host", "State", "Last check", "# of conns", "Bw in", "Bw out", "# persist"}, rows)
+		displayTable(headers, rows)
 	}
+	return staleCount
 }
 
 func enableHost(host, port, configFile string) error {
@@ -510,7 +1116,9 @@ func enableHost(host, port, configFile string) error {
 	return cli.SetHost(key, utils.Up, time.Now())
 }
 
-func forgetHost(host, port, configFile string) error {
+// forgetHost deletes a host in etcd and returns the number of hosts actually
+// deleted (0 if the host was not in etcd).
+func forgetHost(host, port, configFile string) (int64, error) {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
 
@@ -518,14 +1126,96 @@ func forgetHost(host, port, configFile string) error {
 	return cli.DelHost(key)
 }
 
-func disableHost(host, port, configFile string) error {
+// disableHost disables a host in etcd, until it is enabled again if duration
+// is 0, otherwise only for duration.
+func disableHost(host, port, configFile string, duration time.Duration) error {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
 
 	key := fmt.Sprintf("%s:%s", host, port)
+	if duration > 0 {
+		return cli.SetHostWithTTL(key, utils.Disabled, time.Now(), duration)
+	}
 	return cli.SetHost(key, utils.Disabled, time.Now())
 }
 
+func maintenanceHost(host, port, configFile string) error {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	key := fmt.Sprintf("%s:%s", host, port)
+	return cli.SetHost(key, utils.Maintenance, time.Now())
+}
+
+// cordonHosts cordons (or uncordons if cordon is false) the hosts with the
+// ports in etcd.
+func cordonHosts(hosts, ports []string, cordon bool, configFile string) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	for _, host := range hosts {
+		for _, port := range ports {
+			key := fmt.Sprintf("%s:%s", host, port)
+			if cordon {
+				if err := cli.CordonHost(key); err != nil {
+					log.Fatalf("ERROR: cordoning %s in etcd: %v", key, etcdError(err))
+				}
+			} else if _, err := cli.UncordonHost(key); err != nil {
+				log.Fatalf("ERROR: uncordoning %s in etcd: %v", key, etcdError(err))
+			}
+		}
+	}
+}
+
+// disconnect deletes the connections matching userString, serviceString,
+// hostString and portString (empty strings match any value), in each etcd
+// namespace.
+func disconnect(userString, serviceString, hostString, portString, configFile string) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	n := 0
+	for _, ns := range etcdNamespaces(configFile) {
+		nsN, err := cli.WithNamespace(ns).DelConnection(userString, serviceString, hostString, portString)
+		n += nsN
+		if err != nil {
+			log.Fatalf("ERROR: deleting connections in etcd: %v", etcdError(err))
+		}
+	}
+	fmt.Printf("%d connection(s) disconnected\n", n)
+}
+
+// forgetConnections deletes the orphaned connections older than olderThan
+// (see utils.DelStaleConnections) matching userString, serviceString,
+// hostString and portString (empty strings match any value), in each etcd
+// namespace. The connections are only printed if dryRun is true.
+func forgetConnections(configFile, userString, serviceString, hostString, portString string, olderThan time.Duration, dryRun bool) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	action := "forgetting"
+	if dryRun {
+		action = "would forget"
+	}
+	now := time.Now()
+	n := 0
+	for _, ns := range etcdNamespaces(configFile) {
+		connections, err := cli.WithNamespace(ns).DelStaleConnections(userString, serviceString, hostString, portString, olderThan, dryRun)
+		for _, c := range connections {
+			fmt.Printf("%s %s@%s %s -> %s (started %s)\n", action, c.User, c.Service, c.From, c.Dest, formatTime(c.Ts, now))
+		}
+		n += len(connections)
+		if err != nil {
+			log.Fatalf("ERROR: forgetting connections in etcd: %v", etcdError(err))
+		}
+	}
+	if dryRun {
+		fmt.Printf("%d connections would be forgotten\n", n)
+	} else {
+		fmt.Printf("%d connections forgotten\n", n)
+	}
+}
+
 func setErrorBanner(errorBanner string, expire time.Time, configFile string) error {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
@@ -536,6 +1226,26 @@ func setErrorBanner(errorBanner string, expire time.Time, configFile string) err
 	return cli.SetErrorBanner(errorBanner, expire)
 }
 
+func setUserLimit(userString string, max int, expire time.Time, configFile string) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	if err := cli.SetUserLimit(userString, max, expire); err != nil {
+		log.Fatalf("ERROR: setting limit of %s in etcd: %v", userString, etcdError(err))
+	}
+}
+
+func forgetUserLimit(userString, configFile string) {
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	n, err := cli.DelUserLimit(userString)
+	if err != nil {
+		log.Fatalf("ERROR: forgetting limit of %s in etcd: %v", userString, etcdError(err))
+	}
+	fmt.Printf("%d limits forgotten\n", n)
+}
+
 func showErrorBanner(configFile string) {
 	cli := mustInitEtcdClient(configFile)
 	defer cli.Close()
@@ -553,7 +1263,10 @@ func showErrorBanner(configFile string) {
 	}
 }
 
-func showConfig(configFile, userString, groupsString, sourceString string) {
+// getGroups returns the system groups of the user userString (if it exists)
+// and the groups of groupsString (comma separated). The returned comment
+// indicates if the user is unknown.
+func getGroups(userString, groupsString string) (map[string]bool, string) {
 	groupsMap := make(map[string]bool)
 	userComment := ""
 	// get system groups of given user, if it exists
@@ -569,19 +1282,319 @@ func showConfig(configFile, userString, groupsString, sourceString string) {
 			groupsMap[group] = true
 		}
 	}
-	// get config for given user / groups
-	config, err := utils.LoadConfig(configFile, userString, "", time.Now(), groupsMap, sourceString)
-	if err != nil {
-		log.Fatalf("reading configuration file %s: %v", configFile, err)
-	}
-	fmt.Fprintf(os.Stdout, "user = %s%s\n", userString, userComment)
-	for _, configLine := range utils.PrintConfig(config, groupsMap) {
-		fmt.Fprintln(os.Stdout, configLine)
-	}
+	return groupsMap, userComment
 }
 
-func showVersion() {
-	fmt.Fprintf(flag.CommandLine.Output(), "%s version %s\n", os.Args[0], SshproxyVersion)
+// envVariables is a repeatable flag of "KEY=VAL" environment variables.
+type envVariables map[string]string
+
+func (e envVariables) String() string {
+	return fmt.Sprintf("%v", map[string]string(e))
+}
+
+func (e envVariables) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid environment variable '%s' (KEY=VAL expected)", value)
+	}
+	e[key] = val
+	return nil
+}
+
+func showConfig(configFile string, csvFlag bool, jsonFlag bool, effectiveRoutesFlag bool, jsonMergedFlag bool, liveFlag bool, userString, groupsString, sourceString string, env envVariables) {
+	groupsMap, userComment := getGroups(userString, groupsString)
+	// get config for given user / groups / environment
+	config, err := utils.LoadConfig(configFile, userString, "", time.Now(), groupsMap, sourceString, env)
+	if err != nil {
+		log.Fatalf("reading configuration file %s: %v", configFile, err)
+	}
+	if effectiveRoutesFlag {
+		showEffectiveRoutes(config, csvFlag, jsonFlag)
+		return
+	}
+	if jsonMergedFlag {
+		// like sshproxy, the local configuration is used alone if the
+		// configuration stored in etcd cannot be read
+		if err := config.EtcdConfigError(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		}
+		displayJSON(map[string]interface{}{
+			"user":   userString,
+			"groups": utils.SortedGroups(groupsMap),
+			"source": sourceString,
+			"config": utils.ConfigView(config),
+		})
+		return
+	}
+	fmt.Fprintf(os.Stdout, "user = %s%s\n", userString, userComment)
+	for _, configLine := range utils.PrintConfig(config, groupsMap) {
+		fmt.Fprintln(os.Stdout, configLine)
+	}
+	if liveFlag {
+		showUserLimit(config, userString)
+	}
+}
+
+// showUserLimit shows the temporary connection limit of the user set in etcd
+// with set-limit, which replaces max_connections_per_user.
+func showUserLimit(config *utils.Config, userString string) {
+	cli, err := utils.NewEtcdClient(config, nil)
+	if err != nil {
+		log.Fatalf("configuring etcd client: %v", err)
+	}
+	defer cli.Close()
+
+	limit, err := cli.GetUserLimit(userString)
+	switch err {
+	case nil:
+		fmt.Fprintf(os.Stdout, "live.max_connections_per_user = %d (until %s)\n", limit.Max, limit.Expire.Format("2006-01-02 15:04:05"))
+	case utils.ErrKeyNotFound:
+		fmt.Fprintln(os.Stdout, "live.max_connections_per_user = none")
+	default:
+		log.Fatalf("ERROR: getting limit of %s from etcd: %v", userString, err)
+	}
+}
+
+// effectiveRoute is a destination of a service, as iterated by the route
+// selection.
+type effectiveRoute struct {
+	Service     string
+	RouteSelect string
+	Rank        int
+	Dest        string
+	Weight      int
+	Address     string
+}
+
+// showEffectiveRoutes shows the destinations of the service configured by
+// config after the expansion of the nodesets, in the order given to the route
+// selection, with their weight and the address actually connected to (see
+// dest_rewrite).
+func showEffectiveRoutes(config *utils.Config, csvFlag bool, jsonFlag bool) {
+	routes := make([]*effectiveRoute, len(config.Dest))
+	for i, dest := range config.Dest {
+		weight := 1
+		if i < len(config.DestWeights) {
+			weight = config.DestWeights[i]
+		}
+		routes[i] = &effectiveRoute{
+			Service:     config.Service,
+			RouteSelect: config.RouteSelect,
+			Rank:        i + 1,
+			Dest:        dest,
+			Weight:      weight,
+			Address:     utils.RewriteDest(config.DestRewrite, dest),
+		}
+	}
+
+	if jsonFlag {
+		displayJSON(routes)
+		return
+	}
+
+	rows := make([][]string, len(routes))
+	for i, r := range routes {
+		rows[i] = []string{
+			r.Service,
+			r.RouteSelect,
+			strconv.Itoa(r.Rank),
+			r.Dest,
+			strconv.Itoa(r.Weight),
+			r.Address,
+		}
+	}
+
+	if csvFlag {
+		displayCSV(rows)
+	} else {
+		displayTable([]string{"Service", "Route select", "Rank", "Destination", "Weight", "Address"}, rows)
+	}
+}
+
+// routedHost is the routing decision simulated for a destination of a
+// service.
+type routedHost struct {
+	Service     string
+	Mode        string
+	RouteSelect string
+	Dest        string
+	State       utils.State
+	Available   bool
+	Selected    bool
+	Sticky      bool
+}
+
+// stateChecker implements the utils.HostChecker interface with known states,
+// without connecting to the hosts nor updating etcd.
+type stateChecker struct {
+	states          map[string]utils.State
+	availableStates []string
+}
+
+// Check returns true if the state of hostport is an available state.
+func (c *stateChecker) Check(hostport string) bool {
+	return slices.Contains(c.availableStates, c.states[hostport].String())
+}
+
+// routeService simulates the routing of a user (which can be empty) to the
+// service configured by config, with the states of the hosts. It returns the
+// routing decision for each destination.
+func routeService(cli *utils.Client, config *utils.Config, states map[string]utils.State, username string) []*routedHost {
+	checker := &stateChecker{states, config.AvailableStates}
+	key := fmt.Sprintf("%s@%s", username, config.Service)
+
+	selected := ""
+	sticky := false
+	if config.Mode == "sticky" && username != "" {
+		dest, err := cli.GetDestination(key, config.EtcdKeyTTL, nil)
+		if err != nil && err != utils.ErrKeyNotFound {
+			log.Fatalf("ERROR: getting destination of %s from etcd: %v", key, err)
+		} else if err == nil && utils.IsDestinationInRoutes(dest, config.Dest) && checker.Check(dest) {
+			selected = dest
+			sticky = true
+		}
+	}
+	if selected == "" {
+		var err error
+		// the route selection can reorder the destinations
+		selected, err = utils.SelectRoute(config.RouteSelect, append([]string{}, config.Dest...), config.DestWeights, checker, cli, key, config.MaxProbes, &config.RouteExternal)
+		if err != nil {
+			log.Fatalf("ERROR: selecting a destination for service %s: %v", config.Service, err)
+		}
+	}
+
+	hosts := make([]*routedHost, len(config.Dest))
+	for i, dest := range config.Dest {
+		hosts[i] = &routedHost{
+			Service:     config.Service,
+			Mode:        config.Mode,
+			RouteSelect: config.RouteSelect,
+			Dest:        dest,
+			State:       states[dest],
+			Available:   checker.Check(dest),
+			Selected:    dest == selected,
+			Sticky:      dest == selected && sticky,
+		}
+	}
+	return hosts
+}
+
+func showRouting(configFile string, csvFlag bool, jsonFlag bool, userString, groupsString, sourceString string, env envVariables) {
+	var configs []*utils.Config
+	if userString != "" {
+		groupsMap, _ := getGroups(userString, groupsString)
+		config, err := utils.LoadConfig(configFile, userString, "", time.Now(), groupsMap, sourceString, env)
+		if err != nil {
+			log.Fatalf("reading configuration file %s: %v", configFile, err)
+		}
+		configs = []*utils.Config{config}
+	} else {
+		var err error
+		configs, err = utils.LoadServicesConfigs(configFile)
+		if err != nil {
+			log.Fatalf("reading configuration file %s: %v", configFile, err)
+		}
+	}
+
+	cli := mustInitEtcdClient(configFile)
+	defer cli.Close()
+
+	// states of the hosts by etcd namespace
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	states := map[string]map[string]utils.State{}
+	for _, config := range configs {
+		if states[config.EtcdNamespace] != nil {
+			continue
+		}
+		hosts, err := cli.WithNamespace(config.EtcdNamespace).GetAllHosts(ctx)
+		if err != nil {
+			log.Fatalf("ERROR: getting hosts from etcd: %v", err)
+		}
+		states[config.EtcdNamespace] = map[string]utils.State{}
+		for _, h := range hosts {
+			states[config.EtcdNamespace][h.Hostname] = h.State
+		}
+	}
+	// like sshproxy, check the hosts which are not yet in etcd
+	type unknownHost struct {
+		config *utils.Config
+		states map[string]utils.State
+		dest   string
+	}
+	var unknown []unknownHost
+	for _, config := range configs {
+		nsStates := states[config.EtcdNamespace]
+		for _, dest := range config.Dest {
+			if _, ok := nsStates[dest]; ok {
+				continue
+			}
+			nsStates[dest] = utils.Down
+			unknown = append(unknown, unknownHost{config, nsStates, dest})
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, u := range unknown {
+		wg.Add(1)
+		go func(u unknownHost) {
+			defer wg.Done()
+			if utils.ProbeDestination(u.config, u.dest) == utils.Up {
+				mu.Lock()
+				u.states[u.dest] = utils.Up
+				mu.Unlock()
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	routed := []*routedHost{}
+	for _, config := range configs {
+		routed = append(routed, routeService(cli.WithNamespace(config.EtcdNamespace).DryRun(), config, states[config.EtcdNamespace], userString)...)
+	}
+
+	if jsonFlag {
+		displayJSON(routed)
+		return
+	}
+
+	rows := make([][]string, len(routed))
+	for i, r := range routed {
+		selected := ""
+		switch {
+		case r.Sticky:
+			selected = "yes (sticky)"
+		case r.Selected:
+			selected = "yes"
+		}
+		rows[i] = []string{
+			r.Service,
+			r.Mode,
+			r.RouteSelect,
+			r.Dest,
+			r.State.String(),
+			fmt.Sprintf("%v", r.Available),
+			selected,
+		}
+	}
+
+	if csvFlag {
+		displayCSV(rows)
+	} else {
+		displayTable([]string{"Service", "Mode", "Route select", "Destination", "State", "Available", "Selected"}, rows)
+	}
+}
+
+func showSchema() {
+	w := json.NewEncoder(os.Stdout)
+	w.SetIndent("", "  ")
+	if err := w.Encode(utils.ConfigSchema()); err != nil {
+		log.Fatalln("error writing JSON:", err)
+	}
+}
+
+func showVersion() {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s version %s\n", os.Args[0], SshproxyVersion)
 }
 
 func usage() {
@@ -592,9 +1605,21 @@ The commands are:
   version       show version number and exit
   show          show states present in etcd
   enable        enable a host in etcd
-  forget        forget a host in etcd
+  forget        forget a host, old history entries or a user limit in etcd
   disable       disable a host in etcd
+  maintenance   put a host in maintenance in etcd
+  cordon        stop routing new connections to a host
+  uncordon      route new connections to a cordoned host again
+  disconnect    terminate connections in progress
   error_banner  set the error banner in etcd
+  set-limit     set a temporary connection limit of a user in etcd
+  schema        show the JSON schema of the configuration file
+  doctor        diagnose common misconfigurations
+  compact       compact the revision history of etcd
+  replay-index  build a manifest of the recordings of a directory tree
+  metrics       export the states present in etcd as Prometheus metrics
+  estimate-load estimate the write load of sshproxy on etcd
+  test-route    show the destination a user would be routed to
 
 The common options are:
 `, os.Args[0])
@@ -626,24 +1651,68 @@ Show version and exit.
 	return fs
 }
 
-func newShowParser(csvFlag *bool, jsonFlag *bool, allFlag *bool, userString *string, groupsString *string, sourceString *string) *flag.FlagSet {
+func newShowParser(csvFlag *bool, jsonFlag *bool, allFlag *bool, probeFlag *bool, updateFlag *bool, followFlag *bool, anonymizeFlag *bool, saltString *string, userString *string, groupsString *string, sourceString *string, env envVariables, sortString *string, reverseFlag *bool, watchFlag *bool, intervalDuration *time.Duration, usersFileString *string, serviceString *string, destString *string, routeSelectString *string, stateString *string, effectiveRoutesFlag *bool, staleDuration *time.Duration, jsonMergedFlag *bool, ageFlag *bool, liveFlag *bool, countFlag *bool) *flag.FlagSet {
 	fs := flag.NewFlagSet("show", flag.ExitOnError)
 	fs.BoolVar(csvFlag, "csv", false, "show results in CSV format")
 	fs.BoolVar(jsonFlag, "json", false, "show results in JSON format")
 	fs.BoolVar(allFlag, "all", false, "show all connections / users / groups")
-	fs.StringVar(userString, "user", "", "show the config for this specific user and this user's groups (if any)")
-	fs.StringVar(groupsString, "groups", "", "show the config for these specific groups (comma separated)")
-	fs.StringVar(sourceString, "source", "", "show the config for this specific source (host[:port])")
+	fs.BoolVar(probeFlag, "probe", false, "check if a connection can be made to the hosts")
+	fs.BoolVar(updateFlag, "update", false, "save the result of the probe in etcd")
+	fs.StringVar(stateString, "state", "", "show the hosts in these states (comma separated: up, down, disabled, maintenance, unknown)")
+	fs.BoolVar(followFlag, "follow", false, "print the connections of a user (-user) as they start and end")
+	fs.BoolVar(anonymizeFlag, "anonymize", false, "replace user names by pseudonyms")
+	fs.StringVar(saltString, "salt", "", "salt used by -anonymize (random by default)")
+	fs.StringVar(userString, "user", "", "show the connections / history / config / routing for this specific user and this user's groups (if any)")
+	fs.StringVar(serviceString, "service", "", "show the connections to this service")
+	fs.StringVar(destString, "dest", "", "show the connections to this destination (host or host:port)")
+	fs.StringVar(routeSelectString, "route-select", "", "show the connections placed by this route_select algorithm")
+	fs.StringVar(groupsString, "groups", "", "show the connections of the members of these groups / the config / routing for these specific groups (comma separated)")
+	fs.StringVar(sourceString, "source", "", "show the config / routing for this specific source (host[:port])")
+	fs.Var(env, "env", "show the config / routing for this environment variable (KEY=VAL, can be repeated)")
+	fs.StringVar(usersFileString, "all-users-file", "", "show the main options of the config of each user listed in this file (one per line)")
+	fs.StringVar(sortString, "sort", "", "sort the connections by this column (user, service, dest, n, last, bwin, bwout; with -all: user, service, from, dest, start, bwin, bwout, kind, mode, route) or the hosts (state, host, conns, bw, lastcheck)")
+	fs.BoolVar(reverseFlag, "reverse", false, "sort the connections or the hosts in reverse order (with -sort)")
+	fs.BoolVar(ageFlag, "age", false, "show the age of the connections instead of their time in the table")
+	fs.BoolVar(countFlag, "count", false, "only show the number of connections / hosts / users / groups")
+	fs.BoolVar(watchFlag, "watch", false, "refresh the connections periodically until interrupted")
+	fs.DurationVar(intervalDuration, "interval", 2*time.Second, "interval between two refreshes (with -watch)")
+	fs.DurationVar(staleDuration, "stale", 0, "mark the hosts which were not checked during this duration (e.g. 10m)")
+	fs.BoolVar(jsonMergedFlag, "json-merged", false, "show the whole config (merged with the config stored in etcd) in JSON format")
+	fs.BoolVar(effectiveRoutesFlag, "effective-routes", false, "show the destinations of the config as iterated by the route selection")
+	fs.BoolVar(liveFlag, "live", false, "also show the temporary connection limit of the user (-user) set in etcd")
 	fs.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s show COMMAND [OPTIONS]
 
 The commands are:
-  connections [-all] [-csv|-json]                        show connections stored in etcd
-  hosts [-csv|-json]                                     show hosts stored in etcd
-  users [-all] [-csv|-json]                              show users stored in etcd
-  groups [-all] [-csv|-json]                             show groups stored in etcd
+  connections -count [-csv|-json] [-user USER] [-groups GROUPS] [-service SERVICE] [-dest DEST] [-route-select ALGO]
+                                                         show the number of connections stored in etcd
+  connections [-all] [-csv|-json|-age] [-user USER] [-groups GROUPS] [-service SERVICE] [-dest DEST] [-route-select ALGO] [-sort KEY [-reverse]] [-anonymize [-salt SALT]]
+                                                         show connections stored in etcd
+  connections -watch [-interval INTERVAL] [-all] [-age] [-user USER] [-groups GROUPS] [-service SERVICE] [-dest DEST] [-route-select ALGO] [-sort KEY [-reverse]] [-anonymize [-salt SALT]]
+                                                         refresh the connections stored in etcd periodically
+  connections -follow -user USER [-csv|-json] [-anonymize [-salt SALT]]
+                                                         print the connections of a user as they start and end
+  hosts [-csv|-json] [-state STATES] [-sort KEY [-reverse]] [-stale DURATION] [-probe [-update]]
+                                                         show hosts stored in etcd
+  hosts -count [-csv|-json] [-state STATES] [-stale DURATION]
+                                                         show the number of hosts stored in etcd by state
+  users [-all] [-csv|-json] [-anonymize [-salt SALT]]    show users stored in etcd
+  users -count [-all] [-csv|-json]                       show the number of users stored in etcd
+  history [-csv|-json] [-user USER] [-anonymize [-salt SALT]]
+                                                         show the history (persistent destinations) stored in etcd
+  groups [-all] [-csv|-json] [-anonymize [-salt SALT]]   show groups stored in etcd
+  groups -count [-all] [-csv|-json]                      show the number of groups stored in etcd
   error_banner                                           show error banners stored in etcd and in configuration
-  config [-user USER] [-groups GROUPS] [-source SOURCE]  show the calculated configuration
+  config [-user USER [-live]] [-groups GROUPS] [-source SOURCE] [-env KEY=VAL]...
+                                                         show the calculated configuration
+  config -json-merged [-user USER] [-groups GROUPS] [-source SOURCE] [-env KEY=VAL]...
+                                                         show the calculated configuration in JSON format
+  config -effective-routes [-csv|-json] [-user USER] [-groups GROUPS] [-source SOURCE] [-env KEY=VAL]...
+                                                         show the expanded destinations of the calculated configuration
+  config -all-users-file FILE [-csv|-json] [-groups GROUPS] [-source SOURCE] [-env KEY=VAL]...
+                                                         show the main options of the configuration of each user listed in FILE
+  routing [-csv|-json] [-user USER] [-groups GROUPS] [-source SOURCE] [-env KEY=VAL]...
+                                                         show the simulated routing of each service
 
 The options are:
 `, os.Args[0])
@@ -659,7 +1728,7 @@ func newEnableParser() *flag.FlagSet {
 	fs.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s enable HOST [PORT]
 
-Enable a previously disabled host in etcd. The default port is %s. Host and port
+Enable a previously disabled (or in maintenance) host in etcd. The default port is %s. Host and port
 can be nodesets.
 `, os.Args[0], defaultHostPort)
 		os.Exit(2)
@@ -667,38 +1736,284 @@ can be nodesets.
 	return fs
 }
 
-func newForgetParser() *flag.FlagSet {
+func newForgetParser(olderThanString *string, dryRunFlag *bool, userString *string, serviceString *string, hostString *string, portString *string) *flag.FlagSet {
 	fs := flag.NewFlagSet("forget", flag.ExitOnError)
+	fs.StringVar(olderThanString, "older-than", "", "forget the history entries unused, or the orphaned connections started, for this duration (e.g. 12h or 30d)")
+	fs.BoolVar(dryRunFlag, "dry-run", false, "only show the history entries or the orphaned connections which would be forgotten")
+	fs.StringVar(userString, "user", "", "forget the connection limit or the connections of this user")
+	fs.StringVar(serviceString, "service", "", "forget the connections to this service")
+	fs.StringVar(hostString, "host", "", "forget the connections to this destination host")
+	fs.StringVar(portString, "port", "", "forget the connections to this destination port")
 	fs.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s forget HOST [PORT]
+       %s forget history -older-than DURATION [-dry-run]
+       %s forget limit -user USER
+       %s forget connection -older-than DURATION [-user USER] [-service SERVICE] [-host HOST] [-port PORT] [-dry-run]
 
 Forget a host in etcd. The default port is %s. Remember that if this host is
 used, it will appear back in the list. Host and port can be nodesets.
-`, os.Args[0], defaultHostPort)
+
+Or forget the history entries (the destinations remembered with etcd_keyttl)
+which were not used for more than DURATION.
+
+Or forget the temporary connection limit of a user set with set-limit, before
+it expires.
+
+Or forget the orphaned connection entries (without a lease kept alive by a
+sshproxy process, i.e. written without a lease) which started more than
+DURATION ago and match all the specified options. The connections still in
+progress are never forgotten.
+
+The options are:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], defaultHostPort)
+		fs.PrintDefaults()
 		os.Exit(2)
 	}
 	return fs
 }
 
-func newDisableParser() *flag.FlagSet {
+func newDisableParser(forString *string) *flag.FlagSet {
 	fs := flag.NewFlagSet("disable", flag.ExitOnError)
+	fs.StringVar(forString, "for", "", "disable the host only for this duration (e.g. 2h or 1d)")
 	fs.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s disable HOST [PORT]
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s disable [-for DURATION] HOST [PORT]
 
 Disable a host in etcd. The default port is %s. Host and port can be nodesets.
+With -for, the host is only disabled for DURATION, then it is checked again as
+usual.
+
+The options are:
+`, os.Args[0], defaultHostPort)
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newMaintenanceParser() *flag.FlagSet {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s maintenance HOST [PORT]
+
+Put a host in maintenance in etcd. The default port is %s. Host and port can be
+nodesets.
 `, os.Args[0], defaultHostPort)
 		os.Exit(2)
 	}
 	return fs
 }
 
-func newErrorBannerParser(expireFlag *string) *flag.FlagSet {
+func newCordonParser() *flag.FlagSet {
+	fs := flag.NewFlagSet("cordon", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s cordon HOST [PORT]
+
+Cordon a host in etcd: no new connection is routed to it, but its state is
+unchanged and the connections in progress are not affected. The default port
+is %s. Host and port can be nodesets.
+`, os.Args[0], defaultHostPort)
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newUncordonParser() *flag.FlagSet {
+	fs := flag.NewFlagSet("uncordon", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s uncordon HOST [PORT]
+
+Uncordon a host in etcd: new connections can be routed to it again. The
+default port is %s. Host and port can be nodesets.
+`, os.Args[0], defaultHostPort)
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newDisconnectParser(userString *string, serviceString *string, hostString *string, portString *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	fs.StringVar(userString, "user", "", "disconnect the connections of this user")
+	fs.StringVar(serviceString, "service", "", "disconnect the connections to this service")
+	fs.StringVar(hostString, "host", "", "disconnect the connections to this destination host")
+	fs.StringVar(portString, "port", "", "disconnect the connections to this destination port")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s disconnect [-user USER] [-service SERVICE] [-host HOST] [-port PORT]
+
+Terminate the connections in progress matching all the specified options (at
+least one option is mandatory): their entries are deleted in etcd and the
+sshproxy processes handling them exit.
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newErrorBannerParser(expireFlag *string, tzString *string, fileString *string) *flag.FlagSet {
 	fs := flag.NewFlagSet("error_banner", flag.ExitOnError)
-	fs.StringVar(expireFlag, "expire", "", "set the expiration date of this error banner. Format: YYYY-MM-DD[ HH:MM[:SS]]")
+	fs.StringVar(expireFlag, "expire", "", "set the expiration date of this error banner. Format: YYYY-MM-DD[ HH:MM[:SS][ -0700]]")
+	fs.StringVar(tzString, "tz", "", "time zone of the expiration date (e.g. Europe/Paris, local time zone by default)")
+	fs.StringVar(fileString, "file", "", "read the error banner from this file (\"-\" for the standard input)")
 	fs.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s error_banner [-expire DATE] MESSAGE
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s error_banner [-expire DATE [-tz ZONE]] MESSAGE
+       %s error_banner [-expire DATE [-tz ZONE]] -file FILE
 
-Set the error banner in etcd.
+Set the error banner in etcd. The error banner is removed if MESSAGE (or the
+content of FILE) is empty.
+
+The options are:
+`, os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newSetLimitParser(userString *string, maxInt *int, expireFlag *string, tzString *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("set-limit", flag.ExitOnError)
+	fs.StringVar(userString, "user", "", "set the connection limit of this user (mandatory)")
+	fs.IntVar(maxInt, "max", 0, "maximum number of simultaneous connections of the user (mandatory)")
+	fs.StringVar(expireFlag, "expire", "", "expiration date of the limit (mandatory). Format: YYYY-MM-DD[ HH:MM[:SS][ -0700]]")
+	fs.StringVar(tzString, "tz", "", "time zone of the expiration date (e.g. Europe/Paris, local time zone by default)")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s set-limit -user USER -max N -expire DATE [-tz ZONE]
+
+Set in etcd the maximum number of simultaneous connections of a user until
+DATE, e.g. to temporarily raise it during a big job launch. It replaces the
+max_connections_per_user option of the configuration for this user, then it
+is automatically deleted. It can be removed before with forget limit.
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newSchemaParser() *flag.FlagSet {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s schema
+
+Show the JSON schema describing the configuration file. It can be used to
+validate a configuration with any JSON schema compatible YAML linter.
+`, os.Args[0])
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newDoctorParser() *flag.FlagSet {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s doctor
+
+Diagnose common misconfigurations: check that the configuration file parses,
+that the destinations resolve, that the TLS certificates are valid, that etcd
+is reachable with read/write permissions and that the destinations have their
+state stored in etcd. Exit with a non-zero status if a critical check fails.
+`, os.Args[0])
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newCompactParser(keepInt *int64, dryRunFlag *bool, yesFlag *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Int64Var(keepInt, "keep", defaultCompactKeep, "number of revisions to keep")
+	fs.BoolVar(dryRunFlag, "dry-run", false, "only show the revision which would be compacted")
+	fs.BoolVar(yesFlag, "yes", false, "do not ask for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s compact [-keep N] [-dry-run] [-yes]
+
+Compact the revision history of etcd, which grows with the keys frequently
+written by sshproxy, keeping the N last revisions. WARNING: the compaction
+affects the whole etcd store, not only the keys of sshproxy, and the compacted
+revisions cannot be read nor watched anymore.
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newMetricsParser(textfileString *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	fs.StringVar(textfileString, "textfile", "", "write the metrics in this file instead of the standard output")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s metrics [-textfile FILE]
+
+Export the connections, users and hosts stored in etcd as gauges in the
+Prometheus text format. With -textfile, the file is atomically replaced so it
+can be read by the textfile collector of node_exporter (e.g. when this command
+is run periodically by cron).
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newEstimateLoadParser(connectionsInt *int) *flag.FlagSet {
+	fs := flag.NewFlagSet("estimate-load", flag.ExitOnError)
+	fs.IntVar(connectionsInt, "connections", 0, "number of concurrent connections")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s estimate-load -connections N
+
+Estimate, for each service of the configuration file, the number of writes per
+second made by sshproxy to etcd with N concurrent connections: lease
+keepalives, bandwidth updates and host checks. It is computed from the options
+of the configuration file only, etcd is not contacted.
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newTestRouteParser(userString *string, groupsString *string, sourceString *string, serviceString *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("test-route", flag.ExitOnError)
+	fs.StringVar(userString, "user", "", "route this user (mandatory)")
+	fs.StringVar(groupsString, "groups", "", "route the user with these groups (comma separated)")
+	fs.StringVar(sourceString, "source", "", "route the user connected to this source (host[:port])")
+	fs.StringVar(serviceString, "service", "", "route the user to this service instead of the matched one")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s test-route -user USER [-groups GROUPS] [-source SOURCE] [-service SERVICE]
+
+Show the destination the user would be routed to right now, without opening
+an SSH session, and the steps of the choice: existing connection in sticky
+mode, route_select algorithm used and hosts skipped (down, disabled, in
+maintenance or full). The same logic as sshproxy is used, so the hosts are
+really checked, but etcd is not modified: the states of the hosts and the
+scores of the external algorithm are not written.
+
+The options are:
+`, os.Args[0])
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs
+}
+
+func newReplayIndexParser(jsonFlag *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("replay-index", flag.ExitOnError)
+	fs.BoolVar(jsonFlag, "json", false, "show results in JSON format")
+	fs.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s replay-index [-json] DIR...
+
+Scan the directory trees for the recordings dumped by sshproxy and show their
+manifest (file, user, source, destination, command, start time and size) in
+CSV (the default) or JSON format. Only the headers of the recordings are read.
+The files which are not recordings are skipped with a warning.
 
 The options are:
 `, os.Args[0])
@@ -744,7 +2059,27 @@ func getHostPortFromCommandLine(args []string) ([]string, []string, error) {
 	return hosts, ports, nil
 }
 
-func getErrorBannerFromCommandLine(args []string) (string, error) {
+// getErrorBannerFromCommandLine returns the error banner given as argument or,
+// if file is not empty, the content of file (the standard input if file is
+// "-").
+func getErrorBannerFromCommandLine(args []string, file string) (string, error) {
+	if file != "" {
+		if len(args) > 0 {
+			return "", fmt.Errorf("MESSAGE and -file cannot be used together")
+		}
+		var content []byte
+		var err error
+		if file == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	}
+
 	errorBanner := ""
 	switch len(args) {
 	case 0:
@@ -797,26 +2132,42 @@ func secondsToHuman(s int64, passthrough bool) string {
 	return fmt.Sprintf("%.fd %.fh %.fm %.fs", d, h, m, seconds)
 }
 
-func matchExpire(expire string) (time.Time, error) {
-	layouts := []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05"}
-	loc, _ := time.LoadLocation("Local")
+// matchExpire parses the expiration date expire, in the time zone tz (an IANA
+// zone name such as "Europe/Paris", the local time zone if empty) unless it
+// ends with an explicit offset (e.g. "+0200"). An error is returned if the
+// date is before now. A zero time is returned if expire is empty.
+func matchExpire(expire, tz string, now time.Time) (time.Time, error) {
+	layouts := []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02 15:04 -0700", "2006-01-02 15:04:05 -0700"}
+	loc := time.Local
+	if tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time zone: %s", tz)
+		}
+	}
+	if expire == "" {
+		return time.Time{}, nil
+	}
 	var err error
 	var t time.Time
 	for _, layout := range layouts {
 		t, err = time.ParseInLocation(layout, expire, loc)
 		if err == nil {
+			if t.Before(now) {
+				return t, fmt.Errorf("%s is in the past!", expire)
+			}
 			return t, nil
 		}
 	}
-	if expire != "" {
-		return t, err
-	}
-	return t, nil
+	return t, err
 }
 
 func main() {
 	flag.Usage = usage
 	configFile := flag.String("c", defaultConfig, "path to configuration file")
+	flag.StringVar(&scopedService, "service", "", "use the etcd namespace of this service")
+	flag.BoolVar(&readOnly, "read-only", os.Getenv("SSHPROXYCTL_READ_ONLY") != "", "refuse the commands modifying etcd (default true if SSHPROXYCTL_READ_ONLY is set)")
 	flag.Parse()
 
 	if flag.NArg() == 0 {
@@ -827,23 +2178,71 @@ func main() {
 	var csvFlag bool
 	var jsonFlag bool
 	var allFlag bool
+	var probeFlag bool
+	var updateFlag bool
+	var followFlag bool
+	var watchFlag bool
+	var intervalDuration time.Duration
+	var usersFileString string
+	var anonymizeFlag bool
+	var saltString string
 	var expire string
+	var tzString string
 	var userString string
 	var groupsString string
 	var sourceString string
+	env := envVariables{}
+	var sortString string
+	var reverseFlag bool
+	var serviceString string
+	var destString string
+	var routeSelectString string
+	var stateString string
+	var effectiveRoutesFlag bool
+	var staleDuration time.Duration
+	var jsonMergedFlag bool
+	var ageFlag bool
+	var liveFlag bool
+	var countFlag bool
+	var maxInt int
+	var olderThanString string
+	var dryRunFlag bool
+	var forString string
+	var hostString string
+	var portString string
+	var textfileString string
+	var fileString string
+	var connectionsInt int
+	var keepInt int64
+	var yesFlag bool
 
 	parsers := map[string]*flag.FlagSet{
-		"help":         newHelpParser(),
-		"version":      newVersionParser(),
-		"show":         newShowParser(&csvFlag, &jsonFlag, &allFlag, &userString, &groupsString, &sourceString),
-		"enable":       newEnableParser(),
-		"forget":       newForgetParser(),
-		"disable":      newDisableParser(),
-		"error_banner": newErrorBannerParser(&expire),
+		"help":          newHelpParser(),
+		"version":       newVersionParser(),
+		"show":          newShowParser(&csvFlag, &jsonFlag, &allFlag, &probeFlag, &updateFlag, &followFlag, &anonymizeFlag, &saltString, &userString, &groupsString, &sourceString, env, &sortString, &reverseFlag, &watchFlag, &intervalDuration, &usersFileString, &serviceString, &destString, &routeSelectString, &stateString, &effectiveRoutesFlag, &staleDuration, &jsonMergedFlag, &ageFlag, &liveFlag, &countFlag),
+		"enable":        newEnableParser(),
+		"forget":        newForgetParser(&olderThanString, &dryRunFlag, &userString, &serviceString, &hostString, &portString),
+		"disable":       newDisableParser(&forString),
+		"maintenance":   newMaintenanceParser(),
+		"cordon":        newCordonParser(),
+		"uncordon":      newUncordonParser(),
+		"disconnect":    newDisconnectParser(&userString, &serviceString, &hostString, &portString),
+		"error_banner":  newErrorBannerParser(&expire, &tzString, &fileString),
+		"set-limit":     newSetLimitParser(&userString, &maxInt, &expire, &tzString),
+		"schema":        newSchemaParser(),
+		"doctor":        newDoctorParser(),
+		"compact":       newCompactParser(&keepInt, &dryRunFlag, &yesFlag),
+		"replay-index":  newReplayIndexParser(&jsonFlag),
+		"metrics":       newMetricsParser(&textfileString),
+		"estimate-load": newEstimateLoadParser(&connectionsInt),
+		"test-route":    newTestRouteParser(&userString, &groupsString, &sourceString, &serviceString),
 	}
 
 	cmd := flag.Arg(0)
 	args := flag.Args()[1:]
+	if readOnly && isWriteCommand(cmd) {
+		log.Fatalf("ERROR: %s is not allowed in read-only mode", cmd)
+	}
 	switch cmd {
 	case "help":
 		p := parsers[cmd]
@@ -873,19 +2272,117 @@ func main() {
 		// parse flags after subcommand
 		args = p.Args()[1:]
 		p.Parse(args)
+		if saltString != "" && !anonymizeFlag {
+			fmt.Fprintf(os.Stderr, "ERROR: -salt can only be used with -anonymize\n\n")
+			p.Usage()
+		}
+		var anon *anonymizer
+		if anonymizeFlag {
+			anon = newAnonymizer(saltString)
+		}
+		if countFlag && !slices.Contains([]string{"connections", "hosts", "users", "groups"}, subcmd) {
+			fmt.Fprintf(os.Stderr, "ERROR: -count can only be used with connections, hosts, users and groups\n\n")
+			p.Usage()
+		}
 		switch subcmd {
 		case "hosts":
-			showHosts(*configFile, csvFlag, jsonFlag)
+			if updateFlag && !probeFlag {
+				fmt.Fprintf(os.Stderr, "ERROR: -update can only be used with -probe\n\n")
+				p.Usage()
+			}
+			if updateFlag && readOnly {
+				log.Fatalf("ERROR: -update is not allowed in read-only mode")
+			}
+			if countFlag && probeFlag {
+				fmt.Fprintf(os.Stderr, "ERROR: -count cannot be used with -probe\n\n")
+				p.Usage()
+			}
+			states, err := parseStates(stateString)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value for -state: %v\n\n", err)
+				p.Usage()
+			}
+			if sortString != "" && !slices.Contains(hostsSortKeys(), sortString) {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid sort key: %s (valid keys: %s)\n\n", sortString, strings.Join(hostsSortKeys(), ", "))
+				p.Usage()
+			}
+			if staleDuration < 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: -stale must be positive\n\n")
+				p.Usage()
+			}
+			// the stale hosts are also reported in the exit status, so
+			// that it can be used by a monitoring check
+			if n := showHosts(*configFile, csvFlag, jsonFlag, probeFlag, updateFlag, states, sortString, reverseFlag, staleDuration, countFlag); n > 0 {
+				fmt.Fprintf(os.Stderr, "%d hosts not checked for more than %s\n", n, staleDuration)
+				os.Exit(1)
+			}
 		case "connections":
-			showConnections(*configFile, csvFlag, jsonFlag, allFlag)
+			if countFlag && (followFlag || watchFlag) {
+				fmt.Fprintf(os.Stderr, "ERROR: -count cannot be used with -follow or -watch\n\n")
+				p.Usage()
+			}
+			if followFlag {
+				if userString == "" {
+					fmt.Fprintf(os.Stderr, "ERROR: -follow needs a user (-user)\n\n")
+					p.Usage()
+				}
+				if watchFlag {
+					fmt.Fprintf(os.Stderr, "ERROR: -watch cannot be used with -follow\n\n")
+					p.Usage()
+				}
+				followConnections(*configFile, csvFlag, jsonFlag, userString, anon)
+			} else {
+				if sortString != "" && !slices.Contains(connectionsSortKeys(allFlag), sortString) {
+					fmt.Fprintf(os.Stderr, "ERROR: invalid sort key: %s (valid keys: %s)\n\n", sortString, strings.Join(connectionsSortKeys(allFlag), ", "))
+					p.Usage()
+				}
+				if routeSelectString != "" && !utils.IsRouteAlgorithm(routeSelectString) {
+					fmt.Fprintf(os.Stderr, "ERROR: invalid route_select algorithm: %s\n\n", routeSelectString)
+					p.Usage()
+				}
+				filter := newConnectionFilter(userString, groupsString, serviceString, destString, routeSelectString)
+				if watchFlag {
+					if csvFlag || jsonFlag {
+						fmt.Fprintf(os.Stderr, "ERROR: -watch cannot be used with -csv or -json, run the command periodically instead\n\n")
+						p.Usage()
+					}
+					if intervalDuration <= 0 {
+						fmt.Fprintf(os.Stderr, "ERROR: -interval must be positive\n\n")
+						p.Usage()
+					}
+					watchConnections(*configFile, allFlag, filter, sortString, reverseFlag, anon, intervalDuration, ageFlag)
+				} else {
+					showConnections(*configFile, csvFlag, jsonFlag, allFlag, filter, sortString, reverseFlag, anon, ageFlag, countFlag)
+				}
+			}
+		case "history":
+			showHistory(*configFile, csvFlag, jsonFlag, userString, anon)
 		case "users":
-			showUsers(*configFile, csvFlag, jsonFlag, allFlag)
+			showUsers(*configFile, csvFlag, jsonFlag, allFlag, anon, countFlag)
 		case "groups":
-			showGroups(*configFile, csvFlag, jsonFlag, allFlag)
+			showGroups(*configFile, csvFlag, jsonFlag, allFlag, anon, countFlag)
 		case "error_banner":
 			showErrorBanner(*configFile)
 		case "config":
-			showConfig(*configFile, userString, groupsString, sourceString)
+			if usersFileString != "" {
+				if userString != "" {
+					fmt.Fprintf(os.Stderr, "ERROR: -all-users-file cannot be used with -user\n\n")
+					p.Usage()
+				}
+				if effectiveRoutesFlag || jsonMergedFlag || liveFlag {
+					fmt.Fprintf(os.Stderr, "ERROR: -all-users-file cannot be used with -effective-routes, -json-merged or -live\n\n")
+					p.Usage()
+				}
+				showUsersConfig(*configFile, csvFlag, jsonFlag, usersFileString, groupsString, sourceString, env)
+			} else {
+				if liveFlag && (userString == "" || effectiveRoutesFlag || jsonMergedFlag) {
+					fmt.Fprintf(os.Stderr, "ERROR: -live needs -user and cannot be used with -effective-routes or -json-merged\n\n")
+					p.Usage()
+				}
+				showConfig(*configFile, csvFlag, jsonFlag, effectiveRoutesFlag, jsonMergedFlag, liveFlag, userString, groupsString, sourceString, env)
+			}
+		case "routing":
+			showRouting(*configFile, csvFlag, jsonFlag, userString, groupsString, sourceString, env)
 		default:
 			fmt.Fprintf(os.Stderr, "ERROR: unknown subcommand: %s\n\n", subcmd)
 			p.Usage()
@@ -900,23 +2397,119 @@ func main() {
 		}
 		for _, host := range hosts {
 			for _, port := range ports {
-				enableHost(host, port, *configFile)
+				if err := enableHost(host, port, *configFile); err != nil {
+					log.Fatalf("ERROR: enabling %s:%s in etcd: %v", host, port, etcdError(err))
+				}
 			}
 		}
 	case "forget":
 		p := parsers[cmd]
 		p.Parse(args)
+		if p.Arg(0) == "history" {
+			// parse flags after subcommand
+			p.Parse(p.Args()[1:])
+			if p.NArg() != 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments: %s\n\n", strings.Join(p.Args(), " "))
+				p.Usage()
+			}
+			if olderThanString == "" {
+				fmt.Fprintf(os.Stderr, "ERROR: forget history needs -older-than\n\n")
+				p.Usage()
+			}
+			olderThan, err := parseAge(olderThanString)
+			if err != nil || olderThan <= 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value for -older-than: %s\n\n", olderThanString)
+				p.Usage()
+			}
+			forgetHistory(*configFile, olderThan, dryRunFlag)
+			break
+		}
+		if p.Arg(0) == "connection" {
+			// parse flags after subcommand
+			p.Parse(p.Args()[1:])
+			if p.NArg() != 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments: %s\n\n", strings.Join(p.Args(), " "))
+				p.Usage()
+			}
+			if olderThanString == "" {
+				fmt.Fprintf(os.Stderr, "ERROR: forget connection needs -older-than\n\n")
+				p.Usage()
+			}
+			olderThan, err := parseAge(olderThanString)
+			if err != nil || olderThan <= 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value for -older-than: %s\n\n", olderThanString)
+				p.Usage()
+			}
+			forgetConnections(*configFile, userString, serviceString, hostString, portString, olderThan, dryRunFlag)
+			break
+		}
+		if serviceString != "" || hostString != "" || portString != "" {
+			fmt.Fprintf(os.Stderr, "ERROR: -service, -host and -port can only be used with forget connection\n\n")
+			p.Usage()
+		}
+		if p.Arg(0) == "limit" {
+			// parse flags after subcommand
+			p.Parse(p.Args()[1:])
+			if p.NArg() != 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments: %s\n\n", strings.Join(p.Args(), " "))
+				p.Usage()
+			}
+			if userString == "" {
+				fmt.Fprintf(os.Stderr, "ERROR: forget limit needs -user\n\n")
+				p.Usage()
+			}
+			forgetUserLimit(userString, *configFile)
+			break
+		}
+		if olderThanString != "" || dryRunFlag {
+			fmt.Fprintf(os.Stderr, "ERROR: -older-than and -dry-run can only be used with forget history or forget connection\n\n")
+			p.Usage()
+		}
+		if userString != "" {
+			fmt.Fprintf(os.Stderr, "ERROR: -user can only be used with forget limit or forget connection\n\n")
+			p.Usage()
+		}
 		hosts, ports, err := getHostPortFromCommandLine(p.Args())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
 			p.Usage()
 		}
+		var forgotten int64
 		for _, host := range hosts {
 			for _, port := range ports {
-				forgetHost(host, port, *configFile)
+				n, err := forgetHost(host, port, *configFile)
+				if err != nil {
+					log.Fatalf("ERROR: forgetting %s:%s in etcd: %v", host, port, etcdError(err))
+				}
+				forgotten += n
 			}
 		}
+		fmt.Printf("%d hosts forgotten\n", forgotten)
 	case "disable":
+		p := parsers[cmd]
+		p.Parse(args)
+		var duration time.Duration
+		if forString != "" {
+			var err error
+			duration, err = parseAge(forString)
+			if err != nil || duration <= 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value for -for: %s\n\n", forString)
+				p.Usage()
+			}
+		}
+		hosts, ports, err := getHostPortFromCommandLine(p.Args())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
+			p.Usage()
+		}
+		for _, host := range hosts {
+			for _, port := range ports {
+				if err := disableHost(host, port, *configFile, duration); err != nil {
+					log.Fatalf("ERROR: disabling %s:%s in etcd: %v", host, port, etcdError(err))
+				}
+			}
+		}
+	case "maintenance":
 		p := parsers[cmd]
 		p.Parse(args)
 		hosts, ports, err := getHostPortFromCommandLine(p.Args())
@@ -926,27 +2519,118 @@ func main() {
 		}
 		for _, host := range hosts {
 			for _, port := range ports {
-				disableHost(host, port, *configFile)
+				if err := maintenanceHost(host, port, *configFile); err != nil {
+					log.Fatalf("ERROR: putting %s:%s in maintenance in etcd: %v", host, port, etcdError(err))
+				}
 			}
 		}
+	case "cordon", "uncordon":
+		p := parsers[cmd]
+		p.Parse(args)
+		hosts, ports, err := getHostPortFromCommandLine(p.Args())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
+			p.Usage()
+		}
+		cordonHosts(hosts, ports, cmd == "cordon", *configFile)
+	case "disconnect":
+		p := parsers[cmd]
+		p.Parse(args)
+		if userString == "" && serviceString == "" && hostString == "" && portString == "" {
+			fmt.Fprintf(os.Stderr, "ERROR: at least one of -user, -service, -host or -port is mandatory\n\n")
+			p.Usage()
+		}
+		disconnect(userString, serviceString, hostString, portString, *configFile)
 	case "error_banner":
 		p := parsers[cmd]
 		p.Parse(args)
-		errorBanner, err := getErrorBannerFromCommandLine(p.Args())
+		errorBanner, err := getErrorBannerFromCommandLine(p.Args(), fileString)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
 			p.Usage()
 		}
-		t, err := matchExpire(expire)
+		t, err := matchExpire(expire, tzString, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
+			p.Usage()
+		}
+		if err := setErrorBanner(errorBanner, t, *configFile); err != nil {
+			log.Fatalf("ERROR: setting error banner in etcd: %v", etcdError(err))
+		}
+	case "set-limit":
+		p := parsers[cmd]
+		p.Parse(args)
+		if p.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments: %s\n\n", strings.Join(p.Args(), " "))
+			p.Usage()
+		}
+		if userString == "" || expire == "" {
+			fmt.Fprintf(os.Stderr, "ERROR: -user and -expire are mandatory\n\n")
+			p.Usage()
+		}
+		if maxInt <= 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: -max must be a positive number\n\n")
+			p.Usage()
+		}
+		t, err := matchExpire(expire, tzString, time.Now())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
 			p.Usage()
 		}
-		if expire != "" && t.Before(time.Now()) {
-			fmt.Fprintf(os.Stderr, "ERROR: %s is in the past!\n\n", expire)
+		setUserLimit(userString, maxInt, t, *configFile)
+	case "schema":
+		p := parsers[cmd]
+		p.Parse(args)
+		showSchema()
+	case "doctor":
+		p := parsers[cmd]
+		p.Parse(args)
+		if !doctor(*configFile) {
+			os.Exit(1)
+		}
+	case "compact":
+		p := parsers[cmd]
+		p.Parse(args)
+		if p.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: unexpected arguments: %s\n\n", strings.Join(p.Args(), " "))
+			p.Usage()
+		}
+		if keepInt < 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid value for -keep: %d\n\n", keepInt)
+			p.Usage()
+		}
+		compact(*configFile, keepInt, dryRunFlag, yesFlag)
+	case "metrics":
+		p := parsers[cmd]
+		p.Parse(args)
+		showMetrics(*configFile, textfileString)
+	case "estimate-load":
+		p := parsers[cmd]
+		p.Parse(args)
+		if connectionsInt <= 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: -connections must be a positive integer\n\n")
+			p.Usage()
+		}
+		showLoadEstimate(*configFile, connectionsInt)
+	case "test-route":
+		p := parsers[cmd]
+		p.Parse(args)
+		if userString == "" {
+			fmt.Fprintf(os.Stderr, "ERROR: -user is mandatory\n\n")
+			p.Usage()
+		}
+		if serviceString == "" {
+			serviceString = scopedService
+		}
+		testRoute(*configFile, userString, groupsString, sourceString, serviceString)
+	case "replay-index":
+		p := parsers[cmd]
+		p.Parse(args)
+		if p.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "ERROR: missing directory\n\n")
 			p.Usage()
 		}
-		setErrorBanner(errorBanner, t, *configFile)
+		replayIndex(p.Args(), jsonFlag)
 	default:
 		fmt.Fprintf(os.Stderr, "ERROR: unknown command: %s\n\n", cmd)
 		usage()
@@ -0,0 +1,476 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/record"
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+var matchExpireTests = []struct {
+	expire, tz string
+	want       time.Time
+}{
+	{"", "", time.Time{}},
+	{"2030-06-01 12:00 +0200", "", time.Date(2030, 6, 1, 10, 0, 0, 0, time.UTC)},
+	{"2030-06-01 12:00:30 -0500", "", time.Date(2030, 6, 1, 17, 0, 30, 0, time.UTC)},
+	// an explicit offset takes precedence over the time zone
+	{"2030-06-01 12:00 +0200", "America/New_York", time.Date(2030, 6, 1, 10, 0, 0, 0, time.UTC)},
+	{"2030-06-01 12:00", "Europe/Paris", time.Date(2030, 6, 1, 10, 0, 0, 0, time.UTC)},
+	{"2030-01-15", "Europe/Paris", time.Date(2030, 1, 14, 23, 0, 0, 0, time.UTC)},
+	{"2030-01-15 08:30:00", "UTC", time.Date(2030, 1, 15, 8, 30, 0, 0, time.UTC)},
+}
+
+func TestMatchExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range matchExpireTests {
+		got, err := matchExpire(tt.expire, tt.tz, now)
+		if err != nil {
+			t.Errorf("matchExpire(%q, %q) error = %v, want nil", tt.expire, tt.tz, err)
+		} else if !got.Equal(tt.want) {
+			t.Errorf("matchExpire(%q, %q) = %s, want %s", tt.expire, tt.tz, got, tt.want)
+		}
+	}
+}
+
+var matchExpireInvalidTests = []struct {
+	expire, tz, want string
+}{
+	{"2025-12-31 18:00 -0500", "", "2025-12-31 18:00 -0500 is in the past!"},
+	{"2025-12-31", "UTC", "2025-12-31 is in the past!"},
+	{"2026-01-01 00:30", "Europe/Paris", "2026-01-01 00:30 is in the past!"},
+	{"2030-06-01", "Mars/Olympus", "invalid time zone: Mars/Olympus"},
+	{"tomorrow", "", `parsing time "tomorrow" as "2006-01-02 15:04:05 -0700": cannot parse "tomorrow" as "2006"`},
+}
+
+func TestInvalidMatchExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range matchExpireInvalidTests {
+		_, err := matchExpire(tt.expire, tt.tz, now)
+		if err == nil {
+			t.Errorf("matchExpire(%q, %q) got no error", tt.expire, tt.tz)
+		} else if err.Error() != tt.want {
+			t.Errorf("matchExpire(%q, %q) error = %v, want %v", tt.expire, tt.tz, err, tt.want)
+		}
+	}
+}
+
+var sortHostsTests = []struct {
+	key     string
+	reverse bool
+	want    []string
+}{
+	{"", false, []string{"h1", "h2", "h3", "h4", "h5"}},
+	{"state", false, []string{"h3", "h5", "h4", "h1", "h2"}},
+	{"state", true, []string{"h1", "h2", "h4", "h5", "h3"}},
+	{"conns", false, []string{"h3", "h4", "h5", "h2", "h1"}},
+	{"bw", true, []string{"h2", "h1", "h3", "h4", "h5"}},
+	{"lastcheck", false, []string{"h5", "h4", "h3", "h2", "h1"}},
+}
+
+func TestSortHosts(t *testing.T) {
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range sortHostsTests {
+		hosts := []*utils.FlatHost{
+			{Hostname: "h1", N: 4, BwIn: 10, BwOut: 10, Host: &utils.Host{State: utils.Up, Ts: ts.Add(4 * time.Second)}},
+			{Hostname: "h2", N: 3, BwIn: 30, BwOut: 0, Host: &utils.Host{State: utils.Up, Ts: ts.Add(3 * time.Second)}},
+			{Hostname: "h3", N: 0, BwIn: 0, BwOut: 5, Host: &utils.Host{State: utils.Down, Ts: ts.Add(2 * time.Second)}},
+			{Hostname: "h4", N: 0, BwIn: 0, BwOut: 0, Host: &utils.Host{State: utils.Unknown, Ts: ts.Add(time.Second)}},
+			{Hostname: "h5", N: 1, BwIn: 0, BwOut: 0, Host: &utils.Host{State: utils.Disabled, Ts: ts}},
+		}
+		sortHosts(hosts, tt.key, tt.reverse)
+		var got []string
+		for _, h := range hosts {
+			got = append(got, h.Hostname)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortHosts(%q, %v) = %v, want %v", tt.key, tt.reverse, got, tt.want)
+		}
+	}
+}
+
+var isStaleTests = []struct {
+	state utils.State
+	age   time.Duration
+	stale time.Duration
+	want  bool
+}{
+	{utils.Up, time.Hour, 0, false},
+	{utils.Up, time.Minute, 10 * time.Minute, false},
+	{utils.Up, time.Hour, 10 * time.Minute, true},
+	{utils.Down, time.Hour, 10 * time.Minute, true},
+	{utils.Disabled, time.Hour, 10 * time.Minute, false},
+	{utils.Maintenance, time.Hour, 10 * time.Minute, false},
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range isStaleTests {
+		h := &utils.FlatHost{Hostname: "server1:22", Host: &utils.Host{State: tt.state, Ts: now.Add(-tt.age)}}
+		if got := isStale(h, tt.stale, now); got != tt.want {
+			t.Errorf("isStale(%s checked %s ago, %s) = %v, want %v", tt.state, tt.age, tt.stale, got, tt.want)
+		}
+	}
+}
+
+var formatTimeTests = []struct {
+	t    time.Time
+	now  time.Time
+	want string
+}{
+	{time.Date(2026, 1, 1, 12, 30, 5, 0, time.Local), time.Time{}, "2026-01-01 12:30:05"},
+	{time.Date(2026, 1, 1, 12, 30, 5, 0, time.UTC), time.Date(2026, 1, 1, 12, 33, 17, 0, time.UTC), "3m 12s ago"},
+	{time.Date(2026, 1, 1, 12, 30, 5, 0, time.UTC), time.Date(2026, 1, 2, 14, 30, 5, 0, time.UTC), "1d 2h 0m 0s ago"},
+	{time.Date(2026, 1, 1, 12, 30, 5, 0, time.UTC), time.Date(2026, 1, 1, 12, 30, 5, 0, time.UTC), "0s ago"},
+}
+
+func TestFormatTime(t *testing.T) {
+	for _, tt := range formatTimeTests {
+		if got := formatTime(tt.t, tt.now); got != tt.want {
+			t.Errorf("formatTime(%s, %s) = %q, want %q", tt.t, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestHostsCounts(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	hosts := []*utils.FlatHost{
+		{Hostname: "server1:22", Host: &utils.Host{State: utils.Up, Ts: now}},
+		{Hostname: "server2:22", Host: &utils.Host{State: utils.Up, Ts: now.Add(-time.Hour)}, Cordoned: true},
+		{Hostname: "server3:22", Host: &utils.Host{State: utils.Down, Ts: now}},
+		{Hostname: "server4:22", Host: &utils.Host{State: utils.Disabled, Ts: now.Add(-time.Hour)}},
+	}
+	want := []count{
+		{"total", 4},
+		{"unknown", 0},
+		{"up", 2},
+		{"down", 1},
+		{"disabled", 1},
+		{"maintenance", 0},
+		{"cordoned", 1},
+	}
+	if got := hostsCounts(hosts, 0, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("hostsCounts(0) = %v, want %v", got, want)
+	}
+	want = append(want, count{"stale", 1})
+	if got := hostsCounts(hosts, 10*time.Minute, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("hostsCounts(10m) = %v, want %v", got, want)
+	}
+}
+
+func TestIsWriteCommand(t *testing.T) {
+	for _, cmd := range []string{"enable", "forget", "cordon", "error_banner", "set-limit", "compact"} {
+		if !isWriteCommand(cmd) {
+			t.Errorf("isWriteCommand(%q) = false, want true", cmd)
+		}
+	}
+	for _, cmd := range []string{"help", "show", "doctor", "metrics", "test-route"} {
+		if isWriteCommand(cmd) {
+			t.Errorf("isWriteCommand(%q) = true, want false", cmd)
+		}
+	}
+}
+
+func TestCheckDuplicateServices(t *testing.T) {
+	for _, tt := range []struct {
+		configs []*utils.Config
+		status  checkStatus
+	}{
+		{[]*utils.Config{{Service: "default", Dest: []string{"a"}}, {Service: "gpu", Dest: []string{"b"}}}, checkPassed},
+		{[]*utils.Config{{Service: "gpu", Dest: []string{"a"}}, {Service: "gpu", Dest: []string{"a"}}}, checkWarning},
+		// e.g. the same service routed differently for two groups
+		{[]*utils.Config{{Service: "gpu", Dest: []string{"a"}}, {Service: "gpu", Dest: []string{"b"}}}, checkWarning},
+	} {
+		if got := checkDuplicateServices(tt.configs); got.Status != tt.status {
+			t.Errorf("checkDuplicateServices(%d configs) = %s, want %s", len(tt.configs), got.Status, tt.status)
+		}
+	}
+}
+
+func TestProbeConfig(t *testing.T) {
+	configs := []*utils.Config{
+		{Service: "default", Dest: []string{"server1:22"}},
+		{Service: "gpu", Dest: []string{"gpu1:22"}},
+		{Service: "other", EtcdNamespace: "ns", Dest: []string{"gpu1:22"}},
+	}
+	for _, tt := range []struct {
+		host *utils.FlatHost
+		want string
+	}{
+		{&utils.FlatHost{Hostname: "gpu1:22"}, "gpu"},
+		{&utils.FlatHost{Hostname: "gpu1:22", Namespace: "ns"}, "other"},
+		{&utils.FlatHost{Hostname: "unknown:22"}, "default"},
+	} {
+		if got := probeConfig(configs, tt.host); got.Service != tt.want {
+			t.Errorf("probeConfig(%s in %q) = %s, want %s", tt.host.Hostname, tt.host.Namespace, got.Service, tt.want)
+		}
+	}
+}
+
+func TestConnectionFilter(t *testing.T) {
+	// the users are unknown on this host, so the groups stored with the
+	// connections are used
+	connections := []*utils.FlatConnection{
+		{User: "sshproxy-test-alice", Service: "default", Dest: "server1:22", Groups: []string{"projA", "users"}},
+		{User: "sshproxy-test-bob", Service: "gpu", Dest: "server2:22", Groups: []string{"projB", "users"}},
+		{User: "sshproxy-test-carol", Service: "default", Dest: "server2:2222", Groups: []string{"users"}},
+	}
+	for _, tt := range []struct {
+		filter *connectionFilter
+		want   []string
+	}{
+		{newConnectionFilter("", "", "", "", ""), []string{"sshproxy-test-alice", "sshproxy-test-bob", "sshproxy-test-carol"}},
+		{newConnectionFilter("", "projA", "", "", ""), []string{"sshproxy-test-alice"}},
+		{newConnectionFilter("", "projA, projB", "", "", ""), []string{"sshproxy-test-alice", "sshproxy-test-bob"}},
+		{newConnectionFilter("", "users", "default", "", ""), []string{"sshproxy-test-alice", "sshproxy-test-carol"}},
+		{newConnectionFilter("", "projB", "default", "", ""), nil},
+		{newConnectionFilter("", "", "", "server2", ""), []string{"sshproxy-test-bob", "sshproxy-test-carol"}},
+		{newConnectionFilter("", "", "", "server2:22", ""), []string{"sshproxy-test-bob"}},
+	} {
+		var got []string
+		for _, c := range connections {
+			if tt.filter.match(c) {
+				got = append(got, c.User)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filter %+v matches %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func writeTestRecording(t *testing.T, filename string, infos *record.FileInfo) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("creating %s: %v", filename, err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if filepath.Ext(filename) == ".gz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	if _, err := record.NewWriter(w, infos); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+}
+
+func TestIndexRecordings(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1700000000, 0)
+	if err := os.Mkdir(filepath.Join(dir, "bob"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestRecording(t, filepath.Join(dir, "alice.rec"), &record.FileInfo{
+		Version: 1, Time: start,
+		SrcIP: net.ParseIP("192.168.0.1"), SrcPort: 40000,
+		DstIP: net.ParseIP("192.168.0.10"), DstPort: 22,
+		User: "alice", Command: "ls",
+	})
+	writeTestRecording(t, filepath.Join(dir, "bob", "session.rec.gz"), &record.FileInfo{
+		Version: 1, Time: start.Add(time.Hour),
+		SrcIP: net.ParseIP("192.168.0.2"), SrcPort: 40001,
+		DstIP: net.ParseIP("192.168.0.11"), DstPort: 2222,
+		User: "bob", Command: "",
+	})
+	// a truncated header and a file which is not gzipped are skipped
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.rec"), []byte{0, 1, 0}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notgzip.rec.gz"), []byte("plain text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := indexRecordings([]string{dir, filepath.Join(dir, "missing")})
+	type entry struct {
+		File, User, Src, Dst, Command string
+		Start                         time.Time
+	}
+	want := []entry{
+		{filepath.Join(dir, "alice.rec"), "alice", "192.168.0.1:40000", "192.168.0.10:22", "ls", start},
+		{filepath.Join(dir, "bob", "session.rec.gz"), "bob", "192.168.0.2:40001", "192.168.0.11:2222", "", start.Add(time.Hour)},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("indexRecordings returned %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		got := entry{e.File, e.User, e.Src, e.Dst, e.Command, e.Start}
+		if got != want[i] {
+			t.Errorf("indexRecordings entry %d = %+v, want %+v", i, got, want[i])
+		}
+		if fi, err := os.Stat(e.File); err != nil || fi.Size() != e.Size {
+			t.Errorf("indexRecordings entry %d size = %d, want the file size", i, e.Size)
+		}
+	}
+}
+
+func TestFlatConnectionsSortBy(t *testing.T) {
+	now := time.Now()
+	connections := flatConnections{
+		{User: "bob", Dest: "server2:22", Ts: now, BwIn: 10},
+		{User: "alice", Dest: "server1:22", Ts: now.Add(-time.Hour), BwIn: 30},
+		{User: "carol", Dest: "server1:22", Ts: now.Add(time.Hour), BwIn: 20},
+	}
+	for _, tt := range []struct {
+		key     string
+		reverse bool
+		want    []string
+	}{
+		{"", false, []string{"bob", "alice", "carol"}},
+		{"unknown", true, []string{"bob", "alice", "carol"}},
+		{"user", false, []string{"alice", "bob", "carol"}},
+		{"user", true, []string{"carol", "bob", "alice"}},
+		{"start", false, []string{"alice", "bob", "carol"}},
+		{"bwin", true, []string{"alice", "carol", "bob"}},
+		// the sort is stable
+		{"dest", false, []string{"alice", "carol", "bob"}},
+		{"dest", true, []string{"bob", "alice", "carol"}},
+	} {
+		fc := make(flatConnections, len(connections))
+		copy(fc, connections)
+		fc.sortBy(tt.key, tt.reverse)
+		var got []string
+		for _, c := range fc {
+			got = append(got, c.User)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortBy(%q, %v) = %v, want %v", tt.key, tt.reverse, got, tt.want)
+		}
+	}
+}
+
+func TestAggregatedConnectionsSortBy(t *testing.T) {
+	now := time.Now()
+	connections := aggregatedConnections{
+		{User: "bob", N: 2, Last: now, BwOut: 5},
+		{User: "alice", N: 3, Last: now.Add(-time.Hour), BwOut: 5},
+		{User: "carol", N: 1, Last: now.Add(time.Hour), BwOut: 1},
+	}
+	for _, tt := range []struct {
+		key     string
+		reverse bool
+		want    []string
+	}{
+		{"", false, []string{"bob", "alice", "carol"}},
+		{"start", false, []string{"bob", "alice", "carol"}},
+		{"user", false, []string{"alice", "bob", "carol"}},
+		{"n", true, []string{"alice", "bob", "carol"}},
+		{"last", false, []string{"alice", "bob", "carol"}},
+		{"bwout", false, []string{"carol", "bob", "alice"}},
+	} {
+		ac := make(aggregatedConnections, len(connections))
+		copy(ac, connections)
+		ac.sortBy(tt.key, tt.reverse)
+		var got []string
+		for _, c := range ac {
+			got = append(got, c.User)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sortBy(%q, %v) = %v, want %v", tt.key, tt.reverse, got, tt.want)
+		}
+	}
+}
+
+func TestConnectionsSortKeys(t *testing.T) {
+	for _, tt := range []struct {
+		allFlag bool
+		want    []string
+	}{
+		{false, []string{"bwin", "bwout", "dest", "last", "n", "service", "user"}},
+		{true, []string{"bwin", "bwout", "dest", "from", "kind", "mode", "route", "service", "start", "user"}},
+	} {
+		if got := connectionsSortKeys(tt.allFlag); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("connectionsSortKeys(%v) = %v, want %v", tt.allFlag, got, tt.want)
+		}
+	}
+}
+
+func TestMetricWrite(t *testing.T) {
+	for _, tt := range []struct {
+		m    *metric
+		want string
+	}{
+		{
+			&metric{name: "sshproxy_users", help: "Number of connected users."},
+			"# HELP sshproxy_users Number of connected users.\n# TYPE sshproxy_users gauge\n",
+		},
+		{
+			&metric{name: "sshproxy_users", help: "Number of connected users.", samples: []metricSample{{value: 3}}},
+			"# HELP sshproxy_users Number of connected users.\n# TYPE sshproxy_users gauge\nsshproxy_users 3\n",
+		},
+		{
+			&metric{name: "sshproxy_connections", help: "Connections.", samples: []metricSample{
+				{labels: [][2]string{{"service", "default"}, {"dest", "server1:22"}}, value: 2},
+				{labels: [][2]string{{"service", ""}, {"dest", "server2:22"}}, value: 0.5},
+			}},
+			"# HELP sshproxy_connections Connections.\n# TYPE sshproxy_connections gauge\n" +
+				"sshproxy_connections{service=\"default\",dest=\"server1:22\"} 2\n" +
+				"sshproxy_connections{dest=\"server2:22\"} 0.5\n",
+		},
+		{
+			&metric{name: "m", help: "Escaped labels.", samples: []metricSample{
+				{labels: [][2]string{{"host", "a\"b\\c\nd"}}, value: 1},
+			}},
+			"# HELP m Escaped labels.\n# TYPE m gauge\nm{host=\"a\\\"b\\\\c\\nd\"} 1\n",
+		},
+	} {
+		var buf bytes.Buffer
+		tt.m.write(&buf)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s write = %q, want %q", tt.m.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sshproxy.prom")
+	for _, content := range []string{"first\n", "second\n"} {
+		if err := writeTextfile(filename, []byte(content)); err != nil {
+			t.Fatalf("writeTextfile(%q) error = %v, want nil", content, err)
+		}
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("reading %s: %v", filename, err)
+		}
+		if string(got) != content {
+			t.Errorf("writeTextfile content = %q, want %q", got, content)
+		}
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("writeTextfile mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0644))
+	}
+	// the temporary files are removed
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("%s contains %d entries, want 1", dir, len(entries))
+	}
+
+	if err := writeTextfile(filepath.Join(dir, "missing", "sshproxy.prom"), []byte("content")); err == nil {
+		t.Errorf("writeTextfile in a missing directory error = nil, want an error")
+	}
+}
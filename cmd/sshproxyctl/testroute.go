@@ -0,0 +1,65 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// testRoute finds the destination a user would be routed to right now, with
+// the same logic as sshproxy, and prints it with the steps of the choice.
+// The configuration of serviceString is used if it is not empty, otherwise
+// the one matched by the user, the groups and the source.
+func testRoute(configFile, userString, groupsString, sourceString, serviceString string) {
+	var config *utils.Config
+	if serviceString != "" {
+		config = mustGetServiceConfig(configFile, serviceString)
+	} else {
+		groupsMap, _ := getGroups(userString, groupsString)
+		var err error
+		config, err = utils.LoadConfig(configFile, userString, "", time.Now(), groupsMap, sourceString, nil)
+		if err != nil {
+			log.Fatalf("reading configuration file %s: %v", configFile, err)
+		}
+	}
+
+	trace := &utils.RouteTrace{}
+	var cli *utils.Client
+	if len(config.Etcd.Endpoints) > 0 {
+		var err error
+		cli, err = utils.NewEtcdClient(config, nil)
+		if err != nil {
+			trace.Steps = append(trace.Steps, fmt.Sprintf("etcd unavailable: %v", err))
+		} else {
+			defer cli.Close()
+			// the states of the hosts checked and the scores of the
+			// routes must not be written by a simulation
+			cli = cli.DryRun()
+		}
+	}
+	dest, err := utils.FindDestination(cli, userString, config, sourceString, nil, trace)
+	fmt.Printf("service = %s\n", config.Service)
+	for _, step := range trace.Steps {
+		fmt.Printf("  %s\n", step)
+	}
+	switch {
+	case err != nil:
+		log.Fatalf("ERROR: finding destination: %v", err)
+	case dest == "":
+		fmt.Println("destination = none (the error banner would be displayed)")
+	default:
+		fmt.Printf("destination = %s\n", dest)
+	}
+}
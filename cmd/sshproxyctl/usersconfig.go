@@ -0,0 +1,110 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cea-hpc/sshproxy/pkg/utils"
+)
+
+// userConfig is the summary of the configuration calculated for a user.
+type userConfig struct {
+	User                  string
+	Service               string
+	Dest                  []string
+	Mode                  string
+	RouteSelect           string
+	MaxConnectionsPerUser int
+	MaxTransfersPerUser   int
+	MaxConnectionsPerHost int
+}
+
+// readUsersFile returns the user names listed in filename, one per line.
+// Empty lines and lines starting with # are ignored.
+func readUsersFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var users []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		users = append(users, line)
+	}
+	return users, scanner.Err()
+}
+
+// showUsersConfig shows the main options of the configuration calculated for
+// each user listed in usersFile, with their system groups and the given
+// groups, source and environment.
+func showUsersConfig(configFile string, csvFlag bool, jsonFlag bool, usersFile, groupsString, sourceString string, env envVariables) {
+	users, err := readUsersFile(usersFile)
+	if err != nil {
+		log.Fatalf("ERROR: reading users file %s: %v", usersFile, err)
+	}
+
+	configs := make([]userConfig, len(users))
+	for i, user := range users {
+		groupsMap, _ := getGroups(user, groupsString)
+		utils.ResetConfigCache()
+		config, err := utils.LoadConfig(configFile, user, "", time.Now(), groupsMap, sourceString, env)
+		if err != nil {
+			log.Fatalf("reading configuration file %s for user %s: %v", configFile, user, err)
+		}
+		configs[i] = userConfig{
+			User:                  user,
+			Service:               config.Service,
+			Dest:                  config.Dest,
+			Mode:                  config.Mode,
+			RouteSelect:           config.RouteSelect,
+			MaxConnectionsPerUser: config.MaxConnectionsPerUser,
+			MaxTransfersPerUser:   config.MaxTransfersPerUser,
+			MaxConnectionsPerHost: config.MaxConnectionsPerHost,
+		}
+	}
+
+	if jsonFlag {
+		displayJSON(configs)
+		return
+	}
+
+	rows := make([][]string, len(configs))
+	for i, c := range configs {
+		rows[i] = []string{
+			c.User,
+			c.Service,
+			strings.Join(c.Dest, ","),
+			c.Mode,
+			c.RouteSelect,
+			strconv.Itoa(c.MaxConnectionsPerUser),
+			strconv.Itoa(c.MaxTransfersPerUser),
+			strconv.Itoa(c.MaxConnectionsPerHost),
+		}
+	}
+
+	if csvFlag {
+		displayCSV(rows)
+	} else {
+		displayTable([]string{"User", "Service", "Dest", "Mode", "Route select", "Max conn/user", "Max transfers/user", "Max conn/host"}, rows)
+	}
+}
@@ -5,55 +5,114 @@ _sshproxyctl() {
         COMPREPLY=()
         cur="${COMP_WORDS[COMP_CWORD]}"
         prev="${COMP_WORDS[COMP_CWORD-1]}"
-        commands="disable enable error_banner forget help show version"
-        opts="-h -c ${commands}"
+        commands="compact cordon disable disconnect doctor enable error_banner estimate-load forget help maintenance metrics replay-index schema set-limit show test-route uncordon version"
+        opts="-h -c -read-only -service ${commands}"
 
         case "${prev}" in
             help)
                 COMPREPLY=( $(compgen -W "${commands}" -- "${cur}") )
                 ;;
             show)
-                COMPREPLY=( $(compgen -W '-all -csv -json -user -groups -source connections hosts users groups error_banner config' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-age -all -anonymize -count -csv -follow -interval -json -probe -reverse -salt -service -dest -route-select -sort -stale -state -update -user -watch -groups -source -env -all-users-file -effective-routes -json-merged -live connections hosts users groups history error_banner config routing' -- "${cur}") )
                 ;;
             connections)
-                COMPREPLY=( $(compgen -W '-all -csv -json' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-age -all -anonymize -count -csv -dest -follow -groups -interval -json -reverse -route-select -salt -service -sort -user -watch' -- "${cur}") )
                 ;;
             hosts)
-                COMPREPLY=( $(compgen -W '-csv -json' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-count -csv -json -probe -reverse -sort -stale -state -update' -- "${cur}") )
                 ;;
             users)
-                COMPREPLY=( $(compgen -W '-all -csv -json' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-all -anonymize -count -csv -json -salt' -- "${cur}") )
                 ;;
             groups)
-                COMPREPLY=( $(compgen -W '-all -csv -json' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-all -anonymize -count -csv -json -salt' -- "${cur}") )
+                ;;
+            history)
+                COMPREPLY=( $(compgen -W '-anonymize -csv -dry-run -json -older-than -salt -user' -- "${cur}") )
                 ;;
             config)
-                COMPREPLY=( $(compgen -W '-user -groups -source' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-csv -effective-routes -json -json-merged -live -user -groups -source -env' -- "${cur}") )
+                ;;
+            routing)
+                COMPREPLY=( $(compgen -W '-csv -json -user -groups -source -env' -- "${cur}") )
+                ;;
+            disconnect)
+                COMPREPLY=( $(compgen -W '-user -service -host -port' -- "${cur}") )
                 ;;
             error_banner)
-                COMPREPLY=( $(compgen -W '-expire' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-expire -file -tz' -- "${cur}") )
+                ;;
+            disable)
+                COMPREPLY=( $(compgen -W '-for' -- "${cur}") )
+                ;;
+            forget)
+                COMPREPLY=( $(compgen -W 'connection history limit' -- "${cur}") )
+                ;;
+            limit)
+                COMPREPLY=( $(compgen -W '-user' -- "${cur}") )
+                ;;
+            connection)
+                COMPREPLY=( $(compgen -W '-dry-run -host -older-than -port -service -user' -- "${cur}") )
+                ;;
+            set-limit)
+                COMPREPLY=( $(compgen -W '-expire -max -tz -user' -- "${cur}") )
+                ;;
+            compact)
+                COMPREPLY=( $(compgen -W '-dry-run -keep -yes' -- "${cur}") )
+                ;;
+            estimate-load)
+                COMPREPLY=( $(compgen -W '-connections' -- "${cur}") )
+                ;;
+            test-route)
+                COMPREPLY=( $(compgen -W '-user -groups -source -service' -- "${cur}") )
+                ;;
+            metrics)
+                COMPREPLY=( $(compgen -W '-textfile' -- "${cur}") )
+                ;;
+            -file|-textfile|-all-users-file)
+                _filedir
+                ;;
+            replay-index)
+                COMPREPLY=( $(compgen -W '-json' -- "${cur}") )
+                _filedir -d
                 ;;
             -all)
                 COMPREPLY=( $(compgen -W '-csv -json connections users groups' -- "${cur}") )
                 ;;
             -csv)
-                COMPREPLY=( $(compgen -W '-all connections hosts users groups' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-all -probe -user -groups -source -env -all-users-file connections hosts users groups config routing' -- "${cur}") )
                 ;;
             -json)
-                COMPREPLY=( $(compgen -W '-all connections hosts users groups' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-all -probe -user -groups -source -env -all-users-file connections hosts users groups config routing' -- "${cur}") )
+                ;;
+            -probe)
+                COMPREPLY=( $(compgen -W '-csv -json -update hosts' -- "${cur}") )
+                ;;
+            -anonymize)
+                COMPREPLY=( $(compgen -W '-all -csv -json -salt connections users groups' -- "${cur}") )
+                ;;
+            -update)
+                COMPREPLY=( $(compgen -W '-csv -json -probe hosts' -- "${cur}") )
                 ;;
             -user)
-                COMPREPLY=( $(compgen -W '-groups -source config' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-csv -follow -json -groups -source connections config routing' -- "${cur}") )
                 ;;
             -groups)
-                COMPREPLY=( $(compgen -W '-user -source config' -- "${cur}") )
+                COMPREPLY=( $(compgen -g -- "${cur}") )
                 ;;
             -source)
-                COMPREPLY=( $(compgen -W '-user -groups config' -- "${cur}") )
+                COMPREPLY=( $(compgen -W '-csv -json -user -groups -env config routing' -- "${cur}") )
+                ;;
+            -env)
+                ;;
+            -sort)
+                COMPREPLY=( $(compgen -W 'user service from dest n last start bwin bwout kind' -- "${cur}") )
                 ;;
             -c)
                 _filedir
                 ;;
+            -service)
+                ;;
             *)
                 COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
                 ;;
@@ -253,6 +253,12 @@ func NewWriter(writer io.Writer, infos *FileInfo) (*Writer, error) {
 	return w, nil
 }
 
+// NewAppendWriter writes records to an io.Writer appending them to a file
+// which already starts with a header (see NewWriter).
+func NewAppendWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer}
+}
+
 // Write writes a Record in the Writer.
 func (w *Writer) Write(rec *Record) error {
 	return Encode(w.writer, rec)
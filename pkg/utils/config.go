@@ -13,9 +13,12 @@ package utils
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,42 +33,173 @@ var (
 	// defaultAlgorithm is the default algorithm used to find a route if no
 	// other algorithm is specified in configuration.
 	defaultAlgorithm = "ordered"
+	// defaultRouteExternalTimeout is the default timeout of the requests made
+	// to the URL of the external route_select algorithm.
+	defaultRouteExternalTimeout = Duration(time.Second)
 	// defaultMode is the default mode used to find a route if no other mode is
 	// specified in the configuration.
-	defaultMode    = "sticky"
-	defaultService = "default"
-	defaultDest    = []string{}
+	defaultMode = "sticky"
+	// forceTTYModes are the possible values of the force_tty option, the
+	// first one being the default.
+	forceTTYModes = []string{"auto", "always", "never"}
+	// fileModes are the possible values of the log_mode and dump_mode
+	// options.
+	fileModes = []string{"append", "truncate"}
+	// logFormats are the possible values of the log_format option, the
+	// first one is the default.
+	logFormats = []string{"text", "json"}
+	// dumpCompressions are the possible values of the dump_compress option,
+	// the first one is the default.
+	dumpCompressions = []string{"none", "gzip"}
+	// defaultLogMode and defaultDumpMode are the default modes of opening of
+	// the log and dump files.
+	defaultLogMode  = "append"
+	defaultDumpMode = "truncate"
+	defaultService  = "default"
+	// defaultBlockingCommandRetryInterval is the time to wait before the
+	// first retry of the blocking command.
+	defaultBlockingCommandRetryInterval = Duration(time.Second)
+	// defaultBlockingCommandTimeout is the time after which an attempt of
+	// the blocking command is killed.
+	defaultBlockingCommandTimeout = Duration(30 * time.Second)
+	// defaultConnectTimeout is the timeout of the connections made to check
+	// if a host is alive.
+	defaultConnectTimeout = Duration(time.Second)
+	// defaultCheckCommandTimeout is the timeout of the command run to check
+	// if a host is alive.
+	defaultCheckCommandTimeout = Duration(5 * time.Second)
+	// defaultParentCheckInterval is the interval at which sshproxy checks
+	// if its SSH parent connection is dead.
+	defaultParentCheckInterval = Duration(time.Second)
+	defaultDest                = []string{}
+	// defaultAvailableStates are the states of the hosts to which a user can
+	// be routed if no other states are specified in the configuration.
+	defaultAvailableStates = []string{"up"}
+	// matchConditions are the conditions which can be used in the match
+	// section of an override.
+	matchConditions = []string{"users", "groups", "sources", "env"}
+	// etcdPrefixRegex matches the valid prefixes of the etcd keys.
+	etcdPrefixRegex = regexp.MustCompile(`^(/[^/]+)+$`)
+	// etcdNamespaceRegex matches the valid names of etcd namespaces.
+	etcdNamespaceRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	// unknownKeyRegex matches the errors of the YAML parser about the
+	// unknown keys.
+	unknownKeyRegex = regexp.MustCompile(`^line (\d+): field (.+) not found in type `)
 )
 
 var cachedConfig Config
 
+// etcdConfigs caches the configurations read from etcd (or the errors) by key,
+// as the configuration file can be read several times.
+var etcdConfigs = map[string]*etcdConfigEntry{}
+
+type etcdConfigEntry struct {
+	content []byte
+	err     error
+}
+
+// StringList is a list of strings which can be written in the configuration
+// file as a single string or as a list of strings.
+type StringList []string
+
+// UnmarshalYAML is used by the YAML library to unmarshal a string or a list of
+// strings. See go-yaml documentation for details.
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	*l = nil
+	if text != "" {
+		*l = StringList{text}
+	}
+	return nil
+}
+
 // Config represents the configuration for sshproxy.
 type Config struct {
-	ready                 bool // true when the configuration has already been loaded
-	Nodeset               string
-	Debug                 bool
-	Log                   string
-	CheckInterval         Duration `yaml:"check_interval"`
-	ErrorBanner           string   `yaml:"error_banner"`
-	Dump                  string
-	DumpLimitSize         uint64   `yaml:"dump_limit_size"`
-	DumpLimitWindow       Duration `yaml:"dump_limit_window"`
-	Etcd                  etcdConfig
-	EtcdStatsInterval     Duration `yaml:"etcd_stats_interval"`
-	LogStatsInterval      Duration `yaml:"log_stats_interval"`
-	BgCommand             string   `yaml:"bg_command"`
-	SSH                   sshConfig
-	TranslateCommands     map[string]*TranslateCommandConfig `yaml:"translate_commands"`
-	Environment           map[string]string
-	Service               string
-	Dest                  []string
-	RouteSelect           string `yaml:"route_select"`
-	Mode                  string
-	ForceCommand          string `yaml:"force_command"`
-	CommandMustMatch      bool   `yaml:"command_must_match"`
-	EtcdKeyTTL            int64  `yaml:"etcd_keyttl"`
-	MaxConnectionsPerUser int    `yaml:"max_connections_per_user"`
-	Overrides             []subConfig
+	ready                        bool   // true when the configuration has already been loaded
+	etcdConfigErr                error  // error while loading the configuration from etcd
+	Nodeset                      string `yaml:"-"`
+	Debug                        bool
+	Log                          string
+	LogMode                      string   `yaml:"log_mode"`
+	LogFormat                    string   `yaml:"log_format"`
+	CheckInterval                Duration `yaml:"check_interval"`
+	ConnectTimeout               Duration `yaml:"connect_timeout"`
+	CheckCommand                 string   `yaml:"check_command"`
+	CheckCommandTimeout          Duration `yaml:"check_command_timeout"`
+	HostWriteInterval            Duration `yaml:"host_write_interval"`
+	ParentCheckInterval          Duration `yaml:"parent_check_interval"`
+	ErrorBanner                  string   `yaml:"error_banner"`
+	Dump                         string
+	DumpMode                     string   `yaml:"dump_mode"`
+	DumpCompress                 string   `yaml:"dump_compress"`
+	DumpLimitSize                uint64   `yaml:"dump_limit_size"`
+	DumpLimitWindow              Duration `yaml:"dump_limit_window"`
+	DumpUserQuota                uint64   `yaml:"dump_user_quota"`
+	BandwidthLimit               int      `yaml:"bandwidth_limit"`
+	Etcd                         etcdConfig
+	ConfigFromEtcd               string     `yaml:"config_from_etcd"`
+	EtcdStatsInterval            Duration   `yaml:"etcd_stats_interval"`
+	LogStatsInterval             Duration   `yaml:"log_stats_interval"`
+	BgCommand                    string     `yaml:"bg_command"`
+	BlockingCommand              StringList `yaml:"blocking_command"`
+	BlockingCommandRetries       int        `yaml:"blocking_command_retries"`
+	BlockingCommandRetryInterval Duration   `yaml:"blocking_command_retry_interval"`
+	BlockingCommandRetryCodes    []int      `yaml:"blocking_command_retry_codes"`
+	BlockingCommandTimeout       Duration   `yaml:"blocking_command_timeout"`
+	BlockingCommandDestOverride  bool       `yaml:"blocking_command_dest_override"`
+	SSH                          sshConfig
+	Nice                         map[string]int
+	IONice                       map[string]string `yaml:"ionice"`
+	DestRewrite                  map[string]string `yaml:"dest_rewrite"`
+	Cgroup                       string
+	PrometheusPushgateway        string                             `yaml:"prometheus_pushgateway"`
+	OtelEndpoint                 string                             `yaml:"otel_endpoint"`
+	TranslateCommands            map[string]*TranslateCommandConfig `yaml:"translate_commands"`
+	Environment                  map[string]string
+	Service                      string
+	Dest                         []string
+	DestWeights                  []int               `yaml:"-"` // weight of each destination, parallel to Dest
+	CommandAllowRegexps          []*regexp.Regexp    `yaml:"-"` // compiled command_allow
+	CommandDenyRegexps           []*regexp.Regexp    `yaml:"-"` // compiled command_deny
+	InsecureAllowEmptyDest       bool                `yaml:"insecure_allow_empty_dest"`
+	DefaultDestPort              int                 `yaml:"default_dest_port"`
+	RouteSelect                  string              `yaml:"route_select"`
+	RouteExternal                ExternalRouteConfig `yaml:"route_external"`
+	Mode                         string
+	MaxProbes                    int            `yaml:"max_probes"`
+	StickySourcePrefix           int            `yaml:"sticky_source_prefix"`
+	StickySourcePrefix6          int            `yaml:"sticky_source_prefix6"`
+	AvailableStates              []string       `yaml:"available_states"`
+	ForceCommand                 string         `yaml:"force_command"`
+	CommandMustMatch             bool           `yaml:"command_must_match"`
+	ForceTTY                     string         `yaml:"force_tty"`
+	EtcdKeyTTL                   int64          `yaml:"etcd_keyttl"`
+	EtcdNamespace                string         `yaml:"etcd_namespace"`
+	MaxConnectionsPerUser        int            `yaml:"max_connections_per_user"`
+	MaxConnectionsPerHost        int            `yaml:"max_connections_per_host"`
+	ConnectionLimitWarnRatio     float64        `yaml:"connection_limit_warn_ratio"`
+	MaxTransfersPerUser          int            `yaml:"max_transfers_per_user"`
+	MaxConnectionsPerMinute      int            `yaml:"max_connections_per_minute"`
+	MaxConnectionsPerUserPct     int            `yaml:"max_connections_per_user_pct"`
+	MaxConnectionsPerGroup       map[string]int `yaml:"max_connections_per_group"`
+	MaxConnectionsPerSource      int            `yaml:"max_connections_per_source"`
+	DedupWindow                  Duration       `yaml:"dedup_window"`
+	ConnectionLimitExemptUsers   []string       `yaml:"connection_limit_exempt_users"`
+	ConnectionLimitExemptGroups  []string       `yaml:"connection_limit_exempt_groups"`
+	ConnectionLimitExemptSources []string       `yaml:"connection_limit_exempt_sources"`
+	SourceAllow                  []string       `yaml:"source_allow"`
+	SourceDeny                   []string       `yaml:"source_deny"`
+	CommandAllow                 []string       `yaml:"command_allow"`
+	CommandDeny                  []string       `yaml:"command_deny"`
+	Overrides                    []subConfig
 }
 
 // TranslateCommandConfig represents the configuration of a translate_command.
@@ -76,18 +210,35 @@ type TranslateCommandConfig struct {
 	DisableDump bool `yaml:"disable_dump"`
 }
 
+// ExternalRouteConfig represents the configuration of the external
+// route_select algorithm. URL is mandatory. CacheDuration defaults to 0 (no
+// cache).
+type ExternalRouteConfig struct {
+	URL           string
+	Timeout       Duration
+	CacheDuration Duration `yaml:"cache_duration"`
+}
+
 type sshConfig struct {
-	Exe  string
-	Args []string
+	Exe             string
+	Args            []string
+	InteractiveArgs []string `yaml:"interactive_args"`
+	SFTPArgs        []string `yaml:"sftp_args"`
+	ExecArgs        []string `yaml:"exec_args"`
+	BindAddress     string   `yaml:"bind_address"`
 }
 
 type etcdConfig struct {
-	Endpoints []string
-	TLS       etcdTLSConfig
-	Username  string
-	Password  string
-	KeyTTL    int64
-	Mandatory bool
+	Endpoints      []string
+	TLS            etcdTLSConfig
+	Username       string
+	Password       string
+	PasswordFile   string
+	KeyTTL         int64
+	Prefix         string
+	Mandatory      bool
+	RequestTimeout Duration `yaml:"request_timeout"`
+	DialTimeout    Duration `yaml:"dial_timeout"`
 }
 
 type etcdTLSConfig struct {
@@ -99,29 +250,98 @@ type etcdTLSConfig struct {
 // We use interface{} instead of real type to check if the option was specified
 // or not.
 type subConfig struct {
-	Match                 []map[string][]string
-	Debug                 interface{}
-	Log                   interface{}
-	CheckInterval         interface{} `yaml:"check_interval"`
-	ErrorBanner           interface{} `yaml:"error_banner"`
-	Dump                  interface{}
-	DumpLimitSize         interface{} `yaml:"dump_limit_size"`
-	DumpLimitWindow       interface{} `yaml:"dump_limit_window"`
-	Etcd                  interface{}
-	EtcdStatsInterval     interface{} `yaml:"etcd_stats_interval"`
-	LogStatsInterval      interface{} `yaml:"log_stats_interval"`
-	BgCommand             interface{} `yaml:"bg_command"`
-	SSH                   interface{}
-	TranslateCommands     map[string]*TranslateCommandConfig `yaml:"translate_commands"`
-	Environment           map[string]string
-	Service               interface{}
-	Dest                  []string
-	RouteSelect           interface{} `yaml:"route_select"`
-	Mode                  interface{}
-	ForceCommand          interface{} `yaml:"force_command"`
-	CommandMustMatch      interface{} `yaml:"command_must_match"`
-	EtcdKeyTTL            interface{} `yaml:"etcd_keyttl"`
-	MaxConnectionsPerUser interface{} `yaml:"max_connections_per_user"`
+	Match                        []map[string][]string
+	Debug                        interface{}
+	Log                          interface{}
+	LogMode                      interface{} `yaml:"log_mode"`
+	LogFormat                    interface{} `yaml:"log_format"`
+	CheckInterval                interface{} `yaml:"check_interval"`
+	ConnectTimeout               interface{} `yaml:"connect_timeout"`
+	CheckCommand                 interface{} `yaml:"check_command"`
+	CheckCommandTimeout          interface{} `yaml:"check_command_timeout"`
+	HostWriteInterval            interface{} `yaml:"host_write_interval"`
+	ParentCheckInterval          interface{} `yaml:"parent_check_interval"`
+	ErrorBanner                  interface{} `yaml:"error_banner"`
+	Dump                         interface{}
+	DumpMode                     interface{} `yaml:"dump_mode"`
+	DumpCompress                 interface{} `yaml:"dump_compress"`
+	DumpLimitSize                interface{} `yaml:"dump_limit_size"`
+	DumpLimitWindow              interface{} `yaml:"dump_limit_window"`
+	DumpUserQuota                interface{} `yaml:"dump_user_quota"`
+	BandwidthLimit               interface{} `yaml:"bandwidth_limit"`
+	Etcd                         interface{}
+	EtcdStatsInterval            interface{} `yaml:"etcd_stats_interval"`
+	LogStatsInterval             interface{} `yaml:"log_stats_interval"`
+	BgCommand                    interface{} `yaml:"bg_command"`
+	BlockingCommand              *StringList `yaml:"blocking_command"`
+	BlockingCommandRetries       interface{} `yaml:"blocking_command_retries"`
+	BlockingCommandRetryInterval interface{} `yaml:"blocking_command_retry_interval"`
+	BlockingCommandRetryCodes    []int       `yaml:"blocking_command_retry_codes"`
+	BlockingCommandTimeout       interface{} `yaml:"blocking_command_timeout"`
+	BlockingCommandDestOverride  interface{} `yaml:"blocking_command_dest_override"`
+	SSH                          *sshConfig
+	Nice                         map[string]int
+	IONice                       map[string]string `yaml:"ionice"`
+	DestRewrite                  map[string]string `yaml:"dest_rewrite"`
+	Cgroup                       interface{}
+	PrometheusPushgateway        interface{}                        `yaml:"prometheus_pushgateway"`
+	OtelEndpoint                 interface{}                        `yaml:"otel_endpoint"`
+	TranslateCommands            map[string]*TranslateCommandConfig `yaml:"translate_commands"`
+	Environment                  map[string]string
+	Service                      interface{}
+	Dest                         []string
+	InsecureAllowEmptyDest       interface{}          `yaml:"insecure_allow_empty_dest"`
+	DefaultDestPort              interface{}          `yaml:"default_dest_port"`
+	RouteSelect                  interface{}          `yaml:"route_select"`
+	RouteExternal                *ExternalRouteConfig `yaml:"route_external"`
+	Mode                         interface{}
+	MaxProbes                    interface{}    `yaml:"max_probes"`
+	StickySourcePrefix           interface{}    `yaml:"sticky_source_prefix"`
+	StickySourcePrefix6          interface{}    `yaml:"sticky_source_prefix6"`
+	AvailableStates              []string       `yaml:"available_states"`
+	ForceCommand                 interface{}    `yaml:"force_command"`
+	CommandMustMatch             interface{}    `yaml:"command_must_match"`
+	ForceTTY                     interface{}    `yaml:"force_tty"`
+	EtcdKeyTTL                   interface{}    `yaml:"etcd_keyttl"`
+	EtcdNamespace                interface{}    `yaml:"etcd_namespace"`
+	MaxConnectionsPerUser        interface{}    `yaml:"max_connections_per_user"`
+	MaxConnectionsPerHost        interface{}    `yaml:"max_connections_per_host"`
+	ConnectionLimitWarnRatio     interface{}    `yaml:"connection_limit_warn_ratio"`
+	MaxTransfersPerUser          interface{}    `yaml:"max_transfers_per_user"`
+	MaxConnectionsPerMinute      interface{}    `yaml:"max_connections_per_minute"`
+	MaxConnectionsPerUserPct     interface{}    `yaml:"max_connections_per_user_pct"`
+	MaxConnectionsPerGroup       map[string]int `yaml:"max_connections_per_group"`
+	MaxConnectionsPerSource      interface{}    `yaml:"max_connections_per_source"`
+	DedupWindow                  interface{}    `yaml:"dedup_window"`
+	ConnectionLimitExemptUsers   []string       `yaml:"connection_limit_exempt_users"`
+	ConnectionLimitExemptGroups  []string       `yaml:"connection_limit_exempt_groups"`
+	ConnectionLimitExemptSources []string       `yaml:"connection_limit_exempt_sources"`
+	SourceAllow                  []string       `yaml:"source_allow"`
+	SourceDeny                   []string       `yaml:"source_deny"`
+	CommandAllow                 []string       `yaml:"command_allow"`
+	CommandDeny                  []string       `yaml:"command_deny"`
+}
+
+// FileModes returns the list of valid values of the log_mode and dump_mode
+// options.
+func FileModes() []string {
+	return append([]string{}, fileModes...)
+}
+
+// LogFormats returns the list of valid values of the log_format option.
+func LogFormats() []string {
+	return append([]string{}, logFormats...)
+}
+
+// DumpCompressions returns the list of valid values of the dump_compress
+// option.
+func DumpCompressions() []string {
+	return append([]string{}, dumpCompressions...)
+}
+
+// ForceTTYModes returns the list of valid values of the force_tty option.
+func ForceTTYModes() []string {
+	return append([]string{}, forceTTYModes...)
 }
 
 // Return slice of strings containing formatted configuration values
@@ -130,28 +350,77 @@ func PrintConfig(config *Config, groups map[string]bool) []string {
 	output = append(output, fmt.Sprintf("groups = %v", groups))
 	output = append(output, fmt.Sprintf("config.debug = %v", config.Debug))
 	output = append(output, fmt.Sprintf("config.log = %s", config.Log))
+	output = append(output, fmt.Sprintf("config.log_mode = %s", config.LogMode))
+	output = append(output, fmt.Sprintf("config.log_format = %s", config.LogFormat))
 	output = append(output, fmt.Sprintf("config.check_interval = %s", config.CheckInterval.Duration()))
+	output = append(output, fmt.Sprintf("config.connect_timeout = %s", config.ConnectTimeout.Duration()))
+	output = append(output, fmt.Sprintf("config.check_command = %s", config.CheckCommand))
+	output = append(output, fmt.Sprintf("config.check_command_timeout = %s", config.CheckCommandTimeout.Duration()))
+	output = append(output, fmt.Sprintf("config.host_write_interval = %s", config.HostWriteInterval.Duration()))
+	output = append(output, fmt.Sprintf("config.parent_check_interval = %s", config.ParentCheckInterval.Duration()))
 	output = append(output, fmt.Sprintf("config.error_banner = %s", config.ErrorBanner))
 	output = append(output, fmt.Sprintf("config.dump = %s", config.Dump))
+	output = append(output, fmt.Sprintf("config.dump_mode = %s", config.DumpMode))
+	output = append(output, fmt.Sprintf("config.dump_compress = %s", config.DumpCompress))
 	output = append(output, fmt.Sprintf("config.dump_limit_size = %d", config.DumpLimitSize))
 	output = append(output, fmt.Sprintf("config.dump_limit_window = %s", config.DumpLimitWindow.Duration()))
+	output = append(output, fmt.Sprintf("config.dump_user_quota = %d", config.DumpUserQuota))
+	output = append(output, fmt.Sprintf("config.bandwidth_limit = %d", config.BandwidthLimit))
 	output = append(output, fmt.Sprintf("config.etcd = %+v", config.Etcd))
+	output = append(output, fmt.Sprintf("config.config_from_etcd = %s", config.ConfigFromEtcd))
 	output = append(output, fmt.Sprintf("config.etcd_stats_interval = %s", config.EtcdStatsInterval.Duration()))
 	output = append(output, fmt.Sprintf("config.log_stats_interval = %s", config.LogStatsInterval.Duration()))
 	output = append(output, fmt.Sprintf("config.bg_command = %s", config.BgCommand))
+	output = append(output, fmt.Sprintf("config.blocking_command = %q", config.BlockingCommand))
+	output = append(output, fmt.Sprintf("config.blocking_command_retries = %d", config.BlockingCommandRetries))
+	output = append(output, fmt.Sprintf("config.blocking_command_retry_interval = %s", config.BlockingCommandRetryInterval.Duration()))
+	output = append(output, fmt.Sprintf("config.blocking_command_retry_codes = %v", config.BlockingCommandRetryCodes))
+	output = append(output, fmt.Sprintf("config.blocking_command_timeout = %s", config.BlockingCommandTimeout.Duration()))
+	output = append(output, fmt.Sprintf("config.blocking_command_dest_override = %v", config.BlockingCommandDestOverride))
 	output = append(output, fmt.Sprintf("config.ssh = %+v", config.SSH))
+	output = append(output, fmt.Sprintf("config.nice = %v", config.Nice))
+	output = append(output, fmt.Sprintf("config.ionice = %v", config.IONice))
+	output = append(output, fmt.Sprintf("config.dest_rewrite = %v", config.DestRewrite))
+	output = append(output, fmt.Sprintf("config.cgroup = %s", config.Cgroup))
+	output = append(output, fmt.Sprintf("config.prometheus_pushgateway = %s", config.PrometheusPushgateway))
+	output = append(output, fmt.Sprintf("config.otel_endpoint = %s", config.OtelEndpoint))
 	for k, v := range config.TranslateCommands {
 		output = append(output, fmt.Sprintf("config.TranslateCommands.%s = %+v", k, v))
 	}
 	output = append(output, fmt.Sprintf("config.environment = %v", config.Environment))
 	output = append(output, fmt.Sprintf("config.service = %s", config.Service))
 	output = append(output, fmt.Sprintf("config.dest = %v", config.Dest))
+	output = append(output, fmt.Sprintf("config.dest_weights = %v", config.DestWeights))
+	output = append(output, fmt.Sprintf("config.insecure_allow_empty_dest = %v", config.InsecureAllowEmptyDest))
+	output = append(output, fmt.Sprintf("config.default_dest_port = %d", config.DefaultDestPort))
 	output = append(output, fmt.Sprintf("config.route_select = %s", config.RouteSelect))
+	output = append(output, fmt.Sprintf("config.route_external = %+v", config.RouteExternal))
 	output = append(output, fmt.Sprintf("config.mode = %s", config.Mode))
+	output = append(output, fmt.Sprintf("config.max_probes = %d", config.MaxProbes))
+	output = append(output, fmt.Sprintf("config.sticky_source_prefix = %d", config.StickySourcePrefix))
+	output = append(output, fmt.Sprintf("config.sticky_source_prefix6 = %d", config.StickySourcePrefix6))
+	output = append(output, fmt.Sprintf("config.available_states = %v", config.AvailableStates))
 	output = append(output, fmt.Sprintf("config.force_command = %s", config.ForceCommand))
 	output = append(output, fmt.Sprintf("config.command_must_match = %v", config.CommandMustMatch))
+	output = append(output, fmt.Sprintf("config.force_tty = %s", config.ForceTTY))
 	output = append(output, fmt.Sprintf("config.etcd_keyttl = %d", config.EtcdKeyTTL))
+	output = append(output, fmt.Sprintf("config.etcd_namespace = %s", config.EtcdNamespace))
 	output = append(output, fmt.Sprintf("config.max_connections_per_user = %d", config.MaxConnectionsPerUser))
+	output = append(output, fmt.Sprintf("config.max_connections_per_host = %d", config.MaxConnectionsPerHost))
+	output = append(output, fmt.Sprintf("config.connection_limit_warn_ratio = %g", config.ConnectionLimitWarnRatio))
+	output = append(output, fmt.Sprintf("config.max_transfers_per_user = %d", config.MaxTransfersPerUser))
+	output = append(output, fmt.Sprintf("config.max_connections_per_minute = %d", config.MaxConnectionsPerMinute))
+	output = append(output, fmt.Sprintf("config.max_connections_per_user_pct = %d", config.MaxConnectionsPerUserPct))
+	output = append(output, fmt.Sprintf("config.max_connections_per_group = %v", config.MaxConnectionsPerGroup))
+	output = append(output, fmt.Sprintf("config.max_connections_per_source = %d", config.MaxConnectionsPerSource))
+	output = append(output, fmt.Sprintf("config.dedup_window = %s", config.DedupWindow.Duration()))
+	output = append(output, fmt.Sprintf("config.connection_limit_exempt_users = %v", config.ConnectionLimitExemptUsers))
+	output = append(output, fmt.Sprintf("config.connection_limit_exempt_groups = %v", config.ConnectionLimitExemptGroups))
+	output = append(output, fmt.Sprintf("config.connection_limit_exempt_sources = %v", config.ConnectionLimitExemptSources))
+	output = append(output, fmt.Sprintf("config.source_allow = %v", config.SourceAllow))
+	output = append(output, fmt.Sprintf("config.source_deny = %v", config.SourceDeny))
+	output = append(output, fmt.Sprintf("config.command_allow = %q", config.CommandAllow))
+	output = append(output, fmt.Sprintf("config.command_deny = %q", config.CommandDeny))
 	return output
 }
 
@@ -164,6 +433,14 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		config.Log = subconfig.Log.(string)
 	}
 
+	if subconfig.LogMode != nil {
+		config.LogMode = subconfig.LogMode.(string)
+	}
+
+	if subconfig.LogFormat != nil {
+		config.LogFormat = subconfig.LogFormat.(string)
+	}
+
 	if subconfig.CheckInterval != nil {
 		var err error
 		config.CheckInterval, err = ParseDuration(subconfig.CheckInterval.(string))
@@ -172,6 +449,42 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		}
 	}
 
+	if subconfig.ConnectTimeout != nil {
+		var err error
+		config.ConnectTimeout, err = ParseDuration(subconfig.ConnectTimeout.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if subconfig.CheckCommand != nil {
+		config.CheckCommand = subconfig.CheckCommand.(string)
+	}
+
+	if subconfig.CheckCommandTimeout != nil {
+		var err error
+		config.CheckCommandTimeout, err = ParseDuration(subconfig.CheckCommandTimeout.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if subconfig.HostWriteInterval != nil {
+		var err error
+		config.HostWriteInterval, err = ParseDuration(subconfig.HostWriteInterval.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if subconfig.ParentCheckInterval != nil {
+		var err error
+		config.ParentCheckInterval, err = ParseDuration(subconfig.ParentCheckInterval.(string))
+		if err != nil {
+			return err
+		}
+	}
+
 	if subconfig.ErrorBanner != nil {
 		config.ErrorBanner = subconfig.ErrorBanner.(string)
 	}
@@ -180,6 +493,14 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		config.Dump = subconfig.Dump.(string)
 	}
 
+	if subconfig.DumpMode != nil {
+		config.DumpMode = subconfig.DumpMode.(string)
+	}
+
+	if subconfig.DumpCompress != nil {
+		config.DumpCompress = subconfig.DumpCompress.(string)
+	}
+
 	if subconfig.DumpLimitSize != nil {
 		config.DumpLimitSize = uint64(subconfig.DumpLimitSize.(int))
 	}
@@ -192,6 +513,14 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		}
 	}
 
+	if subconfig.DumpUserQuota != nil {
+		config.DumpUserQuota = uint64(subconfig.DumpUserQuota.(int))
+	}
+
+	if subconfig.BandwidthLimit != nil {
+		config.BandwidthLimit = subconfig.BandwidthLimit.(int)
+	}
+
 	if subconfig.Etcd != nil {
 		config.Etcd = subconfig.Etcd.(etcdConfig)
 	}
@@ -216,8 +545,66 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		config.BgCommand = subconfig.BgCommand.(string)
 	}
 
+	if subconfig.BlockingCommand != nil {
+		config.BlockingCommand = *subconfig.BlockingCommand
+	}
+
+	if subconfig.BlockingCommandRetries != nil {
+		config.BlockingCommandRetries = subconfig.BlockingCommandRetries.(int)
+	}
+
+	if subconfig.BlockingCommandRetryInterval != nil {
+		var err error
+		config.BlockingCommandRetryInterval, err = ParseDuration(subconfig.BlockingCommandRetryInterval.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(subconfig.BlockingCommandRetryCodes) > 0 {
+		config.BlockingCommandRetryCodes = subconfig.BlockingCommandRetryCodes
+	}
+
+	if subconfig.BlockingCommandTimeout != nil {
+		var err error
+		config.BlockingCommandTimeout, err = ParseDuration(subconfig.BlockingCommandTimeout.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if subconfig.BlockingCommandDestOverride != nil {
+		config.BlockingCommandDestOverride = subconfig.BlockingCommandDestOverride.(bool)
+	}
+
 	if subconfig.SSH != nil {
-		config.SSH = subconfig.SSH.(sshConfig)
+		config.SSH = *subconfig.SSH
+	}
+
+	// merge nice
+	for k, v := range subconfig.Nice {
+		config.Nice[k] = v
+	}
+
+	// merge ionice
+	for k, v := range subconfig.IONice {
+		config.IONice[k] = v
+	}
+
+	for k, v := range subconfig.DestRewrite {
+		config.DestRewrite[k] = v
+	}
+
+	if subconfig.Cgroup != nil {
+		config.Cgroup = subconfig.Cgroup.(string)
+	}
+
+	if subconfig.PrometheusPushgateway != nil {
+		config.PrometheusPushgateway = subconfig.PrometheusPushgateway.(string)
+	}
+
+	if subconfig.OtelEndpoint != nil {
+		config.OtelEndpoint = subconfig.OtelEndpoint.(string)
 	}
 
 	// merge translate_commands
@@ -238,14 +625,42 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		config.Dest = subconfig.Dest
 	}
 
+	if subconfig.InsecureAllowEmptyDest != nil {
+		config.InsecureAllowEmptyDest = subconfig.InsecureAllowEmptyDest.(bool)
+	}
+
+	if subconfig.DefaultDestPort != nil {
+		config.DefaultDestPort = subconfig.DefaultDestPort.(int)
+	}
+
 	if subconfig.RouteSelect != nil {
 		config.RouteSelect = subconfig.RouteSelect.(string)
 	}
 
+	if subconfig.RouteExternal != nil {
+		config.RouteExternal = *subconfig.RouteExternal
+	}
+
 	if subconfig.Mode != nil {
 		config.Mode = subconfig.Mode.(string)
 	}
 
+	if subconfig.MaxProbes != nil {
+		config.MaxProbes = subconfig.MaxProbes.(int)
+	}
+
+	if subconfig.StickySourcePrefix != nil {
+		config.StickySourcePrefix = subconfig.StickySourcePrefix.(int)
+	}
+
+	if subconfig.StickySourcePrefix6 != nil {
+		config.StickySourcePrefix6 = subconfig.StickySourcePrefix6.(int)
+	}
+
+	if len(subconfig.AvailableStates) > 0 {
+		config.AvailableStates = subconfig.AvailableStates
+	}
+
 	if subconfig.ForceCommand != nil {
 		config.ForceCommand = subconfig.ForceCommand.(string)
 	}
@@ -254,14 +669,93 @@ func parseSubConfig(config *Config, subconfig *subConfig) error {
 		config.CommandMustMatch = subconfig.CommandMustMatch.(bool)
 	}
 
+	if subconfig.ForceTTY != nil {
+		config.ForceTTY = subconfig.ForceTTY.(string)
+	}
+
 	if subconfig.EtcdKeyTTL != nil {
 		config.EtcdKeyTTL = int64(subconfig.EtcdKeyTTL.(int))
 	}
 
+	if subconfig.EtcdNamespace != nil {
+		config.EtcdNamespace = subconfig.EtcdNamespace.(string)
+	}
+
 	if subconfig.MaxConnectionsPerUser != nil {
 		config.MaxConnectionsPerUser = subconfig.MaxConnectionsPerUser.(int)
 	}
 
+	if subconfig.MaxConnectionsPerHost != nil {
+		config.MaxConnectionsPerHost = subconfig.MaxConnectionsPerHost.(int)
+	}
+
+	if subconfig.ConnectionLimitWarnRatio != nil {
+		// an integer ratio (0 or 1) is decoded as an int
+		switch ratio := subconfig.ConnectionLimitWarnRatio.(type) {
+		case int:
+			config.ConnectionLimitWarnRatio = float64(ratio)
+		default:
+			config.ConnectionLimitWarnRatio = ratio.(float64)
+		}
+	}
+
+	if subconfig.MaxTransfersPerUser != nil {
+		config.MaxTransfersPerUser = subconfig.MaxTransfersPerUser.(int)
+	}
+
+	if subconfig.MaxConnectionsPerMinute != nil {
+		config.MaxConnectionsPerMinute = subconfig.MaxConnectionsPerMinute.(int)
+	}
+
+	if subconfig.MaxConnectionsPerUserPct != nil {
+		config.MaxConnectionsPerUserPct = subconfig.MaxConnectionsPerUserPct.(int)
+	}
+
+	// merge max_connections_per_group
+	for k, v := range subconfig.MaxConnectionsPerGroup {
+		config.MaxConnectionsPerGroup[k] = v
+	}
+
+	if subconfig.MaxConnectionsPerSource != nil {
+		config.MaxConnectionsPerSource = subconfig.MaxConnectionsPerSource.(int)
+	}
+
+	if subconfig.DedupWindow != nil {
+		var err error
+		config.DedupWindow, err = ParseDuration(subconfig.DedupWindow.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(subconfig.ConnectionLimitExemptUsers) > 0 {
+		config.ConnectionLimitExemptUsers = subconfig.ConnectionLimitExemptUsers
+	}
+
+	if len(subconfig.ConnectionLimitExemptGroups) > 0 {
+		config.ConnectionLimitExemptGroups = subconfig.ConnectionLimitExemptGroups
+	}
+
+	if len(subconfig.ConnectionLimitExemptSources) > 0 {
+		config.ConnectionLimitExemptSources = subconfig.ConnectionLimitExemptSources
+	}
+
+	if len(subconfig.SourceAllow) > 0 {
+		config.SourceAllow = subconfig.SourceAllow
+	}
+
+	if len(subconfig.SourceDeny) > 0 {
+		config.SourceDeny = subconfig.SourceDeny
+	}
+
+	if len(subconfig.CommandAllow) > 0 {
+		config.CommandAllow = subconfig.CommandAllow
+	}
+
+	if len(subconfig.CommandDeny) > 0 {
+		config.CommandDeny = subconfig.CommandDeny
+	}
+
 	return nil
 }
 
@@ -274,27 +768,40 @@ func replace(src string, replacer *patternReplacer) string {
 	return replacer.Regexp.ReplaceAllString(src, replacer.Text)
 }
 
-// LoadConfig load configuration file and adapt it according to specified user/group/sshdHostPort.
-func LoadConfig(filename, currentUsername, sid string, start time.Time, groups map[string]bool, sshdHostPort string) (*Config, error) {
-	if cachedConfig.ready {
-		return &cachedConfig, nil
+// ResetConfigCache forgets the configuration cached by LoadConfig, so the next
+// call to LoadConfig reads the configuration file again. It is used to load
+// the configurations of several users in the same process.
+func ResetConfigCache() {
+	cachedConfig = Config{}
+}
+
+// ReloadConfig reads the configuration file again, bypassing the
+// configuration cached by LoadConfig, and caches the new one. If the new
+// configuration cannot be loaded, an error is returned and the previous one
+// is kept in the cache. As LoadConfig, it returns a pointer to the cached
+// configuration: the configuration previously returned is updated too.
+func ReloadConfig(filename, currentUsername, sid string, start time.Time, groups map[string]bool, sshdHostPort string, env map[string]string) (*Config, error) {
+	previous := cachedConfig
+	ResetConfigCache()
+	config, err := LoadConfig(filename, currentUsername, sid, start, groups, sshdHostPort, env)
+	if err != nil {
+		cachedConfig = previous
+		return nil, err
 	}
+	return config, nil
+}
 
-	patterns := map[string]*patternReplacer{
-		"{user}": {regexp.MustCompile(`{user}`), currentUsername},
-		"{sid}":  {regexp.MustCompile(`{sid}`), sid},
-		"{time}": {regexp.MustCompile(`{time}`), start.Format(time.RFC3339Nano)},
+// LoadConfig load configuration file and adapt it according to specified user/group/sshdHostPort/environment.
+func LoadConfig(filename, currentUsername, sid string, start time.Time, groups map[string]bool, sshdHostPort string, env map[string]string) (*Config, error) {
+	if cachedConfig.ready {
+		return &cachedConfig, nil
 	}
 
-	yamlFile, err := os.ReadFile(filename)
+	err := readConfig(filename, &cachedConfig)
 	if err != nil {
 		return nil, err
 	}
-
-	// if no environment is defined in cachedConfig it seems to not be allocated
-	cachedConfig.Environment = make(map[string]string)
-
-	if err := yaml.Unmarshal(yamlFile, &cachedConfig); err != nil {
+	if err := checkOverrides(&cachedConfig); err != nil {
 		return nil, err
 	}
 
@@ -302,8 +809,7 @@ func LoadConfig(filename, currentUsername, sid string, start time.Time, groups m
 		for _, conditions := range override.Match {
 			match := true
 			for cType, cValue := range conditions {
-				// other cType can be defined as needed. For example
-				// environment variables could be useful matches
+				// other cType can be defined as needed
 				if cType == "users" {
 					match = slices.Contains(cValue, currentUsername)
 				} else if cType == "groups" {
@@ -332,6 +838,16 @@ func LoadConfig(filename, currentUsername, sid string, start time.Time, groups m
 							}
 						}
 					}
+				} else if cType == "env" {
+					match = false
+					for _, variable := range cValue {
+						if matchEnv(variable, env) {
+							// no need to go further as match is true and
+							// we're in an "or" statement
+							match = true
+							break
+						}
+					}
 				}
 				if !match {
 					// no need to go further as match is false and we're in an
@@ -350,75 +866,676 @@ func LoadConfig(filename, currentUsername, sid string, start time.Time, groups m
 		}
 	}
 
-	if cachedConfig.Service == "" {
-		cachedConfig.Service = defaultService
+	if err := setDefaults(&cachedConfig, newPatterns(currentUsername, sid, start)); err != nil {
+		return nil, err
+	}
+
+	cachedConfig.ready = true
+	return &cachedConfig, nil
+}
+
+// matchEnv checks if the environment env has a variable KEY with the value
+// VAL when variable is of the form "KEY=VAL", or has a variable KEY (whatever
+// its value) when variable is of the form "KEY".
+func matchEnv(variable string, env map[string]string) bool {
+	key, value, hasValue := strings.Cut(variable, "=")
+	actual, present := env[key]
+	return present && (!hasValue || actual == value)
+}
+
+// EnvironMap returns the environment environ (a list of "KEY=VAL" strings,
+// as returned by os.Environ) as a map.
+func EnvironMap(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, variable := range environ {
+		if key, value, ok := strings.Cut(variable, "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// newPatterns returns the patterns which can be used in the configuration.
+func newPatterns(currentUsername, sid string, start time.Time) map[string]*patternReplacer {
+	return map[string]*patternReplacer{
+		"{user}": {regexp.MustCompile(`{user}`), currentUsername},
+		"{sid}":  {regexp.MustCompile(`{sid}`), sid},
+		"{time}": {regexp.MustCompile(`{time}`), start.Format(time.RFC3339Nano)},
+	}
+}
+
+// readConfig reads the configuration file filename in config, without
+// applying the overrides.
+func readConfig(filename string, config *Config) error {
+	yamlFile, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// if no environment is defined in config it seems to not be allocated
+	config.Environment = make(map[string]string)
+	config.Nice = make(map[string]int)
+	config.IONice = make(map[string]string)
+	config.DestRewrite = make(map[string]string)
+	config.MaxConnectionsPerGroup = make(map[string]int)
+
+	if err := yaml.Unmarshal(yamlFile, config); err != nil {
+		return err
+	}
+	if config.ConfigFromEtcd == "" {
+		return nil
+	}
+
+	// the configuration stored in etcd is applied over the local one, which
+	// is used alone if etcd cannot be read
+	content, err := readEtcdConfig(config)
+	if err != nil {
+		config.etcdConfigErr = fmt.Errorf("loading the configuration from etcd key %s: %v", config.ConfigFromEtcd, err)
+		return nil
+	}
+	// a configuration which cannot be parsed must not reject all the
+	// connections, nor be partially applied
+	if err := yaml.Unmarshal(content, &Config{}); err != nil {
+		config.etcdConfigErr = fmt.Errorf("parsing the configuration from etcd key %s: %v", config.ConfigFromEtcd, err)
+		return nil
+	}
+	return yaml.Unmarshal(content, config)
+}
+
+// readEtcdConfig returns the configuration stored in etcd at the key given by
+// the config_from_etcd option, using the etcd options of config. The
+// connection to etcd is kept to be reused (see NewEtcdClient).
+func readEtcdConfig(config *Config) ([]byte, error) {
+	entry, present := etcdConfigs[config.ConfigFromEtcd]
+	if !present {
+		entry = &etcdConfigEntry{}
+		var cli *Client
+		cli, entry.err = NewEtcdClient(config, nil)
+		if entry.err == nil {
+			entry.content, entry.err = cli.GetConfig(config.ConfigFromEtcd)
+			keepBootstrapClient(config, cli.cli)
+		}
+		etcdConfigs[config.ConfigFromEtcd] = entry
+	}
+	return entry.content, entry.err
+}
+
+// EtcdConfigError returns the error which occurred while loading the
+// configuration from etcd (see the config_from_etcd option), in which case
+// only the local configuration file is used.
+func (config *Config) EtcdConfigError() error {
+	return config.etcdConfigErr
+}
+
+// splitDestWeight splits a destination with an optional weight (e.g.
+// "server[1-4]:22*3") into the destination and its weight, 1 by default.
+func splitDestWeight(dst string) (string, int, error) {
+	dest, weight, found := strings.Cut(dst, "*")
+	if !found {
+		return dst, 1, nil
+	}
+	w, err := strconv.Atoi(weight)
+	if err != nil || w <= 0 {
+		return dst, 0, fmt.Errorf("the weight must be a positive integer")
+	}
+	return dest, w, nil
+}
+
+// isIPv6Dest returns true if the destination dst is an IPv6 address in
+// brackets, with an optional port (e.g. "[2001:db8::1]" or
+// "[2001:db8::1]:22").
+func isIPv6Dest(dst string) bool {
+	if !strings.HasPrefix(dst, "[") {
+		return false
+	}
+	addr, rest, found := strings.Cut(dst[1:], "]")
+	if !found || (rest != "" && !strings.HasPrefix(rest, ":")) {
+		return false
+	}
+	ip, err := netip.ParseAddr(addr)
+	return err == nil && ip.Is6()
+}
+
+// LoadServicesConfigs loads the configuration of each service defined in the
+// configuration file, whatever the user: the service defined at the top level
+// and the ones defined by the overrides (without taking their match
+// conditions into account). It does not use nor modify the configuration
+// cached by LoadConfig.
+func LoadServicesConfigs(filename string) ([]*Config, error) {
+	var base Config
+	if err := readConfig(filename, &base); err != nil {
+		return nil, err
+	}
+	if err := checkOverrides(&base); err != nil {
+		return nil, err
+	}
+
+	// -1 is the top level service
+	services := []int{-1}
+	for i, override := range base.Overrides {
+		if override.Service != nil {
+			services = append(services, i)
+		}
+	}
+
+	configs := make([]*Config, 0, len(services))
+	for _, i := range services {
+		// read the file again to get a fresh copy of the configuration
+		config := &Config{}
+		if err := readConfig(filename, config); err != nil {
+			return nil, err
+		}
+		if i >= 0 {
+			if err := parseSubConfig(config, &config.Overrides[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := setDefaults(config, newPatterns("", "", time.Now())); err != nil {
+			return nil, err
+		}
+		config.ready = true
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// checkOverrides checks the options of the overrides which cannot be checked
+// once they are applied.
+func checkOverrides(config *Config) error {
+	for i, override := range config.Overrides {
+		if override.Service != nil && override.Service.(string) == "" {
+			return fmt.Errorf("invalid value for `service` option of override %d: the service name cannot be empty", i+1)
+		}
+	}
+	return nil
+}
+
+// ServicesConflicts returns a description of each service defined several
+// times (by the top level configuration or by overrides, as returned by
+// LoadServicesConfigs) with different destinations, route_select algorithms
+// or modes. It is legitimate when the overrides match distinct users or
+// groups, but otherwise the routing depends on the order of the overrides.
+func ServicesConflicts(configs []*Config) []string {
+	var conflicts []string
+	first := map[string]*Config{}
+	conflicting := map[string]bool{}
+	for _, config := range configs {
+		prev, present := first[config.Service]
+		if !present {
+			first[config.Service] = config
+			continue
+		}
+		if conflicting[config.Service] {
+			continue
+		}
+		if !slices.Equal(prev.Dest, config.Dest) || !slices.Equal(prev.DestWeights, config.DestWeights) || prev.RouteSelect != config.RouteSelect || prev.Mode != config.Mode {
+			conflicting[config.Service] = true
+			conflicts = append(conflicts, fmt.Sprintf("service '%s' is defined several times with a different routing (dest, route_select or mode)", config.Service))
+		}
+	}
+	return conflicts
+}
+
+// SourcesConflicts returns a description of each pair of overrides of the
+// configuration file filename which set different services and have
+// overlapping `sources` conditions (i.e. matching the same address and port
+// of the listening SSH daemon). The service of the last override matching a
+// connection wins, so the routing depends on the order of the overrides.
+func SourcesConflicts(filename string) ([]string, error) {
+	var config Config
+	if err := readConfig(filename, &config); err != nil {
+		return nil, err
+	}
+	if err := checkOverrides(&config); err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	for i, first := range config.Overrides {
+		if first.Service == nil {
+			continue
+		}
+		for j := i + 1; j < len(config.Overrides); j++ {
+			second := config.Overrides[j]
+			if second.Service == nil || second.Service.(string) == first.Service.(string) {
+				continue
+			}
+			source, other, err := overlappingSources(first, second)
+			if err != nil {
+				return nil, fmt.Errorf("override %d or %d: %v", i+1, j+1, err)
+			} else if source != "" {
+				conflicts = append(conflicts, fmt.Sprintf("services '%s' (override %d) and '%s' (override %d) both match the sources %s and %s: '%s' wins", first.Service, i+1, second.Service, j+1, source, other, second.Service))
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// overlappingSources returns the first source of the override first which
+// matches a source of the override second, with the matched one, or empty
+// strings if their sources do not overlap.
+func overlappingSources(first, second subConfig) (string, string, error) {
+	for _, conditions := range first.Match {
+		for _, source := range conditions["sources"] {
+			for _, otherConditions := range second.Match {
+				for _, other := range otherConditions["sources"] {
+					match, err := MatchSource(source, other)
+					if err != nil {
+						return "", "", err
+					} else if match {
+						return source, other, nil
+					}
+				}
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// UnknownConfigKeys returns a description of each key of the configuration
+// file filename which is not an option of sshproxy (e.g. a misspelled or
+// removed option), and is therefore silently ignored when loading the
+// configuration.
+func UnknownConfigKeys(filename string) ([]string, error) {
+	yamlFile, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	err = yaml.UnmarshalStrict(yamlFile, &config)
+	typeErr, ok := err.(*yaml.TypeError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	var unknown []string
+	if typeErr != nil {
+		for _, e := range typeErr.Errors {
+			if m := unknownKeyRegex.FindStringSubmatch(e); m != nil {
+				unknown = append(unknown, fmt.Sprintf("line %s: unknown key '%s'", m[1], m[2]))
+			}
+		}
+	}
+	return unknown, nil
+}
+
+// setDefaults sets the default values of the options which were not
+// specified, checks the values and replaces the patterns in the options
+// accepting them. It is called once the overrides are applied.
+func setDefaults(config *Config, patterns map[string]*patternReplacer) error {
+	if config.Service == "" {
+		config.Service = defaultService
+	}
+
+	if config.Dest == nil {
+		config.Dest = defaultDest
+	}
+
+	if config.DefaultDestPort == 0 {
+		config.DefaultDestPort, _ = strconv.Atoi(DefaultSSHPort)
+	}
+
+	if config.DefaultDestPort < 0 || config.DefaultDestPort > 65535 {
+		return fmt.Errorf("invalid value for `default_dest_port` option of service '%s': %d", config.Service, config.DefaultDestPort)
+	}
+
+	// the logical destinations are normalized like the destinations
+	rewrites := make(map[string]string, len(config.DestRewrite))
+	for logical, actual := range config.DestRewrite {
+		host, port, err := SplitHostPortWithDefault(logical, strconv.Itoa(config.DefaultDestPort))
+		if err != nil {
+			return fmt.Errorf("invalid destination '%s' in `dest_rewrite` option of service '%s': %s", logical, config.Service, err)
+		}
+		if _, _, err := SplitHostPortWithDefault(actual, ""); err != nil {
+			return fmt.Errorf("invalid value for `dest_rewrite` option of service '%s': %s", config.Service, err)
+		}
+		rewrites[net.JoinHostPort(host, port)] = actual
+	}
+	config.DestRewrite = rewrites
+
+	for _, command := range config.BlockingCommand {
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("invalid value for `blocking_command` option of service '%s': empty command", config.Service)
+		}
+	}
+
+	if config.BlockingCommandRetries < 0 {
+		return fmt.Errorf("invalid value for `blocking_command_retries` option of service '%s': %d", config.Service, config.BlockingCommandRetries)
+	}
+
+	if config.ConnectTimeout < 0 {
+		return fmt.Errorf("invalid value for `connect_timeout` option of service '%s': %s", config.Service, config.ConnectTimeout.Duration())
+	} else if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = defaultConnectTimeout
+	}
+
+	if config.CheckCommand != "" && strings.TrimSpace(config.CheckCommand) == "" {
+		return fmt.Errorf("invalid value for `check_command` option of service '%s': the command cannot be blank", config.Service)
+	}
+
+	if config.CheckCommandTimeout < 0 {
+		return fmt.Errorf("invalid value for `check_command_timeout` option of service '%s': %s", config.Service, config.CheckCommandTimeout.Duration())
+	} else if config.CheckCommandTimeout == 0 {
+		config.CheckCommandTimeout = defaultCheckCommandTimeout
+	}
+
+	if config.HostWriteInterval < 0 {
+		return fmt.Errorf("invalid value for `host_write_interval` option of service '%s': %s", config.Service, config.HostWriteInterval.Duration())
+	} else if config.CheckInterval > 0 && config.HostWriteInterval > config.CheckInterval {
+		// a host whose state was not written would be checked again at
+		// each connection, as it would seem not checked for too long
+		return fmt.Errorf("invalid value for `host_write_interval` option of service '%s': %s is greater than `check_interval`", config.Service, config.HostWriteInterval.Duration())
+	}
+
+	if config.DedupWindow < 0 {
+		return fmt.Errorf("invalid value for `dedup_window` option of service '%s': %s", config.Service, config.DedupWindow.Duration())
+	}
+
+	if config.ParentCheckInterval < 0 {
+		return fmt.Errorf("invalid value for `parent_check_interval` option of service '%s': %s", config.Service, config.ParentCheckInterval.Duration())
+	} else if config.ParentCheckInterval == 0 {
+		config.ParentCheckInterval = defaultParentCheckInterval
+	}
+
+	if config.BlockingCommandRetryInterval == 0 {
+		config.BlockingCommandRetryInterval = defaultBlockingCommandRetryInterval
+	}
+
+	if config.BlockingCommandTimeout < 0 {
+		return fmt.Errorf("invalid value for `blocking_command_timeout` option of service '%s': %s", config.Service, config.BlockingCommandTimeout.Duration())
+	} else if config.BlockingCommandTimeout == 0 {
+		config.BlockingCommandTimeout = defaultBlockingCommandTimeout
+	}
+
+	for kind, nice := range config.Nice {
+		if !slices.Contains(sessionKinds, kind) {
+			return fmt.Errorf("invalid session kind in `nice` option of service '%s': %s", config.Service, kind)
+		}
+		if nice < -20 || nice > 19 {
+			return fmt.Errorf("invalid value for `nice` option of service '%s': %d", config.Service, nice)
+		}
+	}
+
+	for kind, ioprio := range config.IONice {
+		if !slices.Contains(sessionKinds, kind) {
+			return fmt.Errorf("invalid session kind in `ionice` option of service '%s': %s", config.Service, kind)
+		}
+		if _, _, err := ParseIOPriority(ioprio); err != nil {
+			return fmt.Errorf("invalid value for `ionice` option of service '%s': %s", config.Service, err)
+		}
+	}
+
+	if config.SSH.Exe == "" {
+		config.SSH.Exe = defaultSSHExe
+	}
+
+	if config.SSH.Args == nil {
+		config.SSH.Args = defaultSSHArgs
+	}
+
+	if config.SSH.BindAddress != "" && net.ParseIP(config.SSH.BindAddress) == nil {
+		return fmt.Errorf("invalid value for `ssh.bind_address` option of service '%s': %s is not an IP address", config.Service, config.SSH.BindAddress)
+	}
+
+	if config.RouteSelect == "" {
+		config.RouteSelect = defaultAlgorithm
+	}
+
+	if !IsRouteAlgorithm(config.RouteSelect) {
+		return fmt.Errorf("invalid value for `route_select` option of service '%s': %s", config.Service, config.RouteSelect)
+	}
+
+	if config.RouteSelect == "external" && config.RouteExternal.URL == "" {
+		return fmt.Errorf("invalid value for `route_external` option of service '%s': url is mandatory with the external route_select", config.Service)
+	}
+
+	if config.RouteExternal.Timeout == 0 {
+		config.RouteExternal.Timeout = defaultRouteExternalTimeout
+	}
+
+	if config.Mode == "" {
+		config.Mode = defaultMode
+	}
+
+	if !IsRouteMode(config.Mode) {
+		return fmt.Errorf("invalid value for `mode` option of service '%s': %s", config.Service, config.Mode)
+	}
+
+	if config.LogMode == "" {
+		config.LogMode = defaultLogMode
+	}
+
+	if !slices.Contains(fileModes, config.LogMode) {
+		return fmt.Errorf("invalid value for `log_mode` option of service '%s': %s", config.Service, config.LogMode)
+	}
+
+	// the concurrent sessions must not truncate the log of each other
+	if config.LogMode == "truncate" && config.Log != "" && config.Log != "syslog" && !strings.Contains(config.Log, "{sid}") {
+		return fmt.Errorf("invalid value for `log_mode` option of service '%s': truncate needs {sid} in `log`", config.Service)
+	}
+
+	if config.LogFormat == "" {
+		config.LogFormat = logFormats[0]
+	}
+
+	if !slices.Contains(logFormats, config.LogFormat) {
+		return fmt.Errorf("invalid value for `log_format` option of service '%s': %s", config.Service, config.LogFormat)
+	}
+
+	if config.DumpMode == "" {
+		config.DumpMode = defaultDumpMode
+	}
+
+	if !slices.Contains(fileModes, config.DumpMode) {
+		return fmt.Errorf("invalid value for `dump_mode` option of service '%s': %s", config.Service, config.DumpMode)
+	}
+
+	if config.DumpCompress == "" {
+		config.DumpCompress = dumpCompressions[0]
+	}
+
+	if !slices.Contains(dumpCompressions, config.DumpCompress) {
+		return fmt.Errorf("invalid value for `dump_compress` option of service '%s': %s", config.Service, config.DumpCompress)
+	}
+
+	if config.ForceTTY == "" {
+		config.ForceTTY = forceTTYModes[0]
+	}
+
+	if !slices.Contains(forceTTYModes, config.ForceTTY) {
+		return fmt.Errorf("invalid value for `force_tty` option of service '%s': %s", config.Service, config.ForceTTY)
+	}
+
+	for _, option := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"source_allow", config.SourceAllow},
+		{"source_deny", config.SourceDeny},
+		{"connection_limit_exempt_sources", config.ConnectionLimitExemptSources},
+	} {
+		for _, cidr := range option.cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid value for `%s` option of service '%s': %s", option.name, config.Service, cidr)
+			}
+		}
+	}
+
+	for key := range config.TranslateCommands {
+		if IsTranslateCommandRegexp(key) {
+			if _, err := regexp.Compile(key); err != nil {
+				return fmt.Errorf("invalid value for `translate_commands` option of service '%s': %s", config.Service, err)
+			}
+		}
 	}
 
-	if cachedConfig.Dest == nil {
-		cachedConfig.Dest = defaultDest
+	config.CommandAllowRegexps = nil
+	config.CommandDenyRegexps = nil
+	for _, option := range []struct {
+		name     string
+		patterns []string
+		regexps  *[]*regexp.Regexp
+	}{
+		{"command_allow", config.CommandAllow, &config.CommandAllowRegexps},
+		{"command_deny", config.CommandDeny, &config.CommandDenyRegexps},
+	} {
+		for _, pattern := range option.patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid value for `%s` option of service '%s': %s", option.name, config.Service, err)
+			}
+			*option.regexps = append(*option.regexps, re)
+		}
+	}
+
+	if config.ConnectionLimitWarnRatio < 0 || config.ConnectionLimitWarnRatio > 1 {
+		return fmt.Errorf("invalid value for `connection_limit_warn_ratio` option of service '%s': %g", config.Service, config.ConnectionLimitWarnRatio)
+	}
+
+	if config.BandwidthLimit < 0 {
+		return fmt.Errorf("invalid value for `bandwidth_limit` option of service '%s': %d", config.Service, config.BandwidthLimit)
+	}
+
+	for group, limit := range config.MaxConnectionsPerGroup {
+		if limit < 0 {
+			return fmt.Errorf("invalid value for `max_connections_per_group` option of service '%s': %s: %d", config.Service, group, limit)
+		}
+	}
+
+	if config.MaxConnectionsPerUserPct < 0 || config.MaxConnectionsPerUserPct > 100 {
+		return fmt.Errorf("invalid value for `max_connections_per_user_pct` option of service '%s': %d", config.Service, config.MaxConnectionsPerUserPct)
 	}
 
-	if cachedConfig.SSH.Exe == "" {
-		cachedConfig.SSH.Exe = defaultSSHExe
+	for _, option := range []struct {
+		name    string
+		timeout Duration
+	}{
+		{"etcd.request_timeout", config.Etcd.RequestTimeout},
+		{"etcd.dial_timeout", config.Etcd.DialTimeout},
+	} {
+		if option.timeout < 0 {
+			return fmt.Errorf("invalid value for `%s` option of service '%s': %s", option.name, config.Service, option.timeout.Duration())
+		}
 	}
 
-	if cachedConfig.SSH.Args == nil {
-		cachedConfig.SSH.Args = defaultSSHArgs
+	if config.Etcd.Prefix != "" && !etcdPrefixRegex.MatchString(config.Etcd.Prefix) {
+		return fmt.Errorf("invalid value for `etcd.prefix` option of service '%s': %s", config.Service, config.Etcd.Prefix)
 	}
 
-	if cachedConfig.RouteSelect == "" {
-		cachedConfig.RouteSelect = defaultAlgorithm
+	if config.EtcdNamespace != "" && !etcdNamespaceRegex.MatchString(config.EtcdNamespace) {
+		return fmt.Errorf("invalid value for `etcd_namespace` option of service '%s': %s", config.Service, config.EtcdNamespace)
 	}
 
-	if !IsRouteAlgorithm(cachedConfig.RouteSelect) {
-		return nil, fmt.Errorf("invalid value for `route_select` option of service '%s': %s", cachedConfig.Service, cachedConfig.RouteSelect)
+	if config.MaxProbes < 0 {
+		return fmt.Errorf("invalid value for `max_probes` option of service '%s': %d", config.Service, config.MaxProbes)
 	}
 
-	if cachedConfig.Mode == "" {
-		cachedConfig.Mode = defaultMode
+	if config.StickySourcePrefix < 0 || config.StickySourcePrefix > 32 {
+		return fmt.Errorf("invalid value for `sticky_source_prefix` option of service '%s': %d", config.Service, config.StickySourcePrefix)
 	}
 
-	if !IsRouteMode(cachedConfig.Mode) {
-		return nil, fmt.Errorf("invalid value for `mode` option of service '%s': %s", cachedConfig.Service, cachedConfig.Mode)
+	if config.StickySourcePrefix6 < 0 || config.StickySourcePrefix6 > 128 {
+		return fmt.Errorf("invalid value for `sticky_source_prefix6` option of service '%s': %d", config.Service, config.StickySourcePrefix6)
 	}
 
-	if cachedConfig.Log != "" {
-		cachedConfig.Log = replace(cachedConfig.Log, patterns["{user}"])
+	if len(config.AvailableStates) == 0 {
+		config.AvailableStates = defaultAvailableStates
 	}
 
-	for k, v := range cachedConfig.Environment {
-		cachedConfig.Environment[k] = replace(v, patterns["{user}"])
+	for _, state := range config.AvailableStates {
+		if _, err := ParseState(state); err != nil {
+			return fmt.Errorf("invalid value for `available_states` option of service '%s': %s", config.Service, state)
+		}
 	}
 
-	if len(cachedConfig.Dest) == 0 {
-		return nil, fmt.Errorf("no destination defined for service '%s'", cachedConfig.Service)
+	if config.Log != "" {
+		config.Log = replace(config.Log, patterns["{user}"])
+		config.Log = replace(config.Log, patterns["{sid}"])
 	}
 
-	// expand destination nodesets
+	for k, v := range config.Environment {
+		config.Environment[k] = replace(v, patterns["{user}"])
+	}
+
+	if config.Cgroup != "" {
+		config.Cgroup = replace(config.Cgroup, patterns["{user}"])
+		config.Cgroup = replace(config.Cgroup, &patternReplacer{regexp.MustCompile(`{service}`), config.Service})
+	}
+
+	if config.PrometheusPushgateway != "" {
+		u, err := url.Parse(config.PrometheusPushgateway)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid value for `prometheus_pushgateway` option of service '%s': %s is not an http(s) URL", config.Service, config.PrometheusPushgateway)
+		}
+	}
+
+	if config.OtelEndpoint != "" {
+		u, err := url.Parse(config.OtelEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid value for `otel_endpoint` option of service '%s': %s is not an http(s) URL", config.Service, config.OtelEndpoint)
+		}
+	}
+
+	if len(config.Dest) == 0 {
+		if !config.InsecureAllowEmptyDest {
+			return fmt.Errorf("no destination defined for service '%s'", config.Service)
+		}
+		// the destinations must come from the configuration stored in
+		// etcd, which is checked when a destination is looked for
+		if config.ConfigFromEtcd == "" {
+			return fmt.Errorf("invalid value for `insecure_allow_empty_dest` option of service '%s': config_from_etcd is needed without destination", config.Service)
+		}
+	}
+
+	// expand destination nodesets, one destination at a time in order to
+	// keep the order of the destinations (and their optional port)
 	nodesetComment, nodesetDlclose, nodesetExpand := nodesets.InitExpander()
 	defer nodesetDlclose()
-	cachedConfig.Nodeset = nodesetComment
-	dsts, err := nodesetExpand(strings.Join(cachedConfig.Dest, ","))
-	if err != nil {
-		return nil, fmt.Errorf("invalid nodeset for service '%s': %s", cachedConfig.Service, err)
+	config.Nodeset = nodesetComment
+	dsts := []string{}
+	weights := []int{}
+	for _, dst := range config.Dest {
+		dst, weight, err := splitDestWeight(dst)
+		if err != nil {
+			return fmt.Errorf("invalid destination '%s' for service '%s': %s", dst, config.Service, err)
+		}
+		var expanded []string
+		if isIPv6Dest(dst) {
+			// the brackets of an IPv6 address are not a nodeset range
+			expanded = []string{dst}
+		} else {
+			expanded, err = nodesetExpand(dst)
+			if err != nil {
+				return fmt.Errorf("invalid nodeset for service '%s': %s", config.Service, err)
+			}
+		}
+		dsts = append(dsts, expanded...)
+		for range expanded {
+			weights = append(weights, weight)
+		}
 	}
-	cachedConfig.Dest = dsts
+	config.Dest = dsts
+	config.DestWeights = weights
 
 	// replace destinations (with possible missing port) with host:port
-	for i, dst := range cachedConfig.Dest {
-		host, port, err := SplitHostPort(dst)
+	defaultDestPort := strconv.Itoa(config.DefaultDestPort)
+	for i, dst := range config.Dest {
+		host, port, err := SplitHostPortWithDefault(dst, defaultDestPort)
 		if err != nil {
-			return nil, fmt.Errorf("invalid destination '%s' for service '%s': %s", dst, cachedConfig.Service, err)
+			return fmt.Errorf("invalid destination '%s' for service '%s': %s", dst, config.Service, err)
+		}
+		if isIPv6Dest(host) {
+			// IPv6 address without port
+			host = host[1 : len(host)-1]
 		}
-		cachedConfig.Dest[i] = net.JoinHostPort(host, port)
+		config.Dest[i] = net.JoinHostPort(host, port)
 	}
 
-	if cachedConfig.Dump != "" {
+	if config.Dump != "" {
 		for _, repl := range patterns {
-			cachedConfig.Dump = replace(cachedConfig.Dump, repl)
+			config.Dump = replace(config.Dump, repl)
 		}
 	}
 
-	cachedConfig.ready = true
-	return &cachedConfig, nil
+	return nil
 }
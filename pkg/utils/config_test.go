@@ -0,0 +1,908 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig writes content in a temporary configuration file and loads
+// it for the given user, groups and source.
+func loadTestConfig(t *testing.T, content, user string, groups map[string]bool, source string) (*Config, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	cachedConfig = Config{}
+	return LoadConfig(filename, user, "", time.Now(), groups, source, nil)
+}
+
+var loadConfigDestTests = []struct {
+	content string
+	want    []string
+}{
+	{
+		"dest: [server1]",
+		[]string{"server1:22"},
+	},
+	{
+		"dest: [\"server[1-3]:2222\"]",
+		[]string{"server1:2222", "server2:2222", "server3:2222"},
+	},
+	{
+		"dest: [\"a:2022\", \"b[1-2]:2023\", c]",
+		[]string{"a:2022", "b1:2023", "b2:2023", "c:22"},
+	},
+	{
+		"dest: [\"server[1-2]\", \"server3:22\"]\ndefault_dest_port: 2222",
+		[]string{"server1:2222", "server2:2222", "server3:22"},
+	},
+	{
+		"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    default_dest_port: 2222",
+		[]string{"server1:2222"},
+	},
+	{
+		"dest: [\"[2001:db8::1]:2222\", \"[2001:db8::2]\"]",
+		[]string{"[2001:db8::1]:2222", "[2001:db8::2]:22"},
+	},
+	{
+		"dest: [\"server[1-2]\", \"[2001:db8::1]\", \"192.168.0.1:2222\", \"[::ffff:192.168.0.2]:2223\"]",
+		[]string{"server1:22", "server2:22", "[2001:db8::1]:22", "192.168.0.1:2222", "[::ffff:192.168.0.2]:2223"},
+	},
+	{
+		"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    service: ipv6\n    dest: [\"[fe80::1%eth0]:2222\"]",
+		[]string{"[fe80::1%eth0]:2222"},
+	},
+}
+
+func TestLoadConfigDest(t *testing.T) {
+	for _, tt := range loadConfigDestTests {
+		config, err := loadTestConfig(t, tt.content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.content, err)
+		} else if !reflect.DeepEqual(config.Dest, tt.want) {
+			t.Errorf("%q LoadConfig dest = %v, want %v", tt.content, config.Dest, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigDestWeights(t *testing.T) {
+	content := "dest: [\"server[1-2]:2222*3\", server3, \"server4*2\"]"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("%q LoadConfig error = %v, want nil", content, err)
+	}
+	wantDest := []string{"server1:2222", "server2:2222", "server3:22", "server4:22"}
+	wantWeights := []int{3, 3, 1, 2}
+	if !reflect.DeepEqual(config.Dest, wantDest) {
+		t.Errorf("%q LoadConfig dest = %v, want %v", content, config.Dest, wantDest)
+	}
+	if !reflect.DeepEqual(config.DestWeights, wantWeights) {
+		t.Errorf("%q LoadConfig dest weights = %v, want %v", content, config.DestWeights, wantWeights)
+	}
+}
+
+var loadConfigInvalidTests = []struct {
+	content, want string
+}{
+	{
+		"dest: []",
+		"no destination defined for service 'default'",
+	},
+	{
+		"insecure_allow_empty_dest: true",
+		"invalid value for `insecure_allow_empty_dest` option of service 'default': config_from_etcd is needed without destination",
+	},
+	{
+		"insecure_allow_empty_dest: true\netcd:\n  endpoints: [\"host1:2379\"]",
+		"invalid value for `insecure_allow_empty_dest` option of service 'default': config_from_etcd is needed without destination",
+	},
+	{
+		"dest: [server1]\nroute_select: external",
+		"invalid value for `route_external` option of service 'default': url is mandatory with the external route_select",
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - users: [alice]\n  service: \"\"",
+		"invalid value for `service` option of override 1: the service name cannot be empty",
+	},
+	{
+		"dest: [server1]\netcd:\n  prefix: /site1/",
+		"invalid value for `etcd.prefix` option of service 'default': /site1/",
+	},
+	{
+		"dest: [server1]\nparent_check_interval: -5s",
+		"invalid value for `parent_check_interval` option of service 'default': -5s",
+	},
+	{
+		"dest: [server1]\nconnect_timeout: -1s",
+		"invalid value for `connect_timeout` option of service 'default': -1s",
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - users: [alice]\n  connect_timeout: \"5\"",
+		"time: missing unit in duration \"5\"",
+	},
+	{
+		"dest: [server1]\ncheck_command: \" \"",
+		"invalid value for `check_command` option of service 'default': the command cannot be blank",
+	},
+	{
+		"dest: [server1]\ncheck_command_timeout: -1s",
+		"invalid value for `check_command_timeout` option of service 'default': -1s",
+	},
+	{
+		"dest: [server1]\nblocking_command_timeout: -1s",
+		"invalid value for `blocking_command_timeout` option of service 'default': -1s",
+	},
+	{
+		"dest: [server1]\nhost_write_interval: -1m",
+		"invalid value for `host_write_interval` option of service 'default': -1m0s",
+	},
+	{
+		"dest: [server1]\ncheck_interval: 1m\nhost_write_interval: 2m",
+		"invalid value for `host_write_interval` option of service 'default': 2m0s is greater than `check_interval`",
+	},
+	{
+		"dest: [server1]\ndedup_window: -5s",
+		"invalid value for `dedup_window` option of service 'default': -5s",
+	},
+	{
+		"dest: [server1]\nssh:\n  bind_address: eth0",
+		"invalid value for `ssh.bind_address` option of service 'default': eth0 is not an IP address",
+	},
+	{
+		"dest: [\"server1*0\"]",
+		"invalid destination 'server1*0' for service 'default': the weight must be a positive integer",
+	},
+	{
+		"dest: [server1]\nlog_format: xml",
+		"invalid value for `log_format` option of service 'default': xml",
+	},
+	{
+		"dest: [server1]\nprometheus_pushgateway: pushgateway:9091",
+		"invalid value for `prometheus_pushgateway` option of service 'default': pushgateway:9091 is not an http(s) URL",
+	},
+	{
+		"dest: [server1]\notel_endpoint: collector:4318",
+		"invalid value for `otel_endpoint` option of service 'default': collector:4318 is not an http(s) URL",
+	},
+	{
+		"dest: [server1]\ndefault_dest_port: 65536",
+		"invalid value for `default_dest_port` option of service 'default': 65536",
+	},
+	{
+		"dest: [\"server1:port\"]",
+		"invalid destination 'server1:port' for service 'default': address server1:port: invalid port",
+	},
+	{
+		"dest: [server1]\navailable_states: [up, sleeping]",
+		"invalid value for `available_states` option of service 'default': sleeping",
+	},
+	{
+		"dest: [server1]\netcd_namespace: login/nodes",
+		"invalid value for `etcd_namespace` option of service 'default': login/nodes",
+	},
+	{
+		"dest: [server1]\nconnection_limit_warn_ratio: 1.5",
+		"invalid value for `connection_limit_warn_ratio` option of service 'default': 1.5",
+	},
+	{
+		"dest: [server1]\nbandwidth_limit: -1",
+		"invalid value for `bandwidth_limit` option of service 'default': -1",
+	},
+	{
+		"dest: [server1]\nmax_connections_per_user_pct: 101",
+		"invalid value for `max_connections_per_user_pct` option of service 'default': 101",
+	},
+	{
+		"dest: [server1]\nsource_allow: [192.168.0.0/16, 10.0.0.1]",
+		"invalid value for `source_allow` option of service 'default': 10.0.0.1",
+	},
+	{
+		"dest: [server1]\ntranslate_commands:\n  \"^rsync (.*\":\n    command: rsync",
+		"invalid value for `translate_commands` option of service 'default': error parsing regexp: missing closing ): `^rsync (.*`",
+	},
+	{
+		"dest: [server1]\nlog: /var/log/sshproxy/{user}.log\nlog_mode: truncate",
+		"invalid value for `log_mode` option of service 'default': truncate needs {sid} in `log`",
+	},
+	{
+		"dest: [server1]\nmax_connections_per_group:\n  projA: -1",
+		"invalid value for `max_connections_per_group` option of service 'default': projA: -1",
+	},
+	{
+		"dest: [server1]\nconnection_limit_exempt_sources: [jumphost]",
+		"invalid value for `connection_limit_exempt_sources` option of service 'default': jumphost",
+	},
+	{
+		"dest: [server1]\netcd:\n  request_timeout: -1s",
+		"invalid value for `etcd.request_timeout` option of service 'default': -1s",
+	},
+	{
+		"dest: [server1]\netcd:\n  dial_timeout: -500ms",
+		"invalid value for `etcd.dial_timeout` option of service 'default': -500ms",
+	},
+	{
+		"dest: [server1]\ncommand_allow: [\"^sftp\", \"^(scp\"]",
+		"invalid value for `command_allow` option of service 'default': error parsing regexp: missing closing ): `^(scp`",
+	},
+	{
+		"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    service: sftp\n    command_deny: [\"rm -rf [/\"]",
+		"invalid value for `command_deny` option of service 'sftp': error parsing regexp: missing closing ]: `[/`",
+	},
+	{
+		"dest: [server1]\nforce_tty: sometimes",
+		"invalid value for `force_tty` option of service 'default': sometimes",
+	},
+	{
+		"dest: [server1]\nlog_mode: rotate",
+		"invalid value for `log_mode` option of service 'default': rotate",
+	},
+	{
+		"dest: [server1]\ndump_mode: create",
+		"invalid value for `dump_mode` option of service 'default': create",
+	},
+	{
+		"dest: [server1]\ndump_compress: zstd",
+		"invalid value for `dump_compress` option of service 'default': zstd",
+	},
+	{
+		"dest: [server1]\nmax_probes: -1",
+		"invalid value for `max_probes` option of service 'default': -1",
+	},
+	{
+		"dest: [server1]\nsticky_source_prefix: 33",
+		"invalid value for `sticky_source_prefix` option of service 'default': 33",
+	},
+	{
+		"dest: [server1]\nsticky_source_prefix6: -1",
+		"invalid value for `sticky_source_prefix6` option of service 'default': -1",
+	},
+	{
+		"dest: [server1]\nblocking_command: [/bin/true, \" \"]",
+		"invalid value for `blocking_command` option of service 'default': empty command",
+	},
+	{
+		"dest: [server1]\nblocking_command: /bin/true\nblocking_command_retries: -1",
+		"invalid value for `blocking_command_retries` option of service 'default': -1",
+	},
+	{
+		"dest: [server1]\nnice:\n  bulk: 10",
+		"invalid session kind in `nice` option of service 'default': bulk",
+	},
+	{
+		"dest: [server1]\nnice:\n  sftp: 20",
+		"invalid value for `nice` option of service 'default': 20",
+	},
+	{
+		"dest: [server1]\nionice:\n  sftp: lazy",
+		"invalid value for `ionice` option of service 'default': unknown I/O scheduling class: lazy",
+	},
+}
+
+var loadConfigAvailableStatesTests = []struct {
+	content string
+	want    []string
+}{
+	{
+		"dest: [server1]",
+		[]string{"up"},
+	},
+	{
+		"dest: [server1]\navailable_states: [up, unknown]",
+		[]string{"up", "unknown"},
+	},
+	{
+		"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    available_states: [maintenance]",
+		[]string{"maintenance"},
+	},
+}
+
+func TestLoadConfigAvailableStates(t *testing.T) {
+	for _, tt := range loadConfigAvailableStatesTests {
+		config, err := loadTestConfig(t, tt.content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.content, err)
+		} else if !reflect.DeepEqual(config.AvailableStates, tt.want) {
+			t.Errorf("%q LoadConfig available_states = %v, want %v", tt.content, config.AvailableStates, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigSSH(t *testing.T) {
+	content := `dest: [server1]
+ssh:
+    args: ["-q"]
+    sftp_args: ["-oCompression=yes"]
+overrides:
+    - match:
+        - users: [alice]
+      ssh:
+          exe: /usr/bin/ssh
+          interactive_args: ["-X"]
+`
+	for _, tt := range []struct {
+		user string
+		want sshConfig
+	}{
+		{"bob", sshConfig{Exe: "ssh", Args: []string{"-q"}, SFTPArgs: []string{"-oCompression=yes"}}},
+		{"alice", sshConfig{Exe: "/usr/bin/ssh", Args: []string{"-q", "-Y"}, InteractiveArgs: []string{"-X"}}},
+	} {
+		config, err := loadTestConfig(t, content, tt.user, nil, "")
+		if err != nil {
+			t.Errorf("%s LoadConfig error = %v, want nil", tt.user, err)
+		} else if !reflect.DeepEqual(config.SSH, tt.want) {
+			t.Errorf("%s LoadConfig ssh = %+v, want %+v", tt.user, config.SSH, tt.want)
+		}
+	}
+}
+
+var loadConfigFromEtcdTests = []struct {
+	entry *etcdConfigEntry
+	dest  []string
+	err   string
+}{
+	{&etcdConfigEntry{content: []byte("dest: [server2]")}, []string{"server2:22"}, ""},
+	{&etcdConfigEntry{err: ErrKeyNotFound}, []string{"server1:22"}, "loading the configuration from etcd key /sshproxy/config: key not found"},
+	{&etcdConfigEntry{content: []byte("dest: [server2\nservice: [")}, []string{"server1:22"}, "parsing the configuration from etcd key /sshproxy/config: "},
+	{&etcdConfigEntry{content: []byte("dest: {server2: 1}")}, []string{"server1:22"}, "parsing the configuration from etcd key /sshproxy/config: "},
+}
+
+func TestLoadConfigFromEtcd(t *testing.T) {
+	content := "dest: [server1]\nconfig_from_etcd: /sshproxy/config"
+	defer delete(etcdConfigs, "/sshproxy/config")
+	for _, tt := range loadConfigFromEtcdTests {
+		etcdConfigs["/sshproxy/config"] = tt.entry
+		config, err := loadTestConfig(t, content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.entry.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(config.Dest, tt.dest) {
+			t.Errorf("%q LoadConfig dest = %v, want %v", tt.entry.content, config.Dest, tt.dest)
+		}
+		etcdErr := config.EtcdConfigError()
+		if tt.err == "" && etcdErr != nil {
+			t.Errorf("%q EtcdConfigError = %v, want nil", tt.entry.content, etcdErr)
+		} else if tt.err != "" && (etcdErr == nil || !strings.HasPrefix(etcdErr.Error(), tt.err)) {
+			t.Errorf("%q EtcdConfigError = %v, want %q", tt.entry.content, etcdErr, tt.err)
+		}
+	}
+}
+
+func TestLoadConfigBlockingCommand(t *testing.T) {
+	content := `dest: [server1]
+blocking_command: /usr/bin/admission
+blocking_command_retries: 2
+overrides:
+    - match:
+        - users: [alice]
+      blocking_command_retry_interval: 500ms
+      blocking_command_retry_codes: [75]
+      blocking_command_timeout: 5s
+    - match:
+        - users: [carol]
+      blocking_command: [/usr/bin/quota, "/usr/bin/policy -v"]
+`
+	for _, tt := range []struct {
+		user     string
+		commands StringList
+		interval time.Duration
+		codes    []int
+		timeout  time.Duration
+	}{
+		{"bob", StringList{"/usr/bin/admission"}, time.Second, nil, 30 * time.Second},
+		{"alice", StringList{"/usr/bin/admission"}, 500 * time.Millisecond, []int{75}, 5 * time.Second},
+		{"carol", StringList{"/usr/bin/quota", "/usr/bin/policy -v"}, time.Second, nil, 30 * time.Second},
+	} {
+		config, err := loadTestConfig(t, content, tt.user, nil, "")
+		if err != nil {
+			t.Errorf("%s LoadConfig error = %v, want nil", tt.user, err)
+			continue
+		}
+		if !reflect.DeepEqual(config.BlockingCommand, tt.commands) {
+			t.Errorf("%s LoadConfig blocking_command = %q, want %q", tt.user, config.BlockingCommand, tt.commands)
+		}
+		if config.BlockingCommandRetries != 2 {
+			t.Errorf("%s LoadConfig blocking_command_retries = %d, want 2", tt.user, config.BlockingCommandRetries)
+		}
+		if config.BlockingCommandRetryInterval.Duration() != tt.interval {
+			t.Errorf("%s LoadConfig blocking_command_retry_interval = %s, want %s", tt.user, config.BlockingCommandRetryInterval.Duration(), tt.interval)
+		}
+		if !reflect.DeepEqual(config.BlockingCommandRetryCodes, tt.codes) {
+			t.Errorf("%s LoadConfig blocking_command_retry_codes = %v, want %v", tt.user, config.BlockingCommandRetryCodes, tt.codes)
+		}
+		if config.BlockingCommandTimeout.Duration() != tt.timeout {
+			t.Errorf("%s LoadConfig blocking_command_timeout = %s, want %s", tt.user, config.BlockingCommandTimeout.Duration(), tt.timeout)
+		}
+	}
+}
+
+func TestLoadConfigConnectTimeout(t *testing.T) {
+	content := `dest: [server1]
+overrides:
+    - match:
+        - users: [alice]
+      connect_timeout: 5s
+`
+	for _, tt := range []struct {
+		user    string
+		timeout time.Duration
+	}{
+		{"bob", time.Second},
+		{"alice", 5 * time.Second},
+	} {
+		config, err := loadTestConfig(t, content, tt.user, nil, "")
+		if err != nil {
+			t.Errorf("%s LoadConfig error = %v, want nil", tt.user, err)
+		} else if config.ConnectTimeout.Duration() != tt.timeout {
+			t.Errorf("%s LoadConfig connect_timeout = %s, want %s", tt.user, config.ConnectTimeout.Duration(), tt.timeout)
+		}
+	}
+}
+
+func TestLoadConfigDestRewrite(t *testing.T) {
+	content := "dest: [server1]\ndefault_dest_port: 2222\ndest_rewrite:\n  server1: 10.0.0.1\n  \"server2:22\": nat-gw"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	want := map[string]string{"server1:2222": "10.0.0.1", "server2:22": "nat-gw"}
+	if err != nil {
+		t.Errorf("%q LoadConfig error = %v, want nil", content, err)
+	} else if !reflect.DeepEqual(config.DestRewrite, want) {
+		t.Errorf("%q LoadConfig dest_rewrite = %v, want %v", content, config.DestRewrite, want)
+	}
+}
+
+func TestLoadConfigInsecureAllowEmptyDest(t *testing.T) {
+	content := "insecure_allow_empty_dest: true\nconfig_from_etcd: /sshproxy/config"
+	defer delete(etcdConfigs, "/sshproxy/config")
+	for _, tt := range []struct {
+		entry   *etcdConfigEntry
+		dest    []string
+		findErr string
+	}{
+		{&etcdConfigEntry{content: []byte("dest: [server2]")}, []string{"server2:22"}, ""},
+		{&etcdConfigEntry{content: []byte("mode: balanced")}, []string{}, "no destination set for service default"},
+		{&etcdConfigEntry{err: ErrKeyNotFound}, []string{}, "no destination set for service default: loading the configuration from etcd key /sshproxy/config: key not found"},
+	} {
+		etcdConfigs["/sshproxy/config"] = tt.entry
+		config, err := loadTestConfig(t, content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.entry.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(config.Dest, tt.dest) {
+			t.Errorf("%q LoadConfig dest = %v, want %v", tt.entry.content, config.Dest, tt.dest)
+		}
+		if tt.findErr == "" {
+			continue
+		}
+		// the missing destination is only an error when routing a user
+		if _, err := FindDestination(nil, "alice", config, "", nil, nil); err == nil || err.Error() != tt.findErr {
+			t.Errorf("%q FindDestination error = %v, want %q", tt.entry.content, err, tt.findErr)
+		}
+	}
+}
+
+func TestLoadConfigCgroup(t *testing.T) {
+	content := "dest: [server1]\nservice: login\ncgroup: /sys/fs/cgroup/{service}/{user}"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Errorf("%q LoadConfig error = %v, want nil", content, err)
+	} else if want := "/sys/fs/cgroup/login/alice"; config.Cgroup != want {
+		t.Errorf("%q LoadConfig cgroup = %s, want %s", content, config.Cgroup, want)
+	}
+}
+
+func TestLoadConfigLogTruncate(t *testing.T) {
+	content := "dest: [server1]\nlog: /var/log/sshproxy/{user}/{sid}.log\nlog_mode: truncate"
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	cachedConfig = Config{}
+	config, err := LoadConfig(filename, "alice", "0123456789", time.Now(), nil, "", nil)
+	if err != nil {
+		t.Errorf("%q LoadConfig error = %v, want nil", content, err)
+	} else if want := "/var/log/sshproxy/alice/0123456789.log"; config.Log != want {
+		t.Errorf("%q LoadConfig log = %s, want %s", content, config.Log, want)
+	}
+}
+
+func TestLoadConfigConnectionLimitWarnRatio(t *testing.T) {
+	for _, tt := range []struct {
+		content string
+		want    float64
+	}{
+		{"dest: [server1]", 0},
+		{"dest: [server1]\nconnection_limit_warn_ratio: 0.9", 0.9},
+		{"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    connection_limit_warn_ratio: 1", 1},
+	} {
+		config, err := loadTestConfig(t, tt.content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.content, err)
+		} else if config.ConnectionLimitWarnRatio != tt.want {
+			t.Errorf("%q LoadConfig connection_limit_warn_ratio = %g, want %g", tt.content, config.ConnectionLimitWarnRatio, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigConnectionLimitExempt(t *testing.T) {
+	content := `dest: [server1]
+connection_limit_exempt_users: [root]
+overrides:
+    - match:
+        - groups: [admin]
+      connection_limit_exempt_users: [alice, bob]
+      connection_limit_exempt_groups: [admin]
+`
+	for _, tt := range []struct {
+		groups     map[string]bool
+		users      []string
+		userGroups []string
+	}{
+		{nil, []string{"root"}, nil},
+		{map[string]bool{"admin": true}, []string{"alice", "bob"}, []string{"admin"}},
+	} {
+		config, err := loadTestConfig(t, content, "alice", tt.groups, "")
+		if err != nil {
+			t.Errorf("%v LoadConfig error = %v, want nil", tt.groups, err)
+			continue
+		}
+		if !reflect.DeepEqual(config.ConnectionLimitExemptUsers, tt.users) {
+			t.Errorf("%v LoadConfig connection_limit_exempt_users = %v, want %v", tt.groups, config.ConnectionLimitExemptUsers, tt.users)
+		}
+		if !reflect.DeepEqual(config.ConnectionLimitExemptGroups, tt.userGroups) {
+			t.Errorf("%v LoadConfig connection_limit_exempt_groups = %v, want %v", tt.groups, config.ConnectionLimitExemptGroups, tt.userGroups)
+		}
+	}
+}
+
+func TestLoadConfigDumpGroups(t *testing.T) {
+	content := `dest: [server1]
+dump: etcd
+overrides:
+    - match:
+        - groups: [admin]
+      dump: /var/spool/sshproxy/{user}/session.dump
+      dump_mode: append
+      dump_compress: gzip
+      dump_limit_size: 1048576
+      dump_limit_window: 1m
+      dump_user_quota: 10485760
+    - match:
+        - groups: [robot]
+      dump: ""
+`
+	type dumpConfig struct {
+		Dump            string
+		DumpMode        string
+		DumpCompress    string
+		DumpLimitSize   uint64
+		DumpLimitWindow time.Duration
+		DumpUserQuota   uint64
+	}
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	for _, tt := range []struct {
+		groups map[string]bool
+		want   dumpConfig
+	}{
+		{nil, dumpConfig{"etcd", "truncate", "none", 0, 0, 0}},
+		{map[string]bool{"users": true}, dumpConfig{"etcd", "truncate", "none", 0, 0, 0}},
+		{map[string]bool{"admin": true}, dumpConfig{"/var/spool/sshproxy/alice/session.dump", "append", "gzip", 1048576, time.Minute, 10485760}},
+		{map[string]bool{"robot": true}, dumpConfig{"", "truncate", "none", 0, 0, 0}},
+		// the last matching override wins
+		{map[string]bool{"admin": true, "robot": true}, dumpConfig{"", "append", "gzip", 1048576, time.Minute, 10485760}},
+	} {
+		cachedConfig = Config{}
+		config, err := LoadConfig(filename, "alice", "", time.Now(), tt.groups, "", nil)
+		if err != nil {
+			t.Errorf("%v LoadConfig error = %v, want nil", tt.groups, err)
+			continue
+		}
+		got := dumpConfig{config.Dump, config.DumpMode, config.DumpCompress, config.DumpLimitSize, config.DumpLimitWindow.Duration(), config.DumpUserQuota}
+		if got != tt.want {
+			t.Errorf("%v LoadConfig dump options = %+v, want %+v", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigEtcdTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		content                     string
+		requestTimeout, dialTimeout time.Duration
+	}{
+		{"dest: [server1]", 0, 0},
+		{"dest: [server1]\netcd:\n  request_timeout: 5s\n  dial_timeout: 1m", 5 * time.Second, time.Minute},
+	} {
+		config, err := loadTestConfig(t, tt.content, "alice", nil, "")
+		if err != nil {
+			t.Errorf("%q LoadConfig error = %v, want nil", tt.content, err)
+		} else if config.Etcd.RequestTimeout.Duration() != tt.requestTimeout || config.Etcd.DialTimeout.Duration() != tt.dialTimeout {
+			t.Errorf("%q LoadConfig etcd timeouts = %s, %s, want %s, %s", tt.content, config.Etcd.RequestTimeout, config.Etcd.DialTimeout, tt.requestTimeout, tt.dialTimeout)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("writing %s: %v", filename, err)
+		}
+	}
+	load := func(f func(string, string, string, time.Time, map[string]bool, string, map[string]string) (*Config, error)) (*Config, error) {
+		return f(filename, "alice", "", time.Now(), nil, "", nil)
+	}
+
+	write("dest: [server1]\nservice: first")
+	ResetConfigCache()
+	if _, err := load(LoadConfig); err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+
+	write("dest: [server1]\nservice: second")
+	if config, _ := load(LoadConfig); config.Service != "first" {
+		t.Errorf("cached LoadConfig service = %s, want first", config.Service)
+	}
+	ResetConfigCache()
+	if config, err := load(LoadConfig); err != nil {
+		t.Errorf("LoadConfig after ResetConfigCache error = %v, want nil", err)
+	} else if config.Service != "second" {
+		t.Errorf("LoadConfig after ResetConfigCache service = %s, want second", config.Service)
+	}
+
+	write("dest: [server1]\nservice: third")
+	if config, err := load(ReloadConfig); err != nil {
+		t.Errorf("ReloadConfig error = %v, want nil", err)
+	} else if config.Service != "third" {
+		t.Errorf("ReloadConfig service = %s, want third", config.Service)
+	}
+
+	// an invalid configuration keeps the previous one
+	write("dest: [server1]\nservice: fourth\nmax_connections_per_user_pct: 200")
+	if _, err := load(ReloadConfig); err == nil {
+		t.Errorf("ReloadConfig of an invalid configuration error = nil, want an error")
+	}
+	if config, _ := load(LoadConfig); config.Service != "third" {
+		t.Errorf("LoadConfig after a failed ReloadConfig service = %s, want third", config.Service)
+	}
+}
+
+func TestLoadConfigMaxConnectionsPerGroup(t *testing.T) {
+	content := `dest: [server1]
+max_connections_per_group:
+    projA: 10
+overrides:
+    - match:
+        - groups: [projB]
+      max_connections_per_group:
+          projB: 20
+    - match:
+        - groups: [projC]
+      max_connections_per_group:
+          projA: 0
+`
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	for _, tt := range []struct {
+		groups map[string]bool
+		want   map[string]int
+	}{
+		{map[string]bool{"users": true}, map[string]int{}},
+		{map[string]bool{"users": true, "projA": true}, map[string]int{"projA": 10}},
+		{map[string]bool{"users": true, "projB": true}, map[string]int{"projB": 20}},
+		{map[string]bool{"users": true, "projA": true, "projB": true}, map[string]int{"projA": 10, "projB": 20}},
+		{map[string]bool{"users": true, "projA": true, "projC": true}, map[string]int{}},
+	} {
+		cachedConfig = Config{}
+		config, err := LoadConfig(filename, "alice", "", time.Now(), tt.groups, "", nil)
+		if err != nil {
+			t.Fatalf("%v LoadConfig error = %v, want nil", tt.groups, err)
+		}
+		got := map[string]int{}
+		for group := range LimitedGroups(config.MaxConnectionsPerGroup, tt.groups) {
+			got[group] = config.MaxConnectionsPerGroup[group]
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v limited groups = %v, want %v", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigMatchEnv(t *testing.T) {
+	content := `dest: [server1]
+overrides:
+    - match:
+        - env: [LC_SSHPROXY_SERVICE=gpu]
+      service: gpu
+    - match:
+        - env: [LC_DEBUG]
+      debug: true
+`
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	for _, tt := range []struct {
+		env     map[string]string
+		service string
+		debug   bool
+	}{
+		{nil, "default", false},
+		{map[string]string{"LC_SSHPROXY_SERVICE": "cpu"}, "default", false},
+		{map[string]string{"LC_SSHPROXY_SERVICE": "gpu"}, "gpu", false},
+		{map[string]string{"LC_DEBUG": ""}, "default", true},
+	} {
+		cachedConfig = Config{}
+		config, err := LoadConfig(filename, "alice", "", time.Now(), nil, "", tt.env)
+		if err != nil {
+			t.Errorf("%v LoadConfig error = %v, want nil", tt.env, err)
+		} else if config.Service != tt.service || config.Debug != tt.debug {
+			t.Errorf("%v LoadConfig service, debug = %s, %v, want %s, %v", tt.env, config.Service, config.Debug, tt.service, tt.debug)
+		}
+	}
+}
+
+func TestLoadServicesConfigs(t *testing.T) {
+	content := `dest: [server1]
+overrides:
+    - match:
+        - users: [alice]
+      dest: [server2]
+    - match:
+        - groups: [admin]
+      service: admin
+      dest: ["admin[1-2]"]
+      route_select: random
+`
+	filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", filename, err)
+	}
+	configs, err := LoadServicesConfigs(filename)
+	if err != nil {
+		t.Fatalf("LoadServicesConfigs error = %v, want nil", err)
+	}
+	want := []struct {
+		service, routeSelect string
+		dest                 []string
+	}{
+		{"default", "ordered", []string{"server1:22"}},
+		{"admin", "random", []string{"admin1:22", "admin2:22"}},
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("LoadServicesConfigs got %d services, want %d", len(configs), len(want))
+	}
+	for i, w := range want {
+		if configs[i].Service != w.service || configs[i].RouteSelect != w.routeSelect || !reflect.DeepEqual(configs[i].Dest, w.dest) {
+			t.Errorf("LoadServicesConfigs service %d = %s %s %v, want %s %s %v", i, configs[i].Service, configs[i].RouteSelect, configs[i].Dest, w.service, w.routeSelect, w.dest)
+		}
+	}
+}
+
+var servicesConflictsTests = []struct {
+	content string
+	want    []string
+}{
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - users: [alice]\n  service: admin\n  dest: [admin1]\n- match:\n  - users: [bob]\n  service: admin\n  dest: [admin1]\n",
+		nil,
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - users: [alice]\n  service: admin\n  dest: [admin1]\n- match:\n  - users: [bob]\n  service: admin\n  dest: [admin2]\n",
+		[]string{"service 'admin' is defined several times with a different routing (dest, route_select or mode)"},
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - users: [alice]\n  service: default\n  route_select: random\n",
+		[]string{"service 'default' is defined several times with a different routing (dest, route_select or mode)"},
+	},
+}
+
+func TestServicesConflicts(t *testing.T) {
+	for _, tt := range servicesConflictsTests {
+		filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+		if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+			t.Fatalf("writing %s: %v", filename, err)
+		}
+		configs, err := LoadServicesConfigs(filename)
+		if err != nil {
+			t.Errorf("%q LoadServicesConfigs error = %v, want nil", tt.content, err)
+			continue
+		}
+		if got := ServicesConflicts(configs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q ServicesConflicts = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+var sourcesConflictsTests = []struct {
+	content string
+	want    []string
+}{
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - sources: [1.1.1.1:22]\n  service: admin\n- match:\n  - sources: [1.1.1.1:2022]\n  service: gpu\n",
+		nil,
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - sources: [1.1.1.1:22]\n  service: admin\n- match:\n  - sources: [1.1.1.1]\n  service: admin\n",
+		nil,
+	},
+	{
+		"dest: [server1]\noverrides:\n- match:\n  - sources: [1.1.1.1:22]\n  service: admin\n- match:\n  - users: [alice]\n  debug: true\n- match:\n  - groups: [foo]\n    sources: [2.2.2.2, 1.1.1.1]\n  service: gpu\n",
+		[]string{"services 'admin' (override 1) and 'gpu' (override 3) both match the sources 1.1.1.1:22 and 1.1.1.1: 'gpu' wins"},
+	},
+}
+
+func TestSourcesConflicts(t *testing.T) {
+	for _, tt := range sourcesConflictsTests {
+		filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+		if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+			t.Fatalf("writing %s: %v", filename, err)
+		}
+		got, err := SourcesConflicts(filename)
+		if err != nil {
+			t.Errorf("%q SourcesConflicts error = %v, want nil", tt.content, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q SourcesConflicts = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+var unknownConfigKeysTests = []struct {
+	content string
+	want    []string
+}{
+	{"dest: [server1]\ncheck_interval: 10s", nil},
+	{
+		"dest: [server1]\nroute_selection: random\netcd:\n  endpoint: [\"host1:2379\"]",
+		[]string{"line 2: unknown key 'route_selection'", "line 4: unknown key 'endpoint'"},
+	},
+	{
+		"dest: [server1]\noverrides:\n  - match:\n      - users: [alice]\n    dests: [server2]",
+		[]string{"line 5: unknown key 'dests'"},
+	},
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+	for _, tt := range unknownConfigKeysTests {
+		filename := filepath.Join(t.TempDir(), "sshproxy.yaml")
+		if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+			t.Fatalf("writing %s: %v", filename, err)
+		}
+		got, err := UnknownConfigKeys(filename)
+		if err != nil {
+			t.Errorf("%q UnknownConfigKeys error = %v, want nil", tt.content, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q UnknownConfigKeys = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidLoadConfig(t *testing.T) {
+	for _, tt := range loadConfigInvalidTests {
+		_, err := loadTestConfig(t, tt.content, "alice", nil, "")
+		if err == nil {
+			t.Errorf("%q LoadConfig got no error", tt.content)
+		} else if err.Error() != tt.want {
+			t.Errorf("%q LoadConfig error = %v, want %v", tt.content, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RouteTrace records the steps of the choice of a destination by
+// FindDestination. A nil *RouteTrace records nothing.
+type RouteTrace struct {
+	Steps []string
+}
+
+func (t *RouteTrace) addf(format string, args ...interface{}) {
+	if t != nil {
+		t.Steps = append(t.Steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// etcdChecker is a HostChecker which uses the states of the hosts stored in
+// etcd, and updates them when they are older than checkInterval.
+type etcdChecker struct {
+	LastState             State
+	checkInterval         Duration
+	connectTimeout        time.Duration
+	checkCommand          string
+	checkCommandTimeout   time.Duration
+	hostWriteInterval     time.Duration
+	availableStates       []State
+	destRewrite           map[string]string
+	maxConnectionsPerHost int
+	cli                   *Client
+	trace                 *RouteTrace
+}
+
+func (c *etcdChecker) Check(hostport string) bool {
+	ts := time.Now()
+	var host *Host
+	var err error
+	if c.cli != nil && c.cli.IsAlive() {
+		host, err = c.cli.GetHost(hostport)
+	} else {
+		host = &Host{}
+	}
+
+	switch {
+	case err != nil:
+		if err != ErrKeyNotFound {
+			mylog.Errorf("problem with etcd: %v", err)
+		}
+		c.LastState = c.doCheck(hostport)
+	case host.State == Disabled || host.State == Maintenance:
+		c.LastState = host.State
+	case ts.Sub(host.Ts) > c.checkInterval.Duration():
+		c.LastState = c.doCheck(hostport)
+	default:
+		c.LastState = host.State
+	}
+	if !slices.Contains(c.availableStates, c.LastState) {
+		c.trace.addf("%s skipped: host %s", hostport, c.LastState)
+		return false
+	}
+	if c.isCordoned(hostport) {
+		c.trace.addf("%s skipped: host cordoned", hostport)
+		return false
+	}
+	if c.isFull(hostport) {
+		c.trace.addf("%s skipped: max connections per host (%d) reached", hostport, c.maxConnectionsPerHost)
+		return false
+	}
+	c.trace.addf("%s accepted: host %s", hostport, c.LastState)
+	return true
+}
+
+// isCordoned returns true if the destination hostport is cordoned in etcd, so
+// that no new connection is routed to it.
+func (c *etcdChecker) isCordoned(hostport string) bool {
+	if c.cli == nil || !c.cli.IsAlive() {
+		return false
+	}
+	cordoned, err := c.cli.IsHostCordoned(hostport)
+	if err != nil {
+		mylog.Errorf("checking if %s is cordoned: %v", hostport, err)
+		return false
+	}
+	if cordoned {
+		mylog.Infof("%s is cordoned", hostport)
+	}
+	return cordoned
+}
+
+// isFull returns true if the destination hostport already has the maximum
+// number of connections per host.
+func (c *etcdChecker) isFull(hostport string) bool {
+	if c.maxConnectionsPerHost <= 0 || c.cli == nil || !c.cli.IsAlive() {
+		return false
+	}
+	count, err := c.cli.GetHostConnectionsCount(hostport)
+	if err != nil {
+		mylog.Errorf("getting connections count of %s: %v", hostport, err)
+		return false
+	}
+	if count >= c.maxConnectionsPerHost {
+		mylog.Infof("%s has reached the max connections per host (%d)", hostport, c.maxConnectionsPerHost)
+		return true
+	}
+	return false
+}
+
+// doCheck checks if the host hostport is alive and stores its state in etcd.
+// The state is not written if it is the same as the one stored in etcd and if
+// this one was written less than the host write interval ago (e.g. by another
+// gateway while the host was checked), to avoid redundant writes.
+func (c *etcdChecker) doCheck(hostport string) State {
+	ts := time.Now()
+	state := c.probe(hostport)
+	if c.cli == nil || !c.cli.IsAlive() {
+		return state
+	}
+	if c.hostWriteInterval > 0 {
+		if current, err := c.cli.GetHost(hostport); err == nil && current.State == state && ts.Sub(current.Ts) < c.hostWriteInterval {
+			mylog.Debugf("%s still %s, state not written in etcd", hostport, state)
+			return state
+		}
+	}
+	if err := c.cli.SetHost(hostport, state, ts); err != nil {
+		mylog.Errorf("setting host state in etcd: %v", err)
+	}
+	return state
+}
+
+// probe checks if the host hostport is alive, with the check command if any
+// or by connecting to it, and returns its state (Up or Down).
+func (c *etcdChecker) probe(hostport string) State {
+	addr := RewriteDest(c.destRewrite, hostport)
+	if c.checkCommand != "" {
+		if c.runCheckCommand(addr) {
+			return Up
+		}
+	} else if CanConnectTimeout(addr, c.connectTimeout) {
+		return Up
+	}
+	return Down
+}
+
+// runCheckCommand checks if the host hostport is alive by running the check
+// command, where {host} and {port} are replaced by the ones of hostport. The
+// host is alive if the command exits with 0 within the check command timeout.
+func (c *etcdChecker) runCheckCommand(hostport string) bool {
+	host, port, err := SplitHostPort(hostport)
+	if err != nil {
+		mylog.Errorf("checking %s: %v", hostport, err)
+		return false
+	}
+	replacer := strings.NewReplacer("{host}", host, "{port}", port)
+	args := strings.Fields(c.checkCommand)
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.checkCommandTimeout)
+	defer cancel()
+	if err := exec.CommandContext(ctx, args[0], args[1:]...).Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", c.checkCommandTimeout)
+		}
+		mylog.Infof("check command failed for %s: %v", hostport, err)
+		return false
+	}
+	return true
+}
+
+// newEtcdChecker returns the checker of the destinations of the service of
+// config, recording its steps in trace.
+func newEtcdChecker(cli *Client, config *Config, trace *RouteTrace) *etcdChecker {
+	checker := &etcdChecker{
+		checkInterval:         config.CheckInterval,
+		connectTimeout:        config.ConnectTimeout.Duration(),
+		checkCommand:          config.CheckCommand,
+		checkCommandTimeout:   config.CheckCommandTimeout.Duration(),
+		hostWriteInterval:     config.HostWriteInterval.Duration(),
+		destRewrite:           config.DestRewrite,
+		maxConnectionsPerHost: config.MaxConnectionsPerHost,
+		cli:                   cli,
+		trace:                 trace,
+	}
+	for _, s := range config.AvailableStates {
+		// the states were already validated when loading the configuration
+		state, _ := ParseState(s)
+		checker.availableStates = append(checker.availableStates, state)
+	}
+	return checker
+}
+
+// CheckDestination returns true if the destination hostport can be used by
+// the service of config, as checked when it is chosen by FindDestination: it
+// must be alive and in one of the available states, not cordoned and not have
+// reached the maximum number of connections per host. The steps of the check
+// are recorded in trace if it is not nil.
+func CheckDestination(cli *Client, config *Config, hostport string, trace *RouteTrace) bool {
+	return newEtcdChecker(cli, config, trace).Check(hostport)
+}
+
+// ProbeDestination checks if the destination hostport is alive right now as
+// sshproxy does for the service of config (with its check_command,
+// connect_timeout and dest_rewrite options), without using nor updating its
+// state in etcd. It returns Up or Down.
+func ProbeDestination(config *Config, hostport string) State {
+	return newEtcdChecker(nil, config, nil).probe(hostport)
+}
+
+// FindDestination finds a reachable destination for the sshd server according
+// to the etcd database if available or the config.Dest and config.RouteSelect
+// algorithm. In sticky mode, only the connections made from the subnet of the
+// source IP address are taken into account if the configuration says so. It
+// returns a string with host:port; an empty string if no destination is found
+// or an error if any. The steps of the choice are recorded in trace if it is
+// not nil.
+func FindDestination(cli *Client, username string, config *Config, sshdHostport string, source net.IP, trace *RouteTrace) (string, error) {
+	if len(config.Dest) == 0 {
+		// only possible with insecure_allow_empty_dest, when the
+		// configuration stored in etcd gives no destination
+		if err := config.EtcdConfigError(); err != nil {
+			return "", fmt.Errorf("no destination set for service %s: %v", config.Service, err)
+		}
+		return "", fmt.Errorf("no destination set for service %s", config.Service)
+	}
+
+	checker := newEtcdChecker(cli, config, trace)
+
+	key := fmt.Sprintf("%s@%s", username, config.Service)
+
+	if config.Mode == "sticky" && cli != nil && cli.IsAlive() {
+		subnet := SourceSubnet(source, config.StickySourcePrefix, config.StickySourcePrefix6)
+		dest, err := cli.GetDestination(key, config.EtcdKeyTTL, subnet)
+		if err != nil {
+			if err != ErrKeyNotFound {
+				mylog.Errorf("problem with etcd: %v", err)
+			}
+			trace.addf("sticky mode: no existing connection of %s", key)
+		} else {
+			trace.addf("sticky mode: existing connection(s) of %s to %s", key, dest)
+			if IsDestinationInRoutes(dest, config.Dest) {
+				if checker.Check(dest) {
+					mylog.Debugf("found destination in etcd: %s", dest)
+					return dest, nil
+				}
+				mylog.Infof("cannot connect %s to already existing connection(s) to %s: host %s", key, dest, checker.LastState)
+			} else {
+				mylog.Infof("cannot connect %s to already existing connection(s) to %s: not in routes", key, dest)
+				trace.addf("%s skipped: not in routes", dest)
+			}
+		}
+	} else if config.Mode == "sticky" {
+		trace.addf("sticky mode: etcd unavailable, existing connections not taken into account")
+	} else {
+		trace.addf("%s mode: existing connections not taken into account", config.Mode)
+	}
+
+	trace.addf("route_select %s among %v", config.RouteSelect, config.Dest)
+	return SelectRoute(config.RouteSelect, config.Dest, config.DestWeights, checker, cli, key, config.MaxProbes, &config.RouteExternal)
+}
@@ -0,0 +1,205 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestFindDestinationWithoutEtcd(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	upAddr := up.Addr().String()
+
+	content := fmt.Sprintf("dest: [\"%s\", \"%s\"]", downAddr, upAddr)
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+	trace := &RouteTrace{}
+	got, err := FindDestination(nil, "alice", config, "", nil, trace)
+	if err != nil {
+		t.Fatalf("FindDestination error = %v, want nil", err)
+	} else if got != upAddr {
+		t.Errorf("FindDestination = %q, want %q", got, upAddr)
+	}
+	want := []string{
+		"sticky mode: etcd unavailable, existing connections not taken into account",
+		fmt.Sprintf("route_select ordered among [%s %s]", downAddr, upAddr),
+		fmt.Sprintf("%s skipped: host down", downAddr),
+		fmt.Sprintf("%s accepted: host up", upAddr),
+	}
+	if !reflect.DeepEqual(trace.Steps, want) {
+		t.Errorf("FindDestination trace = %q, want %q", trace.Steps, want)
+	}
+}
+
+func TestFindDestinationCheckCommand(t *testing.T) {
+	content := "dest: [\"server1:22\", \"server2:2022\"]\ncheck_command: test {port} -eq 2022"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+	trace := &RouteTrace{}
+	got, err := FindDestination(nil, "alice", config, "", nil, trace)
+	if err != nil {
+		t.Fatalf("FindDestination error = %v, want nil", err)
+	} else if want := "server2:2022"; got != want {
+		t.Errorf("FindDestination = %q, want %q", got, want)
+	}
+	want := []string{
+		"sticky mode: etcd unavailable, existing connections not taken into account",
+		"route_select ordered among [server1:22 server2:2022]",
+		"server1:22 skipped: host down",
+		"server2:2022 accepted: host up",
+	}
+	if !reflect.DeepEqual(trace.Steps, want) {
+		t.Errorf("FindDestination trace = %q, want %q", trace.Steps, want)
+	}
+}
+
+func TestFindDestinationCheckCommandTimeout(t *testing.T) {
+	content := "dest: [server1]\ncheck_command: sleep 10\ncheck_command_timeout: 100ms"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+	start := time.Now()
+	got, err := FindDestination(nil, "alice", config, "", nil, nil)
+	if err != nil {
+		t.Fatalf("FindDestination error = %v, want nil", err)
+	} else if got != "" {
+		t.Errorf("FindDestination = %q, want \"\"", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("FindDestination took %s, the check command was not killed", elapsed)
+	}
+}
+
+// mapKV is an etcd KV storing the values of the keys in kvs. Only exact keys
+// are supported.
+type mapKV struct {
+	clientv3.KV
+	kvs map[string]string
+}
+
+func (kv *mapKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp := &clientv3.GetResponse{}
+	if v, ok := kv.kvs[key]; ok {
+		resp.Kvs = []*mvccpb.KeyValue{{Key: []byte(key), Value: []byte(v)}}
+		resp.Count = 1
+	}
+	return resp, nil
+}
+
+func (kv *mapKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	kv.kvs[key] = val
+	return &clientv3.PutResponse{}, nil
+}
+
+func TestCheckDestination(t *testing.T) {
+	content := "dest: [server1, server2, server3, server4]\ncheck_command: test {host} != server4"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+	kv := &mapKV{kvs: map[string]string{}}
+	cli := &Client{cli: &clientv3.Client{KV: kv}, requestTimeout: time.Second, active: true}
+	cli.setNamespace("")
+	now, _ := json.Marshal(time.Now())
+	kv.kvs[cli.toHostKey("server1:22")] = fmt.Sprintf(`{"State":"up","Ts":%s}`, now)
+	kv.kvs[cli.toHostKey("server2:22")] = fmt.Sprintf(`{"State":"disabled","Ts":%s}`, now)
+	kv.kvs[cli.toHostKey("server3:22")] = fmt.Sprintf(`{"State":"up","Ts":%s}`, now)
+	kv.kvs[cli.cordonedPath+"/server3:22"] = "2026-01-01T00:00:00Z"
+	for _, tt := range []struct {
+		dest string
+		want bool
+		step string
+	}{
+		{"server1:22", true, "server1:22 accepted: host up"},
+		{"server2:22", false, "server2:22 skipped: host disabled"},
+		{"server3:22", false, "server3:22 skipped: host cordoned"},
+		{"server4:22", false, "server4:22 skipped: host down"},
+	} {
+		trace := &RouteTrace{}
+		if got := CheckDestination(cli, config, tt.dest, trace); got != tt.want {
+			t.Errorf("CheckDestination(%s) = %v, want %v", tt.dest, got, tt.want)
+		}
+		if len(trace.Steps) != 1 || trace.Steps[0] != tt.step {
+			t.Errorf("CheckDestination(%s) trace = %q, want [%q]", tt.dest, trace.Steps, tt.step)
+		}
+	}
+}
+
+func TestDoCheckHostWriteInterval(t *testing.T) {
+	kv := &mapKV{kvs: map[string]string{}}
+	cli := &Client{cli: &clientv3.Client{KV: kv}, requestTimeout: time.Second, active: true}
+	cli.setNamespace("")
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		state   State
+		age     time.Duration
+		command string
+		written bool
+	}{
+		{"same state written recently", Up, 10 * time.Second, "true", false},
+		{"same state written long ago", Up, 2 * time.Minute, "true", true},
+		{"state changed", Up, 10 * time.Second, "false", true},
+	} {
+		key := cli.toHostKey("server1:22")
+		ts, _ := json.Marshal(now.Add(-tt.age))
+		previous := fmt.Sprintf(`{"State":"%s","Ts":%s}`, tt.state, ts)
+		kv.kvs[key] = previous
+		checker := &etcdChecker{cli: cli, checkCommand: tt.command, checkCommandTimeout: time.Second, hostWriteInterval: time.Minute}
+		checker.doCheck("server1:22")
+		if written := kv.kvs[key] != previous; written != tt.written {
+			t.Errorf("%s: state written = %v, want %v", tt.name, written, tt.written)
+		}
+	}
+}
+
+func TestProbeDestination(t *testing.T) {
+	content := "dest: [server1, server2]\ncheck_command: test {host}:{port} = actual:2022\ndest_rewrite:\n  server1: actual:2022"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("LoadConfig error = %v, want nil", err)
+	}
+	for _, tt := range []struct {
+		dest string
+		want State
+	}{
+		{"server1:22", Up},
+		{"server2:22", Down},
+	} {
+		if got := ProbeDestination(config, tt.dest); got != tt.want {
+			t.Errorf("ProbeDestination(%s) = %s, want %s", tt.dest, got, tt.want)
+		}
+	}
+}
@@ -42,6 +42,11 @@ func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// String returns the duration formatted like a time.Duration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
 // Duration returns a time.Duration object.
 func (d *Duration) Duration() time.Duration {
 	return time.Duration(*d)
@@ -18,14 +18,18 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -38,18 +42,39 @@ type State int
 //
 //	Up: host is up,
 //	Down: host is down,
-//	Disabled: host was disabled by an admin.
+//	Disabled: host was disabled by an admin,
+//	Maintenance: host was put in maintenance by an admin.
+//
+// New states must be added at the end: older clients decode the states they
+// don't know as Unknown.
 const (
 	Unknown State = iota
 	Up
 	Down
 	Disabled
+	Maintenance
 )
 
 var (
 	keyRegex = regexp.MustCompile(`^([^@]+)@([^:]+)$`)
 )
 
+// States returns the names of all the possible states of a host.
+func States() []string {
+	return []string{Unknown.String(), Up.String(), Down.String(), Disabled.String(), Maintenance.String()}
+}
+
+// ParseState returns the state named s (case insensitive) or an error if
+// there is no such state.
+func ParseState(s string) (State, error) {
+	for _, state := range []State{Unknown, Up, Down, Disabled, Maintenance} {
+		if strings.EqualFold(s, state.String()) {
+			return state, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown state: %s", s)
+}
+
 func (s State) String() string {
 	switch s {
 	default:
@@ -60,6 +85,8 @@ func (s State) String() string {
 		return "down"
 	case Disabled:
 		return "disabled"
+	case Maintenance:
+		return "maintenance"
 	}
 }
 
@@ -70,16 +97,8 @@ func (s *State) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &t); err != nil {
 		return err
 	}
-	switch strings.ToLower(t) {
-	default:
-		*s = Unknown
-	case "up":
-		*s = Up
-	case "down":
-		*s = Down
-	case "disabled":
-		*s = Disabled
-	}
+	// states unknown to this version are decoded as Unknown
+	*s, _ = ParseState(t)
 	return nil
 }
 
@@ -89,36 +108,110 @@ func (s State) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.String())
 }
 
-var (
-	etcdRootPath        = "/sshproxy"
-	etcdConnectionsPath = etcdRootPath + "/connections"
-	etcdHistoryPath     = etcdRootPath + "/history"
-	etcdHostsPath       = etcdRootPath + "/hosts"
+// defaultEtcdPrefix is the prefix of all the keys used by sshproxy when the
+// prefix option of etcd is not set.
+const defaultEtcdPrefix = "/sshproxy"
+
+// defaultEtcdTimeout is the timeout of the requests to etcd and of the
+// connection to etcd when they are not configured.
+const defaultEtcdTimeout = 2 * time.Second
+
+// etcdTimeout returns the configured timeout, or defaultEtcdTimeout if it is
+// not set.
+func etcdTimeout(timeout Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultEtcdTimeout
+	}
+	return timeout.Duration()
+}
 
+var (
 	// ErrKeyNotFound is returned when key is not found in etcd.
 	ErrKeyNotFound = errors.New("key not found")
+	// ErrCompacted is returned when the etcd store is already compacted
+	// beyond the requested revision.
+	ErrCompacted = errors.New("revision already compacted")
+	// ErrWatchClosed is returned when a watch is closed by etcd or because
+	// the connection to etcd was replaced, without the expected event.
+	ErrWatchClosed = errors.New("watch closed")
 )
 
-func toConnectionKey(d string) string {
-	return fmt.Sprintf("%s/%s", etcdConnectionsPath, d)
+func (c *Client) toConnectionKey(d string) string {
+	return fmt.Sprintf("%s/%s", c.connectionsPath, d)
 }
 
-func toHistoryKey(d string) string {
-	return fmt.Sprintf("%s/%s", etcdHistoryPath, d)
+func (c *Client) toHistoryKey(d string) string {
+	return fmt.Sprintf("%s/%s", c.historyPath, d)
 }
 
-func toHostKey(h string) string {
-	return fmt.Sprintf("%s/%s", etcdHostsPath, h)
+func (c *Client) toHostKey(h string) string {
+	return fmt.Sprintf("%s/%s", c.hostsPath, h)
+}
+
+// setNamespace sets the paths of the connections, history and hosts trees of
+// the namespace ns (the default tree if ns is empty) under the prefix of the
+// client.
+func (c *Client) setNamespace(ns string) {
+	root := c.prefix
+	if ns != "" {
+		root = fmt.Sprintf("%s/namespaces/%s", c.prefix, ns)
+	}
+	c.namespace = ns
+	c.rootPath = root
+	c.connectionsPath = root + "/connections"
+	c.historyPath = root + "/history"
+	c.hostsPath = root + "/hosts"
+	c.ratelimitPath = root + "/ratelimit"
+	c.limitsPath = root + "/limits"
+	c.cordonedPath = root + "/cordoned"
+}
+
+// WithNamespace returns a client using the trees of the namespace ns (the
+// default trees if ns is empty). It shares its connection to etcd with c, so
+// only one of them must be closed.
+func (c *Client) WithNamespace(ns string) *Client {
+	nc := *c
+	nc.setNamespace(ns)
+	return &nc
+}
+
+// DryRun returns a client which does not write the states of the hosts nor
+// the scores of the routes, to simulate the choice of a destination without
+// modifying etcd. It shares its connection to etcd with c, so only one of them
+// must be closed.
+func (c *Client) DryRun() *Client {
+	nc := *c
+	nc.dryRun = true
+	return &nc
 }
 
 // Client is a wrapper to easily do request to etcd cluster.
 type Client struct {
 	cli            *clientv3.Client
+	lock           *sync.RWMutex // protects cli, replaced by Reauthenticate
+	config         *Config       // used to create a new client when re-authenticating
 	log            *logging.Logger
 	requestTimeout time.Duration
 	keyTTL         int64
 	active         bool
 	leaseID        clientv3.LeaseID
+	connection     Connection // value of the connection set by SetDestination
+	dryRun         bool       // see DryRun
+
+	// keys shared by all the namespaces
+	prefix               string
+	errorBannerKey       string
+	errorBannerExpireKey string
+
+	// trees of the namespace used by the client
+	namespace       string
+	rootPath        string
+	connectionsPath string
+	historyPath     string
+	hostsPath       string
+	ratelimitPath   string
+	limitsPath      string
+	cordonedPath    string
 }
 
 // Host represents the state of a host.
@@ -133,8 +226,96 @@ type Bandwidth struct {
 	Out int // stdout + stderr
 }
 
+// Connection represents the value of a connection stored in etcd. The
+// additional information is omitted when empty, so that connections stored
+// by older versions (with only the bandwidth) can still be decoded.
+type Connection struct {
+	Bandwidth
+	Kind   string   `json:",omitempty"` // kind of session (see SessionKind)
+	Groups []string `json:",omitempty"` // groups of the user at connection time
+	Source string   `json:",omitempty"` // IP address of the client
+	// Mode and RouteSelect are the mode and the route_select algorithm of
+	// the service when the destination was chosen
+	Mode        string `json:",omitempty"`
+	RouteSelect string `json:",omitempty"`
+}
+
+// bootstrapClient is the connection to etcd opened to read the configuration
+// from etcd (see the config_from_etcd option), with the etcd options used to
+// open it. It is reused by the first client created with the same options, so
+// that sshproxy only connects once to etcd.
+var bootstrapClient struct {
+	lock    sync.Mutex
+	cli     *clientv3.Client
+	options etcdConfig
+}
+
+// keepBootstrapClient keeps the connection cli, opened with the etcd options
+// of config, to be reused by NewEtcdClient.
+func keepBootstrapClient(config *Config, cli *clientv3.Client) {
+	bootstrapClient.lock.Lock()
+	defer bootstrapClient.lock.Unlock()
+	if bootstrapClient.cli != nil {
+		bootstrapClient.cli.Close()
+	}
+	bootstrapClient.cli = cli
+	bootstrapClient.options = config.Etcd
+}
+
+// takeBootstrapClient returns the connection kept by keepBootstrapClient if
+// it was opened with the etcd options of config, nil otherwise. The caller
+// then owns it.
+func takeBootstrapClient(config *Config) *clientv3.Client {
+	bootstrapClient.lock.Lock()
+	defer bootstrapClient.lock.Unlock()
+	cli := bootstrapClient.cli
+	if cli == nil || !reflect.DeepEqual(bootstrapClient.options, config.Etcd) {
+		return nil
+	}
+	bootstrapClient.cli = nil
+	return cli
+}
+
 // NewEtcdClient creates a new etcd client.
 func NewEtcdClient(config *Config, log *logging.Logger) (*Client, error) {
+	cli := takeBootstrapClient(config)
+	if cli == nil {
+		var err error
+		cli, err = newEtcdClientv3(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyTTL := config.Etcd.KeyTTL
+	if keyTTL == 0 {
+		keyTTL = 5
+	}
+	prefix := config.Etcd.Prefix
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+
+	c := &Client{
+		cli:            cli,
+		lock:           &sync.RWMutex{},
+		config:         config,
+		log:            log,
+		requestTimeout: etcdTimeout(config.Etcd.RequestTimeout),
+		keyTTL:         keyTTL,
+		active:         true,
+
+		prefix:               prefix,
+		errorBannerKey:       prefix + "/error_banner/value",
+		errorBannerExpireKey: prefix + "/error_banner/expire",
+	}
+	c.setNamespace(config.EtcdNamespace)
+	return c, nil
+}
+
+// newEtcdClientv3 creates a new client of the etcd library. The password is
+// read from the passwordfile option of etcd if it is set.
+func newEtcdClientv3(config *Config) (*clientv3.Client, error) {
 	var tlsConfig *tls.Config
 
 	if config.Etcd.TLS.CertFile != "" && config.Etcd.TLS.KeyFile != "" {
@@ -154,12 +335,21 @@ func NewEtcdClient(config *Config, log *logging.Logger) (*Client, error) {
 		tlsConfig = cfg
 	}
 
+	password := config.Etcd.Password
+	if config.Etcd.PasswordFile != "" {
+		content, err := os.ReadFile(config.Etcd.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading etcd password: %v", err)
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+
 	cli, err := clientv3.New(clientv3.Config{
-		DialTimeout: 2 * time.Second,
+		DialTimeout: etcdTimeout(config.Etcd.DialTimeout),
 		Endpoints:   config.Etcd.Endpoints,
 		TLS:         tlsConfig,
 		Username:    config.Etcd.Username,
-		Password:    config.Etcd.Password,
+		Password:    password,
 		// TODO: find an other way to disable the etcd backend if it doesn't
 		// respond immediately
 		//lint:ignore SA1019 WithBlock is deprecated
@@ -175,19 +365,53 @@ func NewEtcdClient(config *Config, log *logging.Logger) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("creating etcd client: %v", err)
 	}
+	return cli, nil
+}
 
-	keyTTL := config.Etcd.KeyTTL
-	if keyTTL == 0 {
-		keyTTL = 5
+// Reauthenticate replaces the connection to etcd by a new one, authenticated
+// with fresh credentials (the passwordfile option of etcd is read again). It
+// is used when the authentication token of a long session has expired. The
+// watches of the previous connection are closed (see ErrWatchClosed) and must
+// be started again.
+func (c *Client) Reauthenticate() error {
+	cli, err := newEtcdClientv3(c.config)
+	if err != nil {
+		return err
 	}
+	c.lock.Lock()
+	old := c.cli
+	c.cli = cli
+	c.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
 
-	return &Client{
-		cli:            cli,
-		log:            log,
-		requestTimeout: 2 * time.Second,
-		keyTTL:         keyTTL,
-		active:         true,
-	}, nil
+// etcd returns the connection to etcd, which can be replaced concurrently by
+// Reauthenticate.
+func (c *Client) etcd() *clientv3.Client {
+	if c.lock == nil {
+		return c.cli
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cli
+}
+
+// IsAuthError returns true if err is an authentication error returned by
+// etcd, which may be fixed by re-authenticating.
+func IsAuthError(err error) bool {
+	return errors.Is(err, rpctypes.ErrInvalidAuthToken) ||
+		errors.Is(err, rpctypes.ErrAuthOldRevision) ||
+		errors.Is(err, rpctypes.ErrAuthFailed) ||
+		errors.Is(err, rpctypes.ErrUserEmpty)
+}
+
+// IsPermissionError returns true if err is returned by etcd because the user
+// is not allowed to do the request (e.g. a write with a read-only role).
+func IsPermissionError(err error) bool {
+	return errors.Is(err, rpctypes.ErrPermissionDenied)
 }
 
 // NewCertPool creates x509 certPool with provided CA files.
@@ -217,6 +441,10 @@ func newCertPool(CAFile string) (*x509.CertPool, error) {
 
 // Close terminates the etcd client.
 func (c *Client) Close() {
+	if c.lock != nil {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+	}
 	if c.cli != nil {
 		c.cli.Close()
 		c.cli = nil
@@ -224,13 +452,18 @@ func (c *Client) Close() {
 }
 
 // GetDestination returns the destination found in etcd for a user connected to
-// an SSH daemon (key). If the key is not present and etcdKeyTTL is defined,
-// the key is searched in history. If it's not found, the error will be
-// etcd.ErrKeyNotFound.
-func (c *Client) GetDestination(key string, etcdKeyTTL int64) (string, error) {
-	path := toConnectionKey(key)
+// an SSH daemon (key). If subnet is not nil, only the connections made from
+// this subnet are taken into account and the history is not searched (it does
+// not know the source of the connections). Otherwise, if the key is not
+// present and etcdKeyTTL is defined, the key is searched in history. If it's
+// not found, the error will be etcd.ErrKeyNotFound.
+func (c *Client) GetDestination(key string, etcdKeyTTL int64, subnet *net.IPNet) (string, error) {
+	path := c.toConnectionKey(key)
+	if subnet != nil {
+		return c.getDestinationFromSubnet(path, subnet)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, path, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	resp, err := c.etcd().Get(ctx, path, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
 	cancel()
 	if err != nil {
 		return "", err
@@ -238,9 +471,9 @@ func (c *Client) GetDestination(key string, etcdKeyTTL int64) (string, error) {
 
 	if len(resp.Kvs) == 0 {
 		if etcdKeyTTL > 0 {
-			history := toHistoryKey(key)
+			history := c.toHistoryKey(key)
 			ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-			resp, err := c.cli.Get(ctx, history, clientv3.WithPrefix())
+			resp, err := c.etcd().Get(ctx, history, clientv3.WithPrefix())
 			cancel()
 			if err != nil {
 				return "", err
@@ -258,10 +491,35 @@ func (c *Client) GetDestination(key string, etcdKeyTTL int64) (string, error) {
 	return dest[0], nil
 }
 
+// getDestinationFromSubnet returns the destination of the connections stored
+// under path and made from subnet. If there is no such connection, the error
+// will be etcd.ErrKeyNotFound.
+func (c *Client) getDestinationFromSubnet(path string, subnet *net.IPNet) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, path, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	cancel()
+	if err != nil {
+		return "", err
+	}
+
+	for _, ev := range resp.Kvs {
+		conn := &Connection{}
+		if err := json.Unmarshal(ev.Value, conn); err != nil {
+			return "", fmt.Errorf("decoding JSON data at '%s': %v", ev.Key, err)
+		}
+		// connections stored without their source are ignored
+		if ip := net.ParseIP(conn.Source); ip != nil && subnet.Contains(ip) {
+			subkey := string(ev.Key)[len(path)+1:]
+			return strings.SplitN(subkey, "/", 2)[0], nil
+		}
+	}
+	return "", ErrKeyNotFound
+}
+
 func (c *Client) getExistingLease(key string) (string, error) {
-	history := toHistoryKey(key)
+	history := c.toHistoryKey(key)
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, history, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	resp, err := c.etcd().Get(ctx, history, clientv3.WithPrefix(), clientv3.WithKeysOnly())
 	cancel()
 	if err != nil {
 		return "", err
@@ -275,9 +533,10 @@ func (c *Client) getExistingLease(key string) (string, error) {
 	return lease, nil
 }
 
-// SetDestination set current destination in etcd.
-func (c *Client) SetDestination(rootctx context.Context, key, sshdHostport string, dst string, etcdKeyTTL int64) (<-chan *clientv3.LeaseKeepAliveResponse, string, error) {
-	path := fmt.Sprintf("%s/%s/%s/%s", toConnectionKey(key), dst, sshdHostport, time.Now().Format(time.RFC3339Nano))
+// SetDestination set current destination in etcd. The information of conn
+// (except the bandwidth) is stored with the connection.
+func (c *Client) SetDestination(rootctx context.Context, key, sshdHostport string, dst string, etcdKeyTTL int64, conn *Connection) (<-chan *clientv3.LeaseKeepAliveResponse, string, error) {
+	path := fmt.Sprintf("%s/%s/%s/%s", c.toConnectionKey(key), dst, sshdHostport, time.Now().Format(time.RFC3339Nano))
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
 	var history string
 	var historyID clientv3.LeaseID
@@ -287,39 +546,41 @@ func (c *Client) SetDestination(rootctx context.Context, key, sshdHostport strin
 			tmpHistoryID, _ := strconv.Atoi(lease)
 			historyID = clientv3.LeaseID(tmpHistoryID)
 		} else {
-			respHistory, err := c.cli.Grant(ctx, etcdKeyTTL)
+			respHistory, err := c.etcd().Grant(ctx, etcdKeyTTL)
 			if err == nil {
 				historyID = respHistory.ID
 			}
 		}
-		history = fmt.Sprintf("%s/%d", toHistoryKey(key), int64(historyID))
+		history = fmt.Sprintf("%s/%d", c.toHistoryKey(key), int64(historyID))
 	}
-	resp, err := c.cli.Grant(ctx, c.keyTTL)
+	resp, err := c.etcd().Grant(ctx, c.keyTTL)
 	cancel()
 	if err != nil {
 		return nil, "", err
 	}
 
-	bytes, err := json.Marshal(&Bandwidth{
+	c.connection = *conn
+	c.connection.Bandwidth = Bandwidth{
 		In:  0,
 		Out: 0,
-	})
+	}
+	bytes, err := json.Marshal(&c.connection)
 	if err != nil {
 		return nil, "", err
 	}
 	ctx, cancel = context.WithTimeout(context.Background(), c.requestTimeout)
-	_, err = c.cli.Put(ctx, path, string(bytes), clientv3.WithLease(resp.ID))
+	_, err = c.etcd().Put(ctx, path, string(bytes), clientv3.WithLease(resp.ID))
 	if etcdKeyTTL > 0 {
-		_, err = c.cli.Put(ctx, history, dst, clientv3.WithLease(historyID))
+		_, err = c.etcd().Put(ctx, history, dst, clientv3.WithLease(historyID))
 	}
 	cancel()
 	if err != nil {
 		return nil, "", err
 	}
 
-	k, e := c.cli.KeepAlive(rootctx, resp.ID)
+	k, e := c.etcd().KeepAlive(rootctx, resp.ID)
 	if etcdKeyTTL > 0 {
-		c.cli.KeepAlive(rootctx, historyID)
+		c.etcd().KeepAlive(rootctx, historyID)
 	}
 	c.leaseID = resp.ID
 	return k, path, e
@@ -328,29 +589,30 @@ func (c *Client) SetDestination(rootctx context.Context, key, sshdHostport strin
 // NewLease creates a new lease in etcd.
 func (c *Client) NewLease(rootctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Grant(ctx, c.keyTTL)
+	resp, err := c.etcd().Grant(ctx, c.keyTTL)
 	cancel()
 	if err != nil {
 		return nil, err
 	}
 
-	k, e := c.cli.KeepAlive(rootctx, resp.ID)
+	k, e := c.etcd().KeepAlive(rootctx, resp.ID)
 	c.leaseID = resp.ID
 	return k, e
 }
 
 // UpdateStats updates the stats (bandwidth in and out in kB/s) of a connection.
 func (c *Client) UpdateStats(etcdPath string, stats map[int]uint64) error {
-	bytes, err := json.Marshal(&Bandwidth{
+	c.connection.Bandwidth = Bandwidth{
 		In:  int(stats[0] / 1024),
 		Out: int((stats[1] + stats[2]) / 1024),
-	})
+	}
+	bytes, err := json.Marshal(&c.connection)
 	if err != nil {
 		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	_, err = c.cli.Put(ctx, etcdPath, string(bytes), clientv3.WithLease(c.leaseID))
+	_, err = c.etcd().Put(ctx, etcdPath, string(bytes), clientv3.WithLease(c.leaseID))
 	cancel()
 	if err != nil {
 		return err
@@ -363,10 +625,10 @@ func (c *Client) UpdateStats(etcdPath string, stats map[int]uint64) error {
 // present the error will be etcd.ErrKeyNotFound.
 func (c *Client) GetHost(hostport string) (*Host, error) {
 	var h Host
-	key := toHostKey(hostport)
+	key := c.toHostKey(hostport)
 
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, key)
+	resp, err := c.etcd().Get(ctx, key)
 	cancel()
 	if err != nil {
 		return nil, err
@@ -387,21 +649,25 @@ func (c *Client) GetHost(hostport string) (*Host, error) {
 	// not reached
 }
 
-// DelHost deletes a host (passed as "host:port") in etcd.
-func (c *Client) DelHost(hostport string) error {
-	key := toHostKey(hostport)
+// DelHost deletes a host (passed as "host:port") in etcd and returns the
+// number of keys deleted (0 if the host was not in etcd).
+func (c *Client) DelHost(hostport string) (int64, error) {
+	key := c.toHostKey(hostport)
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	_, err := c.cli.Delete(ctx, key)
+	resp, err := c.etcd().Delete(ctx, key)
 	cancel()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return resp.Deleted, nil
 }
 
 // SetHost sets a host (passed as "host:port") state and last checked time (ts)
-// in etcd.
+// in etcd. Nothing is written by a dry run client.
 func (c *Client) SetHost(hostport string, state State, ts time.Time) error {
+	if c.dryRun {
+		return nil
+	}
 	bytes, err := json.Marshal(&Host{
 		State: state,
 		Ts:    ts,
@@ -409,9 +675,9 @@ func (c *Client) SetHost(hostport string, state State, ts time.Time) error {
 	if err != nil {
 		return err
 	}
-	key := toHostKey(hostport)
+	key := c.toHostKey(hostport)
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	_, err = c.cli.Put(ctx, key, string(bytes))
+	_, err = c.etcd().Put(ctx, key, string(bytes))
 	cancel()
 	if err != nil {
 		return err
@@ -419,15 +685,107 @@ func (c *Client) SetHost(hostport string, state State, ts time.Time) error {
 	return nil
 }
 
+// SetHostWithTTL sets the state of a host in etcd for ttl only: the key of the
+// host is attached to a lease of this duration, so it is deleted when the
+// lease expires and the host is then checked again as an unknown host.
+func (c *Client) SetHostWithTTL(hostport string, state State, ts time.Time, ttl time.Duration) error {
+	bytes, err := json.Marshal(&Host{
+		State: state,
+		Ts:    ts,
+	})
+	if err != nil {
+		return err
+	}
+	key := c.toHostKey(hostport)
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	// etcd leases have a granularity of one second
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	lease, err := c.etcd().Grant(ctx, seconds)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd().Put(ctx, key, string(bytes), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// GetConfig returns the configuration file stored in etcd at key.
+// ErrKeyNotFound is returned if there is no such key.
+func (c *Client) GetConfig(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// GetRouteScores returns the scores of the hosts fetched from url by the
+// external route_select algorithm and cached in etcd. ErrKeyNotFound is
+// returned if there is no valid cache.
+func (c *Client) GetRouteScores(url string) (map[string]float64, error) {
+	key := c.rootPath + "/route_scores"
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	var cache struct {
+		URL    string
+		Scores map[string]float64
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &cache); err != nil {
+		return nil, fmt.Errorf("decoding JSON data at '%s': %v", key, err)
+	}
+	// the cache is shared by the services of the namespace
+	if cache.URL != url {
+		return nil, ErrKeyNotFound
+	}
+	return cache.Scores, nil
+}
+
+// SetRouteScores caches in etcd the scores of the hosts fetched from url by
+// the external route_select algorithm during a given time. Nothing is written
+// by a dry run client.
+func (c *Client) SetRouteScores(url string, scores map[string]float64, duration time.Duration) error {
+	if c.dryRun {
+		return nil
+	}
+	bytes, err := json.Marshal(map[string]interface{}{
+		"URL":    url,
+		"Scores": scores,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	resp, err := c.etcd().Grant(ctx, int64(duration.Seconds()))
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd().Put(ctx, c.rootPath+"/route_scores", string(bytes), clientv3.WithLease(resp.ID))
+	return err
+}
+
 // GetErrorBanner returns the current error banner. If error banner is not
 // present an empty string will be returned, without error.
 func (c *Client) GetErrorBanner() (string, string, error) {
-	key := "/sshproxy/error_banner/value"
-	keyExpire := "/sshproxy/error_banner/expire"
+	key := c.errorBannerKey
+	keyExpire := c.errorBannerExpireKey
 
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, key)
-	expire, err2 := c.cli.Get(ctx, keyExpire)
+	resp, err := c.etcd().Get(ctx, key)
+	expire, err2 := c.etcd().Get(ctx, keyExpire)
 	cancel()
 	if err != nil {
 		return "", "", err
@@ -458,8 +816,8 @@ func (c *Client) GetErrorBanner() (string, string, error) {
 // DelErrorBanner deletes the error banner in etcd.
 func (c *Client) DelErrorBanner() error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	_, err := c.cli.Delete(ctx, "/sshproxy/error_banner/value")
-	_, err2 := c.cli.Delete(ctx, "/sshproxy/error_banner/expire")
+	_, err := c.etcd().Delete(ctx, c.errorBannerKey)
+	_, err2 := c.etcd().Delete(ctx, c.errorBannerExpireKey)
 	cancel()
 	if err != nil {
 		return err
@@ -472,20 +830,20 @@ func (c *Client) DelErrorBanner() error {
 
 // SetErrorBanner sets the error banner in etcd during a given time.
 func (c *Client) SetErrorBanner(errorBanner string, expire time.Time) error {
-	key := "/sshproxy/error_banner/value"
-	keyExpire := "/sshproxy/error_banner/expire"
+	key := c.errorBannerKey
+	keyExpire := c.errorBannerExpireKey
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
 	defer cancel()
 	currentTime := time.Now()
 	diff := expire.Sub(currentTime)
 	seconds := int64(diff.Seconds())
 	if seconds > 0 {
-		resp, err := c.cli.Grant(context.TODO(), seconds)
+		resp, err := c.etcd().Grant(context.TODO(), seconds)
 		if err != nil {
 			return err
 		}
-		_, err = c.cli.Put(ctx, key, errorBanner, clientv3.WithLease(resp.ID))
-		_, err2 := c.cli.Put(ctx, keyExpire, expire.Format("2006-01-02 15:04:05"), clientv3.WithLease(resp.ID))
+		_, err = c.etcd().Put(ctx, key, errorBanner, clientv3.WithLease(resp.ID))
+		_, err2 := c.etcd().Put(ctx, keyExpire, expire.Format("2006-01-02 15:04:05"), clientv3.WithLease(resp.ID))
 		if err != nil {
 			return err
 		}
@@ -493,8 +851,8 @@ func (c *Client) SetErrorBanner(errorBanner string, expire time.Time) error {
 			return err2
 		}
 	} else {
-		_, err := c.cli.Put(ctx, key, errorBanner)
-		_, err2 := c.cli.Delete(ctx, keyExpire)
+		_, err := c.etcd().Put(ctx, key, errorBanner)
+		_, err2 := c.etcd().Delete(ctx, keyExpire)
 		if err != nil {
 			return err
 		}
@@ -505,22 +863,102 @@ func (c *Client) SetErrorBanner(errorBanner string, expire time.Time) error {
 	return nil
 }
 
+// UserLimit is a temporary maximum number of connections of a user stored in
+// etcd. It replaces the max_connections_per_user option until it expires.
+type UserLimit struct {
+	Max    int
+	Expire time.Time
+}
+
+// SetUserLimit sets in etcd the maximum number of connections of a user until
+// expire: the key is attached to a lease expiring at this date.
+func (c *Client) SetUserLimit(username string, max int, expire time.Time) error {
+	// etcd leases have a granularity of one second
+	seconds := int64((time.Until(expire) + time.Second - 1) / time.Second)
+	if seconds <= 0 {
+		return fmt.Errorf("%s is in the past", expire.Format("2006-01-02 15:04:05"))
+	}
+	bytes, err := json.Marshal(&UserLimit{
+		Max:    max,
+		Expire: expire,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	lease, err := c.etcd().Grant(ctx, seconds)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd().Put(ctx, fmt.Sprintf("%s/%s", c.limitsPath, username), string(bytes), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// GetUserLimit returns the maximum number of connections of a user set in
+// etcd by SetUserLimit. ErrKeyNotFound is returned if there is none or if it
+// has expired.
+func (c *Client) GetUserLimit(username string) (*UserLimit, error) {
+	key := fmt.Sprintf("%s/%s", c.limitsPath, username)
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	var limit UserLimit
+	if err := json.Unmarshal(resp.Kvs[0].Value, &limit); err != nil {
+		return nil, fmt.Errorf("decoding JSON data at '%s': %v", key, err)
+	}
+	return &limit, nil
+}
+
+// DelUserLimit deletes the maximum number of connections of a user set in
+// etcd by SetUserLimit. It returns the number of deleted keys.
+func (c *Client) DelUserLimit(username string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Delete(ctx, fmt.Sprintf("%s/%s", c.limitsPath, username))
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
+
 // FlatConnection is a structure used to flatten a connection information
 // present in etcd.
 type FlatConnection struct {
-	User    string
-	Service string
-	From    string
-	Dest    string
-	Ts      time.Time
-	BwIn    int
-	BwOut   int
+	User        string
+	Service     string
+	From        string
+	Dest        string
+	Ts          time.Time
+	BwIn        int
+	BwOut       int
+	Kind        string
+	Groups      []string `json:",omitempty"`
+	Mode        string   `json:",omitempty"`
+	RouteSelect string   `json:",omitempty"`
 }
 
-// GetAllConnections returns a list of all connections present in etcd.
-func (c *Client) GetAllConnections() ([]*FlatConnection, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, etcdConnectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+// requestContext returns the context of a request made on behalf of ctx: if
+// ctx has a deadline, it bounds the request (and the other requests made with
+// ctx), otherwise the request is bounded by the request timeout of the client.
+func (c *Client) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.requestTimeout)
+}
+
+// GetAllConnections returns a list of all connections present in etcd. The
+// deadline of ctx, if any, replaces the request timeout of the client.
+func (c *Client) GetAllConnections(ctx context.Context) ([]*FlatConnection, error) {
+	ctx, cancel := c.requestContext(ctx)
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
 	if err != nil {
 		return nil, err
@@ -528,42 +966,282 @@ func (c *Client) GetAllConnections() ([]*FlatConnection, error) {
 
 	conns := make([]*FlatConnection, len(resp.Kvs))
 	for i, ev := range resp.Kvs {
-		v := &FlatConnection{}
-		subkey := string(ev.Key)[len(etcdConnectionsPath)+1:]
-		fields := strings.Split(subkey, "/")
-		if len(fields) != 4 {
-			return nil, fmt.Errorf("bad key format %s", subkey)
+		v, err := c.parseConnectionKey(string(ev.Key))
+		if err != nil {
+			return nil, err
+		}
+		conn := &Connection{}
+		if err := json.Unmarshal(ev.Value, conn); err != nil {
+			return nil, fmt.Errorf("decoding JSON data at '%s': %v", ev.Key, err)
 		}
+		v.BwIn = conn.In
+		v.BwOut = conn.Out
+		v.Kind = conn.Kind
+		v.Groups = conn.Groups
+		v.Mode = conn.Mode
+		v.RouteSelect = conn.RouteSelect
+		conns[i] = v
+	}
+
+	return conns, nil
+}
 
-		userservice := fields[0]
-		v.Dest = fields[1]
-		v.From = fields[2]
-		v.Ts, err = time.Parse(time.RFC3339Nano, fields[3])
+// GetAllConnectionsInNamespaces returns the connections present in etcd in
+// each of the namespaces (see WithNamespace). If ctx has a deadline, it bounds
+// all the requests made to etcd.
+func (c *Client) GetAllConnectionsInNamespaces(ctx context.Context, namespaces []string) ([]*FlatConnection, error) {
+	var conns []*FlatConnection
+	for _, ns := range namespaces {
+		nsConns, err := c.WithNamespace(ns).GetAllConnections(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing time %s", fields[2])
+			return nil, err
+		}
+		conns = append(conns, nsConns...)
+	}
+	return conns, nil
+}
+
+// parseConnectionKey returns the connection information found in the etcd key
+// of a connection.
+func (c *Client) parseConnectionKey(key string) (*FlatConnection, error) {
+	v := &FlatConnection{}
+	subkey := key[len(c.connectionsPath)+1:]
+	fields := strings.Split(subkey, "/")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("bad key format %s", subkey)
+	}
+
+	userservice := fields[0]
+	v.Dest = fields[1]
+	v.From = fields[2]
+	var err error
+	v.Ts, err = time.Parse(time.RFC3339Nano, fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing time %s", fields[3])
+	}
+
+	m := keyRegex.FindStringSubmatch(userservice)
+	if m == nil || len(m) != 3 {
+		return nil, fmt.Errorf("error parsing key %s", userservice)
+	}
+	v.User, v.Service = m[1], m[2]
+	return v, nil
+}
+
+// ConnectionEvent represents the start or the end of a connection.
+type ConnectionEvent struct {
+	Time      time.Time // time at which the event was seen
+	Connected bool      // true for a new connection, false for its end
+	*FlatConnection
+}
+
+// WatchUserConnections watches the connections of a user in etcd and calls
+// fn for each new or ended connection, until ctx is canceled or an error
+// occurs. The updates of the bandwidth of the connections are ignored.
+// ErrWatchClosed is returned if the watch is closed by etcd while ctx is not
+// canceled.
+func (c *Client) WatchUserConnections(ctx context.Context, username string, fn func(*ConnectionEvent)) error {
+	ctx = clientv3.WithRequireLeader(ctx)
+	path := c.toConnectionKey(username + "@")
+	for wresp := range c.etcd().Watch(ctx, path, clientv3.WithPrefix()) {
+		if err := wresp.Err(); err != nil {
+			return err
 		}
+		for _, ev := range wresp.Events {
+			if ev.IsModify() {
+				continue
+			}
+			v, err := c.parseConnectionKey(string(ev.Kv.Key))
+			if err != nil {
+				return err
+			}
+			event := &ConnectionEvent{
+				Time:           time.Now(),
+				Connected:      ev.Type == clientv3.EventTypePut,
+				FlatConnection: v,
+			}
+			if event.Connected {
+				conn := &Connection{}
+				if err := json.Unmarshal(ev.Kv.Value, conn); err != nil {
+					return fmt.Errorf("decoding JSON data at '%s': %v", ev.Kv.Key, err)
+				}
+				v.Kind = conn.Kind
+				v.Groups = conn.Groups
+				v.Mode = conn.Mode
+				v.RouteSelect = conn.RouteSelect
+			}
+			fn(event)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrWatchClosed
+}
+
+// DelConnection deletes in etcd the connections of username to the service
+// service and to the destination host:port. Empty arguments match any value,
+// e.g. only username and service are compared if host and port are empty. It
+// returns the number of deleted connections.
+func (c *Client) DelConnection(username, service, host, port string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, err
+	}
 
-		m := keyRegex.FindStringSubmatch(userservice)
-		if m == nil || len(m) != 3 {
-			return nil, fmt.Errorf("error parsing key %s", userservice)
+	deleted := 0
+	for _, ev := range resp.Kvs {
+		v, err := c.parseConnectionKey(string(ev.Key))
+		if err != nil {
+			return deleted, err
 		}
-		v.User, v.Service = m[1], m[2]
-		b := &Bandwidth{}
-		if err := json.Unmarshal(ev.Value, b); err != nil {
-			return nil, fmt.Errorf("decoding JSON data at '%s': %v", ev.Key, err)
+		match, err := connectionMatches(v, username, service, host, port)
+		if err != nil {
+			return deleted, fmt.Errorf("bad destination in key %s", ev.Key)
 		}
-		v.BwIn = b.In
-		v.BwOut = b.Out
-		conns[i] = v
+		if !match {
+			continue
+		}
+		if _, err := c.etcd().Delete(ctx, string(ev.Key)); err != nil {
+			return deleted, err
+		}
+		deleted++
 	}
+	return deleted, nil
+}
 
-	return conns, nil
+// connectionMatches returns true if the connection v is a connection of
+// username to the service service and to the destination host:port. Empty
+// arguments match any value.
+func connectionMatches(v *FlatConnection, username, service, host, port string) (bool, error) {
+	destHost, destPort, err := SplitHostPort(v.Dest)
+	if err != nil {
+		return false, err
+	}
+	return (username == "" || v.User == username) &&
+		(service == "" || v.Service == service) &&
+		(host == "" || destHost == host) &&
+		(port == "" || destPort == port), nil
+}
+
+// DelStaleConnections deletes in etcd the orphaned connections matching
+// username, service, host and port (see DelConnection) which started more
+// than olderThan ago, according to the RFC3339Nano timestamp ending their key.
+// A connection is orphaned if it has no lease or if its lease is no longer
+// kept alive: no sshproxy process owns it anymore, so deleting it does not
+// disconnect any session (see WaitConnectionDeleted). As etcd deletes the keys
+// whose lease expired, these are in practice the keys written without a lease
+// (e.g. by hand or by a tool). Nothing is deleted if dryRun is true. It
+// returns the (would be) deleted connections.
+func (c *Client) DelStaleConnections(username, service, host, port string, olderThan time.Duration, dryRun bool) ([]*FlatConnection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	// the state of the leases, as several keys can share one
+	leaseOrphaned := map[int64]bool{}
+	now := time.Now()
+	var deleted []*FlatConnection
+	for _, ev := range resp.Kvs {
+		v, err := c.parseConnectionKey(string(ev.Key))
+		if err != nil {
+			return deleted, err
+		}
+		match, err := connectionMatches(v, username, service, host, port)
+		if err != nil {
+			return deleted, fmt.Errorf("bad destination in key %s", ev.Key)
+		}
+		if !match || now.Sub(v.Ts) < olderThan {
+			continue
+		}
+		orphaned, ok := leaseOrphaned[ev.Lease]
+		if !ok {
+			orphaned, err = c.isLeaseOrphaned(ctx, clientv3.LeaseID(ev.Lease))
+			if err != nil {
+				return deleted, err
+			}
+			leaseOrphaned[ev.Lease] = orphaned
+		}
+		if !orphaned {
+			continue
+		}
+		if !dryRun {
+			if _, err := c.etcd().Delete(ctx, string(ev.Key)); err != nil {
+				return deleted, err
+			}
+		}
+		deleted = append(deleted, v)
+	}
+	return deleted, nil
+}
+
+// isLeaseOrphaned returns true if the lease id is 0 (no lease) or if it has
+// expired.
+func (c *Client) isLeaseOrphaned(ctx context.Context, id clientv3.LeaseID) (bool, error) {
+	if id == clientv3.NoLease {
+		return true, nil
+	}
+	resp, err := c.etcd().TimeToLive(ctx, id)
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return resp.TTL <= 0, nil
+}
+
+// WaitConnectionDeleted waits until the connection stored at etcdPath is
+// deleted by DelConnection and returns nil, or returns an error when ctx is
+// canceled. The deletion of the connection because its lease expired (e.g.
+// when etcd was unreachable) is ignored. ErrWatchClosed is returned if the
+// watch is closed without the deletion (e.g. after Reauthenticate): the
+// connection is still there and it must be watched again.
+func (c *Client) WaitConnectionDeleted(ctx context.Context, etcdPath string) error {
+	ctx = clientv3.WithRequireLeader(ctx)
+	for wresp := range c.etcd().Watch(ctx, etcdPath, clientv3.WithPrevKV()) {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wresp.Events {
+			if ev.Type != clientv3.EventTypeDelete || ev.PrevKv == nil {
+				continue
+			}
+			// the key was explicitly deleted if its lease is still alive
+			lctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+			resp, err := c.etcd().TimeToLive(lctx, clientv3.LeaseID(ev.PrevKv.Lease))
+			cancel()
+			if err == nil && resp.TTL > 0 {
+				return nil
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrWatchClosed
+}
+
+// GetTotalConnectionsCount returns the number of active connections of all
+// the users, based on etcd.
+func (c *Client) GetTotalConnectionsCount() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.Count), nil
 }
 
 // GetUserConnectionsCount returns the number of active connections of a user, based on etcd.
 func (c *Client) GetUserConnectionsCount(username string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, etcdConnectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
 	if err != nil {
 		return 0, err
@@ -571,7 +1249,7 @@ func (c *Client) GetUserConnectionsCount(username string) (int, error) {
 
 	count := 0
 	for _, ev := range resp.Kvs {
-		subkey := string(ev.Key)[len(etcdConnectionsPath)+1:]
+		subkey := string(ev.Key)[len(c.connectionsPath)+1:]
 		fields := strings.Split(subkey, "/")
 		if len(fields) != 4 {
 			return 0, fmt.Errorf("bad key format %s", subkey)
@@ -589,20 +1267,256 @@ func (c *Client) GetUserConnectionsCount(username string) (int, error) {
 	return count, nil
 }
 
+// RecordConnectAttempt records in etcd a connection attempt of a user made at
+// ts, identified by the session ID sid. The attempt is attached to a lease of
+// the duration window, so it is deleted once it is no longer counted by
+// CountRecentConnects.
+func (c *Client) RecordConnectAttempt(username, sid string, ts time.Time, window time.Duration) error {
+	key := fmt.Sprintf("%s/%s/%s", c.ratelimitPath, username, sid)
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	// etcd leases have a granularity of one second
+	seconds := int64((window + time.Second - 1) / time.Second)
+	lease, err := c.etcd().Grant(ctx, seconds)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd().Put(ctx, key, ts.Format(time.RFC3339Nano), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// CountRecentConnects returns the number of connection attempts of a user
+// recorded by RecordConnectAttempt during the last window.
+func (c *Client) CountRecentConnects(username string, window time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, fmt.Sprintf("%s/%s/", c.ratelimitPath, username), clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	// the leases may outlive the window by up to one second
+	since := time.Now().Add(-window)
+	count := 0
+	for _, ev := range resp.Kvs {
+		ts, err := time.Parse(time.RFC3339Nano, string(ev.Value))
+		if err != nil {
+			return 0, fmt.Errorf("bad value for key %s: %v", ev.Key, err)
+		}
+		if ts.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetRecentConnectionsCount returns the number of active connections of a
+// user to a service made from the IP address source since the time since,
+// based on etcd. The connections stored without their source are not counted.
+func (c *Client) GetRecentConnectionsCount(username, service, source string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, c.toConnectionKey(fmt.Sprintf("%s@%s", username, service))+"/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, ev := range resp.Kvs {
+		v, err := c.parseConnectionKey(string(ev.Key))
+		if err != nil {
+			return 0, err
+		}
+		var conn Connection
+		if err := json.Unmarshal(ev.Value, &conn); err != nil {
+			return 0, err
+		}
+		if conn.Source == source && v.Ts.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetSourceConnectionsCount returns the number of active connections made
+// from the IP address source, whatever the user, based on etcd. The
+// connections stored without their source are not counted.
+func (c *Client) GetSourceConnectionsCount(source string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, ev := range resp.Kvs {
+		var conn Connection
+		if err := json.Unmarshal(ev.Value, &conn); err != nil {
+			return 0, err
+		}
+		if conn.Source == source {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// CordonHost marks a host (passed as "host:port") as cordoned in etcd: no new
+// connection is routed to it, whatever its state.
+func (c *Client) CordonHost(hostport string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	_, err := c.etcd().Put(ctx, fmt.Sprintf("%s/%s", c.cordonedPath, hostport), time.Now().Format(time.RFC3339Nano))
+	cancel()
+	return err
+}
+
+// UncordonHost removes the cordoned mark of a host (passed as "host:port")
+// in etcd. It returns the number of hosts actually uncordoned.
+func (c *Client) UncordonHost(hostport string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Delete(ctx, fmt.Sprintf("%s/%s", c.cordonedPath, hostport))
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
+
+// IsHostCordoned returns true if a host (passed as "host:port") is marked as
+// cordoned in etcd.
+func (c *Client) IsHostCordoned(hostport string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, fmt.Sprintf("%s/%s", c.cordonedPath, hostport), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// getCordonedHosts returns the hosts marked as cordoned in etcd.
+func (c *Client) getCordonedHosts(ctx context.Context) (map[string]bool, error) {
+	reqctx, cancel := c.requestContext(ctx)
+	resp, err := c.etcd().Get(reqctx, c.cordonedPath+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	cordoned := map[string]bool{}
+	for _, ev := range resp.Kvs {
+		cordoned[string(ev.Key)[len(c.cordonedPath)+1:]] = true
+	}
+	return cordoned, nil
+}
+
+// GetHostConnectionsCount returns the number of active connections to a
+// destination (passed as "host:port"), based on etcd.
+func (c *Client) GetHostConnectionsCount(hostport string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, ev := range resp.Kvs {
+		v, err := c.parseConnectionKey(string(ev.Key))
+		if err != nil {
+			return 0, err
+		}
+		if v.Dest == hostport {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetUserTransfersCount returns the number of active file transfers (SFTP and
+// SCP sessions) of a user, based on etcd. The connections stored without their
+// kind of session are not counted.
+func (c *Client) GetUserTransfersCount(username string) (int, error) {
+	connections, err := c.GetAllConnections(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, connection := range connections {
+		if connection.User == username && IsTransferSession(connection.Kind) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetGroupConnectionsCount returns the number of active connections of the
+// users belonging to each of the groups, based on etcd. The groups of a user
+// are the ones stored with its connections at connection time if present,
+// otherwise its current groups are looked up on this system.
+func (c *Client) GetGroupConnectionsCount(groups map[string]bool) (map[string]int, error) {
+	connections, err := c.GetAllConnections(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return countGroupConnections(connections, groups), nil
+}
+
+// countGroupConnections counts the connections of the users belonging to each
+// of the groups. The connections of the users whose groups cannot be looked
+// up are not counted.
+func countGroupConnections(connections []*FlatConnection, groups map[string]bool) map[string]int {
+	counts := map[string]int{}
+	// groups looked up on this system, by user
+	lookedUp := map[string]map[string]bool{}
+	for _, connection := range connections {
+		var userGroups map[string]bool
+		if len(connection.Groups) > 0 {
+			userGroups = map[string]bool{}
+			for _, group := range connection.Groups {
+				userGroups[group] = true
+			}
+		} else if g, ok := lookedUp[connection.User]; ok {
+			userGroups = g
+		} else {
+			g, err := GetGroupList(connection.User)
+			if err != nil {
+				mylog.Errorf("getting groups of %s: %v", connection.User, err)
+			}
+			lookedUp[connection.User] = g
+			userGroups = g
+		}
+		for group := range groups {
+			if userGroups[group] {
+				counts[group]++
+			}
+		}
+	}
+	return counts
+}
+
 // FlatHost is a structure used to flatten a host information present in etcd.
 type FlatHost struct {
-	Hostname string
-	N        int
-	BwIn     int
-	BwOut    int
-	HistoryN int
+	Hostname  string
+	Namespace string `json:",omitempty"`
+	N         int
+	BwIn      int
+	BwOut     int
+	HistoryN  int
+	Cordoned  bool `json:",omitempty"`
 	*Host
 }
 
 // GetUserHosts returns a list of hosts used by a user@service, based on etcd.
 func (c *Client) GetUserHosts(key string) (map[string]*FlatHost, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, etcdConnectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	resp, err := c.etcd().Get(ctx, c.connectionsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
 	if err != nil {
 		return nil, err
@@ -610,7 +1524,7 @@ func (c *Client) GetUserHosts(key string) (map[string]*FlatHost, error) {
 
 	hosts := map[string]*FlatHost{}
 	for _, ev := range resp.Kvs {
-		subkey := string(ev.Key)[len(etcdConnectionsPath)+1:]
+		subkey := string(ev.Key)[len(c.connectionsPath)+1:]
 		fields := strings.Split(subkey, "/")
 		if len(fields) != 4 {
 			return nil, fmt.Errorf("bad key format %s", subkey)
@@ -639,16 +1553,18 @@ func (c *Client) GetUserHosts(key string) (map[string]*FlatHost, error) {
 	return hosts, nil
 }
 
-// GetAllHosts returns a list of all hosts present in etcd.
-func (c *Client) GetAllHosts() ([]*FlatHost, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, etcdHostsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+// GetAllHosts returns a list of all hosts present in etcd. If ctx has a
+// deadline, it bounds all the requests needed to aggregate the hosts
+// information.
+func (c *Client) GetAllHosts(ctx context.Context) ([]*FlatHost, error) {
+	reqctx, cancel := c.requestContext(ctx)
+	resp, err := c.etcd().Get(reqctx, c.hostsPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
 	if err != nil {
 		return nil, err
 	}
 
-	connections, err := c.GetAllConnections()
+	connections, err := c.GetAllConnections(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: getting connections from etcd: %v", err)
 	}
@@ -666,7 +1582,7 @@ func (c *Client) GetAllHosts() ([]*FlatHost, error) {
 		}
 	}
 
-	history, err := c.GetAllHistory()
+	history, err := c.GetAllHistory(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: getting history from etcd: %v", err)
 	}
@@ -675,13 +1591,18 @@ func (c *Client) GetAllHosts() ([]*FlatHost, error) {
 		statsHistory[hist.Dest]++
 	}
 
+	cordoned, err := c.getCordonedHosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: getting cordoned hosts from etcd: %v", err)
+	}
+
 	hosts := make([]*FlatHost, len(resp.Kvs))
 	for i, ev := range resp.Kvs {
 		v := &FlatHost{}
 		if err := json.Unmarshal([]byte(ev.Value), v); err != nil {
 			return nil, fmt.Errorf("decoding JSON data at '%s': %v", ev.Key, err)
 		}
-		subkey := string(ev.Key)[len(etcdHostsPath)+1:]
+		subkey := string(ev.Key)[len(c.hostsPath)+1:]
 		v.Hostname = subkey
 		if stats[subkey] == nil {
 			v.N = 0
@@ -693,6 +1614,8 @@ func (c *Client) GetAllHosts() ([]*FlatHost, error) {
 			v.BwOut = stats[subkey]["BwOut"]
 		}
 		v.HistoryN = statsHistory[subkey]
+		v.Cordoned = cordoned[subkey]
+		v.Namespace = c.namespace
 		hosts[i] = v
 	}
 
@@ -711,14 +1634,66 @@ type FlatUser struct {
 	TTL     int64
 }
 
+// SortedGroups returns the sorted names of the groups.
+func SortedGroups(groups map[string]bool) []string {
+	g := make([]string, 0, len(groups))
+	for group := range groups {
+		g = append(g, group)
+	}
+	sort.Strings(g)
+	return g
+}
+
+// getUserGroups returns the groups of a user, separated by spaces. The groups
+// stored with a connection at connection time are used if present, otherwise
+// the current groups of the user are looked up on this system.
+func getUserGroups(username string, stored []string) (string, error) {
+	if len(stored) > 0 {
+		g := append([]string{}, stored...)
+		sort.Strings(g)
+		return strings.Join(g, " "), nil
+	}
+	groups, err := GetGroupList(username)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(SortedGroups(groups), " "), nil
+}
+
 // GetAllUsers returns a list of connections present in etcd, aggregated by
-// user@service.
-func (c *Client) GetAllUsers(allFlag bool) ([]*FlatUser, error) {
-	connections, err := c.GetAllConnections()
+// user@service. The list is sorted by user then service. If ctx has a
+// deadline, it bounds all the requests made to etcd.
+func (c *Client) GetAllUsers(ctx context.Context, allFlag bool) ([]*FlatUser, error) {
+	return c.GetAllUsersInNamespaces(ctx, []string{c.namespace}, allFlag)
+}
+
+// GetAllUsersInNamespaces is like GetAllUsers, but the connections of all the
+// namespaces (see WithNamespace) are aggregated together.
+func (c *Client) GetAllUsersInNamespaces(ctx context.Context, namespaces []string, allFlag bool) ([]*FlatUser, error) {
+	connections, err := c.GetAllConnectionsInNamespaces(ctx, namespaces)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: getting connections from etcd: %v", err)
 	}
+	var history []*FlatHistory
+	if allFlag {
+		for _, ns := range namespaces {
+			nsHistory, err := c.WithNamespace(ns).GetAllHistory(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("ERROR: getting history from etcd: %v", err)
+			}
+			history = append(history, nsHistory...)
+		}
+	}
+	return aggregateUsers(connections, history, allFlag)
+}
+
+// aggregateUsers aggregates the connections and the history by user (and by
+// service if allFlag is true). The result is sorted by user then service.
+func aggregateUsers(connections []*FlatConnection, history []*FlatHistory, allFlag bool) ([]*FlatUser, error) {
+	var err error
 	users := map[string]*FlatUser{}
+	// users whose groups were stored with their connections
+	storedGroups := map[string]bool{}
 	for _, connection := range connections {
 		key := connection.User
 		if allFlag {
@@ -726,53 +1701,42 @@ func (c *Client) GetAllUsers(allFlag bool) ([]*FlatUser, error) {
 		}
 		if users[key] == nil {
 			v := &FlatUser{}
-			groups, err := GetGroupList(connection.User)
+			v.Groups, err = getUserGroups(connection.User, connection.Groups)
 			if err != nil {
 				return nil, err
 			}
-			g := make([]string, 0, len(groups))
-			for group := range groups {
-				g = append(g, group)
-			}
-			sort.Strings(g)
-			v.Groups = strings.Join(g, " ")
 			v.N = 1
 			v.BwIn = connection.BwIn
 			v.BwOut = connection.BwOut
 			users[key] = v
 		} else {
+			if !storedGroups[key] && len(connection.Groups) > 0 {
+				// prefer the groups stored at connection time
+				users[key].Groups, _ = getUserGroups(connection.User, connection.Groups)
+			}
 			users[key].N++
 			users[key].BwIn += connection.BwIn
 			users[key].BwOut += connection.BwOut
 		}
+		if len(connection.Groups) > 0 {
+			storedGroups[key] = true
+		}
 	}
 
-	if allFlag {
-		history, err := c.GetAllHistory()
-		if err != nil {
-			return nil, fmt.Errorf("ERROR: getting history from etcd: %v", err)
-		}
-		for _, hist := range history {
-			key := hist.User
-			if users[key] == nil {
-				v := &FlatUser{}
-				groups, err := GetGroupList(strings.Split(hist.User, "@")[0])
-				if err != nil {
-					return nil, err
-				}
-				g := make([]string, 0, len(groups))
-				for group := range groups {
-					g = append(g, group)
-				}
-				sort.Strings(g)
-				v.Groups = strings.Join(g, " ")
-				v.Dest = hist.Dest
-				v.TTL = hist.TTL
-				users[key] = v
-			} else {
-				users[key].Dest = hist.Dest
-				users[key].TTL = hist.TTL
+	for _, hist := range history {
+		key := hist.User
+		if users[key] == nil {
+			v := &FlatUser{}
+			v.Groups, err = getUserGroups(strings.Split(hist.User, "@")[0], nil)
+			if err != nil {
+				return nil, err
 			}
+			v.Dest = hist.Dest
+			v.TTL = hist.TTL
+			users[key] = v
+		} else {
+			users[key].Dest = hist.Dest
+			users[key].TTL = hist.TTL
 		}
 	}
 
@@ -787,6 +1751,12 @@ func (c *Client) GetAllUsers(allFlag bool) ([]*FlatUser, error) {
 		}
 		i++
 	}
+	sort.Slice(usersSlice, func(i, j int) bool {
+		if usersSlice[i].User != usersSlice[j].User {
+			return usersSlice[i].User < usersSlice[j].User
+		}
+		return usersSlice[i].Service < usersSlice[j].Service
+	})
 
 	return usersSlice, nil
 }
@@ -802,16 +1772,30 @@ type FlatGroup struct {
 }
 
 // GetAllGroups returns a list of connections present in etcd, aggregated by
-// groups.
-func (c *Client) GetAllGroups(allFlag bool) ([]*FlatGroup, error) {
-	users, err := c.GetAllUsers(allFlag)
+// groups. The list is sorted by group then service. If ctx has a deadline, it
+// bounds all the requests made to etcd.
+func (c *Client) GetAllGroups(ctx context.Context, allFlag bool) ([]*FlatGroup, error) {
+	return c.GetAllGroupsInNamespaces(ctx, []string{c.namespace}, allFlag)
+}
+
+// GetAllGroupsInNamespaces is like GetAllGroups, but the connections of all
+// the namespaces (see WithNamespace) are aggregated together.
+func (c *Client) GetAllGroupsInNamespaces(ctx context.Context, namespaces []string, allFlag bool) ([]*FlatGroup, error) {
+	users, err := c.GetAllUsersInNamespaces(ctx, namespaces, allFlag)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: getting connections from etcd: %v", err)
 	}
+	return aggregateGroups(users, allFlag), nil
+}
+
+// aggregateGroups aggregates the users by group (and by service if allFlag is
+// true). The result is sorted by group then service.
+func aggregateGroups(users []*FlatUser, allFlag bool) []*FlatGroup {
 	groupUsers := map[string]map[string]bool{}
 	groups := map[string]*FlatGroup{}
 	for _, user := range users {
-		for _, group := range strings.Split(user.Groups, " ") {
+		// strings.Fields ignores the users without groups
+		for _, group := range strings.Fields(user.Groups) {
 			if allFlag {
 				group += "@" + user.Service
 			}
@@ -852,21 +1836,33 @@ func (c *Client) GetAllGroups(allFlag bool) ([]*FlatGroup, error) {
 		}
 		i++
 	}
+	sort.Slice(groupsSlice, func(i, j int) bool {
+		if groupsSlice[i].Group != groupsSlice[j].Group {
+			return groupsSlice[i].Group < groupsSlice[j].Group
+		}
+		return groupsSlice[i].Service < groupsSlice[j].Service
+	})
 
-	return groupsSlice, nil
+	return groupsSlice
 }
 
 // FlatHistory is a structure used to flatten a history information present in etcd.
 type FlatHistory struct {
-	User string
-	Dest string
-	TTL  int64
+	User      string // user@service
+	Namespace string `json:",omitempty"`
+	Dest      string
+	TTL       int64 // remaining TTL in seconds
+	Lease     int64
+	// Age is the time elapsed since the lease was last kept alive, i.e.
+	// since the last connection of the user to the service ended.
+	Age time.Duration `json:"-"`
 }
 
-// GetAllHistory returns a list of all history keys present in etcd.
-func (c *Client) GetAllHistory() ([]*FlatHistory, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
-	resp, err := c.cli.Get(ctx, etcdHistoryPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+// GetAllHistory returns a list of all history keys present in etcd. The
+// deadline of ctx, if any, replaces the request timeout of the client.
+func (c *Client) GetAllHistory(ctx context.Context) ([]*FlatHistory, error) {
+	ctx, cancel := c.requestContext(ctx)
+	resp, err := c.etcd().Get(ctx, c.historyPath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	defer cancel()
 	if err != nil {
 		return nil, err
@@ -874,33 +1870,91 @@ func (c *Client) GetAllHistory() ([]*FlatHistory, error) {
 
 	history := make([]*FlatHistory, len(resp.Kvs))
 	for i, ev := range resp.Kvs {
-		subkey := string(ev.Key)[len(etcdHistoryPath)+1:]
+		subkey := string(ev.Key)[len(c.historyPath)+1:]
 		fields := strings.Split(subkey, "/")
 		if len(fields) != 2 {
 			return nil, fmt.Errorf("bad key format %s", subkey)
 		}
 
-		v := &FlatHistory{}
+		v := &FlatHistory{Namespace: c.namespace}
 		v.User = fields[0]
 		v.Dest = string(ev.Value)
 		leaseID, err := strconv.Atoi(fields[1])
 		if err != nil {
 			return nil, err
 		}
-		ttl, err := c.cli.TimeToLive(ctx, clientv3.LeaseID(leaseID))
+		ttl, err := c.etcd().TimeToLive(ctx, clientv3.LeaseID(leaseID))
 		if err != nil {
 			return nil, err
 		}
 		v.TTL = ttl.TTL
+		v.Lease = int64(leaseID)
+		if ttl.TTL >= 0 {
+			v.Age = time.Duration(ttl.GrantedTTL-ttl.TTL) * time.Second
+		}
 		history[i] = v
 	}
 
 	return history, nil
 }
 
+// DelHistory deletes in etcd the history key of user (user@service) with the
+// lease ID lease.
+func (c *Client) DelHistory(user string, lease int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	_, err := c.etcd().Delete(ctx, fmt.Sprintf("%s/%d", c.toHistoryKey(user), lease))
+	return err
+}
+
+// CheckAccess checks that the client can read and write the keys of
+// sshproxy, by writing then deleting a temporary key in the namespace of the
+// client.
+func (c *Client) CheckAccess() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	if _, err := c.etcd().Get(ctx, c.hostsPath, clientv3.WithPrefix(), clientv3.WithCountOnly()); err != nil {
+		return fmt.Errorf("reading %s: %v", c.hostsPath, err)
+	}
+	hostname, _ := os.Hostname()
+	key := fmt.Sprintf("%s/access/%s", c.rootPath, hostname)
+	if _, err := c.etcd().Put(ctx, key, time.Now().Format(time.RFC3339Nano)); err != nil {
+		return fmt.Errorf("writing %s: %v", key, err)
+	}
+	if _, err := c.etcd().Delete(ctx, key); err != nil {
+		return fmt.Errorf("deleting %s: %v", key, err)
+	}
+	return nil
+}
+
+// Revision returns the current revision of the etcd store and the number of
+// keys of sshproxy (i.e. under its prefix, in all the namespaces).
+func (c *Client) Revision() (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	resp, err := c.etcd().Get(ctx, c.prefix+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Header.Revision, resp.Count, nil
+}
+
+// Compact discards the revision history of the etcd store before revision.
+// It affects all the keys of the store, not only the ones of sshproxy.
+// ErrCompacted is returned if the store is already compacted beyond revision.
+func (c *Client) Compact(revision int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+	defer cancel()
+	_, err := c.etcd().Compact(ctx, revision, clientv3.WithCompactPhysical())
+	if errors.Is(err, rpctypes.ErrCompacted) {
+		return ErrCompacted
+	}
+	return err
+}
+
 // IsAlive checks if etcd client is still usable.
 func (c *Client) IsAlive() bool {
-	return c.cli != nil && c.active
+	return c.etcd() != nil && c.active
 }
 
 // Enable enables the etcd client.
@@ -0,0 +1,613 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testConnections are connections with their groups stored, so that the
+// users are not looked up on the system.
+var testConnections = []*FlatConnection{
+	{User: "carol", Service: "default", Groups: []string{"users"}},
+	{User: "alice", Service: "login", Groups: []string{"admin", "users"}},
+	{User: "bob", Service: "default", Groups: []string{"users"}},
+	{User: "alice", Service: "default", Groups: []string{"admin", "users"}},
+}
+
+func TestAggregateUsersOrder(t *testing.T) {
+	want := []string{"alice@default", "alice@login", "bob@default", "carol@default"}
+	// the users are aggregated in maps: repeat to catch a random order
+	for n := 0; n < 10; n++ {
+		users, err := aggregateUsers(testConnections, nil, true)
+		if err != nil {
+			t.Fatalf("aggregateUsers error = %v, want nil", err)
+		}
+		if len(users) != len(want) {
+			t.Fatalf("aggregateUsers got %d users, want %d", len(users), len(want))
+		}
+		for i, user := range users {
+			if got := user.User + "@" + user.Service; got != want[i] {
+				t.Errorf("aggregateUsers user %d = %s, want %s", i, got, want[i])
+			}
+		}
+	}
+}
+
+func TestAggregateGroupsWithoutGroups(t *testing.T) {
+	users := []*FlatUser{
+		{User: "alice", Service: "default", Groups: "", N: 1},
+		{User: "bob", Service: "default", Groups: "users", N: 2},
+	}
+	for _, allFlag := range []bool{false, true} {
+		groups := aggregateGroups(users, allFlag)
+		if len(groups) != 1 {
+			t.Fatalf("aggregateGroups (all: %v) got %d groups, want 1", allFlag, len(groups))
+		}
+		if groups[0].Group != "users" || groups[0].Users != "bob" || groups[0].N != 2 {
+			t.Errorf("aggregateGroups (all: %v) = %+v, want group users with bob", allFlag, groups[0])
+		}
+		if allFlag && groups[0].Service != "default" {
+			t.Errorf("aggregateGroups (all: true) service = %s, want default", groups[0].Service)
+		}
+	}
+}
+
+func TestAggregateGroupsOrder(t *testing.T) {
+	users, err := aggregateUsers(testConnections, nil, true)
+	if err != nil {
+		t.Fatalf("aggregateUsers error = %v, want nil", err)
+	}
+	want := []string{"admin@default", "admin@login", "users@default", "users@login"}
+	for n := 0; n < 10; n++ {
+		groups := aggregateGroups(users, true)
+		if len(groups) != len(want) {
+			t.Fatalf("aggregateGroups got %d groups, want %d", len(groups), len(want))
+		}
+		for i, group := range groups {
+			if got := group.Group + "@" + group.Service; got != want[i] {
+				t.Errorf("aggregateGroups group %d = %s, want %s", i, got, want[i])
+			}
+		}
+	}
+}
+
+func TestCountGroupConnections(t *testing.T) {
+	got := countGroupConnections(testConnections, map[string]bool{"admin": true, "users": true, "other": true})
+	want := map[string]int{"admin": 2, "users": 4}
+	if len(got) != len(want) {
+		t.Errorf("countGroupConnections = %v, want %v", got, want)
+	}
+	for group, n := range want {
+		if got[group] != n {
+			t.Errorf("countGroupConnections[%s] = %d, want %d", group, got[group], n)
+		}
+	}
+}
+
+var isAuthErrorTests = []struct {
+	err  error
+	want bool
+}{
+	{rpctypes.ErrInvalidAuthToken, true},
+	{fmt.Errorf("granting lease: %w", rpctypes.ErrAuthOldRevision), true},
+	{rpctypes.ErrAuthFailed, true},
+	{rpctypes.ErrNoLeader, false},
+	{errors.New("context deadline exceeded"), false},
+}
+
+func TestEtcdTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout Duration
+		want    time.Duration
+	}{
+		{0, defaultEtcdTimeout},
+		{Duration(-time.Second), defaultEtcdTimeout},
+		{Duration(5 * time.Second), 5 * time.Second},
+	} {
+		if got := etcdTimeout(tt.timeout); got != tt.want {
+			t.Errorf("etcdTimeout(%s) = %s, want %s", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+// mockKV is an etcd KV whose Delete returns deleted keys or err.
+type mockKV struct {
+	clientv3.KV
+	deleted int64
+	kvs     []*mvccpb.KeyValue
+	err     error
+}
+
+func (kv *mockKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	return &clientv3.GetResponse{Kvs: kv.kvs, Count: int64(len(kv.kvs))}, nil
+}
+
+func (kv *mockKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	return &clientv3.DeleteResponse{Deleted: kv.deleted}, nil
+}
+
+func (kv *mockKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	kv.kvs = append(kv.kvs, &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val)})
+	return &clientv3.PutResponse{}, nil
+}
+
+// mockWatcher is an etcd Watcher whose Watch sends the responses and is
+// then closed.
+type mockWatcher struct {
+	clientv3.Watcher
+	responses []clientv3.WatchResponse
+}
+
+func (w *mockWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse, len(w.responses))
+	for _, resp := range w.responses {
+		ch <- resp
+	}
+	close(ch)
+	return ch
+}
+
+// mockLease is an etcd Lease whose TimeToLive returns the TTL of the leases
+// in ttls, or ErrLeaseNotFound. The TTLs of the granted leases are recorded
+// in granted.
+type mockLease struct {
+	clientv3.Lease
+	ttls    map[clientv3.LeaseID]int64
+	granted []int64
+}
+
+func (l *mockLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	l.granted = append(l.granted, ttl)
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(len(l.granted)), TTL: ttl}, nil
+}
+
+func (l *mockLease) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	ttl, ok := l.ttls[id]
+	if !ok {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	return &clientv3.LeaseTimeToLiveResponse{TTL: ttl}, nil
+}
+
+func TestWaitConnectionDeleted(t *testing.T) {
+	deleted := clientv3.WatchResponse{Events: []*clientv3.Event{{
+		Type:   clientv3.EventTypeDelete,
+		PrevKv: &mvccpb.KeyValue{Key: []byte("/sshproxy/connections/alice@default/server1:22/sshd:22/ts"), Lease: 42},
+	}}}
+	for _, tt := range []struct {
+		name      string
+		responses []clientv3.WatchResponse
+		ttl       int64
+		want      error
+	}{
+		{"watch closed", nil, 10, ErrWatchClosed},
+		{"deleted", []clientv3.WatchResponse{deleted}, 10, nil},
+		{"lease expired", []clientv3.WatchResponse{deleted}, -1, ErrWatchClosed},
+	} {
+		c := &Client{cli: &clientv3.Client{Watcher: &mockWatcher{responses: tt.responses}, Lease: &mockLease{ttls: map[clientv3.LeaseID]int64{42: tt.ttl}}}, requestTimeout: time.Second}
+		c.setNamespace("")
+		if err := c.WaitConnectionDeleted(context.Background(), "/sshproxy/connections/alice@default/server1:22/sshd:22/ts"); err != tt.want {
+			t.Errorf("%s: WaitConnectionDeleted error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &Client{cli: &clientv3.Client{Watcher: &mockWatcher{}}, requestTimeout: time.Second}
+	if err := c.WaitConnectionDeleted(ctx, "/sshproxy/connections/alice@default/server1:22/sshd:22/ts"); err != context.Canceled {
+		t.Errorf("canceled: WaitConnectionDeleted error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWatchUserConnections(t *testing.T) {
+	key := "/sshproxy/connections/alice@default/server1:22/192.168.0.1:40000/2024-01-02T03:04:05Z"
+	responses := []clientv3.WatchResponse{
+		{Events: []*clientv3.Event{{
+			Type: clientv3.EventTypePut,
+			Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: []byte(`{"Kind":"shell","Groups":["users"]}`), CreateRevision: 5, ModRevision: 5},
+		}}},
+		// the update of the bandwidth is ignored
+		{Events: []*clientv3.Event{{
+			Type: clientv3.EventTypePut,
+			Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: []byte(`{"Kind":"shell","BwIn":10}`), CreateRevision: 5, ModRevision: 6},
+		}}},
+		{Events: []*clientv3.Event{{
+			Type: clientv3.EventTypeDelete,
+			Kv:   &mvccpb.KeyValue{Key: []byte(key), ModRevision: 7},
+		}}},
+	}
+	c := &Client{cli: &clientv3.Client{Watcher: &mockWatcher{responses: responses}}, requestTimeout: time.Second, prefix: defaultEtcdPrefix}
+	c.setNamespace("")
+	var events []*ConnectionEvent
+	err := c.WatchUserConnections(context.Background(), "alice", func(event *ConnectionEvent) {
+		events = append(events, event)
+	})
+	if err != ErrWatchClosed {
+		t.Errorf("WatchUserConnections error = %v, want %v", err, ErrWatchClosed)
+	}
+	if len(events) != 2 {
+		t.Fatalf("WatchUserConnections sent %d events, want 2", len(events))
+	}
+	if ev := events[0]; !ev.Connected || ev.User != "alice" || ev.Service != "default" || ev.Dest != "server1:22" || ev.Kind != "shell" || !reflect.DeepEqual(ev.Groups, []string{"users"}) {
+		t.Errorf("WatchUserConnections first event = %+v, want a shell connection of alice", ev.FlatConnection)
+	}
+	if ev := events[1]; ev.Connected || ev.User != "alice" || ev.From != "192.168.0.1:40000" {
+		t.Errorf("WatchUserConnections second event = %+v, want the disconnection of alice", ev.FlatConnection)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = &Client{cli: &clientv3.Client{Watcher: &mockWatcher{}}, requestTimeout: time.Second}
+	c.setNamespace("")
+	if err := c.WatchUserConnections(ctx, "alice", func(*ConnectionEvent) {}); err != context.Canceled {
+		t.Errorf("canceled: WatchUserConnections error = %v, want %v", err, context.Canceled)
+	}
+}
+
+var delHostTests = []struct {
+	kv   *mockKV
+	want int64
+	err  error
+}{
+	{&mockKV{deleted: 1}, 1, nil},
+	{&mockKV{deleted: 0}, 0, nil},
+	{&mockKV{err: rpctypes.ErrPermissionDenied}, 0, rpctypes.ErrPermissionDenied},
+}
+
+func TestDelHost(t *testing.T) {
+	for _, tt := range delHostTests {
+		c := &Client{cli: &clientv3.Client{KV: tt.kv}, requestTimeout: time.Second}
+		c.setNamespace("")
+		got, err := c.DelHost("server1:22")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("DelHost error = %v, want %v", err, tt.err)
+		} else if got != tt.want {
+			t.Errorf("DelHost = %d, want %d", got, tt.want)
+		}
+	}
+}
+
+func TestDelStaleConnections(t *testing.T) {
+	kv := &mockKV{deleted: 1}
+	// lease 1 is kept alive, lease 2 expired and 0 is no lease
+	lease := &mockLease{ttls: map[clientv3.LeaseID]int64{1: 5, 2: -1}}
+	c := &Client{cli: &clientv3.Client{KV: kv, Lease: lease}, requestTimeout: time.Second}
+	c.setNamespace("")
+	now := time.Now()
+	for _, key := range []struct {
+		userservice, dest string
+		lease             int64
+		age               time.Duration
+	}{
+		{"alice@default", "server1:22", 0, 2 * time.Hour},
+		{"alice@default", "server2:22", 1, 2 * time.Hour},
+		{"alice@gpu", "server1:22", 2, 2 * time.Hour},
+		{"bob@default", "server1:2222", 2, 2 * time.Hour},
+		{"bob@default", "server2:22", 1, 2 * time.Hour},
+		{"carol@default", "server1:22", 0, time.Minute},
+	} {
+		kv.kvs = append(kv.kvs, &mvccpb.KeyValue{Key: []byte(fmt.Sprintf("%s/%s/%s/192.168.0.1:1234/%s", c.connectionsPath, key.userservice, key.dest, now.Add(-key.age).Format(time.RFC3339Nano))), Lease: key.lease})
+	}
+	for _, tt := range []struct {
+		user, service, host, port string
+		olderThan                 time.Duration
+		want                      []string
+	}{
+		{"", "", "", "", time.Hour, []string{"alice@default server1:22", "alice@gpu server1:22", "bob@default server1:2222"}},
+		{"", "", "", "", time.Second, []string{"alice@default server1:22", "alice@gpu server1:22", "bob@default server1:2222", "carol@default server1:22"}},
+		{"", "", "", "", 3 * time.Hour, nil},
+		{"alice", "", "", "", time.Hour, []string{"alice@default server1:22", "alice@gpu server1:22"}},
+		{"", "default", "", "", time.Hour, []string{"alice@default server1:22", "bob@default server1:2222"}},
+		{"", "", "server1", "2222", time.Hour, []string{"bob@default server1:2222"}},
+		{"", "", "server2", "", time.Hour, nil},
+		{"carol", "", "", "", time.Hour, nil},
+	} {
+		for _, dryRun := range []bool{false, true} {
+			connections, err := c.DelStaleConnections(tt.user, tt.service, tt.host, tt.port, tt.olderThan, dryRun)
+			if err != nil {
+				t.Fatalf("DelStaleConnections error = %v, want nil", err)
+			}
+			var got []string
+			for _, v := range connections {
+				got = append(got, fmt.Sprintf("%s@%s %s", v.User, v.Service, v.Dest))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("DelStaleConnections(%q, %q, %q, %q, %s, %v) = %v, want %v", tt.user, tt.service, tt.host, tt.port, tt.olderThan, dryRun, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestIsHostCordoned(t *testing.T) {
+	for _, tt := range []struct {
+		kv   *mockKV
+		want bool
+		err  error
+	}{
+		{&mockKV{kvs: []*mvccpb.KeyValue{{Key: []byte("/cordoned/server1:22")}}}, true, nil},
+		{&mockKV{}, false, nil},
+		{&mockKV{err: rpctypes.ErrPermissionDenied}, false, rpctypes.ErrPermissionDenied},
+	} {
+		c := &Client{cli: &clientv3.Client{KV: tt.kv}, requestTimeout: time.Second}
+		c.setNamespace("")
+		got, err := c.IsHostCordoned("server1:22")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("IsHostCordoned error = %v, want %v", err, tt.err)
+		} else if got != tt.want {
+			t.Errorf("IsHostCordoned = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestGetUserLimit(t *testing.T) {
+	expire := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		kv   *mockKV
+		want *UserLimit
+		err  error
+	}{
+		{&mockKV{kvs: []*mvccpb.KeyValue{{Value: []byte(`{"Max":100,"Expire":"2025-06-01T12:00:00Z"}`)}}}, &UserLimit{100, expire}, nil},
+		{&mockKV{}, nil, ErrKeyNotFound},
+		{&mockKV{err: rpctypes.ErrPermissionDenied}, nil, rpctypes.ErrPermissionDenied},
+	} {
+		c := &Client{cli: &clientv3.Client{KV: tt.kv}, requestTimeout: time.Second}
+		c.setNamespace("")
+		got, err := c.GetUserLimit("alice")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("GetUserLimit error = %v, want %v", err, tt.err)
+		} else if tt.want != nil && (got.Max != tt.want.Max || !got.Expire.Equal(tt.want.Expire)) {
+			t.Errorf("GetUserLimit = %+v, want %+v", got, tt.want)
+		}
+	}
+}
+
+func TestSetUserLimitPast(t *testing.T) {
+	c := &Client{cli: &clientv3.Client{KV: &mockKV{}}, requestTimeout: time.Second}
+	c.setNamespace("")
+	if err := c.SetUserLimit("alice", 100, time.Now().Add(-time.Hour)); err == nil {
+		t.Errorf("SetUserLimit in the past error = nil, want an error")
+	}
+}
+
+var isPermissionErrorTests = []struct {
+	err  error
+	want bool
+}{
+	{rpctypes.ErrPermissionDenied, true},
+	{fmt.Errorf("putting key: %w", rpctypes.ErrPermissionDenied), true},
+	{rpctypes.ErrAuthFailed, false},
+	{errors.New("context deadline exceeded"), false},
+}
+
+func TestGetSourceConnectionsCount(t *testing.T) {
+	kv := &mockKV{}
+	c := &Client{cli: &clientv3.Client{KV: kv}, requestTimeout: time.Second}
+	c.setNamespace("")
+	for i, value := range []string{
+		`{"Source":"192.168.0.1"}`,
+		`{"Source":"192.168.0.1","Kind":"sftp"}`,
+		`{"Source":"192.168.0.2"}`,
+		`{}`,
+	} {
+		kv.kvs = append(kv.kvs, &mvccpb.KeyValue{Key: []byte(fmt.Sprintf("%s/user%d@default/server1:22/sshd:22/%s", c.connectionsPath, i, time.Now().Format(time.RFC3339Nano))), Value: []byte(value)})
+	}
+	for _, tt := range []struct {
+		source string
+		want   int
+	}{
+		{"192.168.0.1", 2},
+		{"192.168.0.2", 1},
+		{"192.168.0.3", 0},
+	} {
+		got, err := c.GetSourceConnectionsCount(tt.source)
+		if err != nil {
+			t.Fatalf("GetSourceConnectionsCount(%s) error = %v, want nil", tt.source, err)
+		}
+		if got != tt.want {
+			t.Errorf("GetSourceConnectionsCount(%s) = %d, want %d", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestIsPermissionError(t *testing.T) {
+	for _, tt := range isPermissionErrorTests {
+		if got := IsPermissionError(tt.err); got != tt.want {
+			t.Errorf("IsPermissionError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	for _, tt := range isAuthErrorTests {
+		if got := IsAuthError(tt.err); got != tt.want {
+			t.Errorf("IsAuthError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	kv := &mapKV{kvs: map[string]string{}}
+	c := &Client{cli: &clientv3.Client{KV: kv}, requestTimeout: time.Second, active: true}
+	c.setNamespace("")
+	d := c.DryRun()
+	if err := d.SetHost("server1:22", Up, time.Now()); err != nil {
+		t.Errorf("SetHost error = %v, want nil", err)
+	}
+	if err := d.SetRouteScores("http://scores", map[string]float64{"server1": 1}, time.Minute); err != nil {
+		t.Errorf("SetRouteScores error = %v, want nil", err)
+	}
+	if len(kv.kvs) != 0 {
+		t.Errorf("dry run client wrote %v, want nothing", kv.kvs)
+	}
+	if c.dryRun {
+		t.Errorf("DryRun modified the original client")
+	}
+	if err := c.SetHost("server1:22", Up, time.Now()); err != nil || len(kv.kvs) != 1 {
+		t.Errorf("SetHost error = %v, wrote %v, want one host", err, kv.kvs)
+	}
+}
+
+func TestTakeBootstrapClient(t *testing.T) {
+	config := &Config{Etcd: etcdConfig{Endpoints: []string{"etcd1:2379"}, Username: "sshproxy"}}
+	other := &Config{Etcd: etcdConfig{Endpoints: []string{"etcd2:2379"}, Username: "sshproxy"}}
+	cli := &clientv3.Client{}
+	keepBootstrapClient(config, cli)
+	defer func() { bootstrapClient.cli = nil }()
+	if got := takeBootstrapClient(other); got != nil {
+		t.Errorf("takeBootstrapClient with other options = %p, want nil", got)
+	}
+	if got := takeBootstrapClient(config); got != cli {
+		t.Errorf("takeBootstrapClient = %p, want %p", got, cli)
+	}
+	if got := takeBootstrapClient(config); got != nil {
+		t.Errorf("takeBootstrapClient after being taken = %p, want nil", got)
+	}
+}
+
+func TestRecordConnectAttempt(t *testing.T) {
+	kv := &mockKV{}
+	lease := &mockLease{}
+	c := &Client{cli: &clientv3.Client{KV: kv, Lease: lease}, requestTimeout: time.Second, prefix: defaultEtcdPrefix}
+	c.setNamespace("")
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := c.RecordConnectAttempt("alice", "sid1", ts, 1500*time.Millisecond); err != nil {
+		t.Fatalf("RecordConnectAttempt error = %v, want nil", err)
+	}
+	if len(kv.kvs) != 1 || string(kv.kvs[0].Key) != "/sshproxy/ratelimit/alice/sid1" || string(kv.kvs[0].Value) != "2026-01-02T03:04:05.000000006Z" {
+		t.Errorf("RecordConnectAttempt stored %v, want /sshproxy/ratelimit/alice/sid1 = 2026-01-02T03:04:05.000000006Z", kv.kvs)
+	}
+	// the window is rounded up to the second
+	if len(lease.granted) != 1 || lease.granted[0] != 2 {
+		t.Errorf("RecordConnectAttempt granted leases %v, want [2]", lease.granted)
+	}
+}
+
+func TestCountRecentConnects(t *testing.T) {
+	now := time.Now()
+	attempt := func(sid string, age time.Duration) *mvccpb.KeyValue {
+		return &mvccpb.KeyValue{Key: []byte("/sshproxy/ratelimit/alice/" + sid), Value: []byte(now.Add(-age).Format(time.RFC3339Nano))}
+	}
+	for _, tt := range []struct {
+		name string
+		kvs  []*mvccpb.KeyValue
+		want int
+		err  bool
+	}{
+		{"no attempt", nil, 0, false},
+		{"inside the window", []*mvccpb.KeyValue{attempt("a", time.Second), attempt("b", 30*time.Second)}, 2, false},
+		// the lease of an attempt can outlive the window by up to a second
+		{"outside the window", []*mvccpb.KeyValue{attempt("a", time.Second), attempt("b", time.Minute+500*time.Millisecond)}, 1, false},
+		{"bad value", []*mvccpb.KeyValue{{Key: []byte("/sshproxy/ratelimit/alice/a"), Value: []byte("yesterday")}}, 0, true},
+	} {
+		c := &Client{cli: &clientv3.Client{KV: &mockKV{kvs: tt.kvs}}, requestTimeout: time.Second}
+		c.setNamespace("")
+		got, err := c.CountRecentConnects("alice", time.Minute)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: CountRecentConnects error = %v, want error %v", tt.name, err, tt.err)
+		} else if got != tt.want {
+			t.Errorf("%s: CountRecentConnects = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// prefixKV is an etcd KV whose Get returns the keys starting with the
+// requested key, sorted.
+type prefixKV struct {
+	clientv3.KV
+	kvs map[string]string
+}
+
+func (kv *prefixKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp := &clientv3.GetResponse{}
+	for k, v := range kv.kvs {
+		if strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func TestGetAllInNamespaces(t *testing.T) {
+	kv := &prefixKV{kvs: map[string]string{
+		"/sshproxy/connections/alice@default/server1:22/192.168.0.1:40000/2024-01-02T03:04:05Z":            `{"Groups":["users"]}`,
+		"/sshproxy/namespaces/gpu/connections/alice@gpu/gpu1:22/192.168.0.1:40001/2024-01-02T03:04:06Z":    `{"Groups":["users"]}`,
+		"/sshproxy/namespaces/gpu/connections/bob@gpu/gpu2:22/192.168.0.2:40000/2024-01-02T03:04:07Z":      `{"Groups":["gpu"]}`,
+		"/sshproxy/namespaces/other/connections/carol@other/srv:22/192.168.0.3:40000/2024-01-02T03:04:08Z": `{"Groups":["users"]}`,
+	}}
+	c := &Client{cli: &clientv3.Client{KV: kv}, requestTimeout: time.Second, prefix: defaultEtcdPrefix}
+	c.setNamespace("")
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		namespaces []string
+		want       []string
+	}{
+		{[]string{""}, []string{"alice@default"}},
+		{[]string{"gpu"}, []string{"alice@gpu", "bob@gpu"}},
+		{[]string{"", "gpu"}, []string{"alice@default", "alice@gpu", "bob@gpu"}},
+	} {
+		connections, err := c.GetAllConnectionsInNamespaces(ctx, tt.namespaces)
+		if err != nil {
+			t.Fatalf("%q: GetAllConnectionsInNamespaces error = %v, want nil", tt.namespaces, err)
+		}
+		var got []string
+		for _, conn := range connections {
+			got = append(got, conn.User+"@"+conn.Service)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: GetAllConnectionsInNamespaces = %v, want %v", tt.namespaces, got, tt.want)
+		}
+	}
+
+	// the connections of the users are aggregated across the namespaces
+	users, err := c.GetAllUsersInNamespaces(ctx, []string{"", "gpu"}, false)
+	if err != nil {
+		t.Fatalf("GetAllUsersInNamespaces error = %v, want nil", err)
+	}
+	if len(users) != 2 || users[0].User != "alice" || users[0].N != 2 || users[1].User != "bob" || users[1].N != 1 {
+		t.Errorf("GetAllUsersInNamespaces = %+v, want alice with 2 connections and bob with 1", users)
+	}
+	groups, err := c.GetAllGroupsInNamespaces(ctx, []string{"", "gpu"}, false)
+	if err != nil {
+		t.Fatalf("GetAllGroupsInNamespaces error = %v, want nil", err)
+	}
+	if len(groups) != 2 || groups[0].Group != "gpu" || groups[0].Users != "bob" || groups[1].Group != "users" || groups[1].N != 2 {
+		t.Errorf("GetAllGroupsInNamespaces = %+v, want gpu with bob and users with 2 connections", groups)
+	}
+
+	// only the default namespace is read by GetAllUsers
+	if users, err := c.GetAllUsers(ctx, false); err != nil || len(users) != 1 || users[0].N != 1 {
+		t.Errorf("GetAllUsers = %+v, %v, want alice with 1 connection", users, err)
+	}
+}
@@ -11,28 +11,71 @@
 package utils
 
 import (
+	"encoding/json"
+	"io"
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"github.com/op/go-logging"
 )
 
+// FileOpenFlags returns the flags used to open a log or dump file according to
+// its mode: "append" appends to an existing file, "truncate" truncates it.
+// Missing files are created.
+func FileOpenFlags(mode string) int {
+	if mode == "append" {
+		return os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	return os.O_RDWR | os.O_CREATE | os.O_TRUNC
+}
+
+// jsonFormatter formats each message as a JSON object on a single line, with
+// the level, the message, the time (if withTime is true) and constant fields.
+type jsonFormatter struct {
+	fields   map[string]string
+	withTime bool
+}
+
+func (f *jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	entry := make(map[string]string, len(f.fields)+3)
+	for k, v := range f.fields {
+		entry[k] = v
+	}
+	if f.withTime {
+		entry["time"] = r.Time.Format(time.RFC3339)
+	}
+	entry["level"] = r.Level.String()
+	entry["message"] = r.Message()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 // MustSetupLogging setups logging framework.
 //
 // logfile can be:
 //   - empty (""): logs will be written on stdout,
 //   - "syslog": logs will be sent to syslog(),
-//   - a filename: logs will be appended in this file (the subdirectories will
-//     be created if they do not exist).
+//   - a filename: logs will be written in this file (the subdirectories will
+//     be created if they do not exist), opened according to logmode (see
+//     FileOpenFlags).
 //
 // module is the module name of the main logger.
 // logformat and syslogformat are strings to format message (see go-logging
 // documentation for details).
+// If jsonFields is not nil, logformat and syslogformat are not used: each
+// message is a JSON object with the fields of jsonFields, the level, the
+// message and the time (except with syslog, which already adds it).
 // Debug output is enabled if debug is true.
-func MustSetupLogging(module, logfile, logformat, syslogformat string, debug bool) {
+func MustSetupLogging(module, logfile, logmode, logformat, syslogformat string, jsonFields map[string]string, debug bool) {
 	var logBackend logging.Backend
 	logFormat := logformat
+	isSyslog := false
 	if logfile == "syslog" {
 		var err error
 		logBackend, err = logging.NewSyslogBackend(module)
@@ -40,6 +83,7 @@ func MustSetupLogging(module, logfile, logformat, syslogformat string, debug boo
 			log.Fatalf("error opening syslog: %s", err)
 		}
 		logFormat = syslogformat
+		isSyslog = true
 	} else {
 		var f *os.File
 		if logfile == "" {
@@ -50,7 +94,7 @@ func MustSetupLogging(module, logfile, logformat, syslogformat string, debug boo
 				log.Fatalf("creating directory %s: %s", path.Dir(logfile), err)
 			}
 
-			f, err = os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			f, err = os.OpenFile(logfile, FileOpenFlags(logmode), 0666)
 			if err != nil {
 				log.Fatalf("error opening log file %s: %v", logfile, err)
 			}
@@ -59,7 +103,11 @@ func MustSetupLogging(module, logfile, logformat, syslogformat string, debug boo
 	}
 
 	logging.SetBackend(logBackend)
-	logging.SetFormatter(logging.MustStringFormatter(logFormat))
+	if jsonFields != nil {
+		logging.SetFormatter(&jsonFormatter{fields: jsonFields, withTime: !isSyslog})
+	} else {
+		logging.SetFormatter(logging.MustStringFormatter(logFormat))
+	}
 	if debug {
 		logging.SetLevel(logging.DEBUG, module)
 	} else {
@@ -0,0 +1,43 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+func TestJSONFormatter(t *testing.T) {
+	r := &logging.Record{
+		Time:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level: logging.INFO,
+		Args:  []interface{}{"alice connected"},
+	}
+	fields := map[string]string{"sid": "ABCDEF", "user": "alice"}
+	for _, tt := range []struct {
+		withTime bool
+		want     string
+	}{
+		{true, `{"level":"INFO","message":"alice connected","sid":"ABCDEF","time":"2025-01-02T03:04:05Z","user":"alice"}`},
+		{false, `{"level":"INFO","message":"alice connected","sid":"ABCDEF","user":"alice"}`},
+	} {
+		var buf bytes.Buffer
+		f := &jsonFormatter{fields: fields, withTime: tt.withTime}
+		if err := f.Format(0, r, &buf); err != nil {
+			t.Errorf("jsonFormatter.Format (withTime=%v) error = %v, want nil", tt.withTime, err)
+		} else if got := buf.String(); got != tt.want {
+			t.Errorf("jsonFormatter.Format (withTime=%v) = %s, want %s", tt.withTime, got, tt.want)
+		}
+	}
+}
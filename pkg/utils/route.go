@@ -11,8 +11,14 @@
 package utils
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"slices"
 	"sort"
 	"time"
 
@@ -38,18 +44,52 @@ func (bhc *BasicHostChecker) Check(hostport string) bool {
 	return CanConnect(hostport)
 }
 
+// probesLimiter is a HostChecker which gives up after max checks.
+type probesLimiter struct {
+	checker HostChecker
+	max     int
+	probes  int
+}
+
+// Check tests if a connection to host:port can be made with the wrapped
+// checker, unless the maximum number of checks was already reached.
+func (pl *probesLimiter) Check(hostport string) bool {
+	if pl.probes >= pl.max {
+		if pl.probes == pl.max {
+			mylog.Warningf("maximum number of probed destinations (%d) reached, not checking %s and the following ones", pl.max, hostport)
+			pl.probes++
+		}
+		return false
+	}
+	pl.probes++
+	return pl.checker.Check(hostport)
+}
+
 var (
 	routeSelecters = map[string]selectDestinationFunc{
-		"ordered":     selectDestinationOrdered,
-		"random":      selectDestinationRandom,
-		"connections": selectDestinationConnections,
-		"bandwidth":   selectDestinationBandwidth,
+		"ordered":         selectDestinationOrdered,
+		"random":          selectDestinationRandom,
+		"connections":     selectDestinationConnections,
+		"bandwidth":       selectDestinationBandwidth,
+		"least_bandwidth": selectDestinationLeastBandwidth,
 	}
+	// routeAlgorithmsWithOptions are the algorithms which need more than the
+	// destinations (the configuration of the external source or the weights
+	// of the destinations), called directly by SelectRoute.
+	routeAlgorithmsWithOptions = []string{"external", "weighted"}
+
+	routeModes = []string{"sticky", "balanced"}
 )
 
 // CanConnect tests if a connection to host:port can be made (with a 1s timeout).
 func CanConnect(hostport string) bool {
-	c, err := net.DialTimeout("tcp", hostport, time.Second)
+	return CanConnectTimeout(hostport, time.Second)
+}
+
+// CanConnectTimeout tests if a connection to host:port can be made within
+// timeout.
+func CanConnectTimeout(hostport string, timeout time.Duration) bool {
+	c, err := net.DialTimeout("tcp", hostport, timeout)
 	if err != nil {
 		mylog.Infof("cannot connect to %s: %s", hostport, err)
 		return false
@@ -97,7 +137,7 @@ func selectDestinationConnections(destinations []string, checker HostChecker, cl
 		for _, userHost := range userHosts {
 			userHostsc[userHost.Hostname] = userHost.N
 		}
-		hosts, err := cli.GetAllHosts()
+		hosts, err := cli.GetAllHosts(context.Background())
 		if err != nil {
 			return "", nil
 		}
@@ -135,7 +175,7 @@ func selectDestinationBandwidth(destinations []string, checker HostChecker, cli
 		for _, userHost := range userHosts {
 			userHostsbw[userHost.Hostname] = (uint64(userHost.BwIn) * uint64(userHost.BwIn)) + (uint64(userHost.BwOut) * uint64(userHost.BwOut)) + uint64(userHost.N)
 		}
-		hosts, err := cli.GetAllHosts()
+		hosts, err := cli.GetAllHosts(context.Background())
 		if err != nil {
 			return "", nil
 		}
@@ -159,13 +199,188 @@ func selectDestinationBandwidth(destinations []string, checker HostChecker, cli
 	return selectDestinationRandom(destinations, checker, cli, key)
 }
 
+// orderDestinationsByBandwidth sorts the destinations by the bandwidth (in
+// kB/s) they currently carry, the least loaded first. The order of the
+// destinations with the same bandwidth is kept.
+func orderDestinationsByBandwidth(destinations []string, bandwidth map[string]int) {
+	sort.SliceStable(destinations, func(i, j int) bool {
+		return bandwidth[destinations[i]] < bandwidth[destinations[j]]
+	})
+}
+
+// selectDestinationLeastBandwidth selects the destination currently carrying
+// the least traffic (incoming plus outgoing bandwidth of all the
+// connections). In case of a draw, the destinations are tried in their order.
+// Without etcd, it falls back on the ordered algorithm. It returns its host
+// and port.
+func selectDestinationLeastBandwidth(destinations []string, checker HostChecker, cli *Client, key string) (string, error) {
+	if cli == nil || !cli.IsAlive() {
+		return selectDestinationOrdered(destinations, checker, cli, key)
+	}
+	hosts, err := cli.GetAllHosts(context.Background())
+	if err != nil {
+		mylog.Warningf("cannot get the bandwidth of the hosts, falling back on the ordered algorithm: %v", err)
+		return selectDestinationOrdered(destinations, checker, cli, key)
+	}
+	bandwidth := map[string]int{}
+	for _, host := range hosts {
+		bandwidth[host.Hostname] = host.BwIn + host.BwOut
+	}
+	orderDestinationsByBandwidth(destinations, bandwidth)
+	mylog.Debugf("ordered destinations based on the bandwidth of the hosts: %v", destinations)
+	return selectDestinationOrdered(destinations, checker, cli, key)
+}
+
+// fetchRouteScores fetches the scores of the hosts from the URL of the
+// external route_select algorithm. The URL must return a JSON object whose
+// keys are the hosts (with an optional port) and whose values are their
+// scores.
+func fetchRouteScores(external *ExternalRouteConfig) (map[string]float64, error) {
+	client := &http.Client{Timeout: external.Timeout.Duration()}
+	resp, err := client.Get(external.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", external.URL, resp.Status)
+	}
+	var scores map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&scores); err != nil {
+		return nil, fmt.Errorf("decoding JSON data from %s: %v", external.URL, err)
+	}
+	return scores, nil
+}
+
+// getRouteScores returns the scores of the hosts for the external
+// route_select algorithm, from the cache in etcd if it is still valid.
+func getRouteScores(external *ExternalRouteConfig, cli *Client) (map[string]float64, error) {
+	useCache := cli != nil && cli.IsAlive() && external.CacheDuration.Duration() >= time.Second
+	if useCache {
+		scores, err := cli.GetRouteScores(external.URL)
+		if err == nil {
+			return scores, nil
+		} else if err != ErrKeyNotFound {
+			mylog.Errorf("getting the cached scores of the hosts: %v", err)
+		}
+	}
+	scores, err := fetchRouteScores(external)
+	if err != nil {
+		return nil, err
+	}
+	if useCache {
+		if err := cli.SetRouteScores(external.URL, scores, external.CacheDuration.Duration()); err != nil {
+			mylog.Errorf("caching the scores of the hosts: %v", err)
+		}
+	}
+	return scores, nil
+}
+
+// routeScore returns the score of a destination ("host:port"), given for
+// "host:port" or for "host". The second value is false if the destination has
+// no score.
+func routeScore(scores map[string]float64, destination string) (float64, bool) {
+	if score, ok := scores[destination]; ok {
+		return score, true
+	}
+	host, _, err := SplitHostPort(destination)
+	if err != nil {
+		return 0, false
+	}
+	score, ok := scores[host]
+	return score, ok
+}
+
+// selectDestinationExternal selects the reachable destination with the
+// lowest score given by an external source (e.g. the load of the hosts). The
+// destinations without score come last, in their order. If the scores
+// cannot be fetched, it falls back on the ordered algorithm. It returns its
+// host and port.
+func selectDestinationExternal(destinations []string, checker HostChecker, cli *Client, key string, external *ExternalRouteConfig) (string, error) {
+	scores, err := getRouteScores(external, cli)
+	if err != nil {
+		mylog.Warningf("cannot get the scores of the hosts, falling back on the ordered algorithm: %v", err)
+		return selectDestinationOrdered(destinations, checker, cli, key)
+	}
+	sort.SliceStable(destinations, func(i, j int) bool {
+		scoreI, okI := routeScore(scores, destinations[i])
+		scoreJ, okJ := routeScore(scores, destinations[j])
+		if okI && okJ {
+			return scoreI < scoreJ
+		}
+		return okI && !okJ
+	})
+	mylog.Debugf("ordered destinations based on external scores: %v", destinations)
+	return selectDestinationOrdered(destinations, checker, cli, key)
+}
+
+// orderDestinationsByWeight shuffles the destinations so that each one is
+// first with a probability proportional to its weight, and so on for the
+// next positions among the remaining destinations (weighted random sampling
+// without replacement). A missing weight counts as 1.
+func orderDestinationsByWeight(destinations []string, weights []int) {
+	keys := make(map[string]float64, len(destinations))
+	for i, dst := range destinations {
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		// the largest keys come first (Efraimidis-Spirakis)
+		keys[dst] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+	sort.SliceStable(destinations, func(i, j int) bool {
+		return keys[destinations[i]] > keys[destinations[j]]
+	})
+}
+
+// selectDestinationWeighted selects a reachable destination randomly, with a
+// probability proportional to its weight: when the chosen destination is not
+// reachable, another one is chosen among the remaining destinations. It
+// returns its host and port.
+func selectDestinationWeighted(destinations []string, checker HostChecker, cli *Client, key string, weights []int) (string, error) {
+	// keep the destinations in the order of their weights
+	destinations = append([]string{}, destinations...)
+	orderDestinationsByWeight(destinations, weights)
+	mylog.Debugf("ordered destinations based on their weights: %v", destinations)
+	return selectDestinationOrdered(destinations, checker, cli, key)
+}
+
 // SelectRoute returns a destination among the destinations according to the
 // specified algo. The destination was successfully checked by the specified
-// checker.
-func SelectRoute(algo string, destinations []string, checker HostChecker, cli *Client, key string) (string, error) {
+// checker. If maxProbes is greater than 0, at most maxProbes destinations are
+// checked. weights are the weights of the destinations (in the same order)
+// for the weighted algorithm and external is the configuration of the
+// external algorithm.
+func SelectRoute(algo string, destinations []string, weights []int, checker HostChecker, cli *Client, key string, maxProbes int, external *ExternalRouteConfig) (string, error) {
+	if checker != nil && maxProbes > 0 {
+		checker = &probesLimiter{checker: checker, max: maxProbes}
+	}
+	switch algo {
+	case "external":
+		return selectDestinationExternal(destinations, checker, cli, key, external)
+	case "weighted":
+		return selectDestinationWeighted(destinations, checker, cli, key, weights)
+	}
 	return routeSelecters[algo](destinations, checker, cli, key)
 }
 
+// RewriteDest returns the address to connect to for the logical destination
+// hostport, according to the rewrites (logical host:port to actual host with
+// an optional port, the logical port being used by default). It returns
+// hostport if there is no rewrite for it.
+func RewriteDest(rewrites map[string]string, hostport string) string {
+	actual, ok := rewrites[hostport]
+	if !ok {
+		return hostport
+	}
+	_, logicalPort, _ := SplitHostPort(hostport)
+	host, port, err := SplitHostPortWithDefault(actual, logicalPort)
+	if err != nil {
+		return hostport
+	}
+	return net.JoinHostPort(host, port)
+}
+
 // IsDestinationInRoutes returns true if dest exists in routes, false otherwise
 func IsDestinationInRoutes(dest string, routes []string) bool {
 	for _, route := range routes {
@@ -179,15 +394,30 @@ func IsDestinationInRoutes(dest string, routes []string) bool {
 // IsRouteAlgorithm checks if the specified algo is valid.
 func IsRouteAlgorithm(algo string) bool {
 	_, ok := routeSelecters[algo]
-	return ok
+	return ok || slices.Contains(routeAlgorithmsWithOptions, algo)
 }
 
 // IsRouteMode checks if the specified mode is valid.
 func IsRouteMode(mode string) bool {
-	for _, realMode := range []string{"sticky", "balanced"} {
+	for _, realMode := range routeModes {
 		if mode == realMode {
 			return true
 		}
 	}
 	return false
 }
+
+// RouteAlgorithms returns the sorted list of valid route algorithms.
+func RouteAlgorithms() []string {
+	algos := append([]string{}, routeAlgorithmsWithOptions...)
+	for algo := range routeSelecters {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	return algos
+}
+
+// RouteModes returns the list of valid route modes.
+func RouteModes() []string {
+	return append([]string{}, routeModes...)
+}
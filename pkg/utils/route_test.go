@@ -0,0 +1,187 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingChecker is a HostChecker which only accepts the host "up:22" and
+// records the checked hosts.
+type recordingChecker struct {
+	checked []string
+}
+
+func (rc *recordingChecker) Check(hostport string) bool {
+	rc.checked = append(rc.checked, hostport)
+	return hostport == "up:22"
+}
+
+var selectRouteMaxProbesTests = []struct {
+	maxProbes int
+	want      string
+	checked   []string
+}{
+	{0, "up:22", []string{"down1:22", "down2:22", "up:22"}},
+	{3, "up:22", []string{"down1:22", "down2:22", "up:22"}},
+	{2, "", []string{"down1:22", "down2:22"}},
+}
+
+var selectRouteExternalTests = []struct {
+	status  int
+	scores  string
+	checked []string
+}{
+	{http.StatusOK, `{"down2": 0.1, "down1:22": 0.5, "up": 0.9}`, []string{"down2:22", "down1:22", "up:22"}},
+	{http.StatusOK, `{"up:22": 0.5, "down2:22": 0.1}`, []string{"down2:22", "up:22"}},
+	{http.StatusOK, `{"up": "high"}`, []string{"down1:22", "up:22"}},
+	{http.StatusInternalServerError, "", []string{"down1:22", "up:22"}},
+}
+
+var orderDestinationsByBandwidthTests = []struct {
+	bandwidth map[string]int
+	want      []string
+}{
+	{map[string]int{"h1:22": 300, "h2:22": 100, "h3:22": 200}, []string{"h2:22", "h3:22", "h1:22"}},
+	{map[string]int{"h1:22": 100, "h2:22": 100, "h3:22": 50}, []string{"h3:22", "h1:22", "h2:22"}},
+	{map[string]int{"h1:22": 100, "h3:22": 100}, []string{"h2:22", "h1:22", "h3:22"}},
+	{map[string]int{}, []string{"h1:22", "h2:22", "h3:22"}},
+}
+
+var rewriteDestTests = []struct {
+	hostport, want string
+}{
+	{"server1:22", "10.0.0.1:22"},
+	{"server2:2222", "nat-gw:2022"},
+	{"server3:22", "server3:22"},
+}
+
+func TestRewriteDest(t *testing.T) {
+	rewrites := map[string]string{"server1:22": "10.0.0.1", "server2:2222": "nat-gw:2022"}
+	for _, tt := range rewriteDestTests {
+		if got := RewriteDest(rewrites, tt.hostport); got != tt.want {
+			t.Errorf("%s RewriteDest = %s, want %s", tt.hostport, got, tt.want)
+		}
+	}
+}
+
+func TestSelectRouteMaxProbes(t *testing.T) {
+	for _, tt := range selectRouteMaxProbesTests {
+		checker := &recordingChecker{}
+		got, err := SelectRoute("ordered", []string{"down1:22", "down2:22", "up:22"}, nil, checker, nil, "alice@default", tt.maxProbes, nil)
+		if err != nil {
+			t.Errorf("max_probes %d SelectRoute error = %v, want nil", tt.maxProbes, err)
+		} else if got != tt.want {
+			t.Errorf("max_probes %d SelectRoute = %q, want %q", tt.maxProbes, got, tt.want)
+		}
+		if !reflect.DeepEqual(checker.checked, tt.checked) {
+			t.Errorf("max_probes %d SelectRoute checked %v, want %v", tt.maxProbes, checker.checked, tt.checked)
+		}
+	}
+}
+
+func TestOrderDestinationsByBandwidth(t *testing.T) {
+	for _, tt := range orderDestinationsByBandwidthTests {
+		got := []string{"h1:22", "h2:22", "h3:22"}
+		orderDestinationsByBandwidth(got, tt.bandwidth)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v orderDestinationsByBandwidth = %v, want %v", tt.bandwidth, got, tt.want)
+		}
+	}
+}
+
+func TestOrderDestinationsByWeight(t *testing.T) {
+	const draws = 10000
+	first := map[string]int{}
+	for i := 0; i < draws; i++ {
+		destinations := []string{"small:22", "big:22"}
+		orderDestinationsByWeight(destinations, []int{1, 3})
+		first[destinations[0]]++
+	}
+	// big:22 should be first 3 times out of 4
+	if ratio := float64(first["big:22"]) / draws; ratio < 0.7 || ratio > 0.8 {
+		t.Errorf("orderDestinationsByWeight put the heaviest destination first %.2f%% of the time, want about 75%%", ratio*100)
+	}
+}
+
+func TestSelectRouteWeighted(t *testing.T) {
+	checker := &recordingChecker{}
+	destinations := []string{"down1:22", "up:22", "down2:22"}
+	got, err := SelectRoute("weighted", destinations, []int{5, 1, 5}, checker, nil, "alice@default", 0, nil)
+	if err != nil {
+		t.Errorf("SelectRoute error = %v, want nil", err)
+	} else if got != "up:22" {
+		t.Errorf("SelectRoute = %q, want \"up:22\"", got)
+	}
+	if want := []string{"down1:22", "up:22", "down2:22"}; !reflect.DeepEqual(destinations, want) {
+		t.Errorf("SelectRoute reordered the destinations: %v, want %v", destinations, want)
+	}
+}
+
+func TestSelectRouteLeastBandwidthWithoutEtcd(t *testing.T) {
+	checker := &recordingChecker{}
+	got, err := SelectRoute("least_bandwidth", []string{"down1:22", "up:22", "down2:22"}, nil, checker, nil, "alice@default", 0, nil)
+	if err != nil {
+		t.Errorf("SelectRoute error = %v, want nil", err)
+	} else if got != "up:22" {
+		t.Errorf("SelectRoute = %q, want \"up:22\"", got)
+	}
+	want := []string{"down1:22", "up:22"}
+	if !reflect.DeepEqual(checker.checked, want) {
+		t.Errorf("SelectRoute checked %v, want %v", checker.checked, want)
+	}
+}
+
+func TestSelectRouteExternal(t *testing.T) {
+	for _, tt := range selectRouteExternalTests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.scores)
+		}))
+		external := &ExternalRouteConfig{URL: server.URL, Timeout: Duration(time.Second)}
+		checker := &recordingChecker{}
+		got, err := SelectRoute("external", []string{"down1:22", "up:22", "down2:22"}, nil, checker, nil, "alice@default", 0, external)
+		server.Close()
+		if err != nil {
+			t.Errorf("%d %q SelectRoute error = %v, want nil", tt.status, tt.scores, err)
+		} else if got != "up:22" {
+			t.Errorf("%d %q SelectRoute = %q, want \"up:22\"", tt.status, tt.scores, got)
+		}
+		if !reflect.DeepEqual(checker.checked, tt.checked) {
+			t.Errorf("%d %q SelectRoute checked %v, want %v", tt.status, tt.scores, checker.checked, tt.checked)
+		}
+	}
+}
+
+func TestRouteAlgorithms(t *testing.T) {
+	want := []string{"bandwidth", "connections", "external", "least_bandwidth", "ordered", "random", "weighted"}
+	if got := RouteAlgorithms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RouteAlgorithms() = %v, want %v", got, want)
+	}
+	for _, algo := range want {
+		if !IsRouteAlgorithm(algo) {
+			t.Errorf("IsRouteAlgorithm(%q) = false, want true", algo)
+		}
+	}
+	if IsRouteAlgorithm("fastest") {
+		t.Errorf("IsRouteAlgorithm(%q) = true, want false", "fastest")
+	}
+	for algo, selecter := range routeSelecters {
+		if selecter == nil {
+			t.Errorf("route_select %s has no selecter", algo)
+		}
+	}
+}
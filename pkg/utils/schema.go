@@ -0,0 +1,210 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	durationType   = reflect.TypeOf(Duration(0))
+	stringListType = reflect.TypeOf(StringList{})
+	configType     = reflect.TypeOf(Config{})
+	subConfigType  = reflect.TypeOf(subConfig{})
+
+	// schemaEnums lists the options which only accept a fixed set of
+	// values.
+	schemaEnums = map[string]func() []string{
+		"route_select":     RouteAlgorithms,
+		"mode":             RouteModes,
+		"available_states": States,
+		"force_tty":        ForceTTYModes,
+		"log_mode":         FileModes,
+		"log_format":       LogFormats,
+		"dump_mode":        FileModes,
+		"dump_compress":    DumpCompressions,
+	}
+)
+
+// yamlKey returns the key used in the YAML configuration for a struct field,
+// following the rules of the YAML library: the name given in the yaml tag or
+// the lowercased field name.
+func yamlKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return key
+}
+
+// ConfigSchema returns a JSON Schema describing the configuration file. It is
+// generated from the Config structure (and the subConfig structure for the
+// overrides) so it always describes the options really read by LoadConfig.
+func ConfigSchema() map[string]interface{} {
+	schema := structSchema(configType)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "sshproxy configuration"
+	return schema
+}
+
+// structSchema returns the JSON Schema of a struct type.
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := yamlKey(field)
+		if !field.IsExported() || key == "-" {
+			continue
+		}
+		fieldType := field.Type
+		if t == subConfigType && fieldType.Kind() == reflect.Interface {
+			// subConfig uses interface{} to know if an option was
+			// specified: the real type is the one used in Config.
+			if configField, ok := configType.FieldByName(field.Name); ok {
+				fieldType = configField.Type
+			}
+		}
+		if t == subConfigType && key == "match" {
+			properties[key] = matchSchema()
+		} else {
+			properties[key] = typeSchema(key, fieldType)
+		}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// matchSchema returns the JSON Schema of the match section of an override.
+func matchSchema() map[string]interface{} {
+	conditions := map[string]interface{}{}
+	for _, condition := range matchConditions {
+		conditions[condition] = typeSchema(condition, reflect.TypeOf([]string{}))
+	}
+	return map[string]interface{}{
+		"type": "array",
+		"items": map[string]interface{}{
+			"type":                 "object",
+			"properties":           conditions,
+			"additionalProperties": false,
+		},
+	}
+}
+
+// typeSchema returns the JSON Schema of an option named key whose Go type is
+// t.
+func typeSchema(key string, t reflect.Type) map[string]interface{} {
+	var schema map[string]interface{}
+	switch {
+	case t == durationType:
+		schema = map[string]interface{}{
+			"type":    "string",
+			"pattern": `^([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$|^0$`,
+		}
+	case t == stringListType:
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			},
+		}
+	case t.Kind() == reflect.Ptr:
+		return typeSchema(key, t.Elem())
+	case t.Kind() == reflect.Struct:
+		schema = structSchema(t)
+	case t.Kind() == reflect.Slice:
+		// the possible values of a list apply to its items
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(key, t.Elem()),
+		}
+	case t.Kind() == reflect.Map:
+		schema = map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema("", t.Elem()),
+		}
+	case t.Kind() == reflect.Bool:
+		schema = map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		schema = map[string]interface{}{"type": "integer"}
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		schema = map[string]interface{}{"type": "integer", "minimum": 0}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = map[string]interface{}{"type": "number"}
+	default:
+		schema = map[string]interface{}{"type": "string"}
+	}
+	if enum, ok := schemaEnums[key]; ok {
+		schema["enum"] = enum()
+	}
+	return schema
+}
+
+// ConfigView returns the options of the configuration config keyed by their
+// name in the configuration file, e.g. to serialize the configuration used by
+// a session in JSON. The durations are formatted like in the configuration
+// file, the overrides (already applied) are omitted and the etcd password is
+// masked. The weights of the destinations are added as dest_weights.
+func ConfigView(config *Config) map[string]interface{} {
+	view := valueView(reflect.ValueOf(*config)).(map[string]interface{})
+	delete(view, "overrides")
+	view["dest_weights"] = config.DestWeights
+	if config.Etcd.Password != "" {
+		view["etcd"].(map[string]interface{})["password"] = "********"
+	}
+	return view
+}
+
+// valueView returns the value v of an option, with the structs converted to
+// maps keyed by option names.
+func valueView(v reflect.Value) interface{} {
+	switch {
+	case v.Type() == durationType:
+		return v.Interface().(Duration).String()
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return valueView(v.Elem())
+	case v.Kind() == reflect.Struct:
+		view := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := yamlKey(field)
+			if !field.IsExported() || key == "-" {
+				continue
+			}
+			view[key] = valueView(v.Field(i))
+		}
+		return view
+	case v.Kind() == reflect.Slice:
+		if v.IsNil() {
+			return []interface{}{}
+		}
+		view := make([]interface{}, v.Len())
+		for i := range view {
+			view[i] = valueView(v.Index(i))
+		}
+		return view
+	case v.Kind() == reflect.Map:
+		view := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			view[fmt.Sprint(key.Interface())] = valueView(v.MapIndex(key))
+		}
+		return view
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2015-2025 CEA/DAM/DIF
+//  Author: Arnaud Guignard <arnaud.guignard@cea.fr>
+//  Contributor: Cyril Servant <cyril.servant@cea.fr>
+//
+// This software is governed by the CeCILL-B license under French law and
+// abiding by the rules of distribution of free software.  You can  use,
+// modify and/ or redistribute the software under the terms of the CeCILL-B
+// license as circulated by CEA, CNRS and INRIA at the following URL
+// "http://www.cecill.info".
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema()
+	properties := schema["properties"].(map[string]interface{})
+	for _, key := range []string{"dest", "route_select", "mode", "ssh", "overrides"} {
+		if _, ok := properties[key]; !ok {
+			t.Errorf("ConfigSchema() has no property %q", key)
+		}
+	}
+	if _, ok := properties["nodeset"]; ok {
+		t.Errorf("ConfigSchema() has a property for the computed nodeset field")
+	}
+
+	routeSelect := properties["route_select"].(map[string]interface{})
+	if got := routeSelect["enum"]; !reflect.DeepEqual(got, RouteAlgorithms()) {
+		t.Errorf("route_select enum = %v, want %v", got, RouteAlgorithms())
+	}
+
+	overrides := properties["overrides"].(map[string]interface{})
+	override := overrides["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	mode := override["mode"].(map[string]interface{})
+	if got := mode["enum"]; !reflect.DeepEqual(got, RouteModes()) {
+		t.Errorf("overrides mode enum = %v, want %v", got, RouteModes())
+	}
+	if got := override["debug"].(map[string]interface{})["type"]; got != "boolean" {
+		t.Errorf("overrides debug type = %v, want boolean", got)
+	}
+}
+
+func TestConfigView(t *testing.T) {
+	content := "dest: [\"server[1-2]*2\"]\ncheck_interval: 2m\netcd:\n  password: secret\noverrides:\n  - match:\n      - users: [alice]\n    debug: true"
+	config, err := loadTestConfig(t, content, "alice", nil, "")
+	if err != nil {
+		t.Fatalf("%q LoadConfig error = %v, want nil", content, err)
+	}
+	view := ConfigView(config)
+	for key, want := range map[string]interface{}{
+		"debug":          true,
+		"check_interval": "2m0s",
+		"dest":           []interface{}{"server1:22", "server2:22"},
+		"dest_weights":   []int{2, 2},
+	} {
+		if got := view[key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("ConfigView()[%q] = %#v, want %#v", key, got, want)
+		}
+	}
+	if got := view["etcd"].(map[string]interface{})["password"]; got != "********" {
+		t.Errorf("ConfigView() etcd password = %v, want it masked", got)
+	}
+	for _, key := range []string{"overrides", "nodeset"} {
+		if _, ok := view[key]; ok {
+			t.Errorf("ConfigView() has a %q key", key)
+		}
+	}
+}
@@ -15,7 +15,11 @@ import (
 	"fmt"
 	"net"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,6 +29,169 @@ const DefaultSSHPort = "22"
 // DefaultService is the default service name.
 const DefaultService = "default"
 
+// Kinds of sessions. Some options can be set per kind of session in the
+// configuration.
+const (
+	InteractiveSession = "interactive"
+	SFTPSession        = "sftp"
+	SCPSession         = "scp"
+	ExecSession        = "exec"
+)
+
+var sessionKinds = []string{InteractiveSession, SFTPSession, SCPSession, ExecSession}
+
+// SessionKind returns the kind of the session running the command cmd (empty
+// for a shell). interactive is true if the session is attached to a terminal.
+func SessionKind(cmd string, interactive bool) string {
+	fields := strings.Fields(cmd)
+	switch {
+	case len(fields) > 0 && (filepath.Base(fields[0]) == "internal-sftp" || filepath.Base(fields[0]) == "sftp-server"):
+		return SFTPSession
+	case len(fields) > 0 && filepath.Base(fields[0]) == "scp":
+		return SCPSession
+	case len(fields) == 0 || interactive:
+		return InteractiveSession
+	default:
+		return ExecSession
+	}
+}
+
+// MatchCIDRs checks if the IP address ip belongs to one of the networks
+// cidrs (in CIDR notation). The invalid networks are ignored.
+func MatchCIDRs(ip net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitedGroups returns the groups among groups which have a positive limit
+// in limits (see max_connections_per_group).
+func LimitedGroups(limits map[string]int, groups map[string]bool) map[string]bool {
+	limited := map[string]bool{}
+	for group := range groups {
+		if limits[group] > 0 {
+			limited[group] = true
+		}
+	}
+	return limited
+}
+
+// IsTranslateCommandRegexp returns true if the key of translate_commands is a
+// regular expression, i.e. if it starts with '^'. The other keys are exact
+// commands.
+func IsTranslateCommandRegexp(key string) bool {
+	return strings.HasPrefix(key, "^")
+}
+
+// TranslateCommand finds the translation of the command cmd in
+// translateCommands. The key matching exactly cmd is used first, then the
+// first regular expression key (in lexical order) matching cmd: its capture
+// groups ($1, ${name}, etc.) are expanded in the command of the translation.
+// It returns the translation and the translated command, or nil if cmd is not
+// translated. The regular expressions are expected to be valid.
+func TranslateCommand(translateCommands map[string]*TranslateCommandConfig, cmd string) (*TranslateCommandConfig, string) {
+	if conf, ok := translateCommands[cmd]; ok && !IsTranslateCommandRegexp(cmd) {
+		return conf, conf.Command
+	}
+	var keys []string
+	for key := range translateCommands {
+		if IsTranslateCommandRegexp(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		re, err := regexp.Compile(key)
+		if err != nil {
+			continue
+		}
+		m := re.FindStringSubmatchIndex(cmd)
+		if m == nil {
+			continue
+		}
+		conf := translateCommands[key]
+		return conf, string(re.ExpandString(nil, conf.Command, cmd, m))
+	}
+	return nil, ""
+}
+
+// MatchRegexps checks if the string s matches one of the regular expressions
+// regexps.
+func MatchRegexps(s string, regexps []*regexp.Regexp) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionShareLimit returns the maximum number of connections of a user
+// allowed by the max_connections_per_user_pct option: pct percent of the total
+// number of active connections, including the new one, rounded up. The limit
+// is therefore at least 1.
+func ConnectionShareLimit(pct, total int) int {
+	return (pct*(total+1) + 99) / 100
+}
+
+// SourceSubnet returns the subnet of the IP address ip, with a prefix length
+// of prefix4 bits for an IPv4 address or prefix6 bits for an IPv6 address.
+// It returns nil if the prefix length to use is 0.
+func SourceSubnet(ip net.IP, prefix4, prefix6 int) *net.IPNet {
+	bits, prefix := 128, prefix6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, prefix4
+	}
+	if prefix == 0 {
+		return nil
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// IsTransferSession returns true if the kind of session is a file transfer
+// (SFTP or SCP).
+func IsTransferSession(kind string) bool {
+	return kind == SFTPSession || kind == SCPSession
+}
+
+// ioPriorityClasses are the I/O scheduling classes, named as in ionice(1).
+var ioPriorityClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// ParseIOPriority parses an I/O priority of the form "class[:level]" where
+// class is "realtime", "best-effort" or "idle" and level is between 0 (highest
+// priority) and 7 (lowest priority). The level defaults to 4 and is ignored
+// for the "idle" class.
+//
+// Returns the class and level as understood by the ioprio_set syscall.
+func ParseIOPriority(s string) (int, int, error) {
+	name, levelString, hasLevel := strings.Cut(s, ":")
+	class, ok := ioPriorityClasses[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown I/O scheduling class: %s", name)
+	}
+	level := 4
+	if hasLevel {
+		var err error
+		level, err = strconv.Atoi(levelString)
+		if err != nil || level < 0 || level > 7 {
+			return 0, 0, fmt.Errorf("invalid I/O priority level: %s", levelString)
+		}
+	}
+	if class == ioPriorityClasses["idle"] {
+		level = 0
+	}
+	return class, level, nil
+}
+
 // CalcSessionID returns a unique 10 hexadecimal characters string from
 // a user name, time, ip address and port.
 func CalcSessionID(user string, t time.Time, hostport string) string {
@@ -36,12 +203,19 @@ func CalcSessionID(user string, t time.Time, hostport string) string {
 // "host[:port]" into host and port. If the port is not specified the default
 // ssh port ("22") is returned.
 func SplitHostPort(hostport string) (string, string, error) {
+	return SplitHostPortWithDefault(hostport, DefaultSSHPort)
+}
+
+// SplitHostPortWithDefault splits a network address of the form "host:port"
+// or "host[:port]" into host and port. If the port is not specified
+// defaultPort is returned.
+func SplitHostPortWithDefault(hostport, defaultPort string) (string, string, error) {
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
 		if err.(*net.AddrError).Err == "missing port in address" {
-			return hostport, DefaultSSHPort, nil
+			return hostport, defaultPort, nil
 		}
-		return hostport, DefaultSSHPort, err
+		return hostport, defaultPort, err
 	}
 	portNum, err := net.LookupPort("tcp", port)
 	if err != nil {
@@ -12,7 +12,9 @@ package utils
 
 import (
 	"errors"
+	"net"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 )
@@ -190,3 +192,172 @@ func TestInvalidMatchSource(t *testing.T) {
 		}
 	}
 }
+
+var sessionKindTests = []struct {
+	cmd         string
+	interactive bool
+	want        string
+}{
+	{"", false, InteractiveSession},
+	{"", true, InteractiveSession},
+	{"top", true, InteractiveSession},
+	{"ls -l", false, ExecSession},
+	{"scp -t /tmp", false, SCPSession},
+	{"/usr/bin/scp -f file", true, SCPSession},
+	{"internal-sftp", false, SFTPSession},
+	{"/usr/libexec/openssh/sftp-server -l INFO", false, SFTPSession},
+}
+
+func TestSessionKind(t *testing.T) {
+	for _, tt := range sessionKindTests {
+		if got := SessionKind(tt.cmd, tt.interactive); got != tt.want {
+			t.Errorf("%q (interactive: %v) SessionKind = %s, want %s", tt.cmd, tt.interactive, got, tt.want)
+		}
+	}
+}
+
+var parseIOPriorityTests = []struct {
+	ioprio       string
+	class, level int
+	err          bool
+}{
+	{"realtime", 1, 4, false},
+	{"best-effort:7", 2, 7, false},
+	{"idle", 3, 0, false},
+	{"idle:7", 3, 0, false},
+	{"best-effort:8", 0, 0, true},
+	{"best-effort:low", 0, 0, true},
+	{"none", 0, 0, true},
+}
+
+func TestParseIOPriority(t *testing.T) {
+	for _, tt := range parseIOPriorityTests {
+		class, level, err := ParseIOPriority(tt.ioprio)
+		if (err != nil) != tt.err {
+			t.Errorf("%q ParseIOPriority error = %v, want error: %v", tt.ioprio, err, tt.err)
+		} else if class != tt.class || level != tt.level {
+			t.Errorf("%q ParseIOPriority = %d, %d, want %d, %d", tt.ioprio, class, level, tt.class, tt.level)
+		}
+	}
+}
+
+var matchCIDRsTests = []struct {
+	ip    string
+	cidrs []string
+	want  bool
+}{
+	{"192.168.1.42", []string{"10.0.0.0/8", "192.168.0.0/16"}, true},
+	{"192.168.1.42", []string{"10.0.0.0/8"}, false},
+	{"192.168.1.42", nil, false},
+	{"2001:db8::42", []string{"2001:db8::/32"}, true},
+	{"2001:db8::42", []string{"192.168.0.0/16"}, false},
+}
+
+func TestMatchCIDRs(t *testing.T) {
+	for _, tt := range matchCIDRsTests {
+		if got := MatchCIDRs(net.ParseIP(tt.ip), tt.cidrs); got != tt.want {
+			t.Errorf("%s MatchCIDRs(%v) = %v, want %v", tt.ip, tt.cidrs, got, tt.want)
+		}
+	}
+}
+
+var matchRegexpsTests = []struct {
+	s        string
+	patterns []string
+	want     bool
+}{
+	{"rm -rf /", []string{`^rm\s+-rf\s+/$`}, true},
+	{"rm -rf /tmp/foo", []string{`^rm\s+-rf\s+/$`}, false},
+	{"/usr/libexec/openssh/sftp-server", []string{"^bash", "sftp-server$"}, true},
+	{"", []string{"^$"}, true},
+	{"", []string{"sftp-server"}, false},
+	{"hostname", nil, false},
+}
+
+func TestMatchRegexps(t *testing.T) {
+	for _, tt := range matchRegexpsTests {
+		var regexps []*regexp.Regexp
+		for _, pattern := range tt.patterns {
+			regexps = append(regexps, regexp.MustCompile(pattern))
+		}
+		if got := MatchRegexps(tt.s, regexps); got != tt.want {
+			t.Errorf("%q MatchRegexps(%q) = %v, want %v", tt.s, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+var translateCommands = map[string]*TranslateCommandConfig{
+	"internal-sftp":                    {Command: "sftp"},
+	"^rsync --server (.*)$":            {Command: "/usr/bin/rsync --server $1"},
+	"^scp (?P<flags>-[a-z]+) (.*)$":    {Command: "/usr/bin/scp ${flags} -- $2"},
+	"^(internal-sftp|sftp-server) .*$": {Command: "sftp-with-args"},
+}
+
+var translateCommandTests = []struct {
+	cmd, want string
+}{
+	{"internal-sftp", "sftp"},
+	{"internal-sftp -l INFO", "sftp-with-args"},
+	{"rsync --server -vlogDtpre.iLsfxC . /tmp/", "/usr/bin/rsync --server -vlogDtpre.iLsfxC . /tmp/"},
+	{"scp -t /tmp/file", "/usr/bin/scp -t -- /tmp/file"},
+	{"hostname", ""},
+	{"^rsync --server (.*)$", ""},
+}
+
+func TestTranslateCommand(t *testing.T) {
+	for _, tt := range translateCommandTests {
+		conf, got := TranslateCommand(translateCommands, tt.cmd)
+		if (conf == nil) != (tt.want == "") || got != tt.want {
+			t.Errorf("TranslateCommand(%q) = %+v, %q, want %q", tt.cmd, conf, got, tt.want)
+		}
+	}
+}
+
+var connectionShareLimitTests = []struct {
+	pct, total, want int
+}{
+	{10, 0, 1},
+	{10, 9, 1},
+	{10, 10, 2},
+	{10, 99, 10},
+	{25, 99, 25},
+	{100, 4, 5},
+	{1, 1000, 11},
+}
+
+func TestConnectionShareLimit(t *testing.T) {
+	for _, tt := range connectionShareLimitTests {
+		if got := ConnectionShareLimit(tt.pct, tt.total); got != tt.want {
+			t.Errorf("ConnectionShareLimit(%d, %d) = %d, want %d", tt.pct, tt.total, got, tt.want)
+		}
+	}
+}
+
+var sourceSubnetTests = []struct {
+	ip               string
+	prefix4, prefix6 int
+	want             string
+}{
+	{"192.168.1.42", 24, 64, "192.168.1.0/24"},
+	{"192.168.1.42", 0, 64, "<nil>"},
+	{"2001:db8:1:2::42", 24, 48, "2001:db8:1::/48"},
+	{"2001:db8:1:2::42", 24, 0, "<nil>"},
+}
+
+func TestSourceSubnet(t *testing.T) {
+	for _, tt := range sourceSubnetTests {
+		if got := SourceSubnet(net.ParseIP(tt.ip), tt.prefix4, tt.prefix6); got.String() != tt.want {
+			t.Errorf("%s SourceSubnet(%d, %d) = %s, want %s", tt.ip, tt.prefix4, tt.prefix6, got, tt.want)
+		}
+	}
+}
+
+func TestGetUserGroupsStored(t *testing.T) {
+	// the stored groups are used without looking up the (unknown) user
+	got, err := getUserGroups("unknown-user-of-sshproxy-tests", []string{"foo", "bar"})
+	if err != nil {
+		t.Errorf("getUserGroups error = %v, want nil", err)
+	} else if want := "bar foo"; got != want {
+		t.Errorf("getUserGroups = %q, want %q", got, want)
+	}
+}
@@ -32,6 +32,7 @@ cat <<EOF >/etc/sshproxy/sshproxy.yaml
 debug: true
 log: /tmp/sshproxy-{user}.log
 max_connections_per_user: 0
+max_transfers_per_user: 0
 environment:
     XMODIFIERS: globalEnv_{user}
 ssh:
@@ -381,6 +381,38 @@ func TestEtcdConnections(t *testing.T) {
 	}
 }
 
+func TestDisconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	args, _ := prepareCommand("gateway1", 2023, "sleep 20")
+	done := make(chan time.Time, 1)
+	go func() {
+		runCommand(ctx, "ssh", args, nil, nil)
+		done <- time.Now()
+	}()
+
+	time.Sleep(time.Second)
+	start := time.Now()
+	_, _, _, err := runCommand(ctx, "ssh", []string{"gateway1", "--", fmt.Sprintf("%s disconnect -user fedora -host server1", SSHPROXYCTL)}, nil, nil)
+	if err != nil {
+		t.Fatalf("disconnect error = %v, want nil", err)
+	}
+
+	select {
+	case end := <-done:
+		if end.Sub(start) > 10*time.Second {
+			t.Errorf("session ended after %s, want less than 10s", end.Sub(start))
+		}
+	case <-ctx.Done():
+		t.Error("session not ended after disconnect")
+	}
+
+	connections, jsonStr := getEtcdConnections()
+	if len(connections) != 0 {
+		t.Errorf("%s found %d connections, want 0", jsonStr, len(connections))
+	}
+}
+
 func TestWithoutEtcd(t *testing.T) {
 	updateLineSSHProxyConf("endpoints", "[\"https:\\/\\/void:2379\"]")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -431,6 +463,37 @@ func TestMaxConnectionsPerUser(t *testing.T) {
 	}
 }
 
+func TestMaxTransfersPerUser(t *testing.T) {
+	// remove old connections stored in etcd
+	time.Sleep(4 * time.Second)
+
+	updateLineSSHProxyConf("max_transfers_per_user", "1")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// seen as a SCP transfer by sshproxy
+	args, _ := prepareCommand("gateway1", 2023, "scp -t /tmp; sleep 20")
+	ch := make(chan *os.Process)
+	go func() {
+		runCommand(ctx, "ssh", args, nil, ch)
+	}()
+	process1 := <-ch
+
+	time.Sleep(time.Second)
+
+	args, _ = prepareCommand("gateway1", 2023, "scp -t /tmp")
+	_, _, _, errTransfer := runCommand(ctx, "ssh", args, nil, nil)
+	args, _ = prepareCommand("gateway1", 2023, "hostname")
+	_, _, _, errExec := runCommand(ctx, "ssh", args, nil, nil)
+	process1.Kill()
+	updateLineSSHProxyConf("max_transfers_per_user", "0")
+	if errTransfer == nil {
+		t.Error("the second transfer should have been rejected")
+	}
+	if errExec != nil {
+		t.Errorf("the command should have been allowed: %v", errExec)
+	}
+}
+
 func TestStickyConnections(t *testing.T) {
 	// remove old connections stored in etcd
 	time.Sleep(4 * time.Second)